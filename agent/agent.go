@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"time"
+)
+
+// PeerConfig is an enabled peer of a device as the server hands it to the agent. Keys are in base64, as everywhere
+// else in the api.
+type PeerConfig struct {
+	PublicKey    string   `json:"public_key"`
+	PreSharedKey string   `json:"preshared_key,omitempty"`
+	Endpoint     string   `json:"endpoint,omitempty"`
+	AllowedIPs   []string `json:"allowed_ips"`
+	// PersistentKeepalive is in seconds.
+	PersistentKeepalive int64 `json:"persistent_keepalive"`
+}
+
+// DeviceConfig is a device as the server hands it to the agent of the host running it.
+type DeviceConfig struct {
+	Name       string       `json:"name"`
+	PrivateKey string       `json:"private_key"`
+	ListenPort uint16       `json:"listen_port"`
+	Peers      []PeerConfig `json:"peers"`
+}
+
+// Config is everything a host runs, as GET /agent/config gives it.
+type Config struct {
+	Host    string         `json:"host"`
+	Devices []DeviceConfig `json:"devices"`
+}
+
+type PeerReport struct {
+	PublicKey string `json:"public_key"`
+	// LastHandshake is in unix seconds, zero if there was none.
+	LastHandshake int64  `json:"last_handshake"`
+	RxBytes       uint64 `json:"rx_bytes"`
+	TxBytes       uint64 `json:"tx_bytes"`
+}
+
+type DeviceReport struct {
+	Name  string       `json:"name"`
+	Peers []PeerReport `json:"peers"`
+}
+
+// Report is what the agent saw of the devices it runs, as POST /agent/report takes it.
+type Report struct {
+	Devices []DeviceReport `json:"devices"`
+}
+
+// toDeviceConfig gives the device with the peers to configure on it, as repo.PeerConfigs picks them: the device has
+// nowhere to keep the disabled ones.
+func toDeviceConfig(d repo.DeviceInfo, peers []repo.PeerInfo) (DeviceConfig, error) {
+	configs, err := repo.PeerConfigs(peers)
+	if err != nil {
+		return DeviceConfig{}, err
+	}
+
+	ret := DeviceConfig{
+		Name:       d.Name,
+		PrivateKey: d.PrivateKey.String(),
+		ListenPort: d.ListenPort,
+		Peers:      make([]PeerConfig, 0, len(configs)),
+	}
+
+	for _, p := range configs {
+		c := PeerConfig{
+			PublicKey:           formatKey(p.PublicKey),
+			PreSharedKey:        formatKey(p.PreSharedKey),
+			AllowedIPs:          make([]string, 0, len(p.AllowedIPs)),
+			PersistentKeepalive: int64(p.PersistentKeepAlive / time.Second),
+		}
+
+		if p.Endpoint != nil {
+			c.Endpoint = p.Endpoint.String()
+		}
+
+		for _, ip := range p.AllowedIPs {
+			c.AllowedIPs = append(c.AllowedIPs, ip.String())
+		}
+		ret.Peers = append(ret.Peers, c)
+	}
+	return ret, nil
+}
+
+// formatKey writes a key in base64, or "" if it's the zero one.
+func formatKey(k wg.Key) string {
+	if k.IsZero() {
+		return ""
+	}
+	return wgtypes.Key(k).String()
+}
+
+// parseKey reads a base64 key, the zero one if it's empty.
+func parseKey(s string) (wg.Key, error) {
+	if len(s) == 0 {
+		return wg.Key{}, nil
+	}
+
+	k, err := wgtypes.ParseKey(s)
+	return wg.Key(k), err
+}
+
+// toWg gives the configuration the agent brings the device up with.
+func (c DeviceConfig) toWg() (ret wg.DeviceConfig, err error) {
+	ret = wg.DeviceConfig{
+		Name:       c.Name,
+		ListenPort: c.ListenPort,
+		Peers:      make([]wg.PeerConfig, 0, len(c.Peers)),
+	}
+
+	if ret.PrivateKey, err = parseKey(c.PrivateKey); err != nil {
+		return
+	}
+
+	for _, p := range c.Peers {
+		peer := wg.PeerConfig{
+			AllowedIPs:          make([]net.IPNet, 0, len(p.AllowedIPs)),
+			PersistentKeepAlive: time.Duration(p.PersistentKeepalive) * time.Second,
+		}
+
+		if peer.PublicKey, err = parseKey(p.PublicKey); err != nil {
+			return
+		}
+
+		if peer.PreSharedKey, err = parseKey(p.PreSharedKey); err != nil {
+			return
+		}
+
+		if len(p.Endpoint) > 0 {
+			if peer.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+				return
+			}
+		}
+
+		for _, s := range p.AllowedIPs {
+			var n *net.IPNet
+			if _, n, err = net.ParseCIDR(s); err != nil {
+				return
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *n)
+		}
+		ret.Peers = append(ret.Peers, peer)
+	}
+	return
+}
+
+// toReport gives what the devices the agent runs saw of their peers.
+func toReport(devices []wg.Device) Report {
+	ret := Report{Devices: make([]DeviceReport, 0, len(devices))}
+	for _, d := range devices {
+		r := DeviceReport{Name: d.Name, Peers: make([]PeerReport, 0, len(d.Peers))}
+		for _, p := range d.Peers {
+			peer := PeerReport{
+				PublicKey: wgtypes.Key(p.PublicKey).String(),
+				RxBytes:   p.RxBytes,
+				TxBytes:   p.TxBytes,
+			}
+			if p.LastHandshake != nil && !p.LastHandshake.IsZero() {
+				peer.LastHandshake = p.LastHandshake.Unix()
+			}
+			r.Peers = append(r.Peers, peer)
+		}
+		ret.Devices = append(ret.Devices, r)
+	}
+	return ret
+}
@@ -0,0 +1,167 @@
+package agent_test
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"net/http/httptest"
+	"nz.cloudwalker/wireguard-webadmin/agent"
+	"nz.cloudwalker/wireguard-webadmin/api"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC)
+
+// countingClient has every peer count the traffic it's told to.
+type countingClient struct {
+	wg.Client
+	rxBytes uint64
+}
+
+func (c *countingClient) Devices() ([]wg.Device, error) {
+	devices, err := c.Client.Devices()
+	for i := range devices {
+		for j := range devices[i].Peers {
+			devices[i].Peers[j].RxBytes = c.rxBytes
+		}
+	}
+	return devices, err
+}
+
+func genKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) (ret []net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, *n)
+	}
+	return
+}
+
+// TestAgent runs an agent against the api of the server, as it would from a host.
+func TestAgent(t *testing.T) {
+	r := repo.NewMemRepository()
+	deviceKey := genKey(t)
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0", PrivateKey: repo.NewPrivateKey(deviceKey), ListenPort: 51820}, {Name: "wg1", PrivateKey: repo.NewPrivateKey(genKey(t))}}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "alice", AllowedIPs: mustParseCIDRs(t, "10.0.0.2/32")}
+	bob := repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "bob", Disabled: true}
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{alice, bob}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := agent.NewSqliteStore("file:agent_e2e?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	series, err := stats.NewSqliteStore("file:agent_e2e_stats?cache=shared&mode=memory", stats.DefaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer series.Close()
+
+	clock := utils.NewManualClock(start)
+	handler, err := api.NewHttpApi(r, api.WithAgents(agent.NewServer(r, store, series, clock)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	token, err := store.SaveHost("gw1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.SaveHost("gw2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AssignDevice("gw1", "wg0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AssignDevice("gw2", "wg1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := wg.NewMemClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &countingClient{Client: mem}
+	a := agent.NewAgent(server.URL, token, client, clock, agent.DefaultInterval)
+
+	runOnce := func(want int) {
+		t.Helper()
+		if got, err := a.RunOnce(); err != nil || got != want {
+			t.Fatalf("RunOnce() = %v, %v, want %v", got, err, want)
+		}
+	}
+
+	// The host only brings up its own device, with the enabled peers.
+	runOnce(1)
+	d, err := mem.Device("wg0")
+	if err != nil || d.PrivateKey != wg.Key(deviceKey) || d.ListenPort != 51820 || len(d.Peers) != 1 ||
+		d.Peers[0].AllowedIPs[0].String() != "10.0.0.2/32" {
+		t.Fatalf("Device() = %+v, %v, want wg0 with alice", d, err)
+	}
+	if devices, _ := mem.Devices(); len(devices) != 1 {
+		t.Errorf("Devices() = %v, want wg0 only", devices)
+	}
+
+	// Nothing changed, nothing to do, but the traffic is reported.
+	clock.Advance(time.Minute)
+	client.rxBytes = 100
+	runOnce(0)
+
+	points, err := series.Series(stats.Query{DeviceName: "wg0", PublicKey: alice.PublicKey, Resolution: stats.Raw, From: start})
+	if err != nil || len(points) != 2 || points[1].RxBytes != 100 {
+		t.Errorf("Series() = %v, %v, want 100 bytes received in the second minute", points, err)
+	}
+
+	if host, ok, err := store.FindHost("gw1"); err != nil || !ok || host.LastSeen != start.Add(time.Minute).Unix() {
+		t.Errorf("FindHost() = %v, %v, %v, want it seen a minute in", host, ok, err)
+	}
+
+	alice.AllowedIPs = mustParseCIDRs(t, "10.0.0.2/32", "10.1.0.0/24")
+	alice.Revision = 0
+	if err = r.UpdatePeers("wg0", []repo.PeerInfo{alice}); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(1)
+	if d, _ = mem.Device("wg0"); len(d.Peers[0].AllowedIPs) != 2 {
+		t.Errorf("alice has AllowedIPs %v after the change", d.Peers[0].AllowedIPs)
+	}
+
+	// Moving the device to another host takes it down here.
+	if err = store.AssignDevice("gw2", "wg0"); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(1)
+	if devices, _ := mem.Devices(); len(devices) != 0 {
+		t.Errorf("Devices() = %v, want none", devices)
+	}
+
+	a.Token = "nope"
+	if _, err = a.RunOnce(); err == nil {
+		t.Error("RunOnce() with an unknown token succeeded")
+	} else if e, ok := err.(*agent.ServerError); !ok || e.StatusCode != 401 {
+		t.Errorf("RunOnce() error = %v, want a 401", err)
+	}
+}
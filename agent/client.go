@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is how often the agent gets its config and reports unless told otherwise.
+const DefaultInterval = 30 * time.Second
+
+// ServerError is what the server answered when it refused a request.
+type ServerError struct {
+	StatusCode  int
+	Name        string
+	Description string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("agent: the server answered %v %v: %v", e.StatusCode, e.Name, e.Description)
+}
+
+type result struct {
+	Data  json.RawMessage `json:"data"`
+	Error *struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// Agent runs on a host, away from the server: it gets the devices the host runs from the server, brings them up
+// through the local client, and reports what they saw of their peers back.
+type Agent struct {
+	// Server is the address of the api, as http://admin.example.com:9090.
+	Server string
+	Token  string
+
+	Client   wg.Client
+	HTTP     *http.Client
+	Clock    utils.Clock
+	Interval time.Duration
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func NewAgent(server string, token string, client wg.Client, clock utils.Clock, interval time.Duration) *Agent {
+	return &Agent{
+		Server:   strings.TrimSuffix(server, "/"),
+		Token:    token,
+		Client:   client,
+		HTTP:     http.DefaultClient,
+		Clock:    clock,
+		Interval: interval,
+	}
+}
+
+// call sends the body, if any, to the api as the host and reads the data of the answer into ret, if any.
+func (a *Agent) call(method string, path string, body interface{}, ret interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, a.Server+path, reader)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+a.Token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.HTTP.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	var r result
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("agent: unexpected answer %v from the server", resp.Status)
+	}
+
+	if r.Error != nil {
+		return &ServerError{StatusCode: resp.StatusCode, Name: r.Error.Name, Description: r.Error.Description}
+	}
+
+	if ret != nil {
+		return json.Unmarshal(r.Data, ret)
+	}
+	return nil
+}
+
+// apply brings up the devices of the config, reconfigures those that changed, and takes down those the host no longer
+// runs. It returns how many devices it changed.
+func (a *Agent) apply(config Config) (int, error) {
+	running, err := a.Client.Devices()
+	if err != nil {
+		return 0, err
+	}
+
+	current := make(map[string]wg.Device, len(running))
+	for _, d := range running {
+		current[d.Id] = d
+	}
+
+	changed := 0
+	wanted := make(map[string]bool, len(config.Devices))
+	for _, d := range config.Devices {
+		wanted[d.Name] = true
+
+		c, err := d.toWg()
+		if err != nil {
+			return changed, fmt.Errorf("agent: device %v: %v", d.Name, err)
+		}
+
+		if r, ok := current[d.Name]; !ok {
+			_, err = a.Client.Up(d.Name, c)
+		} else if !reflect.DeepEqual(r.ToConfig(), c) {
+			err = a.Client.Configure(d.Name, func(config *wg.DeviceConfig) error {
+				*config = c
+				return nil
+			})
+		} else {
+			continue
+		}
+
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	for id := range current {
+		if !wanted[id] {
+			if err = a.Client.Down(id); err != nil {
+				return changed, err
+			}
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// RunOnce gets the config of the host from the server and applies it, then reports what the devices saw. It returns
+// how many devices it changed.
+func (a *Agent) RunOnce() (int, error) {
+	var config Config
+	if err := a.call(http.MethodGet, "/agent/config", nil, &config); err != nil {
+		return 0, err
+	}
+
+	changed, err := a.apply(config)
+	if err != nil {
+		return changed, err
+	}
+
+	devices, err := a.Client.Devices()
+	if err != nil {
+		return changed, err
+	}
+	return changed, a.call(http.MethodPost, "/agent/report", toReport(devices), nil)
+}
+
+func (a *Agent) run() {
+	defer close(a.done)
+
+	for {
+		if changed, err := a.RunOnce(); err != nil {
+			log.Printf("agent: unable to sync with %v: %v", a.Server, err)
+		} else if changed > 0 {
+			log.Printf("agent: changed %v devices", changed)
+		}
+
+		select {
+		case <-a.stop:
+			return
+		case <-a.Clock.After(a.Interval):
+		}
+	}
+}
+
+// Start runs the agent in the background until Close.
+func (a *Agent) Start() {
+	a.stop = make(chan interface{})
+	a.done = make(chan interface{})
+	go a.run()
+}
+
+func (a *Agent) Close() error {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+		a.stop = nil
+	}
+	return nil
+}
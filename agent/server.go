@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+)
+
+// Server is the central side of the agents: it hands every host the devices it runs, from the repository, and
+// takes what they saw of their peers into the stats.
+type Server struct {
+	Repo  repo.Repository
+	Store *Store
+	// Stats, if set, records the reports of the agents as the collector would the local devices.
+	Stats *stats.Store
+	Clock utils.Clock
+}
+
+func NewServer(repository repo.Repository, store *Store, series *stats.Store, clock utils.Clock) *Server {
+	return &Server{
+		Repo:  repository,
+		Store: store,
+		Stats: series,
+		Clock: clock,
+	}
+}
+
+// Config gives the devices the host runs with their enabled peers, and records that its agent was in touch. Devices
+// assigned to the host but not in the repository are left out.
+func (s *Server) Config(host Host) (Config, error) {
+	devices, err := s.Repo.ListDevices()
+	if err != nil {
+		return Config{}, err
+	}
+
+	runs := make(map[string]bool, len(host.Devices))
+	for _, name := range host.Devices {
+		runs[name] = true
+	}
+
+	ret := Config{Host: host.Name, Devices: make([]DeviceConfig, 0, len(host.Devices))}
+	for _, d := range devices {
+		if !runs[d.Name] {
+			continue
+		}
+
+		peers, _, err := s.Repo.ListPeersByDevices([]string{d.Name}, repo.OrderNameAsc, repo.PageRequest{})
+		if err != nil {
+			return Config{}, err
+		}
+
+		c, err := toDeviceConfig(d, peers)
+		if err != nil {
+			return Config{}, err
+		}
+		ret.Devices = append(ret.Devices, c)
+	}
+
+	return ret, s.Store.SawHost(host.Name, s.Clock.Now())
+}
+
+// Report takes what the agent of the host saw into the stats, and returns how many peers it took. The devices the host
+// doesn't run, as one just moved to another, are ignored.
+func (s *Server) Report(host Host, report Report) (int, error) {
+	runs := make(map[string]bool, len(host.Devices))
+	for _, name := range host.Devices {
+		runs[name] = true
+	}
+
+	var samples []stats.Sample
+	for _, d := range report.Devices {
+		if !runs[d.Name] {
+			continue
+		}
+
+		for _, p := range d.Peers {
+			sample := stats.Sample{
+				DeviceName:    d.Name,
+				LastHandshake: p.LastHandshake,
+				RxBytes:       p.RxBytes,
+				TxBytes:       p.TxBytes,
+			}
+			if err := sample.PublicKey.Scan(p.PublicKey); err != nil {
+				return 0, err
+			}
+			samples = append(samples, sample)
+		}
+	}
+
+	if s.Stats == nil {
+		return len(samples), nil
+	}
+	return len(samples), s.Stats.Record(s.Clock.Now(), samples)
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"time"
+)
+
+var tableMigrations = [][]string{
+	{
+		// Only the hash of the token is kept, the token itself being shown once when the host is added.
+		`CREATE TABLE agent_hosts(
+				name TEXT NOT NULL PRIMARY KEY,
+				token_hash TEXT NOT NULL UNIQUE,
+				last_seen INTEGER NOT NULL DEFAULT 0
+			)`,
+
+		// A device runs on one host at most.
+		`CREATE TABLE agent_devices(
+				device_name TEXT NOT NULL PRIMARY KEY,
+				host_name TEXT NOT NULL
+			)`,
+	},
+}
+
+// Host is a machine running the agent, with the devices it runs.
+type Host struct {
+	Name    string
+	Devices []string
+	// LastSeen is when, in unix seconds, its agent last asked for its config, zero if it never did.
+	LastSeen int64
+}
+
+// Store keeps the hosts and which of them runs each device in SQLite, in tables of their own so that it can share
+// the database of the other stores.
+type Store struct {
+	*sqlx.DB
+}
+
+type host struct {
+	Name      string `db:"name"`
+	TokenHash string `db:"token_hash"`
+	LastSeen  int64  `db:"last_seen"`
+}
+
+func NewSqliteStore(dsn string) (*Store, error) {
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{DB: db}
+	if err = schema.MigrateDB(db, "agent_", tableMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveHost adds the host, or gives it a new token if it's there already, and returns the token its agent
+// authenticates with. The token can't be read back later.
+func (s *Store) SaveHost(name string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	_, err := s.Exec(`INSERT INTO agent_hosts(name, token_hash) VALUES (?, ?)
+						ON CONFLICT (name) DO UPDATE SET token_hash = excluded.token_hash`, name, hashToken(token))
+	return token, err
+}
+
+// RemoveHost removes the host, and with it which devices it runs.
+func (s *Store) RemoveHost(name string) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM agent_devices WHERE host_name = ?", name); err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM agent_hosts WHERE name = ?", name)
+	return
+}
+
+func (s *Store) selectHosts(query string, args ...interface{}) ([]Host, error) {
+	var rows []host
+	if err := s.Select(&rows, "SELECT * FROM agent_hosts "+query+" ORDER BY name", args...); err != nil {
+		return nil, err
+	}
+
+	ret := make([]Host, 0, len(rows))
+	for _, row := range rows {
+		h := Host{Name: row.Name, LastSeen: row.LastSeen, Devices: make([]string, 0)}
+		if err := s.Select(&h.Devices, "SELECT device_name FROM agent_devices WHERE host_name = ? ORDER BY device_name", row.Name); err != nil {
+			return nil, err
+		}
+		ret = append(ret, h)
+	}
+	return ret, nil
+}
+
+// ListHosts lists every host by name.
+func (s *Store) ListHosts() ([]Host, error) {
+	return s.selectHosts("")
+}
+
+// FindHost gives the host, ok false if there is none of that name.
+func (s *Store) FindHost(name string) (Host, bool, error) {
+	hosts, err := s.selectHosts("WHERE name = ?", name)
+	if err != nil || len(hosts) == 0 {
+		return Host{}, false, err
+	}
+	return hosts[0], true, nil
+}
+
+// Authenticate gives the host the token was handed to, ok false if it's no host's.
+func (s *Store) Authenticate(token string) (Host, bool, error) {
+	hosts, err := s.selectHosts("WHERE token_hash = ?", hashToken(token))
+	if err != nil || len(hosts) == 0 {
+		return Host{}, false, err
+	}
+	return hosts[0], true, nil
+}
+
+// AssignDevice has the host run the device, moving it from whichever host ran it before.
+func (s *Store) AssignDevice(hostName string, deviceName string) error {
+	_, err := s.Exec(`INSERT INTO agent_devices(device_name, host_name) VALUES (?, ?)
+						ON CONFLICT (device_name) DO UPDATE SET host_name = excluded.host_name`, deviceName, hostName)
+	return err
+}
+
+// UnassignDevice has no host run the device, so that no agent brings it up.
+func (s *Store) UnassignDevice(deviceName string) error {
+	_, err := s.Exec("DELETE FROM agent_devices WHERE device_name = ?", deviceName)
+	return err
+}
+
+// SawHost records that the agent of the host was in touch.
+func (s *Store) SawHost(name string, at time.Time) error {
+	_, err := s.Exec("UPDATE agent_hosts SET last_seen = ? WHERE name = ?", at.Unix(), name)
+	return err
+}
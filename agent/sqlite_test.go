@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T, name string) *Store {
+	s, err := NewSqliteStore("file:agent_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal("NewSqliteStore():", err)
+	}
+	return s
+}
+
+func TestStore_Hosts(t *testing.T) {
+	s := newStore(t, "hosts")
+	defer s.Close()
+
+	token, err := s.SaveHost("gw1")
+	if err != nil || len(token) == 0 {
+		t.Fatalf("SaveHost() = %q, %v", token, err)
+	}
+
+	if _, err = s.SaveHost("gw2"); err != nil {
+		t.Fatal("SaveHost():", err)
+	}
+
+	if host, ok, err := s.Authenticate(token); err != nil || !ok || host.Name != "gw1" {
+		t.Errorf("Authenticate() = %v, %v, %v, want gw1", host, ok, err)
+	}
+
+	// A new token replaces the old one.
+	renewed, err := s.SaveHost("gw1")
+	if err != nil || renewed == token {
+		t.Fatalf("SaveHost() = %q, %v, want a new token", renewed, err)
+	}
+
+	if _, ok, err := s.Authenticate(token); err != nil || ok {
+		t.Errorf("Authenticate() of the old token = %v, %v, want no host", ok, err)
+	}
+
+	for _, a := range [][2]string{{"gw1", "wg0"}, {"gw1", "wg1"}, {"gw2", "wg1"}} {
+		if err := s.AssignDevice(a[0], a[1]); err != nil {
+			t.Fatal("AssignDevice():", err)
+		}
+	}
+
+	if err := s.SawHost("gw2", time.Unix(1000, 0)); err != nil {
+		t.Fatal("SawHost():", err)
+	}
+
+	want := []Host{{Name: "gw1", Devices: []string{"wg0"}}, {Name: "gw2", Devices: []string{"wg1"}, LastSeen: 1000}}
+	if hosts, err := s.ListHosts(); err != nil || !reflect.DeepEqual(hosts, want) {
+		t.Errorf("ListHosts() = %v, %v, want %v", hosts, err, want)
+	}
+
+	if err := s.RemoveHost("gw2"); err != nil {
+		t.Fatal("RemoveHost():", err)
+	}
+
+	if err := s.UnassignDevice("wg0"); err != nil {
+		t.Fatal("UnassignDevice():", err)
+	}
+
+	// Neither device is left on a host: gw2 took wg1 with it.
+	want = []Host{{Name: "gw1", Devices: []string{}}}
+	if hosts, err := s.ListHosts(); err != nil || !reflect.DeepEqual(hosts, want) {
+		t.Errorf("ListHosts() = %v, %v, want %v", hosts, err, want)
+	}
+
+	if _, ok, err := s.FindHost("gw2"); err != nil || ok {
+		t.Errorf("FindHost() of a removed host = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/agent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"strings"
+	"time"
+)
+
+const (
+	auditHostUpdated repo.AuditAction = "host.updated"
+	auditHostRemoved repo.AuditAction = "host.removed"
+)
+
+type agentHost struct {
+	Name     string     `json:"name"`
+	Devices  []string   `json:"devices"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type agentToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// WithAgents serves the hosts running the agent under /hosts, and the agents themselves under /agent.
+func WithAgents(server *agent.Server) Option {
+	return func(api *httpApi) {
+		api.Agents = server
+	}
+}
+
+func (h *agentHost) FromHost(host agent.Host) {
+	h.Name = host.Name
+	h.Devices = host.Devices
+	h.LastSeen = unixTime(host.LastSeen)
+}
+
+// agentHostOf gives the host whose token the request bears as "Authorization: Bearer", failing with 401 if there is
+// none.
+func (api httpApi) agentHostOf(request *http.Request) agent.Host {
+	header := request.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	if token != header && len(token) > 0 {
+		if host, ok, err := api.Agents.Store.Authenticate(token); err != nil {
+			panic(err)
+		} else if ok {
+			return host
+		}
+	}
+
+	panic(&displayableError{
+		Name:        unauthorized,
+		Description: "The token of a host is required",
+		StatusCode:  401,
+	})
+}
+
+func (api httpApi) findHost(name string) agent.Host {
+	host, ok, err := api.Agents.Store.FindHost(name)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		panic(notFoundError("Host"))
+	}
+	return host
+}
+
+// hostAudit gives the host with the name as audited, or nil if there is no such host.
+func (api httpApi) hostAudit(name string) *agentHost {
+	host, ok, err := api.Agents.Store.FindHost(name)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		return nil
+	}
+
+	return hostAuditOf(host)
+}
+
+// hostAuditOf gives the host as audited: when it was last seen isn't a change anyone made.
+func hostAuditOf(host agent.Host) *agentHost {
+	return &agentHost{Name: host.Name, Devices: host.Devices}
+}
+
+func (api httpApi) writeHost(writer http.ResponseWriter, name string) {
+	var ret agentHost
+	ret.FromHost(api.findHost(name))
+	writeHttpResult(ret, nil, writer)
+}
+
+// serveAgents adds the hosts, GET /hosts and GET, PUT and DELETE /hosts/:host, and which devices they run, PUT and
+// DELETE /hosts/:host/devices/:device. PUT of a host answers with the token its agent authenticates with, a new one
+// every time, since it can't be read back. A device runs on one host at most: assigning it moves it.
+//
+// The agents authenticate with their token as "Authorization: Bearer" to get the devices of their host, GET
+// /agent/config, and to report what the devices saw, POST /agent/report.
+func (api httpApi) serveAgents(r *httprouter.Router) {
+	r.GET("/hosts", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		hosts, err := api.Agents.Store.ListHosts()
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]agentHost, 0, len(hosts))
+		for _, h := range hosts {
+			var host agentHost
+			host.FromHost(h)
+			ret = append(ret, host)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/hosts/:host", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeHost(writer, params.ByName("host"))
+	})
+
+	r.PUT("/hosts/:host", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		name := params.ByName("host")
+		before := api.hostAudit(name)
+		token, err := api.Agents.Store.SaveHost(name)
+		if err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditHostUpdated, Subject: name, Changes: map[string]repo.AuditChange{
+			"token": {After: auditChanged},
+		}}
+		api.audit(request, entry, before, api.hostAudit(name))
+		writeHttpResult(agentToken{Name: name, Token: token}, nil, writer)
+	})
+
+	r.DELETE("/hosts/:host", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		name := params.ByName("host")
+		before := api.hostAudit(name)
+		if err := api.Agents.Store.RemoveHost(name); err != nil {
+			panic(err)
+		}
+
+		api.audit(request, repo.AuditEntry{Action: auditHostRemoved, Subject: name}, before, nil)
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.PUT("/hosts/:host/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		host := api.findHost(params.ByName("host"))
+		deviceName := params.ByName("device")
+		if _, ok := api.findDevice(deviceName); !ok {
+			panic(notFoundError("Device"))
+		}
+
+		if err := api.Agents.Store.AssignDevice(host.Name, deviceName); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditHostUpdated, Subject: host.Name}
+		api.audit(request, entry, hostAuditOf(host), api.hostAudit(host.Name))
+		api.writeHost(writer, host.Name)
+	})
+
+	r.DELETE("/hosts/:host/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		host := api.findHost(params.ByName("host"))
+		for _, d := range host.Devices {
+			if d == params.ByName("device") {
+				if err := api.Agents.Store.UnassignDevice(d); err != nil {
+					panic(err)
+				}
+
+				entry := repo.AuditEntry{Action: auditHostUpdated, Subject: host.Name}
+				api.audit(request, entry, hostAuditOf(host), api.hostAudit(host.Name))
+			}
+		}
+		api.writeHost(writer, host.Name)
+	})
+
+	r.GET("/agent/config", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		config, err := api.Agents.Config(api.agentHostOf(request))
+		if err != nil {
+			panic(err)
+		}
+		writeHttpResult(config, nil, writer)
+	})
+
+	r.POST("/agent/report", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		host := api.agentHostOf(request)
+
+		var body agent.Report
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		count, err := api.Agents.Report(host, body)
+		writeBulkResult(writer, count, err)
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"strconv"
+	"time"
+)
+
+type auditEntry struct {
+	Id         int64                       `json:"id"`
+	Time       time.Time                   `json:"time"`
+	Actor      string                      `json:"actor"`
+	SourceIP   string                      `json:"source_ip,omitempty"`
+	Action     repo.AuditAction            `json:"action"`
+	DeviceName string                      `json:"device"`
+	PublicKey  string                      `json:"public_key,omitempty"`
+	Subject    string                      `json:"subject,omitempty"`
+	Changes    map[string]repo.AuditChange `json:"changes"`
+}
+
+func (e *auditEntry) FromAuditEntry(entry repo.AuditEntry) {
+	*e = auditEntry{
+		Id:         entry.Id,
+		Time:       entry.Time.UTC(),
+		Actor:      entry.Actor.Name,
+		SourceIP:   entry.Actor.SourceIP,
+		Action:     entry.Action,
+		DeviceName: entry.DeviceName,
+		PublicKey:  entry.PublicKey,
+		Subject:    entry.Subject,
+		Changes:    entry.Changes,
+	}
+}
+
+// auditChanged is what's recorded of a secret that was set, such as a password, which has no fingerprint to tell it
+// from the one before.
+const auditChanged = "changed"
+
+// anonymous is the actor of the requests that aren't authenticated.
+const anonymous = "anonymous"
+
+// actorOf tells who makes a request: the user it's authenticated as, from the address it comes from. Nothing the
+// request only claims, such as the user of its basic authentication, is taken as who it is.
+func actorOf(request *http.Request) repo.Actor {
+	actor := repo.Actor{Name: anonymous, SourceIP: request.RemoteAddr}
+	if u, ok := userOf(request); ok {
+		actor.Name = u.Name
+	}
+
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		actor.SourceIP = host
+	}
+	return actor
+}
+
+// repoFor gives the repository to make the changes of a request through, so that they're audited as its actor's.
+func (api httpApi) repoFor(request *http.Request) repo.Repository {
+	return repo.AsActor(api.Repo, actorOf(request))
+}
+
+// audit records a change the request made outside the repository as its actor's, if the repository keeps an audit
+// log. The changes of the entry are those from before to after, the views of what was changed as AuditChanges takes
+// them, added to any it has already. Nothing is recorded if nothing changed.
+func (api httpApi) audit(request *http.Request, entry repo.AuditEntry, before interface{}, after interface{}) {
+	log, ok := api.repoFor(request).(repo.AuditLog)
+	if !ok {
+		return
+	}
+
+	changes := repo.AuditChanges(before, after)
+	for k, v := range entry.Changes {
+		changes[k] = v
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	entry.Changes = changes
+	if err := log.Record(entry); err != nil {
+		panic(err)
+	}
+}
+
+// parseAuditFilter reads the filter from the query parameters actor, action, device, public_key, subject, since and
+// until, the last two in RFC 3339.
+func parseAuditFilter(r *http.Request) (filter repo.AuditFilter, err error) {
+	filter.Actor = getQueryParams(r, "actor", "")
+	filter.Action = repo.AuditAction(getQueryParams(r, "action", ""))
+	filter.DeviceName = getQueryParams(r, "device", "")
+	filter.PublicKey = getQueryParams(r, "public_key", "")
+	filter.Subject = getQueryParams(r, "subject", "")
+
+	if filter.Since, err = parseTimeParam(r, "since"); err != nil {
+		return
+	}
+
+	filter.Until, err = parseTimeParam(r, "until")
+	return
+}
+
+// serveAudit adds GET /audit, listing the audit log from the newest entry, a page at a time.
+func (api httpApi) serveAudit(r *httprouter.Router, log repo.AuditLog) {
+	r.GET("/audit", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		limit, err := strconv.ParseUint(getQueryParams(request, "limit", "0"), 10, 32)
+		if err != nil {
+			panic(badParameter("limit"))
+		}
+
+		filter, err := parseAuditFilter(request)
+		if err != nil {
+			panic(err)
+		}
+
+		page := repo.PageRequest{
+			Cursor: getQueryParams(request, "cursor", ""),
+			Limit:  uint(limit),
+		}
+
+		entries, cursors, err := log.ListAudit(filter, page)
+		if err == repo.InvalidCursor {
+			panic(badParameter("cursor"))
+		} else if err != nil {
+			panic(err)
+		}
+
+		contents := make([]auditEntry, len(entries))
+		for i, e := range entries {
+			contents[i].FromAuditEntry(e)
+		}
+
+		writeHttpResult(paginatedResult{Contents: contents, Next: cursors.Next}, nil, writer)
+	})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"strings"
+)
+
+const auditStoreRestored repo.AuditAction = "store.restored"
+
+type restoreResult struct {
+	Devices int `json:"devices"`
+}
+
+// WithBackup serves the backup of the store and its restore under /admin, to requests bearing the admin token only,
+// since the backup holds every private key. Nothing is served with an empty token.
+func WithBackup(store persistent.Repository, adminToken string) Option {
+	return func(api *httpApi) {
+		if len(adminToken) > 0 {
+			api.Store = store
+			api.AdminToken = adminToken
+		}
+	}
+}
+
+// checkAdmin fails with 401 unless the request has the admin token as "Authorization: Bearer", or is an admin's with
+// users.
+func (api httpApi) checkAdmin(request *http.Request) {
+	if u, ok := userOf(request); ok && u.IsAdmin() {
+		return
+	}
+
+	header := request.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(api.AdminToken)) != 1 {
+		panic(&displayableError{
+			Name:        unauthorized,
+			Description: "The admin token is required",
+			StatusCode:  401,
+		})
+	}
+}
+
+// serveBackup adds GET /admin/backup for the backup document, and POST /admin/restore to write one back with the mode
+// parameter, merge or replace, defaulting to merge. A document that isn't valid is refused with 400 as a whole.
+func (api httpApi) serveBackup(r *httprouter.Router) {
+	r.GET("/admin/backup", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.checkAdmin(request)
+
+		if backup, err := api.Store.Backup(); err != nil {
+			panic(err)
+		} else {
+			writeHttpResult(backup, nil, writer)
+		}
+	})
+
+	r.POST("/admin/restore", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.checkAdmin(request)
+
+		modeName := getQueryParams(request, "mode", "merge")
+		mode, err := persistent.ParseRestoreMode(modeName)
+		if err != nil {
+			panic(badParameter("mode"))
+		}
+
+		var backup persistent.Backup
+		if err := json.NewDecoder(request.Body).Decode(&backup); err != nil {
+			panic(badParameter("body"))
+		}
+
+		if err := api.Store.Restore(backup, mode); err != nil {
+			if e, ok := err.(*persistent.InvalidBackupError); ok {
+				panic(&displayableError{
+					Cause:       e,
+					Name:        badRequest,
+					Description: e.Error(),
+					StatusCode:  400,
+				})
+			}
+			panic(err)
+		}
+
+		// What a restore changed is in the backup; the entry tells who wrote it back, and how.
+		entry := repo.AuditEntry{Action: auditStoreRestored, Changes: map[string]repo.AuditChange{
+			"mode":    {After: modeName},
+			"devices": {After: len(backup.Devices)},
+		}}
+		api.audit(request, entry, nil, nil)
+		writeHttpResult(restoreResult{Devices: len(backup.Devices)}, nil, writer)
+	})
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/peercsv"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"strings"
+)
+
+type importedPeer struct {
+	Row        int      `json:"row"`
+	DeviceName string   `json:"device"`
+	Name       string   `json:"name"`
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips"`
+	// PrivateKey is only there for the peers whose key was generated, and is kept nowhere else.
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+func (p *importedPeer) FromImported(imported peercsv.Imported) {
+	*p = importedPeer{
+		Row:        imported.Row,
+		DeviceName: imported.Peer.DeviceName,
+		Name:       imported.Peer.Name,
+		PublicKey:  imported.Peer.PublicKey.String(),
+		AllowedIPs: make([]string, 0, len(imported.Peer.AllowedIPs)),
+		PrivateKey: imported.PrivateKey.String(),
+	}
+
+	for _, ip := range imported.Peer.AllowedIPs {
+		p.AllowedIPs = append(p.AllowedIPs, ip.String())
+	}
+}
+
+// parseNetworks reads the network parameters, which are repeatable and given as device:address/length, the address
+// being the device's own.
+func parseNetworks(r *http.Request) map[string]net.IPNet {
+	ret := make(map[string]net.IPNet)
+	for _, n := range r.URL.Query()["network"] {
+		kv := strings.SplitN(n, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			panic(badParameter("network"))
+		}
+
+		ip, network, err := net.ParseCIDR(kv[1])
+		if err != nil {
+			panic(badParameter("network"))
+		}
+
+		network.IP = ip
+		ret[kv[0]] = *network
+	}
+	return ret
+}
+
+// serveCSV adds the import of peers from CSV, POST /peers/import, and the export of the peers matching the filter of
+// GET /peers as CSV, GET /peers/export. The import is all or nothing, failing with 400 and the problem of every row,
+// and allocates the addresses of the rows without one in the networks given by the network parameters.
+func (api httpApi) serveCSV(r *httprouter.Router) {
+	r.POST("/peers/import", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		imported, err := peercsv.Import(api.repoFor(request), api.Allocator, request.Body, parseNetworks(request))
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]importedPeer, 0, len(imported))
+		for _, p := range imported {
+			var peer importedPeer
+			peer.FromImported(p)
+			ret = append(ret, peer)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/peers/export", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		filter, err := parsePeerFilter(request)
+		if err != nil {
+			panic(err)
+		}
+
+		peers, _, err := api.Repo.ListPeers(filter, repo.OrderNameAsc, repo.PageRequest{})
+		if err != nil {
+			panic(err)
+		}
+
+		writer.Header().Set("Content-Type", "text/csv")
+		writer.Header().Set("Content-Disposition", `attachment; filename="peers.csv"`)
+		_ = peercsv.Export(writer, peers)
+	})
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type deviceRequest struct {
+	ListenPort uint16 `json:"listen_port"`
+}
+
+type peerRequest struct {
+	Name                string            `json:"name"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	Endpoint            string            `json:"endpoint"`
+	PersistentKeepalive int64             `json:"persistent_keepalive"`
+	Meta                map[string]string `json:"meta"`
+	Tags                []string          `json:"tags"`
+	Groups              []string          `json:"groups"`
+	ExpiresAt           *time.Time        `json:"expires_at"`
+	Owner               string            `json:"owner"`
+}
+
+// applyTo sets what can be edited of a peer, leaving its keys, state and handshake alone.
+func (body peerRequest) applyTo(p *repo.PeerInfo) error {
+	p.AllowedIPs = make([]net.IPNet, 0, len(body.AllowedIPs))
+	for _, s := range body.AllowedIPs {
+		if _, n, err := net.ParseCIDR(s); err != nil {
+			return badParameter("allowed_ips")
+		} else {
+			p.AllowedIPs = append(p.AllowedIPs, *n)
+		}
+	}
+
+	p.Endpoint = nil
+	if len(body.Endpoint) > 0 {
+		endpoint, err := net.ResolveUDPAddr("udp", body.Endpoint)
+		if err != nil {
+			return badParameter("endpoint")
+		}
+		p.Endpoint = endpoint
+	}
+
+	if body.PersistentKeepalive < 0 || body.PersistentKeepalive > 65535 {
+		return badParameter("persistent_keepalive")
+	}
+
+	p.Name = body.Name
+	p.PersistentKeepaliveInterval = time.Duration(body.PersistentKeepalive) * time.Second
+	p.Meta = body.Meta
+	p.Tags = body.Tags
+	p.Groups = body.Groups
+	p.Owner = body.Owner
+
+	p.ExpiresAt = 0
+	if body.ExpiresAt != nil {
+		p.ExpiresAt = body.ExpiresAt.Unix()
+	}
+	return nil
+}
+
+func notFoundError(what string) *displayableError {
+	return &displayableError{
+		Name:        notFound,
+		Description: fmt.Sprintf("%s does not exist", what),
+		StatusCode:  404,
+	}
+}
+
+func setETag(writer http.ResponseWriter, revision int64) {
+	writer.Header().Set("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+}
+
+// checkIfMatch fails with 412 unless the request's If-Match, if it has one, names the revision. It gives the revision
+// to write with: the one matched, so that a change made in between fails with 409, or zero without If-Match.
+func checkIfMatch(request *http.Request, revision int64) int64 {
+	header := request.Header.Get("If-Match")
+	if len(header) == 0 {
+		return 0
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" && revision != 0 {
+			return revision
+		}
+
+		if v, err := strconv.Unquote(tag); err == nil && v == strconv.FormatInt(revision, 10) && revision != 0 {
+			return revision
+		}
+	}
+
+	panic(&displayableError{
+		Name:        preconditionFailed,
+		Description: "It has been changed since it was read",
+		StatusCode:  412,
+	})
+}
+
+// parsePeerKey reads a public key from the path, where it may be given in URL-safe base64 since the standard one
+// has slashes.
+func parsePeerKey(params httprouter.Params) repo.PublicKey {
+	var k repo.PublicKey
+	if err := k.Scan(strings.NewReplacer("-", "+", "_", "/").Replace(params.ByName("peer"))); err != nil {
+		panic(badParameter("peer"))
+	}
+	return k
+}
+
+func (api httpApi) findDevice(name string) (repo.DeviceInfo, bool) {
+	devices, err := api.Repo.ListDevices()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, d := range devices {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return repo.DeviceInfo{}, false
+}
+
+func (api httpApi) findPeer(deviceName string, key repo.PublicKey) (repo.PeerInfo, bool) {
+	peers, _, err := api.Repo.ListPeersByKeys(deviceName, []repo.PublicKey{key}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		panic(err)
+	}
+
+	if len(peers) == 0 {
+		return repo.PeerInfo{}, false
+	}
+	return peers[0], true
+}
+
+// allocate gives a new peer the next free address of each of the networks of its device, if it has any, held until
+// the returned release is called once the peer is stored.
+func (api httpApi) allocate(p *repo.PeerInfo) (release func()) {
+	networks, err := api.Allocator.Networks(persistent.DeviceId(p.DeviceName))
+	if err == ipam.ErrNoAddress || os.IsNotExist(err) {
+		return func() {}
+	} else if err != nil {
+		panic(err)
+	}
+
+	used := func() ([]net.IPNet, error) {
+		return repo.DeviceAddresses(api.Repo, p.DeviceName)
+	}
+
+	key, err := p.PublicKey.ToKey()
+	if err != nil {
+		panic(err)
+	}
+
+	held, err := api.Allocator.Hold(persistent.DeviceId(p.DeviceName), networks, used, wg.Key(key))
+	if err != nil {
+		panic(err)
+	}
+
+	p.AllowedIPs = append(p.AllowedIPs, held.AllowedIPs()...)
+	return func() {
+		_ = held.Release()
+	}
+}
+
+func (api httpApi) writeDevice(writer http.ResponseWriter, name string) {
+	d, ok := api.findDevice(name)
+	if !ok {
+		panic(notFoundError("Device"))
+	}
+
+	var ret device
+	ret.FromDeviceInfo(d)
+	setETag(writer, d.Revision)
+	writeHttpResult(ret, nil, writer)
+}
+
+func (api httpApi) writePeer(writer http.ResponseWriter, deviceName string, key repo.PublicKey) {
+	p, ok := api.findPeer(deviceName, key)
+	if !ok {
+		panic(notFoundError("Peer"))
+	}
+
+	var ret peer
+	ret.FromPeerInfo(p)
+
+	var err error
+	if ret.Quota, err = api.peerQuota(deviceName, key); err != nil {
+		panic(err)
+	}
+
+	setETag(writer, p.Revision)
+	writeHttpResult(ret, nil, writer)
+}
+
+// serveDevices adds GET and PUT for a single device, /devices/:device, and a single peer,
+// /devices/:device/peers/:peer. Both answer with the revision as ETag, and PUT takes it back in If-Match to make
+// sure it doesn't overwrite someone else's change: 412 when the revision has already moved on, 409 when it moves on
+// while writing. PUT of a peer creates it if it doesn't exist, with the next free address of each of the networks of
+// the device if it's given no allowed_ips.
+func (api httpApi) serveDevices(r *httprouter.Router) {
+	r.GET("/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeDevice(writer, params.ByName("device"))
+	})
+
+	r.PUT("/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body deviceRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		d, ok := api.findDevice(params.ByName("device"))
+		if !ok {
+			panic(notFoundError("Device"))
+		}
+
+		d.Revision = checkIfMatch(request, d.Revision)
+		d.ListenPort = body.ListenPort
+		if err := api.repoFor(request).UpdateDevices([]repo.DeviceInfo{d}); err != nil {
+			panic(err)
+		}
+
+		api.writeDevice(writer, d.Name)
+	})
+
+	r.GET("/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writePeer(writer, params.ByName("device"), parsePeerKey(params))
+	})
+
+	r.PUT("/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body peerRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		deviceName, key := params.ByName("device"), parsePeerKey(params)
+		if _, ok := api.findDevice(deviceName); !ok {
+			panic(notFoundError("Device"))
+		}
+
+		p, ok := api.findPeer(deviceName, key)
+		if !ok {
+			p = repo.PeerInfo{PublicKey: key, DeviceName: deviceName}
+		}
+
+		p.Revision = checkIfMatch(request, p.Revision)
+		if err := body.applyTo(&p); err != nil {
+			panic(err)
+		}
+		p.Meta = api.normalisePeerMeta(p.Meta)
+
+		if !ok && len(p.AllowedIPs) == 0 {
+			defer api.allocate(&p)()
+		}
+
+		if err := api.repoFor(request).UpdatePeers(deviceName, []repo.PeerInfo{p}); err != nil {
+			panic(err)
+		}
+
+		api.writePeer(writer, deviceName, key)
+	})
+}
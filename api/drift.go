@@ -0,0 +1,43 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+)
+
+// driftDeviceIds reads the repeatable device parameter. None means every device.
+func driftDeviceIds(r *http.Request) (ret []persistent.DeviceId) {
+	for _, id := range r.URL.Query()["device"] {
+		ret = append(ret, persistent.DeviceId(id))
+	}
+	return
+}
+
+// serveDrift adds GET /drift for the report, and POST /drift/adopt and /drift/reapply to settle the drift of the
+// given devices either way. Both of the latter answer with the drift that is left.
+func (api httpApi) serveDrift(r *httprouter.Router) {
+	r.GET("/drift", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if report, err := api.Drift.Check(); err != nil {
+			panic(err)
+		} else {
+			writeHttpResult(report, nil, writer)
+		}
+	})
+
+	r.POST("/drift/adopt", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if report, err := api.Drift.Adopt(driftDeviceIds(request)); err != nil {
+			panic(err)
+		} else {
+			writeHttpResult(report, nil, writer)
+		}
+	})
+
+	r.POST("/drift/reapply", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if report, err := api.Drift.Reapply(driftDeviceIds(request)); err != nil {
+			panic(err)
+		} else {
+			writeHttpResult(report, nil, writer)
+		}
+	})
+}
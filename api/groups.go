@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+)
+
+type allowedIPsRequest struct {
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+type stateRequest struct {
+	Device     string   `json:"device"`
+	PublicKeys []string `json:"public_keys"`
+	Reason     string   `json:"reason"`
+}
+
+// readStateRequest reads the body of an enable or disable action. An empty body is a request with no reason.
+func readStateRequest(request *http.Request) (body stateRequest) {
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil && err != io.EOF {
+		panic(badParameter("body"))
+	}
+	return
+}
+
+func groupFilter(params httprouter.Params) repo.PeerFilter {
+	return repo.PeerFilter{Group: params.ByName("group")}
+}
+
+func writeBulkResult(writer http.ResponseWriter, count int, err error) {
+	if err != nil {
+		panic(err)
+	}
+
+	writeHttpResult(bulkResult{Affected: count}, nil, writer)
+}
+
+// serveGroups adds the operations on every peer of a group, each answering with the number of peers affected:
+// DELETE /groups/:group/peers, PUT /groups/:group/peers/allowed_ips, POST /groups/:group/peers/rotate_psk and
+// POST /groups/:group/peers/enable or disable, which take an optional reason. The peers of a group are listed by
+// GET /peers?group=.
+func (api httpApi) serveGroups(r *httprouter.Router) {
+	r.DELETE("/groups/:group/peers", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		count, err := repo.RemoveMatchingPeers(api.repoFor(request), groupFilter(params))
+		writeBulkResult(writer, count, err)
+	})
+
+	r.PUT("/groups/:group/peers/allowed_ips", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body allowedIPsRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("allowed_ips"))
+		}
+
+		allowedIPs := make([]net.IPNet, 0, len(body.AllowedIPs))
+		for _, s := range body.AllowedIPs {
+			if _, n, err := net.ParseCIDR(s); err != nil {
+				panic(badParameter("allowed_ips"))
+			} else {
+				allowedIPs = append(allowedIPs, *n)
+			}
+		}
+
+		count, err := repo.SetMatchingAllowedIPs(api.repoFor(request), groupFilter(params), allowedIPs)
+		writeBulkResult(writer, count, err)
+	})
+
+	r.POST("/groups/:group/peers/rotate_psk", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		count, err := repo.RotateMatchingPreSharedKeys(api.repoFor(request), groupFilter(params))
+		writeBulkResult(writer, count, err)
+	})
+
+	for action, enabled := range map[string]bool{"enable": true, "disable": false} {
+		enabled := enabled
+		r.POST("/groups/:group/peers/"+action, func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+			body := readStateRequest(request)
+			count, err := repo.SetMatchingEnabled(api.repoFor(request), groupFilter(params), enabled, body.Reason)
+			writeBulkResult(writer, count, err)
+		})
+	}
+}
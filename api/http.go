@@ -2,28 +2,95 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"net"
 	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/agent"
+	"nz.cloudwalker/wireguard-webadmin/drift"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/quota"
 	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/site"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/users"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type httpApi struct {
-	Repo repo.Repository
+	Repo  repo.Repository
+	Drift *drift.Checker
+
+	// Allocator hands out the addresses of the peers added without one. WithAllocator sets one that reserves them
+	// in a store; the default only picks them.
+	Allocator *ipam.Allocator
+
+	// Store and AdminToken are set together, by WithBackup.
+	Store      persistent.Repository
+	AdminToken string
+
+	// Meta is set by WithMetadata.
+	Meta persistent.Repository
+
+	// Stats is set by WithStats.
+	Stats *stats.Store
+
+	// Quotas is set by WithQuotas.
+	Quotas *quota.Enforcer
+
+	// Agents is set by WithAgents.
+	Agents *agent.Server
+
+	// Sites is set by WithSites.
+	Sites *site.Store
+
+	// Users and UserDevices are set together, by WithUsers.
+	Users       *users.Store
+	UserDevices map[string]users.Device
+}
+
+// Option turns on the parts of the api that need more than the repository.
+type Option func(api *httpApi)
+
+// WithDriftChecker serves the drift report and its fixes under /drift.
+func WithDriftChecker(checker *drift.Checker) Option {
+	return func(api *httpApi) {
+		api.Drift = checker
+	}
 }
 
-func (api httpApi) ListPeers(offset uint32, limit uint32) (result paginatedResult, err error) {
+// WithAllocator hands out the addresses of the peers with the allocator, minding the reservations of its store.
+func WithAllocator(allocator *ipam.Allocator) Option {
+	return func(api *httpApi) {
+		api.Allocator = allocator
+	}
+}
+
+func (api httpApi) ListPeers(filter repo.PeerFilter, page repo.PageRequest) (result paginatedResult, err error) {
 	var peerInfo []repo.PeerInfo
+	var cursors repo.PageCursors
 
-	if peerInfo, result.Total, err = api.Repo.ListAllPeers(offset, limit); err != nil {
+	if peerInfo, cursors, err = api.Repo.ListPeers(filter, repo.OrderNameAsc, page); err != nil {
+		if err == repo.InvalidCursor {
+			err = badParameter("cursor")
+		}
 		return
 	}
 
+	result.Next = cursors.Next
+	result.Prev = cursors.Prev
+
 	var peers []peer
 	var p peer
 
 	for _, info := range peerInfo {
 		p.FromPeerInfo(info)
+		if p.Quota, err = api.peerQuota(info.DeviceName, info.PublicKey); err != nil {
+			return
+		}
 		peers = append(peers, p)
 	}
 
@@ -67,8 +134,92 @@ func getQueryParams(r *http.Request, n string, defaultValue string) string {
 	return v
 }
 
-func NewHttpApi(repository repo.Repository) (http.Handler, error) {
-	api := httpApi{Repo: repository}
+func badParameter(name string) *displayableError {
+	return &displayableError{
+		Name:        badRequest,
+		Description: fmt.Sprintf("Parameter %s is not valid", name),
+		StatusCode:  400,
+	}
+}
+
+func parseIPParam(r *http.Request, n string) (net.IP, error) {
+	v := getQueryParams(r, n, "")
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	if ip := net.ParseIP(v); ip != nil {
+		return ip, nil
+	}
+
+	return nil, badParameter(n)
+}
+
+func parseTimeParam(r *http.Request, n string) (time.Time, error) {
+	v := getQueryParams(r, n, "")
+	if len(v) == 0 {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err != nil {
+		return t, badParameter(n)
+	} else {
+		return t, nil
+	}
+}
+
+// parsePeerFilter reads the filter from the query parameters name, public_key, allowed_ip, endpoint_ip,
+// handshake_before, handshake_after, expires_by (all RFC 3339), group, owner, tag, which is repeatable, and meta, which is
+// repeatable and given as key:value.
+func parsePeerFilter(r *http.Request) (filter repo.PeerFilter, err error) {
+	filter.NameContains = getQueryParams(r, "name", "")
+	filter.PublicKeyPrefix = getQueryParams(r, "public_key", "")
+	filter.Group = getQueryParams(r, "group", "")
+	filter.Owner = getQueryParams(r, "owner", "")
+	filter.Tags = r.URL.Query()["tag"]
+
+	if filter.AllowedIP, err = parseIPParam(r, "allowed_ip"); err != nil {
+		return
+	}
+
+	if filter.EndpointIP, err = parseIPParam(r, "endpoint_ip"); err != nil {
+		return
+	}
+
+	if filter.HandshakeBefore, err = parseTimeParam(r, "handshake_before"); err != nil {
+		return
+	}
+
+	if filter.HandshakeAfter, err = parseTimeParam(r, "handshake_after"); err != nil {
+		return
+	}
+
+	if filter.ExpiresBy, err = parseTimeParam(r, "expires_by"); err != nil {
+		return
+	}
+
+	for _, m := range r.URL.Query()["meta"] {
+		kv := strings.SplitN(m, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			err = badParameter("meta")
+			return
+		}
+
+		if filter.Meta == nil {
+			filter.Meta = make(map[string]string)
+		}
+		filter.Meta[kv[0]] = kv[1]
+	}
+
+	return
+}
+
+func NewHttpApi(repository repo.Repository, options ...Option) (http.Handler, error) {
+	api := httpApi{Repo: repository, Allocator: ipam.NewAllocator(nil)}
+	for _, option := range options {
+		option(&api)
+	}
+
 	r := httprouter.New()
 	r.PanicHandler = func(writer http.ResponseWriter, request *http.Request, i interface{}) {
 		if err, ok := i.(error); ok {
@@ -79,14 +230,6 @@ func NewHttpApi(repository repo.Repository) (http.Handler, error) {
 	}
 
 	r.GET("/peers", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-		offset, err := strconv.ParseUint(getQueryParams(request, "offset", "0"), 10, 32)
-		if err != nil {
-			panic(&displayableError{
-				Name:        badRequest,
-				Description: "Parameter offset is not valid",
-				StatusCode:  400,
-			})
-		}
 		limit, err := strconv.ParseUint(getQueryParams(request, "limit", "0"), 10, 32)
 		if err != nil {
 			panic(&displayableError{
@@ -96,11 +239,85 @@ func NewHttpApi(repository repo.Repository) (http.Handler, error) {
 			})
 		}
 
-		if r, err := api.ListPeers(uint32(offset), uint32(limit)); err != nil {
+		filter, err := parsePeerFilter(request)
+		if err != nil {
+			panic(err)
+		}
+
+		page := repo.PageRequest{
+			Cursor: getQueryParams(request, "cursor", ""),
+			Limit:  uint(limit),
+		}
+
+		if r, err := api.ListPeers(filter, page); err != nil {
 			panic(err)
 		} else {
 			writeHttpResult(r, nil, writer)
 		}
 	})
+
+	for action, enabled := range map[string]bool{"enable": true, "disable": false} {
+		enabled := enabled
+		r.POST("/peers/"+action, func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+			body := readStateRequest(request)
+			if len(body.Device) == 0 {
+				panic(badParameter("device"))
+			}
+
+			keys := make([]repo.PublicKey, 0, len(body.PublicKeys))
+			for _, s := range body.PublicKeys {
+				var k repo.PublicKey
+				if err := k.Scan(s); err != nil {
+					panic(badParameter("public_keys"))
+				}
+				keys = append(keys, k)
+			}
+
+			count, err := repo.SetPeersEnabled(api.repoFor(request), body.Device, keys, enabled, body.Reason)
+			writeBulkResult(writer, count, err)
+		})
+	}
+
+	api.serveDevices(r)
+	api.serveGroups(r)
+	api.serveCSV(r)
+	api.serveTopology(r)
+
+	if log, ok := api.Repo.(repo.AuditLog); ok {
+		api.serveAudit(r, log)
+	}
+
+	if api.Drift != nil {
+		api.serveDrift(r)
+	}
+
+	if api.Store != nil {
+		api.serveBackup(r)
+	}
+
+	if api.Meta != nil {
+		api.serveMeta(r)
+	}
+
+	if api.Stats != nil {
+		api.serveStats(r)
+	}
+
+	if api.Quotas != nil {
+		api.serveQuotas(r)
+	}
+
+	if api.Agents != nil {
+		api.serveAgents(r)
+	}
+
+	if api.Sites != nil {
+		api.serveSites(r)
+	}
+
+	if api.Users != nil {
+		api.serveUsers(r)
+		return api.authenticate(r), nil
+	}
 	return r, nil
 }
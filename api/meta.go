@@ -0,0 +1,240 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+)
+
+const (
+	auditMetaUpdated repo.AuditAction = "meta.updated"
+	auditMetaRemoved repo.AuditAction = "meta.removed"
+)
+
+type metaFieldRequest struct {
+	Type        persistent.FieldType `json:"type"`
+	Values      []string             `json:"values"`
+	Description string               `json:"description"`
+}
+
+type metaPeer struct {
+	DeviceId  string `json:"device"`
+	PublicKey string `json:"public_key"`
+}
+
+// WithMetadata serves the metadata of the store's devices and peers, and the custom fields typing it, under /meta.
+// The metadata of the peers written through /devices/:device/peers/:peer is checked against the fields too.
+func WithMetadata(store persistent.Repository) Option {
+	return func(api *httpApi) {
+		api.Meta = store
+	}
+}
+
+// metaFieldAudit gives the field as audited, or nil if it isn't declared. The field is the subject of its entries,
+// as entity/key.
+func (api httpApi) metaFieldAudit(entity persistent.MetaEntity, key persistent.MetaKey) *persistent.MetaField {
+	fields, err := api.Meta.ListMetaFields()
+	if err != nil {
+		panic(err)
+	}
+
+	for i := range fields {
+		if fields[i].Entity == entity && fields[i].Key == key {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+func metaFieldSubject(entity persistent.MetaEntity, key persistent.MetaKey) string {
+	return string(entity) + "/" + string(key)
+}
+
+func toMetaKeys(meta map[string]string) map[persistent.MetaKey]string {
+	ret := make(map[persistent.MetaKey]string, len(meta))
+	for k, v := range meta {
+		ret[persistent.MetaKey(k)] = v
+	}
+	return ret
+}
+
+func fromMetaKeys(meta map[persistent.MetaKey]string) map[string]string {
+	ret := make(map[string]string, len(meta))
+	for k, v := range meta {
+		ret[string(k)] = v
+	}
+	return ret
+}
+
+// normalisePeerMeta checks the metadata of a peer against the peer fields, if there's a store to declare them.
+func (api httpApi) normalisePeerMeta(meta map[string]string) map[string]string {
+	if api.Meta == nil || len(meta) == 0 {
+		return meta
+	}
+
+	fields, err := api.Meta.ListMetaFields()
+	if err != nil {
+		panic(err)
+	}
+
+	normalised, err := persistent.NormaliseMeta(fields, persistent.MetaPeer, toMetaKeys(meta))
+	if err != nil {
+		panic(err)
+	}
+	return fromMetaKeys(normalised)
+}
+
+func readMeta(request *http.Request) map[persistent.MetaKey]string {
+	var body map[string]string
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		panic(badParameter("body"))
+	}
+	return toMetaKeys(body)
+}
+
+func metaPeerId(params httprouter.Params) persistent.PeerId {
+	key, err := wg.NewKeyFromString(params.ByName("peer"))
+	if err != nil {
+		panic(badParameter("peer"))
+	}
+	return persistent.PeerId{DeviceId: persistent.DeviceId(params.ByName("device")), PublicKey: key}
+}
+
+// metaQuery reads the key and value to find entities by. The key is required, an empty value is looked for as such.
+func metaQuery(request *http.Request) (persistent.MetaKey, string) {
+	key := getQueryParams(request, "key", "")
+	if len(key) == 0 {
+		panic(badParameter("key"))
+	}
+	return persistent.MetaKey(key), getQueryParams(request, "value", "")
+}
+
+// serveMeta adds the custom fields, GET /meta/fields, PUT and DELETE /meta/fields/:entity/:key, the metadata of one
+// device or peer, GET and PUT /meta/devices/:device and /meta/devices/:device/peers/:peer, where PUT replaces all of
+// it, and finding the devices or peers by a key and value, GET /meta/devices and /meta/peers with the key and value
+// parameters. Values that don't fit their field are refused with 400.
+func (api httpApi) serveMeta(r *httprouter.Router) {
+	r.GET("/meta/fields", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		fields, err := api.Meta.ListMetaFields()
+		if err != nil {
+			panic(err)
+		}
+
+		if fields == nil {
+			fields = []persistent.MetaField{}
+		}
+		writeHttpResult(fields, nil, writer)
+	})
+
+	r.PUT("/meta/fields/:entity/:key", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body metaFieldRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		field := persistent.MetaField{
+			Entity:      persistent.MetaEntity(params.ByName("entity")),
+			Key:         persistent.MetaKey(params.ByName("key")),
+			Type:        body.Type,
+			Values:      body.Values,
+			Description: body.Description,
+		}
+
+		before := api.metaFieldAudit(field.Entity, field.Key)
+		if err := api.Meta.SaveMetaFields([]persistent.MetaField{field}); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditMetaUpdated, Subject: metaFieldSubject(field.Entity, field.Key)}
+		api.audit(request, entry, before, api.metaFieldAudit(field.Entity, field.Key))
+		writeHttpResult(field, nil, writer)
+	})
+
+	r.DELETE("/meta/fields/:entity/:key", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		entity, key := persistent.MetaEntity(params.ByName("entity")), persistent.MetaKey(params.ByName("key"))
+		before := api.metaFieldAudit(entity, key)
+		if err := api.Meta.RemoveMetaFields(entity, []persistent.MetaKey{key}); err != nil {
+			panic(err)
+		}
+
+		api.audit(request, repo.AuditEntry{Action: auditMetaRemoved, Subject: metaFieldSubject(entity, key)}, before, nil)
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.GET("/meta/devices", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		ids, err := api.Meta.FindDevicesByMeta(metaQuery(request))
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]string, 0, len(ids))
+		for _, id := range ids {
+			ret = append(ret, string(id))
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/meta/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		meta, err := api.Meta.ListDeviceMeta(persistent.DeviceId(params.ByName("device")))
+		writeHttpResult(fromMetaKeys(meta), err, writer)
+	})
+
+	r.PUT("/meta/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		id := persistent.DeviceId(params.ByName("device"))
+		before, err := api.Meta.ListDeviceMeta(id)
+		if err == nil {
+			err = api.Meta.ReplaceDeviceMeta(id, readMeta(request))
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		meta, err := api.Meta.ListDeviceMeta(id)
+		if err == nil {
+			entry := repo.AuditEntry{Action: auditMetaUpdated, DeviceName: string(id)}
+			api.audit(request, entry, fromMetaKeys(before), fromMetaKeys(meta))
+		}
+		writeHttpResult(fromMetaKeys(meta), err, writer)
+	})
+
+	r.GET("/meta/peers", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		ids, err := api.Meta.FindPeersByMeta(metaQuery(request))
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]metaPeer, 0, len(ids))
+		for _, id := range ids {
+			ret = append(ret, metaPeer{DeviceId: string(id.DeviceId), PublicKey: id.PublicKey.String()})
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/meta/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		meta, err := api.Meta.ListPeerMeta(metaPeerId(params))
+		writeHttpResult(fromMetaKeys(meta), err, writer)
+	})
+
+	r.PUT("/meta/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		id := metaPeerId(params)
+		before, err := api.Meta.ListPeerMeta(id)
+		if err == nil {
+			err = api.Meta.ReplacePeerMeta(id, readMeta(request))
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		meta, err := api.Meta.ListPeerMeta(id)
+		if err == nil {
+			entry := repo.AuditEntry{Action: auditMetaUpdated, DeviceName: string(id.DeviceId), PublicKey: id.PublicKey.String()}
+			api.audit(request, entry, fromMetaKeys(before), fromMetaKeys(meta))
+		}
+		writeHttpResult(fromMetaKeys(meta), err, writer)
+	})
+}
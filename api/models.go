@@ -1,12 +1,42 @@
 package api
 
 import (
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/peercsv"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/quota"
 	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/site"
+	"nz.cloudwalker/wireguard-webadmin/topology"
+	"nz.cloudwalker/wireguard-webadmin/users"
+	"time"
 )
 
+type device struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key"`
+	ListenPort uint16 `json:"listen_port"`
+	Revision   int64  `json:"revision"`
+}
+
 type peer struct {
-	PublicKey string `json:"public_key"`
-	Name      string `json:"name"`
+	PublicKey           string            `json:"public_key"`
+	Name                string            `json:"name"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	Endpoint            string            `json:"endpoint,omitempty"`
+	PersistentKeepalive int64             `json:"persistent_keepalive"`
+	Meta                map[string]string `json:"meta,omitempty"`
+	Tags                []string          `json:"tags"`
+	Groups              []string          `json:"groups"`
+	Enabled             bool              `json:"enabled"`
+	StateReason         string            `json:"state_reason,omitempty"`
+	StateChangedAt      *time.Time        `json:"state_changed_at,omitempty"`
+	ExpiresAt           *time.Time        `json:"expires_at,omitempty"`
+	Owner               string            `json:"owner,omitempty"`
+	Revision            int64             `json:"revision"`
+
+	// Quota is only there for peers with a quota, when the api serves them.
+	Quota *peerQuota `json:"quota,omitempty"`
 }
 
 type errorName string
@@ -26,8 +56,14 @@ func (d displayableError) Error() string {
 }
 
 const (
-	unknownError errorName = "unknown"
-	badRequest   errorName = "bad_request"
+	unknownError       errorName = "unknown"
+	badRequest         errorName = "bad_request"
+	notFound           errorName = "not_found"
+	conflict           errorName = "conflict"
+	preconditionFailed errorName = "precondition_failed"
+	unauthorized       errorName = "unauthorized"
+	readOnly           errorName = "read_only"
+	forbidden          errorName = "forbidden"
 )
 
 func newError(name errorName) *displayableError {
@@ -41,6 +77,123 @@ func wrapError(cause error) *displayableError {
 		return ret
 	}
 
+	if cause == repo.ErrRevisionConflict {
+		return &displayableError{
+			Cause:       cause,
+			Name:        conflict,
+			Description: "It has been changed since it was read",
+			StatusCode:  409,
+		}
+	}
+
+	if cause == ipam.ErrExhausted {
+		return &displayableError{
+			Cause:       cause,
+			Name:        conflict,
+			Description: "No address is left in the network of the device",
+			StatusCode:  409,
+		}
+	}
+
+	if cause == repo.ErrAddressTaken {
+		return &displayableError{
+			Cause:       cause,
+			Name:        conflict,
+			Description: "Another peer of the device has the address",
+			StatusCode:  409,
+		}
+	}
+
+	if cause == repo.ErrReadOnly {
+		return &displayableError{
+			Cause:       cause,
+			Name:        readOnly,
+			Description: "The devices and peers can't be changed here",
+			StatusCode:  405,
+		}
+	}
+
+	if e, ok := cause.(*quota.InvalidQuotaError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
+	if e, ok := cause.(*peercsv.InvalidCSVError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
+	if e, ok := cause.(*topology.InvalidNetworkError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
+	if e, ok := cause.(*site.InvalidSiteError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
+	if e, ok := cause.(*users.InvalidUserError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
+	if cause == users.ErrNoDevice {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: "Peers can't be added to the device",
+			StatusCode:  400,
+		}
+	}
+
+	if cause == users.ErrBadCredentials {
+		return &displayableError{
+			Cause:       cause,
+			Name:        unauthorized,
+			Description: "The name or the password is wrong",
+			StatusCode:  401,
+		}
+	}
+
+	if cause == users.ErrPeerLimit {
+		return &displayableError{
+			Cause:       cause,
+			Name:        forbidden,
+			Description: "No more peers can be added",
+			StatusCode:  403,
+		}
+	}
+
+	if e, ok := cause.(*persistent.InvalidMetaError); ok {
+		return &displayableError{
+			Cause:       cause,
+			Name:        badRequest,
+			Description: e.Error(),
+			StatusCode:  400,
+		}
+	}
+
 	return &displayableError{
 		Cause: cause,
 		Name:  unknownError,
@@ -52,12 +205,57 @@ type result struct {
 	Error *displayableError `json:"error,omitempty"`
 }
 
+type bulkResult struct {
+	Affected int `json:"affected"`
+}
+
 type paginatedResult struct {
 	Contents interface{} `json:"contents"`
-	Total    uint32      `json:"total"`
+	Next     string      `json:"next,omitempty"`
+	Prev     string      `json:"prev,omitempty"`
+}
+
+func (d *device) FromDeviceInfo(info repo.DeviceInfo) {
+	d.Name = info.Name
+	d.ListenPort = info.ListenPort
+	d.Revision = info.Revision
+	d.PublicKey = ""
+	if len(info.PrivateKey.String()) > 0 {
+		d.PublicKey = info.PrivateKey.ToPublicKey().String()
+	}
 }
 
 func (p *peer) FromPeerInfo(info repo.PeerInfo) {
-	p.PublicKey = info.PublicKey
+	p.PublicKey = info.PublicKey.String()
 	p.Name = info.Name
+	p.PersistentKeepalive = int64(info.PersistentKeepaliveInterval / time.Second)
+	p.Meta = info.Meta
+	p.Revision = info.Revision
+
+	p.AllowedIPs = make([]string, 0, len(info.AllowedIPs))
+	for _, ip := range info.AllowedIPs {
+		p.AllowedIPs = append(p.AllowedIPs, ip.String())
+	}
+
+	p.Endpoint = ""
+	if info.Endpoint != nil {
+		p.Endpoint = info.Endpoint.String()
+	}
+	p.Tags = info.Tags
+	p.Groups = info.Groups
+	p.Enabled = info.Enabled()
+	p.StateReason = info.StateReason
+	p.StateChangedAt = unixTime(info.StateChangedAt)
+	p.ExpiresAt = unixTime(info.ExpiresAt)
+	p.Owner = info.Owner
+}
+
+// unixTime gives the time of unix seconds, or nil for zero.
+func unixTime(v int64) *time.Time {
+	if v == 0 {
+		return nil
+	}
+
+	t := time.Unix(v, 0).UTC()
+	return &t
 }
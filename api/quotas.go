@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/quota"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"time"
+)
+
+type quotaThreshold struct {
+	Bytes  uint64       `json:"bytes"`
+	Action quota.Action `json:"action"`
+}
+
+const (
+	auditQuotaUpdated repo.AuditAction = "quota.updated"
+	auditQuotaRemoved repo.AuditAction = "quota.removed"
+)
+
+type quotaRequest struct {
+	Period quota.Period `json:"period"`
+	// Window is how far back a rolling quota counts, in seconds.
+	Window        int64           `json:"window"`
+	Soft          *quotaThreshold `json:"soft"`
+	Hard          *quotaThreshold `json:"hard"`
+	RestrictedIPs []string        `json:"restricted_ips"`
+}
+
+type peerQuota struct {
+	Period        quota.Period    `json:"period"`
+	Window        int64           `json:"window,omitempty"`
+	Soft          *quotaThreshold `json:"soft,omitempty"`
+	Hard          *quotaThreshold `json:"hard,omitempty"`
+	RestrictedIPs []string        `json:"restricted_ips,omitempty"`
+	Since         time.Time       `json:"since"`
+	RxBytes       uint64          `json:"rx_bytes"`
+	TxBytes       uint64          `json:"tx_bytes"`
+	Used          uint64          `json:"used"`
+	Level         string          `json:"level"`
+}
+
+type quotaUsage struct {
+	DeviceName string `json:"device"`
+	PublicKey  string `json:"public_key"`
+	peerQuota
+}
+
+// WithQuotas serves the quotas of the peers and their usage under /quotas, and adds the usage to the peers listed.
+func WithQuotas(enforcer *quota.Enforcer) Option {
+	return func(api *httpApi) {
+		api.Quotas = enforcer
+	}
+}
+
+func toThreshold(t *quotaThreshold) quota.Threshold {
+	if t == nil {
+		return quota.Threshold{}
+	}
+	return quota.Threshold{Bytes: t.Bytes, Action: t.Action}
+}
+
+func fromThreshold(t quota.Threshold) *quotaThreshold {
+	if t.Bytes == 0 {
+		return nil
+	}
+	return &quotaThreshold{Bytes: t.Bytes, Action: t.Action}
+}
+
+func (body quotaRequest) toQuota(deviceName string, key repo.PublicKey) (quota.Quota, error) {
+	ret := quota.Quota{
+		DeviceName:    deviceName,
+		PublicKey:     key,
+		Period:        body.Period,
+		Window:        time.Duration(body.Window) * time.Second,
+		Soft:          toThreshold(body.Soft),
+		Hard:          toThreshold(body.Hard),
+		RestrictedIPs: make([]net.IPNet, 0, len(body.RestrictedIPs)),
+	}
+
+	for _, s := range body.RestrictedIPs {
+		if _, n, err := net.ParseCIDR(s); err != nil {
+			return ret, badParameter("restricted_ips")
+		} else {
+			ret.RestrictedIPs = append(ret.RestrictedIPs, *n)
+		}
+	}
+	return ret, nil
+}
+
+func (q *peerQuota) FromUsage(u quota.Usage) {
+	q.Period = u.Period
+	q.Window = int64(u.Window / time.Second)
+	q.Soft = fromThreshold(u.Soft)
+	q.Hard = fromThreshold(u.Hard)
+	q.Since = u.Since.UTC()
+	q.RxBytes = u.RxBytes
+	q.TxBytes = u.TxBytes
+	q.Used = u.Used()
+	q.Level = u.Level.String()
+
+	q.RestrictedIPs = nil
+	for _, ip := range u.RestrictedIPs {
+		q.RestrictedIPs = append(q.RestrictedIPs, ip.String())
+	}
+}
+
+func (body *quotaRequest) FromQuota(q quota.Quota) {
+	*body = quotaRequest{
+		Period: q.Period,
+		Window: int64(q.Window / time.Second),
+		Soft:   fromThreshold(q.Soft),
+		Hard:   fromThreshold(q.Hard),
+	}
+
+	for _, ip := range q.RestrictedIPs {
+		body.RestrictedIPs = append(body.RestrictedIPs, ip.String())
+	}
+}
+
+// quotaAudit gives the quota of the peer as audited, its settings without the usage, or nil if it has none.
+func (api httpApi) quotaAudit(deviceName string, key repo.PublicKey) *quotaRequest {
+	q, ok, err := api.Quotas.Store.FindQuota(deviceName, key)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		return nil
+	}
+
+	var ret quotaRequest
+	ret.FromQuota(q)
+	return &ret
+}
+
+// peerQuota gives the quota of the peer with its usage, or nil if it has none or there are no quotas.
+func (api httpApi) peerQuota(deviceName string, key repo.PublicKey) (*peerQuota, error) {
+	if api.Quotas == nil {
+		return nil, nil
+	}
+
+	q, ok, err := api.Quotas.Store.FindQuota(deviceName, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	u, err := api.Quotas.Usage(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret peerQuota
+	ret.FromUsage(u)
+	return &ret, nil
+}
+
+func (api httpApi) writeQuota(writer http.ResponseWriter, deviceName string, key repo.PublicKey) {
+	q, err := api.peerQuota(deviceName, key)
+	if err != nil {
+		panic(err)
+	} else if q == nil {
+		panic(notFoundError("Quota"))
+	}
+	writeHttpResult(q, nil, writer)
+}
+
+// serveQuotas adds the usage of every quota, GET /quotas, and the quota of a peer, GET, PUT and DELETE
+// /quotas/devices/:device/peers/:peer. Removing a quota undoes what it did to the peer.
+func (api httpApi) serveQuotas(r *httprouter.Router) {
+	r.GET("/quotas", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		usage, err := api.Quotas.ListUsage()
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]quotaUsage, 0, len(usage))
+		for _, u := range usage {
+			q := quotaUsage{DeviceName: u.DeviceName, PublicKey: u.PublicKey.String()}
+			q.FromUsage(u)
+			ret = append(ret, q)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/quotas/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeQuota(writer, params.ByName("device"), parsePeerKey(params))
+	})
+
+	r.PUT("/quotas/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body quotaRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		deviceName, key := params.ByName("device"), parsePeerKey(params)
+		if _, ok := api.findPeer(deviceName, key); !ok {
+			panic(notFoundError("Peer"))
+		}
+
+		q, err := body.toQuota(deviceName, key)
+		if err != nil {
+			panic(err)
+		}
+
+		before := api.quotaAudit(deviceName, key)
+		if err = api.Quotas.Store.SaveQuota(q); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditQuotaUpdated, DeviceName: deviceName, PublicKey: key.String()}
+		api.audit(request, entry, before, api.quotaAudit(deviceName, key))
+		api.writeQuota(writer, deviceName, key)
+	})
+
+	r.DELETE("/quotas/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		deviceName, key := params.ByName("device"), parsePeerKey(params)
+		before := api.quotaAudit(deviceName, key)
+		if err := api.Quotas.RemoveQuota(deviceName, key); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditQuotaRemoved, DeviceName: deviceName, PublicKey: key.String()}
+		api.audit(request, entry, before, nil)
+		writeHttpResult(nil, nil, writer)
+	})
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/site"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"time"
+)
+
+type siteRequest struct {
+	Networks      []string `json:"networks"`
+	LocalNetworks []string `json:"local_networks"`
+}
+
+const (
+	auditSiteUpdated repo.AuditAction = "site.updated"
+	auditSiteRemoved repo.AuditAction = "site.removed"
+)
+
+type siteInfo struct {
+	DeviceName    string   `json:"device"`
+	PublicKey     string   `json:"public_key"`
+	Networks      []string `json:"networks"`
+	LocalNetworks []string `json:"local_networks"`
+}
+
+type remoteRequest struct {
+	// PrivateKey is the site's, left out of the answer when it's not given.
+	PrivateKey string `json:"private_key"`
+	// Address is the device's in the tunnel, as 10.0.0.1/24.
+	Address    string `json:"address"`
+	Endpoint   string `json:"endpoint"`
+	ListenPort uint16 `json:"listen_port"`
+	// PersistentKeepalive is in seconds.
+	PersistentKeepalive int64 `json:"persistent_keepalive"`
+}
+
+// WithSites serves the site-to-site peers under /sites.
+func WithSites(store *site.Store) Option {
+	return func(api *httpApi) {
+		api.Sites = store
+	}
+}
+
+func formatCIDRs(ips []net.IPNet) []string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+func (s *siteInfo) FromSite(o site.Site) {
+	*s = siteInfo{
+		DeviceName:    o.DeviceName,
+		PublicKey:     o.PublicKey.String(),
+		Networks:      formatCIDRs(o.Networks),
+		LocalNetworks: formatCIDRs(o.LocalNetworks),
+	}
+}
+
+func (body remoteRequest) toRemote() (ret site.Remote) {
+	ret = site.Remote{
+		ListenPort:          body.ListenPort,
+		PersistentKeepalive: time.Duration(body.PersistentKeepalive) * time.Second,
+	}
+
+	if len(body.PrivateKey) > 0 {
+		k, err := wgtypes.ParseKey(body.PrivateKey)
+		if err != nil {
+			panic(badParameter("private_key"))
+		}
+		ret.PrivateKey = wg.Key(k)
+	}
+
+	ip, network, err := net.ParseCIDR(body.Address)
+	if err != nil {
+		panic(badParameter("address"))
+	}
+	ret.Address = net.IPNet{IP: ip, Mask: network.Mask}
+
+	if len(body.Endpoint) > 0 {
+		if ret.Endpoint, err = net.ResolveUDPAddr("udp", body.Endpoint); err != nil {
+			panic(badParameter("endpoint"))
+		}
+	}
+	return
+}
+
+func (api httpApi) sites(request *http.Request) site.Manager {
+	return site.Manager{Repo: api.repoFor(request), Store: api.Sites}
+}
+
+func (api httpApi) findSite(deviceName string, key repo.PublicKey) site.Site {
+	s, ok, err := api.Sites.FindSite(deviceName, key)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		panic(notFoundError("Site"))
+	}
+	return s
+}
+
+// siteAudit gives the site the peer is as audited, or nil if it isn't one.
+func (api httpApi) siteAudit(deviceName string, key repo.PublicKey) *siteInfo {
+	s, ok, err := api.Sites.FindSite(deviceName, key)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		return nil
+	}
+
+	var ret siteInfo
+	ret.FromSite(s)
+	return &ret
+}
+
+func (api httpApi) writeSite(writer http.ResponseWriter, deviceName string, key repo.PublicKey) {
+	var ret siteInfo
+	ret.FromSite(api.findSite(deviceName, key))
+	writeHttpResult(ret, nil, writer)
+}
+
+// serveSites adds the sites, GET /sites, and the site a peer is, GET, PUT and DELETE
+// /sites/devices/:device/peers/:peer. A peer made a site is routed the prefixes of its LAN besides what it had, and
+// made an ordinary peer again by DELETE. POST /sites/devices/:device/peers/:peer/remote gives the device of the far
+// end of the site.
+func (api httpApi) serveSites(r *httprouter.Router) {
+	r.GET("/sites", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		sites, err := api.Sites.ListSites()
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]siteInfo, 0, len(sites))
+		for _, s := range sites {
+			var info siteInfo
+			info.FromSite(s)
+			ret = append(ret, info)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/sites/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeSite(writer, params.ByName("device"), parsePeerKey(params))
+	})
+
+	r.PUT("/sites/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body siteRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		deviceName, key := params.ByName("device"), parsePeerKey(params)
+		if _, ok := api.findPeer(deviceName, key); !ok {
+			panic(notFoundError("Peer"))
+		}
+
+		s := site.Site{
+			DeviceName:    deviceName,
+			PublicKey:     key,
+			Networks:      parseCIDRs("networks", body.Networks),
+			LocalNetworks: parseCIDRs("local_networks", body.LocalNetworks),
+		}
+
+		before := api.siteAudit(deviceName, key)
+		if err := api.sites(request).Save(s); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditSiteUpdated, DeviceName: deviceName, PublicKey: key.String()}
+		api.audit(request, entry, before, api.siteAudit(deviceName, key))
+		api.writeSite(writer, deviceName, key)
+	})
+
+	r.DELETE("/sites/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		deviceName, key := params.ByName("device"), parsePeerKey(params)
+		before := api.siteAudit(deviceName, key)
+		if err := api.sites(request).Remove(deviceName, key); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditSiteRemoved, DeviceName: deviceName, PublicKey: key.String()}
+		api.audit(request, entry, before, nil)
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.POST("/sites/devices/:device/peers/:peer/remote", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body remoteRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		s := api.findSite(params.ByName("device"), parsePeerKey(params))
+		remote := body.toRemote()
+		if !remote.PrivateKey.IsZero() && base64Key(remote.PrivateKey.ToPublicKey()) != s.PublicKey.String() {
+			panic(badParameter("private_key"))
+		}
+
+		config, err := api.sites(request).RemoteConfig(s, remote)
+		if err != nil {
+			panic(err)
+		}
+
+		device := toTopologyDevices([]wg.DeviceConfig{config})[0]
+		device.Peers[0].Name = s.DeviceName
+		if remote.PrivateKey.IsZero() {
+			device.PrivateKey, device.PublicKey = "", s.PublicKey.String()
+		}
+		writeHttpResult(device, nil, writer)
+	})
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"time"
+)
+
+// defaultStatsRange is how far back a series goes without a from parameter.
+const defaultStatsRange = 24 * time.Hour
+
+type statsPoint struct {
+	Time          time.Time  `json:"time"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+}
+
+type statsSeries struct {
+	Resolution stats.Resolution `json:"resolution"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	Points     []statsPoint     `json:"points"`
+}
+
+// WithStats serves the handshake and traffic series the collector keeps in the store under /stats.
+func WithStats(store *stats.Store) Option {
+	return func(api *httpApi) {
+		api.Stats = store
+	}
+}
+
+// statsQuery reads the range of the series from the from and to parameters (RFC 3339), which default to the last day,
+// and its resolution, raw, hourly, daily or auto, the default, which picks the finest one kept as far back as from.
+func (api httpApi) statsQuery(r *http.Request, deviceName string) stats.Query {
+	now := time.Now()
+
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		panic(err)
+	} else if to.IsZero() {
+		to = now
+	}
+
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		panic(err)
+	} else if from.IsZero() {
+		from = to.Add(-defaultStatsRange)
+	}
+
+	if !from.Before(to) {
+		panic(badParameter("from"))
+	}
+
+	q := stats.Query{DeviceName: deviceName, From: from, To: to}
+	switch resolution := stats.Resolution(getQueryParams(r, "resolution", "auto")); resolution {
+	case stats.Raw, stats.Hourly, stats.Daily:
+		q.Resolution = resolution
+	case "auto":
+		q.Resolution = api.Stats.Retention.ResolutionFor(now, from)
+	default:
+		panic(badParameter("resolution"))
+	}
+	return q
+}
+
+func (api httpApi) writeSeries(q stats.Query, writer http.ResponseWriter) {
+	points, err := api.Stats.Series(q)
+	if err != nil {
+		panic(err)
+	}
+
+	ret := statsSeries{Resolution: q.Resolution, From: q.From.UTC(), To: q.To.UTC(), Points: make([]statsPoint, 0, len(points))}
+	for _, p := range points {
+		ret.Points = append(ret.Points, statsPoint{
+			Time:          time.Unix(p.Time, 0).UTC(),
+			LastHandshake: unixTime(p.LastHandshake),
+			RxBytes:       p.RxBytes,
+			TxBytes:       p.TxBytes,
+		})
+	}
+	writeHttpResult(ret, nil, writer)
+}
+
+// serveStats adds the series of a device, GET /stats/devices/:device, which adds up the traffic of its peers, and the
+// series of one of its peers, GET /stats/devices/:device/peers/:peer. Each point has the bytes moved in its period.
+func (api httpApi) serveStats(r *httprouter.Router) {
+	r.GET("/stats/devices/:device", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeSeries(api.statsQuery(request, params.ByName("device")), writer)
+	})
+
+	r.GET("/stats/devices/:device/peers/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		q := api.statsQuery(request, params.ByName("device"))
+		q.PublicKey = parsePeerKey(params)
+		api.writeSeries(q, writer)
+	})
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/topology"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"time"
+)
+
+type topologyNode struct {
+	Name string `json:"name"`
+	// PrivateKey is generated when it's not given.
+	PrivateKey string   `json:"private_key"`
+	Address    string   `json:"address"`
+	Endpoint   string   `json:"endpoint"`
+	ListenPort uint16   `json:"listen_port"`
+	NATed      bool     `json:"nated"`
+	Networks   []string `json:"networks"`
+}
+
+type topologyLink struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+type topologyRequest struct {
+	Kind    topology.Kind  `json:"kind"`
+	Network string         `json:"network"`
+	Nodes   []topologyNode `json:"nodes"`
+	Hub     string         `json:"hub"`
+	Links   []topologyLink `json:"links"`
+	// Keepalive is in seconds.
+	Keepalive int64 `json:"keepalive"`
+}
+
+type topologyPeer struct {
+	Name                string   `json:"name"`
+	PublicKey           string   `json:"public_key"`
+	PreSharedKey        string   `json:"preshared_key"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int64    `json:"persistent_keepalive"`
+}
+
+type topologyDevice struct {
+	Name       string         `json:"name"`
+	PrivateKey string         `json:"private_key,omitempty"`
+	PublicKey  string         `json:"public_key"`
+	Address    string         `json:"address"`
+	ListenPort uint16         `json:"listen_port"`
+	Peers      []topologyPeer `json:"peers"`
+}
+
+func base64Key(k wg.Key) string {
+	return wgtypes.Key(k).String()
+}
+
+func parseCIDRs(name string, values []string) []net.IPNet {
+	ret := make([]net.IPNet, 0, len(values))
+	for _, v := range values {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(badParameter(name))
+		}
+		ret = append(ret, *n)
+	}
+	return ret
+}
+
+func (body topologyRequest) toNetwork() (ret topology.Network) {
+	ret = topology.Network{
+		Kind:      body.Kind,
+		Hub:       body.Hub,
+		Keepalive: time.Duration(body.Keepalive) * time.Second,
+		Nodes:     make([]topology.Node, 0, len(body.Nodes)),
+	}
+
+	_, network, err := net.ParseCIDR(body.Network)
+	if err != nil {
+		panic(badParameter("network"))
+	}
+	ret.Network = *network
+
+	for _, n := range body.Nodes {
+		node := topology.Node{
+			Name:       n.Name,
+			ListenPort: n.ListenPort,
+			NATed:      n.NATed,
+			Networks:   parseCIDRs("networks", n.Networks),
+		}
+
+		if len(n.PrivateKey) > 0 {
+			k, err := wgtypes.ParseKey(n.PrivateKey)
+			if err != nil {
+				panic(badParameter("private_key"))
+			}
+			node.PrivateKey = wg.Key(k)
+		}
+
+		if len(n.Address) > 0 {
+			if node.Address = net.ParseIP(n.Address); node.Address == nil {
+				panic(badParameter("address"))
+			}
+		}
+
+		if len(n.Endpoint) > 0 {
+			if node.Endpoint, err = net.ResolveUDPAddr("udp", n.Endpoint); err != nil {
+				panic(badParameter("endpoint"))
+			}
+		}
+		ret.Nodes = append(ret.Nodes, node)
+	}
+
+	for _, l := range body.Links {
+		ret.Links = append(ret.Links, topology.Link{A: l.A, B: l.B})
+	}
+	return
+}
+
+func toTopologyDevices(devices []wg.DeviceConfig) []topologyDevice {
+	names := make(map[wg.Key]string, len(devices))
+	for _, d := range devices {
+		names[d.PrivateKey.ToPublicKey()] = d.Name
+	}
+
+	ret := make([]topologyDevice, 0, len(devices))
+	for _, d := range devices {
+		device := topologyDevice{
+			Name:       d.Name,
+			PrivateKey: base64Key(d.PrivateKey),
+			PublicKey:  base64Key(d.PrivateKey.ToPublicKey()),
+			Address:    d.Address.String(),
+			ListenPort: d.ListenPort,
+			Peers:      make([]topologyPeer, 0, len(d.Peers)),
+		}
+
+		for _, p := range d.Peers {
+			peer := topologyPeer{
+				Name:                names[p.PublicKey],
+				PublicKey:           base64Key(p.PublicKey),
+				PreSharedKey:        base64Key(p.PreSharedKey),
+				AllowedIPs:          make([]string, 0, len(p.AllowedIPs)),
+				PersistentKeepalive: int64(p.PersistentKeepAlive / time.Second),
+			}
+
+			if p.Endpoint != nil {
+				peer.Endpoint = p.Endpoint.String()
+			}
+
+			for _, ip := range p.AllowedIPs {
+				peer.AllowedIPs = append(peer.AllowedIPs, ip.String())
+			}
+			device.Peers = append(device.Peers, peer)
+		}
+		ret = append(ret, device)
+	}
+	return ret
+}
+
+// serveTopology adds POST /topology, which gives the device of every node of the network described, with its peers.
+// Nothing is saved: the keys generated are only in the answer.
+func (api httpApi) serveTopology(r *httprouter.Router) {
+	r.POST("/topology", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body topologyRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		devices, err := topology.Generate(body.toNetwork())
+		if err != nil {
+			panic(err)
+		}
+		writeHttpResult(toTopologyDevices(devices), nil, writer)
+	})
+}
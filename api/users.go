@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/users"
+	"strings"
+	"time"
+)
+
+const (
+	auditUserUpdated repo.AuditAction = "user.updated"
+	auditUserRemoved repo.AuditAction = "user.removed"
+)
+
+type loginRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type userRequest struct {
+	// Password is left empty to keep the one the user has.
+	Password string     `json:"password"`
+	Role     users.Role `json:"role"`
+	MaxPeers int        `json:"max_peers"`
+}
+
+type userInfo struct {
+	Name     string     `json:"name"`
+	Role     users.Role `json:"role"`
+	MaxPeers int        `json:"max_peers"`
+}
+
+type ownPeerRequest struct {
+	Device string `json:"device"`
+	Name   string `json:"name"`
+	// PublicKey is left empty to have the key pair generated.
+	PublicKey string `json:"public_key"`
+}
+
+type createdPeer struct {
+	Peer peer `json:"peer"`
+	// PrivateKey and Config, which has it, are only given here when the key pair is generated, since the private key
+	// is kept nowhere.
+	PrivateKey string `json:"private_key,omitempty"`
+	Config     string `json:"config"`
+}
+
+// WithUsers has every request but logging in and those of the agents authenticated as a user, by the token of their
+// session as "Authorization: Bearer". Members only reach /me, where they manage the peers they own on the devices
+// given, and admins everything. The admin token of WithBackup is taken as an admin's.
+func WithUsers(store *users.Store, devices map[string]users.Device) Option {
+	return func(api *httpApi) {
+		api.Users = store
+		api.UserDevices = devices
+	}
+}
+
+func (u *userInfo) FromUser(o users.User) {
+	*u = userInfo{Name: o.Name, Role: o.Role, MaxPeers: o.MaxPeers}
+}
+
+type userKey struct{}
+
+// userOf gives the user the request is authenticated as, ok false without users.
+func userOf(request *http.Request) (users.User, bool) {
+	u, ok := request.Context().Value(userKey{}).(users.User)
+	return u, ok
+}
+
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if token := strings.TrimPrefix(header, "Bearer "); token != header {
+		return token
+	}
+	return ""
+}
+
+// isSelfService tells the paths members may reach.
+func isSelfService(path string) bool {
+	return path == "/me" || strings.HasPrefix(path, "/me/") || path == "/logout"
+}
+
+// authenticate passes the requests to next with the user they're authenticated as, answering 401 for those that
+// aren't and 403 for those of members outside of /me.
+func (api httpApi) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/login" || strings.HasPrefix(request.URL.Path, "/agent/") {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		var user users.User
+		var ok bool
+		token := bearerToken(request)
+		if len(token) > 0 && len(api.AdminToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(api.AdminToken)) == 1 {
+			user, ok = users.User{Name: "admin", Role: users.Admin}, true
+		} else if len(token) > 0 {
+			var err error
+			if user, ok, err = api.Users.Authenticate(token); err != nil {
+				writeHttpResult(nil, err, writer)
+				return
+			}
+		}
+
+		if !ok {
+			writeHttpResult(nil, &displayableError{
+				Name:        unauthorized,
+				Description: "The token of a session is required",
+				StatusCode:  401,
+			}, writer)
+			return
+		}
+
+		if !user.IsAdmin() && !isSelfService(request.URL.Path) {
+			writeHttpResult(nil, &displayableError{
+				Name:        forbidden,
+				Description: "Only admins can do this",
+				StatusCode:  403,
+			}, writer)
+			return
+		}
+
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), userKey{}, user)))
+	})
+}
+
+func (api httpApi) findUser(name string) users.User {
+	u, ok, err := api.Users.FindUser(name)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		panic(notFoundError("User"))
+	}
+	return u
+}
+
+// userAudit gives the user with the name as audited, or nil if there is no such user.
+func (api httpApi) userAudit(name string) *userInfo {
+	u, ok, err := api.Users.FindUser(name)
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		return nil
+	}
+
+	var ret userInfo
+	ret.FromUser(u)
+	return &ret
+}
+
+func (api httpApi) writeUser(writer http.ResponseWriter, name string) {
+	var ret userInfo
+	ret.FromUser(api.findUser(name))
+	writeHttpResult(ret, nil, writer)
+}
+
+// self gives what the user of the request does to their own peers.
+func (api httpApi) self(request *http.Request) users.Self {
+	u, _ := userOf(request)
+	return users.Self{Repo: api.repoFor(request), User: u, Devices: api.UserDevices, Allocator: api.Allocator}
+}
+
+func findOwnPeer(self users.Self, params httprouter.Params) repo.PeerInfo {
+	p, ok, err := self.Find(params.ByName("device"), parsePeerKey(params))
+	if err != nil {
+		panic(err)
+	} else if !ok {
+		panic(notFoundError("Peer"))
+	}
+	return p
+}
+
+// serveUsers adds POST /login, answering with the token of a new session, and POST /logout to end it. Admins manage
+// the users with GET /users and GET, PUT and DELETE /users/:user. Each user has GET /me, and their own peers under
+// /me/peers: GET lists them, POST adds one up to their limit, and PUT and DELETE /me/peers/:device/:peer rename and
+// revoke one. GET /me/peers/:device/:peer/config gives the wg-quick configuration of one, without its private key.
+func (api httpApi) serveUsers(r *httprouter.Router) {
+	r.POST("/login", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body loginRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		token, expiresAt, err := api.Users.Login(body.Name, body.Password)
+		if err != nil {
+			panic(err)
+		}
+		writeHttpResult(session{Token: token, ExpiresAt: expiresAt.UTC()}, nil, writer)
+	})
+
+	r.POST("/logout", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if err := api.Users.Logout(bearerToken(request)); err != nil {
+			panic(err)
+		}
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.GET("/users", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		list, err := api.Users.ListUsers()
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]userInfo, len(list))
+		for i, u := range list {
+			ret[i].FromUser(u)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/users/:user", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		api.writeUser(writer, params.ByName("user"))
+	})
+
+	r.PUT("/users/:user", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body userRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		u := users.User{Name: params.ByName("user"), Role: body.Role, MaxPeers: body.MaxPeers}
+		before := api.userAudit(u.Name)
+		if err := api.Users.SaveUser(u, body.Password); err != nil {
+			panic(err)
+		}
+
+		entry := repo.AuditEntry{Action: auditUserUpdated, Subject: u.Name}
+		if len(body.Password) > 0 {
+			entry.Changes = map[string]repo.AuditChange{"password": {After: auditChanged}}
+		}
+		api.audit(request, entry, before, api.userAudit(u.Name))
+		api.writeUser(writer, u.Name)
+	})
+
+	r.DELETE("/users/:user", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		name := params.ByName("user")
+		before := api.userAudit(name)
+		if before == nil {
+			panic(notFoundError("User"))
+		}
+
+		if err := api.Users.RemoveUser(name); err != nil {
+			panic(err)
+		}
+		api.audit(request, repo.AuditEntry{Action: auditUserRemoved, Subject: name}, before, nil)
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.GET("/me", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		u, _ := userOf(request)
+		var ret userInfo
+		ret.FromUser(u)
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.GET("/me/peers", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		list, err := api.self(request).Peers()
+		if err != nil {
+			panic(err)
+		}
+
+		ret := make([]peer, len(list))
+		for i, p := range list {
+			ret[i].FromPeerInfo(p)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.POST("/me/peers", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body ownPeerRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		var k repo.PublicKey
+		if len(body.PublicKey) > 0 {
+			if err := k.Scan(body.PublicKey); err != nil {
+				panic(badParameter("public_key"))
+			}
+		}
+
+		self := api.self(request)
+		created, err := self.Create(body.Device, body.Name, k)
+		if err != nil {
+			panic(err)
+		}
+
+		ret := createdPeer{PrivateKey: created.PrivateKey.String()}
+		ret.Peer.FromPeerInfo(created.Peer)
+		if ret.Config, err = self.Config(created.Peer, created.PrivateKey); err != nil {
+			panic(err)
+		}
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.PUT("/me/peers/:device/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var body ownPeerRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			panic(badParameter("body"))
+		}
+
+		p, ok, err := api.self(request).Rename(params.ByName("device"), parsePeerKey(params), body.Name)
+		if err != nil {
+			panic(err)
+		} else if !ok {
+			panic(notFoundError("Peer"))
+		}
+
+		var ret peer
+		ret.FromPeerInfo(p)
+		writeHttpResult(ret, nil, writer)
+	})
+
+	r.DELETE("/me/peers/:device/:peer", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if ok, err := api.self(request).Revoke(params.ByName("device"), parsePeerKey(params)); err != nil {
+			panic(err)
+		} else if !ok {
+			panic(notFoundError("Peer"))
+		}
+		writeHttpResult(nil, nil, writer)
+	})
+
+	r.GET("/me/peers/:device/:peer/config", func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		self := api.self(request)
+		config, err := self.Config(findOwnPeer(self, params), repo.PrivateKey{})
+		if err != nil {
+			panic(err)
+		}
+
+		writer.Header().Set("Content-Type", "text/plain")
+		_, _ = writer.Write([]byte(config))
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"os"
+)
+
+// runBackup writes the whole store, secrets included, as JSON to stdout or the -o file. It exits with 2 on error.
+func runBackup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	keyFile := addKeyFileFlag(flags)
+	output := flags.String("o", "-", "file to write the backup to, stdout if -")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: backup [-db dsn] [-key-file file] [-o file]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "backup:", err)
+		return 2
+	}
+
+	defer store.Close()
+
+	backup, err := store.Backup()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "backup:", err)
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		// The backup has the private keys, so only the owner may read it.
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "backup:", err)
+			return 2
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(backup); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "backup:", err)
+		return 2
+	}
+	return 0
+}
+
+// runRestore writes a backup read from the file, or stdin if -, into the store. It exits with 1 when the backup is
+// not valid, nothing being written, and 2 on any other error.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	keyFile := addKeyFileFlag(flags)
+	mode := flags.String("mode", "merge", "merge to replace only the devices of the backup, replace to drop the others too")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: restore [-db dsn] [-key-file file] [-mode merge|replace] file")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	restoreMode, err := persistent.ParseRestoreMode(*mode)
+	if err != nil || flags.NArg() != 1 {
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "restore:", err)
+		}
+		flags.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if file := flags.Arg(0); file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "restore:", err)
+			return 2
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	var backup persistent.Backup
+	if err = json.NewDecoder(r).Decode(&backup); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "restore: invalid backup:", err)
+		return 1
+	}
+
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "restore:", err)
+		return 2
+	}
+
+	defer store.Close()
+
+	if err = store.Restore(backup, restoreMode); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "restore:", err)
+		if _, ok := err.(*persistent.InvalidBackupError); ok {
+			return 1
+		}
+		return 2
+	}
+
+	_, _ = fmt.Fprintf(os.Stdout, "Restored %v devices\n", len(backup.Devices))
+	return 0
+}
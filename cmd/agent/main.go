@@ -0,0 +1,51 @@
+// The agent runs on each WireGuard host: it brings up the devices the server assigns to the host and reports what
+// they saw back, every interval, until it's interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"nz.cloudwalker/wireguard-webadmin/agent"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// tokenEnv is where the token is read from unless given by -token, which would show it in the process list.
+const tokenEnv = "WGADMIN_AGENT_TOKEN"
+
+func main() {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:9090", "address of the server")
+	token := flags.String("token", os.Getenv(tokenEnv), "token of the host, given by PUT /hosts/:host (default $"+tokenEnv+")")
+	interval := flags.Duration("interval", agent.DefaultInterval, "how often to sync with the server")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: agent [-server address] [-token token] [-interval duration]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+
+	if len(*token) == 0 || *interval <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := wg.NewTunClient()
+	if err != nil {
+		log.Fatalf("agent: %v", err)
+	}
+
+	// Closing the client takes the devices down with the agent.
+	defer client.Close()
+
+	a := agent.NewAgent(*server, *token, client, utils.SystemClock, *interval)
+	a.Start()
+	defer a.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Printf("agent: stopping on %v", <-signals)
+}
@@ -0,0 +1,140 @@
+package drift
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"sync"
+)
+
+// Checker finds the devices whose live state no longer matches the store, e.g. after someone ran `wg set` by hand,
+// and settles them one way or the other.
+type Checker struct {
+	Store  persistent.Repository
+	Client wg.Client
+
+	mutex sync.Mutex
+}
+
+func NewChecker(store persistent.Repository, client wg.Client) *Checker {
+	return &Checker{Store: store, Client: client}
+}
+
+func devicesById(devices []wg.Device) map[persistent.DeviceId]wg.Device {
+	ret := make(map[persistent.DeviceId]wg.Device, len(devices))
+	for _, d := range devices {
+		ret[persistent.DeviceId(d.Id)] = d
+	}
+	return ret
+}
+
+// selected picks the drifted devices among ids. No ids selects all of them.
+func (r Report) selected(ids []persistent.DeviceId) []DeviceDrift {
+	if len(ids) == 0 {
+		return r.Devices
+	}
+
+	var ret []DeviceDrift
+	for _, id := range ids {
+		if d := r.Device(id); d != nil {
+			ret = append(ret, *d)
+		}
+	}
+	return ret
+}
+
+func (c *Checker) read() (stored map[persistent.DeviceId]wg.Device, live map[persistent.DeviceId]wg.Device, report Report, err error) {
+	storedDevices, err := c.Store.ListDevices()
+	if err != nil {
+		return
+	}
+
+	liveDevices, err := c.Client.Devices()
+	if err != nil {
+		return
+	}
+
+	return devicesById(storedDevices), devicesById(liveDevices), Compare(storedDevices, liveDevices), nil
+}
+
+func (c *Checker) Check() (Report, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, _, report, err := c.read()
+	return report, err
+}
+
+// Adopt makes the store match the live state of the drifted devices among ids, or of all of them if there are no
+// ids. It returns the drift left afterwards.
+func (c *Checker) Adopt(ids []persistent.DeviceId) (Report, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stored, live, report, err := c.read()
+	if err != nil {
+		return report, err
+	}
+
+	var saving []wg.Device
+	var removing []persistent.DeviceId
+	for _, d := range report.selected(ids) {
+		if d.Status == StoredOnly {
+			removing = append(removing, d.Id)
+		} else {
+			device := live[d.Id]
+			if len(device.Name) == 0 {
+				device.Name = stored[d.Id].Name
+			}
+			saving = append(saving, device)
+		}
+	}
+
+	if len(saving) > 0 {
+		if err = c.Store.SaveDevices(saving); err != nil {
+			return report, err
+		}
+	}
+
+	if len(removing) > 0 {
+		if err = c.Store.RemoveDevices(removing); err != nil {
+			return report, err
+		}
+	}
+
+	_, _, report, err = c.read()
+	return report, err
+}
+
+// Reapply brings the drifted devices among ids, or all of them if there are no ids, back to their stored state.
+// It returns the drift left afterwards.
+func (c *Checker) Reapply(ids []persistent.DeviceId) (Report, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stored, _, report, err := c.read()
+	if err != nil {
+		return report, err
+	}
+
+	for _, d := range report.selected(ids) {
+		switch d.Status {
+		case LiveOnly:
+			err = c.Client.Down(string(d.Id))
+		case StoredOnly:
+			_, err = c.Client.Up(string(d.Id), stored[d.Id].ToConfig())
+		default:
+			config := stored[d.Id].ToConfig()
+			err = c.Client.Configure(string(d.Id), func(c *wg.DeviceConfig) error {
+				*c = config
+				return nil
+			})
+		}
+
+		if err != nil {
+			return report, err
+		}
+	}
+
+	_, _, report, err = c.read()
+	return report, err
+}
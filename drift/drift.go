@@ -0,0 +1,200 @@
+package drift
+
+import (
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"sort"
+	"strings"
+)
+
+type Status string
+
+const (
+	// StoredOnly is stored but not up.
+	StoredOnly Status = "stored_only"
+	// LiveOnly is up but not stored.
+	LiveOnly Status = "live_only"
+	// Changed is both stored and up, with some fields differing.
+	Changed Status = "changed"
+)
+
+// FieldDrift is a field whose stored value differs from the live one. Secrets are never shown: a private key
+// appears as its public key and a pre-shared key only as whether it is set.
+type FieldDrift struct {
+	Field  string `json:"field"`
+	Stored string `json:"stored"`
+	Live   string `json:"live"`
+}
+
+type PeerDrift struct {
+	PublicKey wg.Key       `json:"public_key"`
+	Status    Status       `json:"status"`
+	Fields    []FieldDrift `json:"fields,omitempty"`
+}
+
+type DeviceDrift struct {
+	Id     persistent.DeviceId `json:"id"`
+	Name   string              `json:"name"`
+	Status Status              `json:"status"`
+	Fields []FieldDrift        `json:"fields,omitempty"`
+	Peers  []PeerDrift         `json:"peers,omitempty"`
+}
+
+// Report lists the devices that have drifted, ordered by id. Devices that match are left out.
+type Report struct {
+	Devices []DeviceDrift `json:"devices"`
+}
+
+func (r Report) InSync() bool {
+	return len(r.Devices) == 0
+}
+
+// Only gives the report of the devices among ids. No ids gives the whole report.
+func (r Report) Only(ids []persistent.DeviceId) Report {
+	return Report{Devices: r.selected(ids)}
+}
+
+// Device finds the drift of the device, or nil if it has not drifted.
+func (r Report) Device(id persistent.DeviceId) *DeviceDrift {
+	for i := range r.Devices {
+		if r.Devices[i].Id == id {
+			return &r.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+func secretState(k wg.Key) string {
+	if k.IsZero() {
+		return "unset"
+	}
+	return "set"
+}
+
+func addressString(a *net.IPNet) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// allowedIPsString canonicalises the networks so that neither their order nor host bits count as drift.
+func allowedIPsString(ips []net.IPNet) string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, (&net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}).String())
+	}
+
+	sort.Strings(ret)
+	return strings.Join(ret, ",")
+}
+
+type fieldDiffer []FieldDrift
+
+func (f *fieldDiffer) compare(field string, stored string, live string) {
+	if stored != live {
+		*f = append(*f, FieldDrift{Field: field, Stored: stored, Live: live})
+	}
+}
+
+// comparePeers compares the peers by public key. The endpoint is left out as a live peer roams freely.
+func comparePeers(stored []wg.Peer, live []wg.Peer) (ret []PeerDrift) {
+	livePeers := make(map[wg.Key]wg.Peer, len(live))
+	for _, p := range live {
+		livePeers[p.PublicKey] = p
+	}
+
+	storedKeys := make(map[wg.Key]bool, len(stored))
+	for _, s := range stored {
+		storedKeys[s.PublicKey] = true
+
+		l, ok := livePeers[s.PublicKey]
+		if !ok {
+			ret = append(ret, PeerDrift{PublicKey: s.PublicKey, Status: StoredOnly})
+			continue
+		}
+
+		var fields fieldDiffer
+		fields.compare("allowed_ips", allowedIPsString(s.AllowedIPs), allowedIPsString(l.AllowedIPs))
+		if s.PreSharedKey != l.PreSharedKey {
+			fields = append(fields, FieldDrift{
+				Field:  "pre_shared_key",
+				Stored: secretState(s.PreSharedKey),
+				Live:   secretState(l.PreSharedKey),
+			})
+		}
+		fields.compare("persistent_keep_alive", s.PersistentKeepAlive.String(), l.PersistentKeepAlive.String())
+
+		if len(fields) > 0 {
+			ret = append(ret, PeerDrift{PublicKey: s.PublicKey, Status: Changed, Fields: fields})
+		}
+	}
+
+	for _, l := range live {
+		if !storedKeys[l.PublicKey] {
+			ret = append(ret, PeerDrift{PublicKey: l.PublicKey, Status: LiveOnly})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].PublicKey.String() < ret[j].PublicKey.String()
+	})
+	return
+}
+
+func compareDevice(stored wg.Device, live wg.Device) *DeviceDrift {
+	var fields fieldDiffer
+	// Devices reached through wgctrl have no names live.
+	if len(live.Name) > 0 {
+		fields.compare("name", stored.Name, live.Name)
+	}
+	fields.compare("public_key", stored.PrivateKey.ToPublicKey().String(), live.PrivateKey.ToPublicKey().String())
+	fields.compare("listen_port", fmt.Sprint(stored.ListenPort), fmt.Sprint(live.ListenPort))
+	fields.compare("address", addressString(stored.Address), addressString(live.Address))
+
+	peers := comparePeers(stored.Peers, live.Peers)
+	if len(fields) == 0 && len(peers) == 0 {
+		return nil
+	}
+
+	return &DeviceDrift{
+		Id:     persistent.DeviceId(stored.Id),
+		Name:   stored.Name,
+		Status: Changed,
+		Fields: fields,
+		Peers:  peers,
+	}
+}
+
+// Compare matches the stored devices with the live ones by id and reports how they differ.
+func Compare(stored []wg.Device, live []wg.Device) (ret Report) {
+	liveDevices := make(map[string]wg.Device, len(live))
+	for _, d := range live {
+		liveDevices[d.Id] = d
+	}
+
+	storedIds := make(map[string]bool, len(stored))
+	for _, s := range stored {
+		storedIds[s.Id] = true
+
+		if l, ok := liveDevices[s.Id]; !ok {
+			ret.Devices = append(ret.Devices, DeviceDrift{Id: persistent.DeviceId(s.Id), Name: s.Name, Status: StoredOnly})
+		} else if d := compareDevice(s, l); d != nil {
+			ret.Devices = append(ret.Devices, *d)
+		}
+	}
+
+	for _, l := range live {
+		if !storedIds[l.Id] {
+			ret.Devices = append(ret.Devices, DeviceDrift{Id: persistent.DeviceId(l.Id), Name: l.Name, Status: LiveOnly})
+		}
+	}
+
+	sort.Slice(ret.Devices, func(i, j int) bool {
+		return ret.Devices[i].Id < ret.Devices[j].Id
+	})
+	return
+}
@@ -0,0 +1,328 @@
+package drift
+
+import (
+	"crypto/sha256"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newKey(v string) wg.Key {
+	return wg.Key(sha256.Sum256([]byte(v)))
+}
+
+func parseCIDR(v string) net.IPNet {
+	ip, n, err := net.ParseCIDR(v)
+	if err != nil {
+		panic(err)
+	}
+	n.IP = ip
+	return *n
+}
+
+func newDevice() wg.Device {
+	address := parseCIDR("10.0.0.1/24")
+	return wg.Device{
+		Id:         "device1",
+		Name:       "wg0",
+		PrivateKey: newKey("device1"),
+		ListenPort: 51820,
+		Address:    &address,
+		Peers: []wg.Peer{
+			{
+				PeerConfig: wg.PeerConfig{
+					PublicKey:           newKey("peer1"),
+					AllowedIPs:          []net.IPNet{parseCIDR("10.0.0.2/32"), parseCIDR("192.168.1.0/24")},
+					PersistentKeepAlive: 25 * time.Second,
+				},
+			},
+		},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	stored := newDevice()
+	another := newKey("another")
+
+	tests := []struct {
+		name   string
+		change func(live *wg.Device)
+		want   Report
+	}{
+		{
+			name:   "in sync",
+			change: func(live *wg.Device) {},
+			want:   Report{},
+		},
+		{
+			name: "allowed ips in another order and with host bits",
+			change: func(live *wg.Device) {
+				live.Peers[0].AllowedIPs = []net.IPNet{parseCIDR("192.168.1.5/24"), parseCIDR("10.0.0.2/32")}
+			},
+			want: Report{},
+		},
+		{
+			name: "no name live",
+			change: func(live *wg.Device) {
+				live.Name = ""
+			},
+			want: Report{},
+		},
+		{
+			name: "endpoint roamed",
+			change: func(live *wg.Device) {
+				live.Peers[0].Endpoint = &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+			},
+			want: Report{},
+		},
+		{
+			name: "device fields",
+			change: func(live *wg.Device) {
+				address := parseCIDR("10.0.1.1/24")
+				live.ListenPort = 51821
+				live.Address = &address
+			},
+			want: Report{Devices: []DeviceDrift{
+				{
+					Id:     "device1",
+					Name:   "wg0",
+					Status: Changed,
+					Fields: []FieldDrift{
+						{Field: "listen_port", Stored: "51820", Live: "51821"},
+						{Field: "address", Stored: "10.0.0.1/24", Live: "10.0.1.1/24"},
+					},
+				},
+			}},
+		},
+		{
+			name: "private key",
+			change: func(live *wg.Device) {
+				live.PrivateKey = another
+			},
+			want: Report{Devices: []DeviceDrift{
+				{
+					Id:     "device1",
+					Name:   "wg0",
+					Status: Changed,
+					Fields: []FieldDrift{
+						{
+							Field:  "public_key",
+							Stored: stored.PrivateKey.ToPublicKey().String(),
+							Live:   another.ToPublicKey().String(),
+						},
+					},
+				},
+			}},
+		},
+		{
+			name: "peer fields",
+			change: func(live *wg.Device) {
+				live.Peers[0].AllowedIPs = []net.IPNet{parseCIDR("10.0.0.3/32")}
+				live.Peers[0].PreSharedKey = newKey("psk")
+				live.Peers[0].PersistentKeepAlive = 0
+			},
+			want: Report{Devices: []DeviceDrift{
+				{
+					Id:     "device1",
+					Name:   "wg0",
+					Status: Changed,
+					Peers: []PeerDrift{
+						{
+							PublicKey: newKey("peer1"),
+							Status:    Changed,
+							Fields: []FieldDrift{
+								{Field: "allowed_ips", Stored: "10.0.0.2/32,192.168.1.0/24", Live: "10.0.0.3/32"},
+								{Field: "pre_shared_key", Stored: "unset", Live: "set"},
+								{Field: "persistent_keep_alive", Stored: "25s", Live: "0s"},
+							},
+						},
+					},
+				},
+			}},
+		},
+		{
+			name: "peer replaced",
+			change: func(live *wg.Device) {
+				live.Peers[0].PublicKey = newKey("peer2")
+			},
+			want: Report{Devices: []DeviceDrift{
+				{
+					Id:     "device1",
+					Name:   "wg0",
+					Status: Changed,
+					Peers: []PeerDrift{
+						{PublicKey: newKey("peer2"), Status: LiveOnly},
+						{PublicKey: newKey("peer1"), Status: StoredOnly},
+					},
+				},
+			}},
+		},
+		{
+			name: "device replaced",
+			change: func(live *wg.Device) {
+				live.Id = "device2"
+				live.Name = "wg1"
+			},
+			want: Report{Devices: []DeviceDrift{
+				{Id: "device1", Name: "wg0", Status: StoredOnly},
+				{Id: "device2", Name: "wg1", Status: LiveOnly},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := newDevice()
+			tt.change(&live)
+
+			if got := Compare([]wg.Device{stored}, []wg.Device{live}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Compare() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeClient keeps the devices as they are given.
+type fakeClient struct {
+	devices map[string]wg.Device
+}
+
+func (f *fakeClient) Up(deviceId string, config wg.DeviceConfig) (wg.Device, error) {
+	if _, ok := f.devices[deviceId]; ok {
+		return wg.Device{}, os.ErrExist
+	}
+
+	d := wg.Device{Id: deviceId}
+	d.UpdateFromConfig(config)
+	f.devices[deviceId] = d
+	return d, nil
+}
+
+func (f *fakeClient) Down(deviceId string) error {
+	delete(f.devices, deviceId)
+	return nil
+}
+
+func (f *fakeClient) Configure(deviceId string, configurator func(config *wg.DeviceConfig) error) error {
+	d, ok := f.devices[deviceId]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	config := d.ToConfig()
+	if err := configurator(&config); err != nil {
+		return err
+	}
+
+	d.UpdateFromConfig(config)
+	f.devices[deviceId] = d
+	return nil
+}
+
+func (f *fakeClient) Devices() (ret []wg.Device, err error) {
+	for _, d := range f.devices {
+		ret = append(ret, d)
+	}
+	return
+}
+
+func (f *fakeClient) Device(id string) (wg.Device, error) {
+	return f.devices[id], nil
+}
+
+func (f *fakeClient) Close() error {
+	return nil
+}
+
+func newDriftedChecker(t *testing.T, dsn string) *Checker {
+	store, err := persistent.NewSqliteRepository(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := newDevice()
+	gone := newDevice()
+	gone.Id = "device2"
+	if err = store.SaveDevices([]wg.Device{stored, gone}); err != nil {
+		t.Fatal(err)
+	}
+
+	live := newDevice()
+	live.ListenPort = 51821
+	live.Peers[0].PreSharedKey = newKey("psk")
+	unmanaged := newDevice()
+	unmanaged.Id = "device3"
+
+	return NewChecker(store, &fakeClient{devices: map[string]wg.Device{"device1": live, "device3": unmanaged}})
+}
+
+func TestChecker_Adopt(t *testing.T) {
+	c := newDriftedChecker(t, "file:drift_adopt?cache=shared&mode=memory")
+	defer c.Store.Close()
+
+	report, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Devices) != 3 {
+		t.Fatalf("Check() = %+v, want 3 drifted devices", report)
+	}
+
+	if report, err = c.Adopt([]persistent.DeviceId{"device1"}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Device("device1") != nil || len(report.Devices) != 2 {
+		t.Errorf("Adopt(device1) = %+v, want device2 and device3 left", report)
+	}
+
+	if only := report.Only([]persistent.DeviceId{"device3", "device1"}); len(only.Devices) != 1 || only.Devices[0].Id != "device3" {
+		t.Errorf("Only(device3, device1) = %+v, want device3", only)
+	}
+
+	// What's adopted of a device that has no name live keeps the stored one.
+	device1, _ := c.Client.Device("device1")
+	device1.Name = ""
+	device1.ListenPort = 51822
+	c.Client.(*fakeClient).devices["device1"] = device1
+	if report, err = c.Adopt([]persistent.DeviceId{"device1"}); err != nil || report.Device("device1") != nil {
+		t.Fatalf("Adopt(device1) = %+v, %v", report, err)
+	}
+
+	stored, err := c.Store.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range stored {
+		if d.Id == "device1" && (d.Name != "wg0" || d.ListenPort != 51822) {
+			t.Errorf("device1 is stored as %+v, want it named wg0 on port 51822", d)
+		}
+	}
+
+	if report, err = c.Adopt(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !report.InSync() {
+		t.Errorf("Adopt() = %+v, want in sync", report)
+	}
+}
+
+func TestChecker_Reapply(t *testing.T) {
+	c := newDriftedChecker(t, "file:drift_reapply?cache=shared&mode=memory")
+	defer c.Store.Close()
+
+	report, err := c.Reapply(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.InSync() {
+		t.Errorf("Reapply() = %+v, want in sync", report)
+	}
+
+	live, _ := c.Client.Devices()
+	if len(live) != 2 || !reflect.DeepEqual(Compare(live, live), Report{}) {
+		t.Errorf("live devices = %+v", live)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"nz.cloudwalker/wireguard-webadmin/drift"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+)
+
+func printDriftReport(w io.Writer, report drift.Report) {
+	if report.InSync() {
+		_, _ = fmt.Fprintln(w, "No drift")
+		return
+	}
+
+	for _, d := range report.Devices {
+		_, _ = fmt.Fprintf(w, "device %v (%v): %v\n", d.Id, d.Name, d.Status)
+		for _, f := range d.Fields {
+			_, _ = fmt.Fprintf(w, "  %v: stored %q, live %q\n", f.Field, f.Stored, f.Live)
+		}
+
+		for _, p := range d.Peers {
+			_, _ = fmt.Fprintf(w, "  peer %v: %v\n", p.PublicKey, p.Status)
+			for _, f := range p.Fields {
+				_, _ = fmt.Fprintf(w, "    %v: stored %q, live %q\n", f.Field, f.Stored, f.Live)
+			}
+		}
+	}
+}
+
+// runDrift checks the devices the host runs against the store, settling the drift first if told to. Device ids narrow
+// the report, and what's settled, to those devices. It exits with 1 when drift remains so that it can be used from
+// scripts, and 2 on error.
+func runDrift(args []string) int {
+	flags := flag.NewFlagSet("drift", flag.ExitOnError)
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	keyFile := addKeyFileFlag(flags)
+	adopt := flags.Bool("adopt", false, "save the live state of the drifted devices")
+	reapply := flags.Bool("reapply", false, "bring the drifted devices back to their stored state")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: drift [-db dsn] [-key-file file] [-adopt | -reapply] [device id...]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *adopt && *reapply {
+		flags.Usage()
+		return 2
+	}
+
+	ids := make([]persistent.DeviceId, 0, flags.NArg())
+	for _, id := range flags.Args() {
+		ids = append(ids, persistent.DeviceId(id))
+	}
+
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "drift:", err)
+		return 2
+	}
+
+	defer store.Close()
+
+	client, err := wg.NewWgctrlClient()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "drift:", err)
+		return 2
+	}
+
+	defer client.Close()
+
+	checker := drift.NewChecker(store, client)
+	var report drift.Report
+	switch {
+	case *adopt:
+		report, err = checker.Adopt(ids)
+	case *reapply:
+		report, err = checker.Reapply(ids)
+	default:
+		report, err = checker.Check()
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "drift:", err)
+		return 2
+	}
+
+	report = report.Only(ids)
+	printDriftReport(os.Stdout, report)
+	if !report.InSync() {
+		return 1
+	}
+	return 0
+}
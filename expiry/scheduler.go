@@ -0,0 +1,155 @@
+package expiry
+
+import (
+	"fmt"
+	"log"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"time"
+)
+
+type Action int
+
+const (
+	// Disable keeps the expired peers, disabled, so that they can be extended later.
+	Disable Action = 0
+	// Remove deletes the expired peers.
+	Remove Action = 1
+)
+
+// MaxWait is the longest the scheduler sleeps without looking at the repository again.
+const MaxWait = time.Hour
+
+// Actor is who the audit log says cut the peers off.
+var Actor = repo.Actor{Name: "expiry"}
+
+// Scheduler cuts peers off once they reach their ExpiresAt. Disabling a peer gives "expired" as its reason; either
+// action goes through the repository, which notifies the change.
+type Scheduler struct {
+	Repo   repo.Repository
+	Clock  utils.Clock
+	Action Action
+
+	// Sync, if set, configures the devices of the peers cut off right away, so that they're off their devices even if
+	// the change is missed by whoever syncs the devices on the changes of the repository.
+	Sync func(deviceNames []string) (int, error)
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func NewScheduler(repository repo.Repository, clock utils.Clock, action Action) *Scheduler {
+	return &Scheduler{
+		Repo:   repository,
+		Clock:  clock,
+		Action: action,
+	}
+}
+
+// due tells whether an expired peer still needs the action done.
+func (s *Scheduler) due(p repo.PeerInfo) bool {
+	return s.Action == Remove || p.Enabled()
+}
+
+// RunOnce acts on every peer that has expired by now. It returns how many peers it acted on and when the next one
+// within MaxWait expires, or a zero time if none does.
+func (s *Scheduler) RunOnce() (count int, next time.Time, err error) {
+	now := s.Clock.Now()
+
+	peers, _, err := s.Repo.ListPeers(repo.PeerFilter{ExpiresBy: now.Add(MaxWait)}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		return
+	}
+
+	expired := make(map[string][]repo.PeerInfo)
+	for _, p := range peers {
+		if !s.due(p) {
+			continue
+		}
+
+		if at := time.Unix(p.ExpiresAt, 0); at.After(now) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		} else {
+			expired[p.DeviceName] = append(expired[p.DeviceName], p)
+		}
+	}
+
+	r := repo.AsActor(s.Repo, Actor)
+	for deviceName, peers := range expired {
+		if s.Action == Remove {
+			keys := make([]repo.PublicKey, 0, len(peers))
+			for _, p := range peers {
+				keys = append(keys, p.PublicKey)
+				log.Printf("expiry: removing peer %v of %v, expired at %v", p.PublicKey, deviceName, time.Unix(p.ExpiresAt, 0))
+			}
+
+			err = r.RemovePeers(deviceName, keys)
+		} else {
+			for i := range peers {
+				peers[i].SetEnabled(false, fmt.Sprintf("expired at %v", time.Unix(peers[i].ExpiresAt, 0).UTC().Format(time.RFC3339)), now)
+			}
+
+			err = r.UpdatePeers(deviceName, peers)
+		}
+
+		if err != nil {
+			return
+		}
+		count += len(peers)
+	}
+
+	if s.Sync != nil && len(expired) > 0 {
+		names := make([]string, 0, len(expired))
+		for deviceName := range expired {
+			names = append(names, deviceName)
+		}
+		_, err = s.Sync(names)
+	}
+
+	return
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	changes := s.Repo.AddChangeNotification()
+	defer s.Repo.RemoveChangeNotification(changes)
+
+	for {
+		wait := MaxWait
+		if _, next, err := s.RunOnce(); err != nil {
+			log.Printf("expiry: unable to expire peers: %v", err)
+		} else if !next.IsZero() {
+			wait = next.Sub(s.Clock.Now())
+		}
+
+		// A change may bring a peer that expires sooner, so it's looked at again.
+		select {
+		case <-s.stop:
+			return
+		case <-s.Clock.After(wait):
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// Start runs the scheduler in the background until Close.
+func (s *Scheduler) Start() {
+	s.stop = make(chan interface{})
+	s.done = make(chan interface{})
+	go s.run()
+}
+
+func (s *Scheduler) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package expiry
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+// newRepository has a peer expiring every minute from start, for each of the offsets, and one that never does.
+func newRepository(t *testing.T, offsets ...time.Duration) repo.Repository {
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []repo.PeerInfo
+	for i, offset := range append(offsets, 0) {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := repo.PeerInfo{PublicKey: repo.NewPublicKey(k.PublicKey()), DeviceName: "wg0", Name: fmt.Sprint("peer", i)}
+		if i < len(offsets) {
+			p.ExpiresAt = start.Add(offset).Unix()
+		}
+		peers = append(peers, p)
+	}
+
+	if err := r.UpdatePeers("wg0", peers); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func listPeers(t *testing.T, r repo.Repository) (enabled int, disabled []repo.PeerInfo) {
+	peers, _, err := r.ListPeers(repo.PeerFilter{}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range peers {
+		if p.Enabled() {
+			enabled++
+		} else {
+			disabled = append(disabled, p)
+		}
+	}
+	return
+}
+
+func TestScheduler_RunOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    Action
+		elapsed   time.Duration
+		wantCount int
+		wantNext  time.Time
+		wantLeft  int
+	}{
+		{name: "nothing due", action: Disable, elapsed: 0, wantCount: 0, wantNext: start.Add(time.Minute), wantLeft: 4},
+		{name: "disable due", action: Disable, elapsed: 2 * time.Minute, wantCount: 2, wantNext: start.Add(3 * time.Minute), wantLeft: 4},
+		{name: "remove due", action: Remove, elapsed: 2 * time.Minute, wantCount: 2, wantNext: start.Add(3 * time.Minute), wantLeft: 2},
+		{name: "all expired", action: Disable, elapsed: 3 * time.Minute, wantCount: 3, wantNext: time.Time{}, wantLeft: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRepository(t, time.Minute, 2*time.Minute, 3*time.Minute)
+			clock := utils.NewManualClock(start.Add(tt.elapsed))
+			s := NewScheduler(r, clock, tt.action)
+
+			count, next, err := s.RunOnce()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantCount || !next.Equal(tt.wantNext) {
+				t.Errorf("RunOnce() = %v, %v, want %v, %v", count, next, tt.wantCount, tt.wantNext)
+			}
+
+			enabled, disabled := listPeers(t, r)
+			if enabled+len(disabled) != tt.wantLeft {
+				t.Errorf("peers left = %v, want %v", enabled+len(disabled), tt.wantLeft)
+			}
+
+			for _, p := range disabled {
+				if p.StateReason != "expired at "+time.Unix(p.ExpiresAt, 0).UTC().Format(time.RFC3339) {
+					t.Errorf("StateReason = %q", p.StateReason)
+				}
+			}
+
+			// Nothing is done twice.
+			if count, _, _ = s.RunOnce(); count != 0 {
+				t.Errorf("RunOnce() again = %v, want 0", count)
+			}
+		})
+	}
+}
+
+func TestScheduler_Start(t *testing.T) {
+	r := newRepository(t, 10*time.Second)
+	clock := utils.NewManualClock(start)
+	changes := r.AddChangeNotification()
+
+	s := NewScheduler(r, clock, Disable)
+	s.Start()
+	defer s.Close()
+
+	// Wait for the scheduler to go to sleep until the expiry.
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(10 * time.Second)
+
+	select {
+	case e := <-changes:
+		if e.Type != repo.PeersUpdated || len(e.PublicKeys) != 1 {
+			t.Errorf("event = %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer did not expire")
+	}
+
+	if _, disabled := listPeers(t, r); len(disabled) != 1 {
+		t.Errorf("disabled peers = %v, want 1", disabled)
+	}
+}
+
+func TestScheduler_Sync(t *testing.T) {
+	r := newRepository(t, time.Minute)
+	clock := utils.NewManualClock(start)
+
+	var synced [][]string
+	s := NewScheduler(r, clock, Disable)
+	s.Sync = func(deviceNames []string) (int, error) {
+		synced = append(synced, deviceNames)
+		return len(deviceNames), nil
+	}
+
+	if _, _, err := s.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 0 {
+		t.Errorf("synced %v with nothing due", synced)
+	}
+
+	clock.Advance(time.Minute)
+	if _, _, err := s.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 1 || len(synced[0]) != 1 || synced[0][0] != "wg0" {
+		t.Errorf("synced %v, want [[wg0]]", synced)
+	}
+}
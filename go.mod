@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/vishvananda/netlink v1.0.0
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
@@ -12,6 +13,7 @@ require (
 	golang.zx2c4.com/wireguard v0.0.20191012
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20191028205011-23406de29c08
 	google.golang.org/appengine v1.6.5 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace golang.zx2c4.com/wireguard => ./wireguard-go
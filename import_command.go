@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"io"
+	"nz.cloudwalker/wireguard-webadmin/importer"
+	"os"
+)
+
+func printImportPlan(w io.Writer, plan importer.Plan, dryRun bool) {
+	if len(plan.Devices) == 0 {
+		_, _ = fmt.Fprintln(w, "No devices found")
+		return
+	}
+
+	if dryRun {
+		_, _ = fmt.Fprintln(w, "Dry run, nothing is saved:")
+	}
+
+	for _, d := range plan.Devices {
+		_, _ = fmt.Fprintf(w, "device %v (%v) from %v: %v\n", d.Id, d.Name, d.Source, d.Action)
+		for _, k := range d.Added {
+			_, _ = fmt.Fprintf(w, "  add peer %v\n", k)
+		}
+		for _, k := range d.Removed {
+			_, _ = fmt.Fprintf(w, "  remove peer %v\n", k)
+		}
+	}
+}
+
+// findDevices reads the devices from the live state, the configuration directory or both.
+func findDevices(live bool, confDir string) ([]importer.Device, error) {
+	var running, files []importer.Device
+	var err error
+
+	if live {
+		client, err := wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+
+		defer client.Close()
+
+		if running, err = importer.ReadLive(client); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(confDir) > 0 {
+		if files, err = importer.ReadConfDir(confDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return importer.Merge(running, files), nil
+}
+
+// runImport brings the devices already on this host into the store. It exits with 1 when devices conflict with
+// stored ones under -conflict fail, and 2 on any other error.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	keyFile := addKeyFileFlag(flags)
+	live := flags.Bool("live", true, "read the devices WireGuard runs")
+	confDir := flags.String("conf-dir", "/etc/wireguard", "read the wg-quick files of the directory, none if empty")
+	conflict := flags.String("conflict", "skip", "what to do with stored devices: skip, merge, replace or fail")
+	dryRun := flags.Bool("dry-run", false, "show what would be imported without saving anything")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: import [-db dsn] [-key-file file] [-live=false] [-conf-dir dir] [-conflict mode] [-dry-run]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	mode, err := importer.ParseConflictMode(*conflict)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "import:", err)
+		flags.Usage()
+		return 2
+	}
+
+	found, err := findDevices(*live, *confDir)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "import:", err)
+		return 2
+	}
+
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "import:", err)
+		return 2
+	}
+
+	defer store.Close()
+
+	plan, err := importer.NewImporter(store, mode).Import(found, *dryRun)
+	printImportPlan(os.Stdout, plan, *dryRun)
+
+	if err == importer.ErrExists {
+		_, _ = fmt.Fprintln(os.Stderr, "import: some devices are already stored, nothing was imported")
+		return 1
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "import:", err)
+		return 2
+	}
+	return 0
+}
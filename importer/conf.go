@@ -0,0 +1,259 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device is a device found on a server, along with the names given to it and its peers.
+type Device struct {
+	wg.Device
+
+	// PeerNames has the names of the peers that were given one.
+	PeerNames map[wg.Key]string
+
+	// Source tells where the device was found: a file or "wgctrl".
+	Source string
+}
+
+// commentName reads a name from a comment: either "Name = value" or, above a section, the whole comment.
+func commentName(comment string, above bool) (string, bool) {
+	kv := strings.SplitN(comment, "=", 2)
+	if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "name") {
+		return strings.TrimSpace(kv[1]), true
+	}
+
+	return comment, above && len(comment) > 0
+}
+
+func parseKey(v string) (wg.Key, error) {
+	k, err := wgtypes.ParseKey(v)
+	return wg.Key(k), err
+}
+
+// parseAddress reads the first address of the device, with its network.
+func parseAddress(v string) (*net.IPNet, error) {
+	first := strings.TrimSpace(strings.Split(v, ",")[0])
+	ip, n, err := net.ParseCIDR(first)
+	if err != nil {
+		return nil, err
+	}
+
+	n.IP = ip
+	return n, nil
+}
+
+func parseAllowedIPs(v string) (ret []net.IPNet, err error) {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) == 0 {
+			continue
+		}
+
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(s); err != nil {
+			return
+		}
+		ret = append(ret, *n)
+	}
+	return
+}
+
+// ParseConf reads the wg-quick configuration of the interface called name. The device is named after the
+// interface unless the [Interface] section gives it a name, and a peer has the name its [Peer] section gives it.
+// A section is given a name by a "# Name = value" comment inside it, or by the comment right above it.
+// Settings only wg-quick knows about, such as DNS or PostUp, are left out.
+func ParseConf(name string, r io.Reader) (ret Device, err error) {
+	ret = Device{
+		Device:    wg.Device{Id: name, Name: name},
+		PeerNames: make(map[wg.Key]string),
+	}
+
+	var section string
+	var peer *wg.Peer
+	var sectionName, above string
+
+	// nameInside names the section being read after a "# Name = value" comment that is not right above the next one.
+	nameInside := func() {
+		if v, ok := commentName(above, false); ok && len(section) > 0 {
+			sectionName = v
+			if section == "interface" {
+				ret.Name = v
+			}
+		}
+		above = ""
+	}
+
+	// endSection files the peer that was being read, if any.
+	endSection := func() error {
+		if peer == nil {
+			return nil
+		}
+
+		if peer.PublicKey.IsZero() {
+			return fmt.Errorf("peer without a public key")
+		}
+
+		ret.Peers = append(ret.Peers, *peer)
+		if len(sectionName) > 0 {
+			ret.PeerNames[peer.PublicKey] = sectionName
+		}
+
+		peer = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#") {
+			above = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		}
+
+		// wg-quick drops whatever follows a #, and keys have none.
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		if len(line) == 0 {
+			nameInside()
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err = endSection(); err != nil {
+				return ret, fmt.Errorf("%v:%v: %v", name, lineNo, err)
+			}
+
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			sectionName, _ = commentName(above, true)
+			above = ""
+
+			switch section {
+			case "interface":
+				if len(sectionName) > 0 {
+					ret.Name = sectionName
+				}
+			case "peer":
+				peer = &wg.Peer{}
+			default:
+				return ret, fmt.Errorf("%v:%v: unknown section %v", name, lineNo, line)
+			}
+			continue
+		}
+
+		nameInside()
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || len(section) == 0 {
+			return ret, fmt.Errorf("%v:%v: unable to read %q", name, lineNo, line)
+		}
+
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if section == "interface" {
+			err = ret.setInterface(key, value)
+		} else {
+			err = setPeer(peer, key, value)
+		}
+
+		if err != nil {
+			return ret, fmt.Errorf("%v:%v: %v: %v", name, lineNo, kv[0], err)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	nameInside()
+	if err = endSection(); err != nil {
+		return ret, fmt.Errorf("%v: %v", name, err)
+	}
+
+	if ret.PrivateKey.IsZero() {
+		return ret, fmt.Errorf("%v: no private key", name)
+	}
+	return
+}
+
+func (d *Device) setInterface(key string, value string) (err error) {
+	switch key {
+	case "privatekey":
+		d.PrivateKey, err = parseKey(value)
+	case "listenport":
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		d.ListenPort = uint16(port)
+	case "address":
+		d.Address, err = parseAddress(value)
+	}
+	return
+}
+
+func setPeer(p *wg.Peer, key string, value string) (err error) {
+	switch key {
+	case "publickey":
+		p.PublicKey, err = parseKey(value)
+	case "presharedkey":
+		p.PreSharedKey, err = parseKey(value)
+	case "endpoint":
+		p.Endpoint, err = net.ResolveUDPAddr("udp", value)
+	case "allowedips":
+		var ips []net.IPNet
+		ips, err = parseAllowedIPs(value)
+		p.AllowedIPs = append(p.AllowedIPs, ips...)
+	case "persistentkeepalive":
+		if strings.EqualFold(value, "off") {
+			p.PersistentKeepAlive = 0
+			return
+		}
+
+		var seconds uint64
+		seconds, err = strconv.ParseUint(value, 10, 16)
+		p.PersistentKeepAlive = time.Duration(seconds) * time.Second
+	default:
+		err = fmt.Errorf("unknown setting")
+	}
+	return
+}
+
+// ReadConfDir reads every *.conf file of dir, such as /etc/wireguard, each configuring the interface it's named
+// after.
+func ReadConfDir(dir string) ([]Device, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Device, 0, len(files))
+	for _, file := range files {
+		d, err := readConfFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+func readConfFile(file string) (Device, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Device{}, err
+	}
+
+	defer f.Close()
+
+	d, err := ParseConf(strings.TrimSuffix(filepath.Base(file), ".conf"), f)
+	d.Source = file
+	return d, err
+}
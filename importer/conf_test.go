@@ -0,0 +1,127 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKey(v string) wg.Key {
+	return wg.Key(sha256.Sum256([]byte(v)))
+}
+
+func base64Key(k wg.Key) string {
+	return wgtypes.Key(k).String()
+}
+
+func parseCIDR(v string) net.IPNet {
+	ip, n, err := net.ParseCIDR(v)
+	if err != nil {
+		panic(err)
+	}
+	n.IP = ip
+	return *n
+}
+
+func parseNet(v string) net.IPNet {
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		panic(err)
+	}
+	return *n
+}
+
+func TestParseConf(t *testing.T) {
+	conf := `# Office
+[Interface]
+PrivateKey = ` + base64Key(newKey("wg0")) + `
+ListenPort = 51820
+Address = 10.0.0.1/24, fd00::1/64
+DNS = 1.1.1.1
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+# alice
+[Peer]
+PublicKey = ` + base64Key(newKey("alice")) + `
+PresharedKey = ` + base64Key(newKey("psk")) + `
+AllowedIPs = 10.0.0.2/32 # laptop
+AllowedIPs = 192.168.1.0/24
+PersistentKeepalive = 25
+
+[Peer]
+# Name = bob
+PublicKey = ` + base64Key(newKey("bob")) + `
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.0.0.3/32
+PersistentKeepalive = off
+
+[Peer]
+PublicKey = ` + base64Key(newKey("carol")) + `
+AllowedIPs = 10.0.0.4/32
+`
+
+	address := parseCIDR("10.0.0.1/24")
+	endpoint, _ := net.ResolveUDPAddr("udp", "192.0.2.1:51820")
+	want := Device{
+		Device: wg.Device{
+			Id:         "wg0",
+			Name:       "Office",
+			PrivateKey: newKey("wg0"),
+			ListenPort: 51820,
+			Address:    &address,
+			Peers: []wg.Peer{
+				{PeerConfig: wg.PeerConfig{
+					PublicKey:           newKey("alice"),
+					PreSharedKey:        newKey("psk"),
+					AllowedIPs:          []net.IPNet{parseNet("10.0.0.2/32"), parseNet("192.168.1.0/24")},
+					PersistentKeepAlive: 25 * time.Second,
+				}},
+				{PeerConfig: wg.PeerConfig{
+					PublicKey:  newKey("bob"),
+					Endpoint:   endpoint,
+					AllowedIPs: []net.IPNet{parseNet("10.0.0.3/32")},
+				}},
+				{PeerConfig: wg.PeerConfig{
+					PublicKey:  newKey("carol"),
+					AllowedIPs: []net.IPNet{parseNet("10.0.0.4/32")},
+				}},
+			},
+		},
+		PeerNames: map[wg.Key]string{newKey("alice"): "alice", newKey("bob"): "bob"},
+	}
+
+	got, err := ParseConf("wg0", strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseConf() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseConf_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want string
+	}{
+		{name: "no private key", conf: "[Interface]\nListenPort = 1\n", want: "wg0: no private key"},
+		{name: "bad key", conf: "[Interface]\nPrivateKey = nope\n", want: "wg0:2: PrivateKey"},
+		{name: "peer without key", conf: "[Peer]\nAllowedIPs = 10.0.0.2/32\n", want: "wg0: peer without a public key"},
+		{name: "unknown section", conf: "[Route]\n", want: "wg0:1: unknown section"},
+		{name: "outside a section", conf: "PrivateKey = x\n", want: "wg0:1: unable to read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseConf("wg0", strings.NewReader(tt.conf)); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("ParseConf() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
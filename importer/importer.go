@@ -0,0 +1,188 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+)
+
+var (
+	ErrExists = errors.New("device is already stored")
+)
+
+// ConflictMode tells what to do with a device that's already stored.
+type ConflictMode int
+
+const (
+	// SkipExisting leaves the stored device as it is.
+	SkipExisting ConflictMode = 0
+	// MergeExisting adds the peers the stored device doesn't have and leaves everything else as stored.
+	MergeExisting ConflictMode = 1
+	// ReplaceExisting overwrites the stored device, dropping the stored peers that weren't found.
+	ReplaceExisting ConflictMode = 2
+	// FailOnExisting imports nothing if any of the devices is already stored.
+	FailOnExisting ConflictMode = 3
+)
+
+var conflictModeNames = map[string]ConflictMode{
+	"skip":    SkipExisting,
+	"merge":   MergeExisting,
+	"replace": ReplaceExisting,
+	"fail":    FailOnExisting,
+}
+
+func ParseConflictMode(v string) (ConflictMode, error) {
+	if m, ok := conflictModeNames[v]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown conflict mode %q", v)
+}
+
+type Action string
+
+const (
+	ActionCreate   Action = "create"
+	ActionSkip     Action = "skip"
+	ActionMerge    Action = "merge"
+	ActionReplace  Action = "replace"
+	ActionConflict Action = "conflict"
+)
+
+// DevicePlan is what importing a device does to the store.
+type DevicePlan struct {
+	Id     string
+	Name   string
+	Source string
+	Action Action
+
+	// Added are the peers the import saves that aren't stored yet, and Removed the stored peers it drops.
+	Added   []wg.Key
+	Removed []wg.Key
+}
+
+// Plan is what an import does, worked out before anything is written so that it can be previewed.
+type Plan struct {
+	Devices []DevicePlan
+
+	save  []wg.Device
+	names map[persistent.PeerId]string
+}
+
+// Importer brings devices that were set up by other means, such as wg-quick, into the store. The keys are kept as
+// they are, so none of the peers has to be set up again.
+type Importer struct {
+	Store    persistent.Repository
+	Conflict ConflictMode
+}
+
+func NewImporter(store persistent.Repository, conflict ConflictMode) *Importer {
+	return &Importer{Store: store, Conflict: conflict}
+}
+
+func peerKeys(peers []wg.Peer) map[wg.Key]bool {
+	ret := make(map[wg.Key]bool, len(peers))
+	for _, p := range peers {
+		ret[p.PublicKey] = true
+	}
+	return ret
+}
+
+// Plan works out what importing the devices does. With FailOnExisting, it fails with ErrExists if any device is
+// already stored, the plan showing which as conflicts.
+func (i *Importer) Plan(found []Device) (plan Plan, err error) {
+	stored, err := i.Store.ListDevices()
+	if err != nil {
+		return
+	}
+
+	storedById := make(map[string]wg.Device, len(stored))
+	for _, d := range stored {
+		storedById[d.Id] = d
+	}
+
+	plan.names = make(map[persistent.PeerId]string)
+	conflicts := 0
+
+	for _, d := range found {
+		p := DevicePlan{Id: d.Id, Name: d.Name, Source: d.Source}
+		existing, exists := storedById[d.Id]
+		storedPeers := peerKeys(existing.Peers)
+
+		save := d.Device
+		switch {
+		case !exists:
+			p.Action = ActionCreate
+		case i.Conflict == SkipExisting:
+			p.Action = ActionSkip
+		case i.Conflict == MergeExisting:
+			p.Action, p.Name = ActionMerge, existing.Name
+			save = existing
+			for _, peer := range d.Peers {
+				if !storedPeers[peer.PublicKey] {
+					save.Peers = append(save.Peers, peer)
+				}
+			}
+		case i.Conflict == ReplaceExisting:
+			p.Action = ActionReplace
+			foundPeers := peerKeys(d.Peers)
+			for _, peer := range existing.Peers {
+				if !foundPeers[peer.PublicKey] {
+					p.Removed = append(p.Removed, peer.PublicKey)
+				}
+			}
+		default:
+			p.Action = ActionConflict
+			conflicts++
+		}
+
+		if p.Action != ActionSkip && p.Action != ActionConflict {
+			for _, peer := range d.Peers {
+				if !storedPeers[peer.PublicKey] {
+					p.Added = append(p.Added, peer.PublicKey)
+				} else if p.Action == ActionMerge {
+					continue
+				}
+
+				if name, ok := d.PeerNames[peer.PublicKey]; ok {
+					plan.names[persistent.PeerId{DeviceId: persistent.DeviceId(d.Id), PublicKey: peer.PublicKey}] = name
+				}
+			}
+			plan.save = append(plan.save, save)
+		}
+
+		plan.Devices = append(plan.Devices, p)
+	}
+
+	if conflicts > 0 {
+		err = ErrExists
+	}
+	return
+}
+
+// Apply saves what the plan says to.
+func (i *Importer) Apply(plan Plan) error {
+	if len(plan.save) > 0 {
+		if err := i.Store.SaveDevices(plan.save); err != nil {
+			return err
+		}
+	}
+
+	for id, name := range plan.names {
+		if err := i.Store.SetPeerMeta(id, persistent.MetaKeyName, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import imports the devices, or only works out what it would do with dryRun.
+func (i *Importer) Import(found []Device, dryRun bool) (Plan, error) {
+	plan, err := i.Plan(found)
+	if err != nil || dryRun {
+		return plan, err
+	}
+
+	return plan, i.Apply(plan)
+}
@@ -0,0 +1,177 @@
+package importer
+
+import (
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"testing"
+)
+
+func newFoundDevice(id string, peers ...string) Device {
+	d := Device{
+		Device:    wg.Device{Id: id, Name: id, PrivateKey: newKey(id)},
+		PeerNames: make(map[wg.Key]string),
+	}
+
+	for _, p := range peers {
+		d.Peers = append(d.Peers, wg.Peer{PeerConfig: wg.PeerConfig{PublicKey: newKey(p)}})
+		d.PeerNames[newKey(p)] = p
+	}
+	return d
+}
+
+func newStore(t *testing.T, dsn string) persistent.Repository {
+	store, err := persistent.NewSqliteRepository(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := newFoundDevice("wg0", "alice", "bob")
+	stored.Name = "stored"
+	if err = store.SaveDevices([]wg.Device{stored.Device}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newKey("alice")
+	if err = store.SaveReservations([]persistent.Reservation{{DeviceId: "wg0", IP: net.ParseIP("10.0.0.2"), PublicKey: &alice}}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func peerKeysOf(t *testing.T, store persistent.Repository, id string) map[wg.Key]bool {
+	devices, err := store.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range devices {
+		if d.Id == id {
+			return peerKeys(d.Peers)
+		}
+	}
+	return nil
+}
+
+func TestImporter_Import(t *testing.T) {
+	found := []Device{newFoundDevice("wg0", "bob", "carol"), newFoundDevice("wg1", "dave")}
+
+	tests := []struct {
+		name     string
+		conflict ConflictMode
+		wantErr  error
+		want     []DevicePlan
+		wantWg0  map[wg.Key]bool
+	}{
+		{
+			name:     "skip",
+			conflict: SkipExisting,
+			want: []DevicePlan{
+				{Id: "wg0", Name: "wg0", Action: ActionSkip},
+				{Id: "wg1", Name: "wg1", Action: ActionCreate, Added: []wg.Key{newKey("dave")}},
+			},
+			wantWg0: map[wg.Key]bool{newKey("alice"): true, newKey("bob"): true},
+		},
+		{
+			name:     "merge",
+			conflict: MergeExisting,
+			want: []DevicePlan{
+				{Id: "wg0", Name: "stored", Action: ActionMerge, Added: []wg.Key{newKey("carol")}},
+				{Id: "wg1", Name: "wg1", Action: ActionCreate, Added: []wg.Key{newKey("dave")}},
+			},
+			wantWg0: map[wg.Key]bool{newKey("alice"): true, newKey("bob"): true, newKey("carol"): true},
+		},
+		{
+			name:     "replace",
+			conflict: ReplaceExisting,
+			want: []DevicePlan{
+				{Id: "wg0", Name: "wg0", Action: ActionReplace, Added: []wg.Key{newKey("carol")}, Removed: []wg.Key{newKey("alice")}},
+				{Id: "wg1", Name: "wg1", Action: ActionCreate, Added: []wg.Key{newKey("dave")}},
+			},
+			wantWg0: map[wg.Key]bool{newKey("bob"): true, newKey("carol"): true},
+		},
+		{
+			name:     "fail",
+			conflict: FailOnExisting,
+			wantErr:  ErrExists,
+			want: []DevicePlan{
+				{Id: "wg0", Name: "wg0", Action: ActionConflict},
+				{Id: "wg1", Name: "wg1", Action: ActionCreate, Added: []wg.Key{newKey("dave")}},
+			},
+			wantWg0: map[wg.Key]bool{newKey("alice"): true, newKey("bob"): true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newStore(t, "file:import_"+tt.name+"?cache=shared&mode=memory")
+			defer store.Close()
+
+			i := NewImporter(store, tt.conflict)
+			plan, err := i.Import(found, true)
+			if err != tt.wantErr || !reflect.DeepEqual(plan.Devices, tt.want) {
+				t.Fatalf("Import(dry run) = %+v, %v, want %+v, %v", plan.Devices, err, tt.want, tt.wantErr)
+			}
+
+			if peerKeysOf(t, store, "wg1") != nil {
+				t.Fatal("dry run saved wg1")
+			}
+
+			if _, err = i.Import(found, false); err != tt.wantErr {
+				t.Fatalf("Import() = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := peerKeysOf(t, store, "wg0"); !reflect.DeepEqual(got, tt.wantWg0) {
+				t.Errorf("wg0 peers = %v, want %v", got, tt.wantWg0)
+			}
+
+			// The address of alice is released along with her.
+			reservations, err := store.ListReservations("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(reservations) > 0; got != tt.wantWg0[newKey("alice")] {
+				t.Errorf("wg0 reservations = %+v, want alice's kept %v", reservations, tt.wantWg0[newKey("alice")])
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			names, err := store.GetPeerMeta(persistent.MetaKeyName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names[persistent.PeerId{DeviceId: "wg1", PublicKey: newKey("dave")}] != "dave" {
+				t.Errorf("peer names = %v, want dave's", names)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	live := newFoundDevice("wg0", "alice", "bob")
+	live.PeerNames = map[wg.Key]string{}
+	live.Source = LiveSource
+
+	file := newFoundDevice("wg0", "alice")
+	file.Name = "Office"
+	file.Source = "/etc/wireguard/wg0.conf"
+	address := parseCIDR("10.0.0.1/24")
+	file.Address = &address
+
+	down := newFoundDevice("wg1")
+
+	got := Merge([]Device{live}, []Device{down, file})
+	if len(got) != 2 || got[0].Id != "wg0" || got[1].Id != "wg1" {
+		t.Fatalf("Merge() = %+v", got)
+	}
+
+	wg0 := got[0]
+	if wg0.Name != "Office" || wg0.Address != &address || len(wg0.Peers) != 2 || wg0.Source != "wgctrl, /etc/wireguard/wg0.conf" {
+		t.Errorf("merged device = %+v", wg0)
+	}
+	if !reflect.DeepEqual(wg0.PeerNames, map[wg.Key]string{newKey("alice"): "alice"}) {
+		t.Errorf("merged peer names = %v", wg0.PeerNames)
+	}
+}
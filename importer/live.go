@@ -0,0 +1,120 @@
+package importer
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"sort"
+)
+
+// LiveSource is where the live devices are read from.
+const LiveSource = "wgctrl"
+
+// DeviceLister lists the devices WireGuard runs, as *wgctrl.Client does.
+type DeviceLister interface {
+	Devices() ([]*wgtypes.Device, error)
+}
+
+// interfaceAddress gives the first address of the network interface, which WireGuard itself knows nothing about.
+var interfaceAddress = func(name string) (*net.IPNet, error) {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := i.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addresses {
+		if n, ok := a.(*net.IPNet); ok {
+			return n, nil
+		}
+	}
+	return nil, nil
+}
+
+func fromLive(d *wgtypes.Device) (ret Device, err error) {
+	ret = Device{
+		Device: wg.Device{
+			Id:         d.Name,
+			Name:       d.Name,
+			PrivateKey: wg.Key(d.PrivateKey),
+			ListenPort: uint16(d.ListenPort),
+		},
+		PeerNames: make(map[wg.Key]string),
+		Source:    LiveSource,
+	}
+
+	if ret.Address, err = interfaceAddress(d.Name); err != nil {
+		return
+	}
+
+	for _, p := range d.Peers {
+		ret.Peers = append(ret.Peers, wg.Peer{PeerConfig: wg.PeerConfig{
+			PublicKey:           wg.Key(p.PublicKey),
+			PreSharedKey:        wg.Key(p.PresharedKey),
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          p.AllowedIPs,
+			PersistentKeepAlive: p.PersistentKeepaliveInterval,
+		}})
+	}
+	return
+}
+
+// ReadLive reads the devices running on this host. The live state has no names, which Merge can take from the
+// configuration files.
+func ReadLive(lister DeviceLister) ([]Device, error) {
+	devices, err := lister.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		found, err := fromLive(d)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, found)
+	}
+	return ret, nil
+}
+
+// Merge puts the devices found live and in files together. What runs is what's imported, so a device found in both
+// has its keys, port and peers from the live one, and only the names, and the address if the interface has none,
+// from the file. The devices are sorted by id.
+func Merge(live []Device, files []Device) []Device {
+	byId := make(map[string]Device, len(live)+len(files))
+	for _, d := range files {
+		byId[d.Id] = d
+	}
+
+	for _, d := range live {
+		if file, ok := byId[d.Id]; ok {
+			d.Name = file.Name
+			d.Source = d.Source + ", " + file.Source
+			if d.Address == nil {
+				d.Address = file.Address
+			}
+
+			for _, p := range d.Peers {
+				if name, ok := file.PeerNames[p.PublicKey]; ok {
+					d.PeerNames[p.PublicKey] = name
+				}
+			}
+		}
+		byId[d.Id] = d
+	}
+
+	ret := make([]Device, 0, len(byId))
+	for _, d := range byId {
+		ret = append(ret, d)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
@@ -0,0 +1,359 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoAddress  = errors.New("device has no network to allocate from")
+	ErrNotHost    = errors.New("address is not a host address of the device's network")
+	ErrPeerExists = errors.New("peer already exists on the device")
+)
+
+// maxAttempts bounds the retries when another writer to the store takes the address we picked.
+const maxAttempts = 16
+
+// Allocator hands out addresses of a device's networks to the peers added through it: one of the network of its
+// Address and one of each of those listed in its persistent.MetaKeyNetworks meta, so that a device can give its peers
+// both an IPv4 and an IPv6 address. An address it gives a peer is pinned to the peer by a reservation, so the store
+// won't give it to anyone else even if it's shared between processes, and is released when the peer is removed.
+// Peers kept elsewhere, as in a repo.Repository, get theirs with Hold.
+type Allocator struct {
+	// Store keeps the devices and the reservations. Without one, Hold keeps what it holds in memory, which only
+	// holds within this process.
+	Store persistent.Repository
+
+	mutex sync.Mutex
+	// held are the reservations Hold makes while there's no Store.
+	held []persistent.Reservation
+}
+
+func NewAllocator(store persistent.Repository) *Allocator {
+	return &Allocator{Store: store}
+}
+
+// device gives the device with the networks it hands addresses out of, failing with ErrNoAddress if there are none.
+func (a *Allocator) device(id persistent.DeviceId) (wg.Device, []*net.IPNet, error) {
+	devices, err := a.Store.ListDevices()
+	if err != nil {
+		return wg.Device{}, nil, err
+	}
+
+	for _, d := range devices {
+		if persistent.DeviceId(d.Id) != id {
+			continue
+		}
+
+		var networks []*net.IPNet
+		if d.Address != nil {
+			networks = append(networks, d.Address)
+		}
+
+		meta, err := a.Store.ListDeviceMeta(id)
+		if err != nil {
+			return d, nil, err
+		}
+
+		for _, v := range strings.Split(meta[persistent.MetaKeyNetworks], ",") {
+			if v = strings.TrimSpace(v); len(v) == 0 {
+				continue
+			}
+
+			n, err := utils.ParseCIDRAsIPNet(v)
+			if err != nil {
+				return d, nil, err
+			}
+			networks = append(networks, n)
+		}
+
+		if len(networks) == 0 {
+			return d, nil, ErrNoAddress
+		}
+		return d, networks, nil
+	}
+
+	return wg.Device{}, nil, os.ErrNotExist
+}
+
+// pool gives what of network can be handed out to peer, leaving out what's reserved for anyone else, and the first
+// address of the network reserved for it as pinned.
+func pool(network *net.IPNet, reservations []persistent.Reservation, peer wg.Key) (pool *Pool, pinned net.IP) {
+	pool = NewPool(network)
+	for _, r := range reservations {
+		if r.PublicKey == nil || *r.PublicKey != peer {
+			pool.Add(r.IP)
+		} else if pinned == nil && IsHost(network, r.IP) {
+			pinned = r.IP
+		}
+	}
+	return
+}
+
+// peerIPs gives the AllowedIPs of the peers of the device but peer.
+func peerIPs(d wg.Device, peer wg.Key) (ret []net.IPNet) {
+	for _, p := range d.Peers {
+		if p.PublicKey != peer {
+			ret = append(ret, p.AllowedIPs...)
+		}
+	}
+	return
+}
+
+// AddPeer adds peer to the device with the next free host address of each of its networks, or the one reserved for
+// it, appended to its AllowedIPs. It returns the peer as saved.
+func (a *Allocator) AddPeer(deviceId persistent.DeviceId, peer wg.PeerConfig) (wg.PeerConfig, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		d, networks, err := a.device(deviceId)
+		if err != nil {
+			return peer, err
+		}
+
+		for _, p := range d.Peers {
+			if p.PublicKey == peer.PublicKey {
+				return peer, ErrPeerExists
+			}
+		}
+
+		reservations, err := a.Store.ListReservations(deviceId)
+		if err != nil {
+			return peer, err
+		}
+
+		key := peer.PublicKey
+		ips := make([]net.IP, 0, len(networks))
+		reserving := make([]persistent.Reservation, 0, len(networks))
+		for _, n := range networks {
+			pool, ip := pool(n, reservations, peer.PublicKey)
+			if ip == nil {
+				pool.AddAllowedIPs(peerIPs(d, peer.PublicKey))
+				if ip, err = pool.Next(); err != nil {
+					return peer, err
+				}
+			}
+
+			ips = append(ips, ip)
+			reserving = append(reserving, persistent.Reservation{DeviceId: deviceId, IP: ip, PublicKey: &key})
+		}
+
+		err = a.Store.SaveReservations(reserving)
+		if err == persistent.ErrAddressReserved && attempt < maxAttempts {
+			continue
+		} else if err != nil {
+			return peer, err
+		}
+
+		added := peer
+		added.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+		for _, ip := range ips {
+			added.AllowedIPs = append(added.AllowedIPs, HostNet(ip))
+		}
+		d.Peers = append(d.Peers, wg.Peer{PeerConfig: added})
+
+		if err = a.Store.SaveDevices([]wg.Device{d}); err != nil {
+			_ = a.Store.RemoveReservations(deviceId, ips)
+			return peer, err
+		}
+
+		return added, nil
+	}
+}
+
+// Networks gives the networks of the device that addresses are handed out of, failing with ErrNoAddress if it has
+// none or there's no Store to tell.
+func (a *Allocator) Networks(deviceId persistent.DeviceId) ([]*net.IPNet, error) {
+	if a.Store == nil {
+		return nil, ErrNoAddress
+	}
+
+	_, networks, err := a.device(deviceId)
+	return networks, err
+}
+
+// Held are the addresses Hold picked for a peer, reserved for it until they're released.
+type Held struct {
+	IPs []net.IP
+
+	allocator *Allocator
+	deviceId  persistent.DeviceId
+	// reserved are the addresses Hold reserved, leaving alone those that were reserved for the peer already.
+	reserved []net.IP
+}
+
+// AllowedIPs gives the addresses as the peer is routed them.
+func (h *Held) AllowedIPs() []net.IPNet {
+	ret := make([]net.IPNet, 0, len(h.IPs))
+	for _, ip := range h.IPs {
+		ret = append(ret, HostNet(ip))
+	}
+	return ret
+}
+
+// Release gives back the reservations Hold made, once the peer is stored with the addresses, which keep them taken
+// from then on, or failed to be.
+func (h *Held) Release() error {
+	a := h.allocator
+	if len(h.reserved) == 0 {
+		return nil
+	} else if a.Store != nil {
+		return a.Release(h.deviceId, h.reserved)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	kept := make([]persistent.Reservation, 0, len(a.held))
+	for _, r := range a.held {
+		if r.DeviceId != h.deviceId || !containsIP(h.reserved, r.IP) {
+			kept = append(kept, r)
+		}
+	}
+	a.held = kept
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservations gives those of the device, from the Store or what's held without one.
+func (a *Allocator) reservations(deviceId persistent.DeviceId) ([]persistent.Reservation, error) {
+	if a.Store != nil {
+		return a.Store.ListReservations(deviceId)
+	}
+
+	var ret []persistent.Reservation
+	for _, r := range a.held {
+		if r.DeviceId == deviceId {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// Hold picks the next free host address of each of the networks for a peer of the device, or the one reserved for
+// it, leaving out those used gives, such as the AllowedIPs of the other peers. The addresses are reserved for the
+// peer until they're released, so that no one sharing the store picks them while the peer is stored where it's kept.
+// used is called once the reservations are read, for it to see the peers stored by those who released theirs since.
+func (a *Allocator) Hold(deviceId persistent.DeviceId, networks []*net.IPNet, used func() ([]net.IPNet, error), peer wg.Key) (*Held, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		reservations, err := a.reservations(deviceId)
+		if err != nil {
+			return nil, err
+		}
+
+		usedIPs, err := used()
+		if err != nil {
+			return nil, err
+		}
+
+		held := &Held{allocator: a, deviceId: deviceId}
+		reserving := make([]persistent.Reservation, 0, len(networks))
+		for _, n := range networks {
+			pool, ip := pool(n, reservations, peer)
+			if ip == nil {
+				pool.AddAllowedIPs(usedIPs)
+				if ip, err = pool.Next(); err != nil {
+					return nil, err
+				}
+
+				key := peer
+				reserving = append(reserving, persistent.Reservation{DeviceId: deviceId, IP: ip, PublicKey: &key})
+				held.reserved = append(held.reserved, ip)
+			}
+			held.IPs = append(held.IPs, ip)
+		}
+
+		if len(reserving) == 0 {
+			return held, nil
+		} else if a.Store == nil {
+			a.held = append(a.held, reserving...)
+			return held, nil
+		}
+
+		err = a.Store.SaveReservations(reserving)
+		if err == persistent.ErrAddressReserved && attempt < maxAttempts {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return held, nil
+	}
+}
+
+// RemovePeers removes the peers, releasing their addresses.
+func (a *Allocator) RemovePeers(deviceId persistent.DeviceId, keys []wg.Key) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ids := make([]persistent.PeerId, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, persistent.PeerId{DeviceId: deviceId, PublicKey: k})
+	}
+
+	return a.Store.RemovePeers(ids)
+}
+
+// Reserve holds ip so that it's not handed out, or, with a peer, so that it's handed out to only that peer.
+func (a *Allocator) Reserve(deviceId persistent.DeviceId, ip net.IP, peer *wg.Key) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	d, networks, err := a.device(deviceId)
+	if err != nil {
+		return err
+	}
+
+	var network *net.IPNet
+	for _, n := range networks {
+		if IsHost(n, ip) && !ip.Equal(n.IP) {
+			network = n
+		}
+	}
+	if network == nil {
+		return ErrNotHost
+	}
+
+	reservations, err := a.Store.ListReservations(deviceId)
+	if err != nil {
+		return err
+	}
+
+	var key wg.Key
+	if peer != nil {
+		key = *peer
+	}
+
+	pool, _ := pool(network, reservations, key)
+	pool.AddAllowedIPs(peerIPs(d, key))
+	if pool.Contains(ip) {
+		return persistent.ErrAddressReserved
+	}
+
+	return a.Store.SaveReservations([]persistent.Reservation{{DeviceId: deviceId, IP: ip, PublicKey: peer}})
+}
+
+// Release gives reserved addresses back, whether or not they are pinned to a peer.
+func (a *Allocator) Release(deviceId persistent.DeviceId, ips []net.IP) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.Store.RemoveReservations(deviceId, ips)
+}
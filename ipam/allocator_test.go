@@ -0,0 +1,295 @@
+package ipam
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newKey(v string) wg.Key {
+	return wg.Key(sha256.Sum256([]byte(v)))
+}
+
+func newAllocator(t *testing.T, dsn string, address string) *Allocator {
+	store, err := persistent.NewSqliteRepository(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network, err := utils.ParseCIDRAsIPNet(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.SaveDevices([]wg.Device{{Id: "device1", Name: "wg0", PrivateKey: newKey("device1"), Address: network}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewAllocator(store)
+}
+
+func addPeer(t *testing.T, a *Allocator, name string) net.IP {
+	p, err := a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey(name)})
+	if err != nil {
+		t.Fatalf("AddPeer(%v): %v", name, err)
+	}
+	return p.AllowedIPs[len(p.AllowedIPs)-1].IP
+}
+
+func TestAllocator_AddPeer(t *testing.T) {
+	a := newAllocator(t, "file:ipam_add?cache=shared&mode=memory", "10.0.0.2/29")
+	defer a.Store.Close()
+
+	if err := a.Reserve("device1", net.ParseIP("10.0.0.3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	peer := newKey("pinned")
+	if err := a.Reserve("device1", net.ParseIP("10.0.0.6"), &peer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		name string
+		ip   string
+	}{
+		{name: "peer1", ip: "10.0.0.1"},
+		{name: "peer2", ip: "10.0.0.4"},
+		{name: "pinned", ip: "10.0.0.6"},
+		{name: "peer3", ip: "10.0.0.5"},
+	} {
+		if got := addPeer(t, a, want.name); !got.Equal(net.ParseIP(want.ip)) {
+			t.Errorf("AddPeer(%v) = %v, want %v", want.name, got, want.ip)
+		}
+	}
+
+	if _, err := a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey("peer4")}); err != ErrExhausted {
+		t.Errorf("AddPeer() error = %v, want %v", err, ErrExhausted)
+	}
+
+	if _, err := a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey("peer1")}); err != ErrPeerExists {
+		t.Errorf("AddPeer() error = %v, want %v", err, ErrPeerExists)
+	}
+
+	if err := a.RemovePeers("device1", []wg.Key{newKey("peer2")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := addPeer(t, a, "peer4"); !got.Equal(net.ParseIP("10.0.0.4")) {
+		t.Errorf("AddPeer(peer4) = %v, want the address released by peer2", got)
+	}
+
+	for _, ip := range []string{"10.0.0.0", "10.0.0.2", "10.0.0.7", "10.0.1.1"} {
+		if err := a.Reserve("device1", net.ParseIP(ip), nil); err != ErrNotHost {
+			t.Errorf("Reserve(%v) error = %v, want %v", ip, err, ErrNotHost)
+		}
+	}
+
+	if err := a.Reserve("device1", net.ParseIP("10.0.0.5"), nil); err != persistent.ErrAddressReserved {
+		t.Errorf("Reserve() error = %v, want %v", err, persistent.ErrAddressReserved)
+	}
+}
+
+func TestAllocator_AddPeer_dualStack(t *testing.T) {
+	a := newAllocator(t, "file:ipam_dual_stack?cache=shared&mode=memory", "10.0.0.1/30")
+	defer a.Store.Close()
+
+	if err := a.Store.SetDeviceMeta("device1", persistent.MetaKeyNetworks, "fd00::1/126"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey("peer1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ip := range p.AllowedIPs {
+		got = append(got, ip.String())
+	}
+	if want := []string{"10.0.0.2/32", "fd00::2/128"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AddPeer() AllowedIPs = %v, want %v", got, want)
+	}
+
+	if err = a.Reserve("device1", net.ParseIP("fd00::1"), nil); err != ErrNotHost {
+		t.Errorf("Reserve(fd00::1) error = %v, want %v", err, ErrNotHost)
+	}
+	if err = a.Reserve("device1", net.ParseIP("fd00::3"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IPv4 network is exhausted, so nothing of the IPv6 one is held for a peer that isn't added.
+	if _, err = a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey("peer2")}); err != ErrExhausted {
+		t.Errorf("AddPeer() error = %v, want %v", err, ErrExhausted)
+	}
+	if reservations, err := a.Store.ListReservations("device1"); err != nil || len(reservations) != 3 {
+		t.Errorf("ListReservations() = %+v, %v, want those of peer1 and fd00::3", reservations, err)
+	}
+}
+
+func TestAllocator_savingWithoutPeerReleases(t *testing.T) {
+	a := newAllocator(t, "file:ipam_save_release?cache=shared&mode=memory", "10.0.0.1/30")
+	defer a.Store.Close()
+
+	addPeer(t, a, "peer1")
+
+	devices, err := a.Store.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices[0].Peers = nil
+	if err = a.Store.SaveDevices(devices); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := addPeer(t, a, "peer2"); !got.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("AddPeer(peer2) = %v, want the address released by peer1", got)
+	}
+}
+
+func TestAllocator_AddPeer_concurrently(t *testing.T) {
+	a := newAllocator(t, "file:ipam_concurrent?cache=shared&mode=memory", "fd00::1/112")
+	defer a.Store.Close()
+
+	const count = 20
+	ips := make(chan string, count)
+	var group sync.WaitGroup
+	for i := 0; i < count; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			p, err := a.AddPeer("device1", wg.PeerConfig{PublicKey: newKey(fmt.Sprint("peer", i))})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ips <- p.AllowedIPs[0].IP.String()
+		}(i)
+	}
+	group.Wait()
+	close(ips)
+
+	seen := make(map[string]bool)
+	for ip := range ips {
+		if seen[ip] {
+			t.Errorf("%v handed out twice", ip)
+		}
+		seen[ip] = true
+	}
+}
+
+func TestAllocator_Hold(t *testing.T) {
+	a := newAllocator(t, "file:ipam_hold?cache=shared&mode=memory", "10.0.0.1/29")
+	defer a.Store.Close()
+
+	networks, err := a.Networks("device1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := newKey("pinned")
+	if err = a.Reserve("device1", net.ParseIP("10.0.0.6"), &peer); err != nil {
+		t.Fatal(err)
+	}
+
+	used := fixed([]net.IPNet{HostNet(net.ParseIP("10.0.0.2"))})
+	held, err := a.Hold("device1", networks, used, newKey("peer1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.3"); len(held.IPs) != 1 || !held.IPs[0].Equal(want) {
+		t.Errorf("Hold() = %v, want %v", held.IPs, want)
+	}
+
+	// Until it's released, what's held isn't handed out again.
+	other, err := a.Hold("device1", networks, used, newKey("peer2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.4"); !other.IPs[0].Equal(want) {
+		t.Errorf("Hold() while held = %v, want %v", other.IPs, want)
+	}
+
+	pinned, err := a.Hold("device1", networks, used, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.6"); !pinned.IPs[0].Equal(want) {
+		t.Errorf("Hold() of the pinned peer = %v, want %v", pinned.IPs, want)
+	}
+
+	for _, h := range []*Held{held, other, pinned} {
+		if err = h.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reservation made ahead of the peer is kept.
+	if reservations, err := a.Store.ListReservations("device1"); err != nil || len(reservations) != 1 {
+		t.Errorf("ListReservations() = %+v, %v, want the pinned one", reservations, err)
+	}
+}
+
+func TestAllocator_Hold_withoutStore(t *testing.T) {
+	a := NewAllocator(nil)
+
+	network, err := utils.ParseCIDRAsIPNet("10.0.0.1/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Networks("device1"); err != ErrNoAddress {
+		t.Errorf("Networks() error = %v, want %v", err, ErrNoAddress)
+	}
+
+	held, err := a.Hold("device1", []*net.IPNet{network}, fixed(nil), newKey("peer1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.2"); !held.IPs[0].Equal(want) || held.AllowedIPs()[0].String() != "10.0.0.2/32" {
+		t.Errorf("Hold() = %v, want %v", held.IPs, want)
+	}
+
+	// What's held is kept in memory until it's released.
+	other, err := a.Hold("device1", []*net.IPNet{network}, fixed(nil), newKey("peer2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.3"); !other.IPs[0].Equal(want) {
+		t.Errorf("Hold() while held = %v, want %v", other.IPs, want)
+	}
+
+	for _, h := range []*Held{held, other} {
+		if err = h.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	again, err := a.Hold("device1", []*net.IPNet{network}, fixed(other.AllowedIPs()), newKey("peer3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("10.0.0.2"); !again.IPs[0].Equal(want) {
+		t.Errorf("Hold() once released = %v, want %v", again.IPs, want)
+	}
+
+	small, err := utils.ParseCIDRAsIPNet("10.1.0.1/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Hold("device1", []*net.IPNet{small}, fixed([]net.IPNet{HostNet(net.ParseIP("10.1.0.2"))}), newKey("peer4")); err != ErrExhausted {
+		t.Errorf("Hold() error = %v, want %v", err, ErrExhausted)
+	}
+}
+
+// fixed gives the used addresses of Hold.
+func fixed(used []net.IPNet) func() ([]net.IPNet, error) {
+	return func() ([]net.IPNet, error) {
+		return used, nil
+	}
+}
@@ -0,0 +1,160 @@
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"net"
+)
+
+var (
+	ErrExhausted = errors.New("no free address left in the network")
+)
+
+// normalise returns the network with its IP masked and in the same length as its mask.
+func normalise(network *net.IPNet) net.IPNet {
+	ip := network.IP
+	if len(network.Mask) == net.IPv4len {
+		ip = ip.To4()
+	}
+
+	return net.IPNet{IP: ip.Mask(network.Mask), Mask: network.Mask}
+}
+
+// sameLength gives ip in the length of network's IP, or nil if it's of another family.
+func sameLength(network net.IPNet, ip net.IP) net.IP {
+	if len(network.IP) == net.IPv4len {
+		return ip.To4()
+	}
+
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+func broadcast(network net.IPNet) net.IP {
+	ret := make(net.IP, len(network.IP))
+	for i := range ret {
+		ret[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ret
+}
+
+func next(ip net.IP) net.IP {
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i]++
+		if ret[i] != 0 {
+			break
+		}
+	}
+	return ret
+}
+
+// IsHost tells whether ip can be handed out in network: it must be inside, and neither the network address nor,
+// for IPv4, the broadcast address. IPv4 /31 and /32 networks have no such addresses to skip.
+func IsHost(network *net.IPNet, ip net.IP) bool {
+	n := normalise(network)
+	if ip = sameLength(n, ip); ip == nil || !n.Contains(ip) {
+		return false
+	}
+
+	if ones, bits := n.Mask.Size(); bits == 8*net.IPv4len && ones >= 31 {
+		return true
+	}
+
+	if ip.Equal(n.IP) {
+		return false
+	}
+
+	return len(n.IP) != net.IPv4len || !ip.Equal(broadcast(n))
+}
+
+// NextFree finds the lowest host address in network that's not used.
+func NextFree(network *net.IPNet, used func(ip net.IP) bool) (net.IP, error) {
+	n := normalise(network)
+	last := broadcast(n)
+
+	for ip := n.IP; ; ip = next(ip) {
+		if IsHost(&n, ip) && !used(ip) {
+			return ip, nil
+		}
+
+		if bytes.Equal(ip, last) {
+			return nil, ErrExhausted
+		}
+	}
+}
+
+// HostNet gives the network that is just ip: a /32 for IPv4 or a /128 for IPv6.
+func HostNet(ip net.IP) net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return net.IPNet{IP: v4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+
+	return net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
+
+// Taken collects the addresses of a network that can't be handed out.
+type Taken struct {
+	network   net.IPNet
+	addresses map[string]bool
+	routed    []net.IPNet
+}
+
+func NewTaken(network *net.IPNet) *Taken {
+	return &Taken{network: normalise(network), addresses: make(map[string]bool)}
+}
+
+func (t *Taken) Add(ip net.IP) {
+	t.addresses[ip.String()] = true
+}
+
+// AddAllowedIPs takes the addresses a peer is routed. Networks as wide as the device's or wider, such as a catch
+// all, are left out since every address would be taken otherwise.
+func (t *Taken) AddAllowedIPs(ips []net.IPNet) {
+	networkOnes, _ := t.network.Mask.Size()
+	for _, ip := range ips {
+		if ones, _ := ip.Mask.Size(); ones > networkOnes && t.network.Contains(ip.IP) {
+			t.routed = append(t.routed, ip)
+		}
+	}
+}
+
+func (t *Taken) Contains(ip net.IP) bool {
+	if t.addresses[ip.String()] {
+		return true
+	}
+
+	for _, r := range t.routed {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pool hands out the free host addresses of a network, the lowest first. The IP of the network, which is the device's
+// own address when it's given as 10.0.0.1/24, is never handed out.
+type Pool struct {
+	*Taken
+	network net.IPNet
+}
+
+func NewPool(network *net.IPNet) *Pool {
+	p := &Pool{Taken: NewTaken(network), network: *network}
+	p.Add(network.IP)
+	return p
+}
+
+// Next gives the lowest free host address, and takes it.
+func (p *Pool) Next() (net.IP, error) {
+	ip, err := NextFree(&p.network, p.Contains)
+	if err == nil {
+		p.Add(ip)
+	}
+	return ip, err
+}
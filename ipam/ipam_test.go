@@ -0,0 +1,101 @@
+package ipam
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNextFree(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		used    []string
+		want    string
+		wantErr error
+	}{
+		{name: "first host", network: "10.0.0.1/24", want: "10.0.0.1"},
+		{name: "skips used", network: "10.0.0.1/24", used: []string{"10.0.0.1", "10.0.0.2"}, want: "10.0.0.3"},
+		{name: "fills gaps", network: "10.0.0.0/24", used: []string{"10.0.0.1", "10.0.0.3"}, want: "10.0.0.2"},
+		{name: "carries over", network: "10.0.0.0/16", used: []string{"10.0.0.1", "10.0.0.254", "10.0.0.255"}, want: "10.0.0.2"},
+		{
+			name:    "skips broadcast",
+			network: "10.0.0.0/30",
+			used:    []string{"10.0.0.1", "10.0.0.2"},
+			wantErr: ErrExhausted,
+		},
+		{name: "point to point", network: "10.0.0.0/31", used: []string{"10.0.0.0"}, want: "10.0.0.1"},
+		{name: "ipv6", network: "fd00::1/64", used: []string{"fd00::1"}, want: "fd00::2"},
+		{name: "ipv6 last address", network: "fd00::/127", used: []string{"fd00::"}, want: "fd00::1"},
+		{name: "ipv6 exhausted", network: "fd00::/127", used: []string{"fd00::1"}, wantErr: ErrExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, network, _ := net.ParseCIDR(tt.network)
+			used := make(map[string]bool)
+			for _, u := range tt.used {
+				used[net.ParseIP(u).String()] = true
+			}
+
+			got, err := NextFree(network, func(ip net.IP) bool { return used[ip.String()] })
+			if err != tt.wantErr {
+				t.Fatalf("NextFree() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("NextFree() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaken_Contains(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	taken := NewTaken(network)
+	taken.Add(net.ParseIP("10.0.0.1"))
+
+	var allowed []net.IPNet
+	for _, s := range []string{"10.0.0.16/30", "0.0.0.0/0", "10.0.0.0/24", "192.168.0.0/16"} {
+		_, n, _ := net.ParseCIDR(s)
+		allowed = append(allowed, *n)
+	}
+	taken.AddAllowedIPs(allowed)
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.0.0.1", want: true},
+		{ip: "10.0.0.2", want: false},
+		{ip: "10.0.0.17", want: true},
+		{ip: "10.0.0.20", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := taken.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_Next(t *testing.T) {
+	ip, network, _ := net.ParseCIDR("10.0.0.2/29")
+	network.IP = ip
+	pool := NewPool(network)
+	pool.Add(net.ParseIP("10.0.0.3"))
+
+	var got []string
+	for {
+		ip, err := pool.Next()
+		if err == ErrExhausted {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ip.String())
+	}
+
+	if want := []string{"10.0.0.1", "10.0.0.4", "10.0.0.5", "10.0.0.6"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+}
@@ -1,136 +1,33 @@
 package main
 
 import (
-	"log"
-	"nz.cloudwalker/wireguard-webadmin/utils"
-	"nz.cloudwalker/wireguard-webadmin/wg"
-	"time"
+	"os"
 )
 
-//func syncRepositoryToWireguard(repository repo.Repository) error {
-//	log.Println("Syncing repository to wireguard")
-//	var result []repo.PeerInfo
-//	var err error
-//	if result, _, err = repository.ListPeers(0, 0); err != nil {
-//		return err
-//	}
-//
-//	log.Print("Got peers:", result)
-//	return nil
-//}
-
 func main() {
-	//repository, err := sqlite.NewSqliteRepository("file:test.db?cache=shared&mode=memory")
-	//repository := repo.NewMemRepository()
-	//
-	//defer repository.Close()
-	//
-	//closed := make(chan interface{}, 1)
-	//finished := make(chan interface{}, 1)
-	//changes := make(chan interface{}, 1)
-	//
-	//repository.AddChangeNotification(changes)
-
-	//go func() {
-	//	defer func() {
-	//		if e := recover(); e != nil {
-	//			log.Println("Error syncing repository:", e)
-	//		}
-	//		finished <- nil
-	//	}()
-	//
-	//	if err := syncRepositoryToWireguard(repository); err != nil {
-	//		panic(err)
-	//	}
-	//
-	//L:
-	//	for {
-	//		select {
-	//		case _ = <-closed:
-	//			{
-	//				break L
-	//			}
-	//
-	//		case _ = <-changes:
-	//			{
-	//				if err := syncRepositoryToWireguard(repository); err != nil {
-	//					panic(err)
-	//				}
-	//			}
-	//		}
-	//	}
-	//}()
-
-	//go func() {
-	//	key, _ := wgtypes.GeneratePrivateKey()
-	//
-	//	peers := []repo.PeerInfo{
-	//		{
-	//			PublicKey: key.PublicKey().String(),
-	//			Name:      "First device",
-	//		},
-	//	}
-	//
-	//	if err := repository.UpdatePeers(peers); err != nil {
-	//		panic(err)
-	//	}
-	//}()
-
-	//httpApi, err := api.NewHttpApi(repository)
-	//if err != nil {
-	//	panic(err)
-	//}
-	//
-	//if err := http.ListenAndServe("localhost:9090", cors.Default().Handler(httpApi)); err != nil {
-	//	log.Printf("error serving http: %v", err)
-	//}
-	//
-	//closed <- nil
-	//<-finished
-
-	client, err := wg.NewTunClient()
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "drift" {
+		os.Exit(runDrift(os.Args[2:]))
 	}
 
-	defer client.Close()
-
-	key, err := wg.NewRandom()
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
 	}
 
-	cidr, err := utils.ParseCIDRAsIPNet("192.168.30.1/24")
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(runBackup(os.Args[2:]))
 	}
 
-	device, err := client.Up("123", wg.DeviceConfig{
-		Name:       "first device",
-		PrivateKey: key,
-		ListenPort: 12356,
-		Address:    cidr,
-	})
-
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:]))
 	}
 
-	err = client.Configure(device.Id, func(config *wg.DeviceConfig) error {
-		config.Peers = []wg.PeerConfig{
-			{
-				PublicKey:           wg.Key{},
-				Endpoint:            nil,
-				AllowedIPs:          nil,
-				PersistentKeepAlive: 25 * time.Second,
-			},
-		}
-		return nil
-	})
+	if len(os.Args) > 1 && os.Args[1] == "rotate-key" {
+		os.Exit(runRotateKey(os.Args[2:]))
+	}
 
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Exit(runServe(os.Args[2:]))
 	}
 
-	log.Println("Got new device:", device)
+	os.Exit(runServe(os.Args[1:]))
 }
@@ -0,0 +1,388 @@
+package peercsv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"sort"
+	"strings"
+)
+
+// Columns are the columns of the CSV, in the order Export writes them. Import takes them in any order, by the header,
+// and only needs name and device.
+var Columns = []string{"name", "device", "public_key", "ip", "tags"}
+
+// listSeparator separates the addresses of the ip column and the tags of the tags column.
+const listSeparator = ";"
+
+type RowError struct {
+	// Row is the record of the CSV, the header being 1, and 0 for problems with the CSV as a whole.
+	Row     int
+	Problem string
+}
+
+// InvalidCSVError lists every row that can't be imported, so that they can all be fixed at once.
+type InvalidCSVError struct {
+	Rows []RowError
+}
+
+func (e *InvalidCSVError) Error() string {
+	problems := make([]string, 0, len(e.Rows))
+	for _, r := range e.Rows {
+		if r.Row > 0 {
+			problems = append(problems, fmt.Sprintf("row %v: %v", r.Row, r.Problem))
+		} else {
+			problems = append(problems, r.Problem)
+		}
+	}
+	return fmt.Sprintf("invalid CSV: %v", strings.Join(problems, "; "))
+}
+
+// Imported is a peer the import added, with the private key generated for it when its row had no public key. The
+// private key is kept nowhere else.
+type Imported struct {
+	Row        int
+	Peer       repo.PeerInfo
+	PrivateKey repo.PrivateKey
+}
+
+type row struct {
+	line   int
+	fields map[string]string
+}
+
+// readRows reads the rows of the CSV by the columns of its header.
+func readRows(in io.Reader) ([]row, error) {
+	reader := csv.NewReader(in)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &InvalidCSVError{Rows: []RowError{{Problem: "the CSV is empty"}}}
+	} else if err != nil {
+		return nil, &InvalidCSVError{Rows: []RowError{{Row: 1, Problem: err.Error()}}}
+	}
+
+	known := make(map[string]bool, len(Columns))
+	for _, c := range Columns {
+		known[c] = true
+	}
+
+	var problems []RowError
+	seen := make(map[string]bool, len(header))
+	for i, c := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(c))
+		if !known[header[i]] {
+			problems = append(problems, RowError{Row: 1, Problem: fmt.Sprintf("unknown column %q", c)})
+		} else if seen[header[i]] {
+			problems = append(problems, RowError{Row: 1, Problem: fmt.Sprintf("column %q is there twice", c)})
+		}
+		seen[header[i]] = true
+	}
+
+	for _, c := range []string{"name", "device"} {
+		if !seen[c] {
+			problems = append(problems, RowError{Row: 1, Problem: fmt.Sprintf("column %q is missing", c)})
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &InvalidCSVError{Rows: problems}
+	}
+
+	var ret []row
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &InvalidCSVError{Rows: []RowError{{Row: line, Problem: err.Error()}}}
+		}
+
+		r := row{line: line, fields: make(map[string]string, len(header))}
+		for i, c := range header {
+			r.fields[c] = strings.TrimSpace(record[i])
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// splitList splits a column holding a list, giving nil for an empty one.
+func splitList(s string) (ret []string) {
+	for _, v := range strings.Split(s, listSeparator) {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			ret = append(ret, v)
+		}
+	}
+	return
+}
+
+// parseIPs reads the ip column, where an address without a prefix length is just that address.
+func parseIPs(s string) ([]net.IPNet, error) {
+	var ret []net.IPNet
+	for _, v := range splitList(s) {
+		if ip := net.ParseIP(v); ip != nil {
+			ret = append(ret, ipam.HostNet(ip))
+		} else if _, n, err := net.ParseCIDR(v); err != nil {
+			return nil, fmt.Errorf("invalid ip %q", v)
+		} else {
+			ret = append(ret, *n)
+		}
+	}
+	return ret, nil
+}
+
+func formatIPs(ips []net.IPNet) string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ones, bits := ip.Mask.Size(); ones == bits {
+			ret = append(ret, ip.IP.String())
+		} else {
+			ret = append(ret, ip.String())
+		}
+	}
+	return strings.Join(ret, listSeparator)
+}
+
+func overlaps(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// importer checks the rows against the repository and each other as it goes.
+type importer struct {
+	devices map[string]bool
+	keys    map[string]map[repo.PublicKey]bool
+	// used are the AllowedIPs of each device, of its peers and of the rows taken so far.
+	used map[string][]net.IPNet
+	// held are the addresses allocated to the rows, held until they're imported.
+	held     []*ipam.Held
+	problems []RowError
+}
+
+func (im *importer) problem(line int, format string, args ...interface{}) {
+	im.problems = append(im.problems, RowError{Row: line, Problem: fmt.Sprintf(format, args...)})
+}
+
+func newImporter(r repo.Repository) (*importer, error) {
+	devices, err := r.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		devices: make(map[string]bool, len(devices)),
+		keys:    make(map[string]map[repo.PublicKey]bool, len(devices)),
+		used:    make(map[string][]net.IPNet, len(devices)),
+	}
+
+	names := make([]string, 0, len(devices))
+	for _, d := range devices {
+		im.devices[d.Name] = true
+		im.keys[d.Name] = make(map[repo.PublicKey]bool)
+		names = append(names, d.Name)
+	}
+
+	peers, _, err := r.ListPeersByDevices(names, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range peers {
+		im.keys[p.DeviceName][p.PublicKey] = true
+		im.used[p.DeviceName] = append(im.used[p.DeviceName], p.AllowedIPs...)
+	}
+	return im, nil
+}
+
+// read checks a row and gives its peer, ok false if it has problems. The peer has no AllowedIPs if the row has no ip.
+func (im *importer) read(r row) (ret Imported, ok bool) {
+	problems := len(im.problems)
+	ret = Imported{
+		Row: r.line,
+		Peer: repo.PeerInfo{
+			Name:       r.fields["name"],
+			DeviceName: r.fields["device"],
+			Tags:       splitList(r.fields["tags"]),
+		},
+	}
+
+	deviceName := ret.Peer.DeviceName
+	if len(ret.Peer.Name) == 0 {
+		im.problem(r.line, "the name is missing")
+	}
+
+	if !im.devices[deviceName] {
+		im.problem(r.line, "there is no device %q", deviceName)
+	}
+
+	if len(r.fields["public_key"]) == 0 {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			im.problem(r.line, "unable to generate a key: %v", err)
+		} else {
+			ret.PrivateKey = repo.NewPrivateKey(k)
+			ret.Peer.PublicKey = repo.NewPublicKey(k.PublicKey())
+		}
+	} else if err := ret.Peer.PublicKey.Scan(r.fields["public_key"]); err != nil {
+		im.problem(r.line, "invalid public key %q", r.fields["public_key"])
+	} else if im.keys[deviceName][ret.Peer.PublicKey] {
+		im.problem(r.line, "device %v already has the peer %v", deviceName, ret.Peer.PublicKey)
+	}
+
+	ips, err := parseIPs(r.fields["ip"])
+	if err != nil {
+		im.problem(r.line, "%v", err)
+	}
+
+	for _, ip := range ips {
+		for _, u := range im.used[deviceName] {
+			if overlaps(ip, u) {
+				im.problem(r.line, "ip %v is already taken on device %v", ip.String(), deviceName)
+				break
+			}
+		}
+	}
+
+	if len(im.problems) > problems {
+		return ret, false
+	}
+
+	ret.Peer.AllowedIPs = ips
+	im.keys[deviceName][ret.Peer.PublicKey] = true
+	im.used[deviceName] = append(im.used[deviceName], ips...)
+	return ret, true
+}
+
+// allocate gives the peer the next free address of the network of its device, held by the allocator until the
+// import is over. The peers stored since the import began are left out too.
+func (im *importer) allocate(r repo.Repository, a *ipam.Allocator, p *Imported, networks map[string]net.IPNet) {
+	deviceName := p.Peer.DeviceName
+	network, ok := networks[deviceName]
+	if !ok {
+		im.problem(p.Row, "no ip is given, and device %v has no network to allocate one from", deviceName)
+		return
+	}
+
+	key, err := p.Peer.PublicKey.ToKey()
+	if err != nil {
+		im.problem(p.Row, "invalid public key %q", p.Peer.PublicKey)
+		return
+	}
+
+	used := func() ([]net.IPNet, error) {
+		stored, err := repo.DeviceAddresses(r, deviceName)
+		return append(stored, im.used[deviceName]...), err
+	}
+
+	held, err := a.Hold(persistent.DeviceId(deviceName), []*net.IPNet{&network}, used, wg.Key(key))
+	if err != nil {
+		im.problem(p.Row, "unable to allocate an ip on device %v: %v", deviceName, err)
+		return
+	}
+
+	im.held = append(im.held, held)
+	p.Peer.AllowedIPs = held.AllowedIPs()
+	im.used[deviceName] = append(im.used[deviceName], p.Peer.AllowedIPs...)
+}
+
+// apply adds the peers a device at a time, removing those it added already when a device fails so that the import
+// is all or nothing.
+func apply(r repo.Repository, imported []Imported) error {
+	byDevice := make(map[string][]repo.PeerInfo)
+	for _, p := range imported {
+		byDevice[p.Peer.DeviceName] = append(byDevice[p.Peer.DeviceName], p.Peer)
+	}
+
+	names := make([]string, 0, len(byDevice))
+	for name := range byDevice {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if err := r.UpdatePeers(name, byDevice[name]); err != nil {
+			for _, done := range names[:i] {
+				keys := make([]repo.PublicKey, 0, len(byDevice[done]))
+				for _, p := range byDevice[done] {
+					keys = append(keys, p.PublicKey)
+				}
+				_ = r.RemovePeers(done, keys)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Import adds the peers of the CSV to the repository, all of them or, if any row has a problem, none, failing with an
+// *InvalidCSVError that lists every problem. Rows without a public key get a new key pair, and rows without an ip
+// the next free address of the network of their device from the allocator, whose IP is the address of the device
+// itself, as in 10.0.0.1/24. The addresses given are allocated first, so that they're not handed out to the rows
+// without one.
+func Import(r repo.Repository, a *ipam.Allocator, in io.Reader, networks map[string]net.IPNet) ([]Imported, error) {
+	rows, err := readRows(in)
+	if err != nil {
+		return nil, err
+	}
+
+	im, err := newImporter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, h := range im.held {
+			_ = h.Release()
+		}
+	}()
+
+	ret := make([]Imported, 0, len(rows))
+	for _, row := range rows {
+		if p, ok := im.read(row); ok {
+			ret = append(ret, p)
+		}
+	}
+
+	for i := range ret {
+		if len(ret[i].Peer.AllowedIPs) == 0 {
+			im.allocate(r, a, &ret[i], networks)
+		}
+	}
+
+	if len(im.problems) > 0 {
+		sort.SliceStable(im.problems, func(i, j int) bool {
+			return im.problems[i].Row < im.problems[j].Row
+		})
+		return nil, &InvalidCSVError{Rows: im.problems}
+	}
+
+	if err = apply(r, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Export writes the peers as CSV, in the columns Import reads.
+func Export(out io.Writer, peers []repo.PeerInfo) error {
+	writer := csv.NewWriter(out)
+	if err := writer.Write(Columns); err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		record := []string{p.Name, p.DeviceName, p.PublicKey.String(), formatIPs(p.AllowedIPs), strings.Join(p.Tags, listSeparator)}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
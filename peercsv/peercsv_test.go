@@ -0,0 +1,220 @@
+package peercsv
+
+import (
+	"bytes"
+	"errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func genKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mustParseNetwork(t *testing.T, s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.IP = ip
+	return *n
+}
+
+// newRepo has wg0 with carol on 10.0.0.2, and an empty wg1.
+func newRepo(t *testing.T) (repo.Repository, repo.PeerInfo) {
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0"}, {Name: "wg1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	carol := repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "carol", AllowedIPs: []net.IPNet{mustParseNetwork(t, "10.0.0.2/32")}}
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{carol}); err != nil {
+		t.Fatal(err)
+	}
+	return r, carol
+}
+
+func listPeers(t *testing.T, r repo.Repository) map[string]repo.PeerInfo {
+	peers, _, err := r.ListPeers(repo.PeerFilter{}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListPeers():", err)
+	}
+
+	ret := make(map[string]repo.PeerInfo, len(peers))
+	for _, p := range peers {
+		ret[p.Name] = p
+	}
+	return ret
+}
+
+func TestImport(t *testing.T) {
+	r, _ := newRepo(t)
+	bob := repo.NewPublicKey(genKey(t).PublicKey())
+
+	// The columns come in any order, and carol's address isn't handed out again.
+	in := "Device, name, tags, public_key\n" +
+		"wg0, dave, sales;laptop,\n" +
+		"wg1, bob, ," + bob.String() + "\n"
+	networks := map[string]net.IPNet{"wg0": mustParseNetwork(t, "10.0.0.1/24"), "wg1": mustParseNetwork(t, "10.1.0.1/24")}
+
+	imported, err := Import(r, ipam.NewAllocator(nil), strings.NewReader(in), networks)
+	if err != nil {
+		t.Fatal("Import():", err)
+	}
+
+	if len(imported) != 2 || imported[0].Row != 2 || len(imported[0].PrivateKey.String()) == 0 || len(imported[1].PrivateKey.String()) != 0 {
+		t.Fatalf("Import() = %+v, want dave with a private key and bob without", imported)
+	}
+
+	private, err := imported[0].PrivateKey.ToKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := listPeers(t, r)
+	dave, b := peers["dave"], peers["bob"]
+	if dave.PublicKey != repo.NewPublicKey(private.PublicKey()) || dave.AllowedIPs[0].String() != "10.0.0.3/32" ||
+		!reflect.DeepEqual(dave.Tags, []string{"laptop", "sales"}) {
+		t.Errorf("dave = %+v, want the generated key on 10.0.0.3", dave)
+	}
+
+	if b.PublicKey != bob || b.DeviceName != "wg1" || b.AllowedIPs[0].String() != "10.1.0.2/32" {
+		t.Errorf("bob = %+v, want his key on 10.1.0.2", b)
+	}
+}
+
+func TestImport_reserved(t *testing.T) {
+	r, _ := newRepo(t)
+	store, err := persistent.NewSqliteRepository("file:peercsv_reserved?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	a := ipam.NewAllocator(store)
+	if err = store.SaveReservations([]persistent.Reservation{{DeviceId: "wg0", IP: net.ParseIP("10.0.0.3")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	in := "name,device\ndave,wg0\n"
+	if _, err = Import(r, a, strings.NewReader(in), map[string]net.IPNet{"wg0": mustParseNetwork(t, "10.0.0.1/24")}); err != nil {
+		t.Fatal("Import():", err)
+	}
+
+	if dave := listPeers(t, r)["dave"]; dave.AllowedIPs[0].String() != "10.0.0.4/32" {
+		t.Errorf("dave = %+v, want him past the reserved 10.0.0.3", dave)
+	}
+
+	// What was held for dave is his by his AllowedIPs now.
+	if reservations, err := store.ListReservations("wg0"); err != nil || len(reservations) != 1 {
+		t.Errorf("ListReservations() = %+v, %v, want 10.0.0.3 only", reservations, err)
+	}
+}
+
+func TestImport_Invalid(t *testing.T) {
+	r, carol := newRepo(t)
+	in := "name,device,public_key,ip\n" +
+		"alice,wg0,,10.0.0.5\n" +
+		",wg9,nope,\n" +
+		"carol,wg0," + carol.PublicKey.String() + ",10.0.0.2\n" +
+		"bob,wg0,,10.0.0.5/32\n" +
+		"eve,wg1,,\n" +
+		"frank,wg0,,10.0.0.300\n"
+
+	_, err := Import(r, ipam.NewAllocator(nil), strings.NewReader(in), map[string]net.IPNet{"wg0": mustParseNetwork(t, "10.0.0.1/24")})
+	invalid, ok := err.(*InvalidCSVError)
+	if !ok {
+		t.Fatalf("Import() error = %v, want an *InvalidCSVError", err)
+	}
+
+	want := []RowError{
+		{Row: 3, Problem: "the name is missing"},
+		{Row: 3, Problem: `there is no device "wg9"`},
+		{Row: 3, Problem: `invalid public key "nope"`},
+		{Row: 4, Problem: "device wg0 already has the peer " + carol.PublicKey.String()},
+		{Row: 4, Problem: "ip 10.0.0.2/32 is already taken on device wg0"},
+		{Row: 5, Problem: "ip 10.0.0.5/32 is already taken on device wg0"},
+		{Row: 6, Problem: "no ip is given, and device wg1 has no network to allocate one from"},
+		{Row: 7, Problem: `invalid ip "10.0.0.300"`},
+	}
+	if !reflect.DeepEqual(invalid.Rows, want) {
+		t.Errorf("problems = %v, want %v", invalid.Rows, want)
+	}
+
+	if peers := listPeers(t, r); len(peers) != 1 {
+		t.Errorf("peers = %v, want carol only", peers)
+	}
+
+	if _, err = Import(r, ipam.NewAllocator(nil), strings.NewReader("name,ip,colour\n"), nil); err == nil || !strings.Contains(err.Error(), `unknown column "colour"`) ||
+		!strings.Contains(err.Error(), `column "device" is missing`) {
+		t.Errorf("Import() of a bad header error = %v", err)
+	}
+}
+
+// failingRepo fails to update the peers of one device.
+type failingRepo struct {
+	repo.Repository
+	device string
+}
+
+var errFailed = errors.New("failed")
+
+func (f failingRepo) UpdatePeers(deviceName string, peers []repo.PeerInfo) error {
+	if deviceName == f.device {
+		return errFailed
+	}
+	return f.Repository.UpdatePeers(deviceName, peers)
+}
+
+func TestImport_AllOrNothing(t *testing.T) {
+	r, _ := newRepo(t)
+	in := "name,device,ip\nalice,wg0,10.0.0.5\nbob,wg1,10.1.0.5\n"
+
+	if _, err := Import(failingRepo{Repository: r, device: "wg1"}, ipam.NewAllocator(nil), strings.NewReader(in), nil); err != errFailed {
+		t.Fatalf("Import() error = %v, want %v", err, errFailed)
+	}
+
+	if peers := listPeers(t, r); len(peers) != 1 {
+		t.Errorf("peers = %v, want carol only", peers)
+	}
+}
+
+func TestExport(t *testing.T) {
+	r, carol := newRepo(t)
+	carol.AllowedIPs = append(carol.AllowedIPs, mustParseNetwork(t, "192.168.0.0/24"))
+	carol.Tags = []string{"a", "b"}
+	carol.Revision = 0
+
+	var out bytes.Buffer
+	if err := Export(&out, []repo.PeerInfo{carol}); err != nil {
+		t.Fatal("Export():", err)
+	}
+
+	want := "name,device,public_key,ip,tags\ncarol,wg0," + carol.PublicKey.String() + ",10.0.0.2;192.168.0.0/24,a;b\n"
+	if out.String() != want {
+		t.Errorf("Export() = %q, want %q", out.String(), want)
+	}
+
+	// What's exported imports back.
+	if err := r.RemovePeers("wg0", []repo.PublicKey{carol.PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Import(r, ipam.NewAllocator(nil), &out, nil); err != nil {
+		t.Fatal("Import():", err)
+	}
+
+	if c := listPeers(t, r)["carol"]; formatIPs(c.AllowedIPs) != formatIPs(carol.AllowedIPs) || !reflect.DeepEqual(c.Tags, carol.Tags) {
+		t.Errorf("carol = %+v, want %+v", c, carol)
+	}
+}
@@ -0,0 +1,193 @@
+package persistent
+
+import (
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"time"
+)
+
+// BackupVersion is the version of the documents Backup writes. Restore takes documents up to this version.
+const BackupVersion = 1
+
+// RestoreMode tells what a restore does with what's stored already.
+type RestoreMode int
+
+const (
+	// RestoreMerge replaces the devices of the document, with everything they have, and keeps the other devices.
+	RestoreMerge RestoreMode = 0
+	// RestoreReplace makes the store hold exactly what the document has.
+	RestoreReplace RestoreMode = 1
+)
+
+var restoreModeNames = map[string]RestoreMode{
+	"merge":   RestoreMerge,
+	"replace": RestoreReplace,
+}
+
+func ParseRestoreMode(v string) (RestoreMode, error) {
+	if m, ok := restoreModeNames[v]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown restore mode %q", v)
+}
+
+// Backup is a document holding the whole store, secrets included, meant to be kept as JSON. Keys are in hex, as
+// they are stored, and the keepalive is in seconds.
+type Backup struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Devices   []BackupDevice `json:"devices"`
+	Fields    []MetaField    `json:"fields,omitempty"`
+}
+
+type BackupDevice struct {
+	Id           string              `json:"id"`
+	Name         string              `json:"name"`
+	PrivateKey   wg.Key              `json:"private_key"`
+	ListenPort   uint16              `json:"listen_port"`
+	Address      string              `json:"address,omitempty"`
+	Meta         map[string]string   `json:"meta,omitempty"`
+	Peers        []BackupPeer        `json:"peers"`
+	Reservations []BackupReservation `json:"reservations,omitempty"`
+}
+
+type BackupPeer struct {
+	PublicKey           wg.Key            `json:"public_key"`
+	PreSharedKey        *wg.Key           `json:"pre_shared_key,omitempty"`
+	Endpoint            string            `json:"endpoint,omitempty"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	PersistentKeepAlive int64             `json:"persistent_keep_alive"`
+	Meta                map[string]string `json:"meta,omitempty"`
+}
+
+type BackupReservation struct {
+	IP        string  `json:"ip"`
+	PublicKey *wg.Key `json:"public_key,omitempty"`
+}
+
+// InvalidBackupError tells what's wrong with a document that can't be restored.
+type InvalidBackupError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidBackupError) Error() string {
+	return fmt.Sprintf("invalid backup: %v: %v", e.Field, e.Reason)
+}
+
+func invalidBackup(field string, format string, args ...interface{}) error {
+	return &InvalidBackupError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks the whole document, so that a restore doesn't stop half way.
+func (b Backup) Validate() error {
+	if b.Version < 1 || b.Version > BackupVersion {
+		return invalidBackup("version", "version %v is not supported", b.Version)
+	}
+
+	ids := make(map[string]bool, len(b.Devices))
+	for i, d := range b.Devices {
+		field := fmt.Sprintf("devices[%v]", i)
+		if err := d.validate(field); err != nil {
+			return err
+		}
+
+		if ids[d.Id] {
+			return invalidBackup(field+".id", "device %v is there twice", d.Id)
+		}
+		ids[d.Id] = true
+
+		if err := validateBackupMeta(b.Fields, MetaDevice, field+".meta", d.Meta); err != nil {
+			return err
+		}
+
+		for j, p := range d.Peers {
+			if err := validateBackupMeta(b.Fields, MetaPeer, fmt.Sprintf("%v.peers[%v].meta", field, j), p.Meta); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, f := range b.Fields {
+		if err := f.Validate(); err != nil {
+			return invalidBackup(fmt.Sprintf("fields[%v]", i), "%v", err)
+		}
+	}
+
+	return nil
+}
+
+// validateBackupMeta checks that the metadata of the document fits the fields of the document.
+func validateBackupMeta(fields []MetaField, entity MetaEntity, field string, meta map[string]string) error {
+	typed := make(map[MetaKey]string, len(meta))
+	for k, v := range meta {
+		typed[MetaKey(k)] = v
+	}
+
+	if _, err := NormaliseMeta(fields, entity, typed); err != nil {
+		return invalidBackup(field, "%v", err)
+	}
+	return nil
+}
+
+func (d BackupDevice) validate(field string) error {
+	if len(d.Id) == 0 {
+		return invalidBackup(field+".id", "missing")
+	}
+
+	if d.PrivateKey.IsZero() {
+		return invalidBackup(field+".private_key", "missing")
+	}
+
+	if len(d.Address) > 0 {
+		if _, _, err := net.ParseCIDR(d.Address); err != nil {
+			return invalidBackup(field+".address", "%v", err)
+		}
+	}
+
+	keys := make(map[wg.Key]bool, len(d.Peers))
+	for i, p := range d.Peers {
+		peerField := fmt.Sprintf("%v.peers[%v]", field, i)
+		if p.PublicKey.IsZero() {
+			return invalidBackup(peerField+".public_key", "missing")
+		}
+
+		if keys[p.PublicKey] {
+			return invalidBackup(peerField+".public_key", "peer %v is there twice", p.PublicKey)
+		}
+		keys[p.PublicKey] = true
+
+		if len(p.Endpoint) > 0 {
+			if _, err := net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+				return invalidBackup(peerField+".endpoint", "%v", err)
+			}
+		}
+
+		for _, ip := range p.AllowedIPs {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return invalidBackup(peerField+".allowed_ips", "%v", err)
+			}
+		}
+
+		if p.PersistentKeepAlive < 0 {
+			return invalidBackup(peerField+".persistent_keep_alive", "negative")
+		}
+	}
+
+	ips := make(map[string]bool, len(d.Reservations))
+	for i, r := range d.Reservations {
+		reservationField := fmt.Sprintf("%v.reservations[%v].ip", field, i)
+		ip := net.ParseIP(r.IP)
+		if ip == nil {
+			return invalidBackup(reservationField, "invalid ip %q", r.IP)
+		}
+
+		if ips[ip.String()] {
+			return invalidBackup(reservationField, "%v is there twice", ip)
+		}
+		ips[ip.String()] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package persistent
+
+import (
+	"encoding/json"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newBackupStore(t *testing.T, name string) Repository {
+	store, err := NewSqliteRepository("file:backup_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func backupDevice(id string, peers ...string) wg.Device {
+	d := wg.Device{
+		Id:         id,
+		Name:       id,
+		PrivateKey: newKeyFromString(id),
+		ListenPort: 51820,
+		Address:    &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+	}
+
+	for i, p := range peers {
+		d.Peers = append(d.Peers, wg.Peer{PeerConfig: wg.PeerConfig{
+			PublicKey:           newKeyFromString(p),
+			PreSharedKey:        newKeyFromString("psk" + p),
+			AllowedIPs:          []net.IPNet{{IP: net.IPv4(10, 0, 0, byte(2+i)).To4(), Mask: net.CIDRMask(32, 32)}},
+			PersistentKeepAlive: 25 * time.Second,
+		}})
+	}
+	return d
+}
+
+func fillBackupStore(t *testing.T, store Repository, devices ...wg.Device) {
+	if err := store.SaveDevices(devices); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range devices {
+		if err := store.SetDeviceMeta(DeviceId(d.Id), "site", "hq-"+d.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range d.Peers {
+			id := PeerId{DeviceId: DeviceId(d.Id), PublicKey: p.PublicKey}
+			if err := store.SetPeerMeta(id, MetaKeyName, "name-"+p.PublicKey.String()[:8]); err != nil {
+				t.Fatal(err)
+			}
+
+			key := p.PublicKey
+			err := store.SaveReservations([]Reservation{{DeviceId: DeviceId(d.Id), IP: p.AllowedIPs[0].IP, PublicKey: &key}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func deviceIds(t *testing.T, store Repository) (ret []string) {
+	devices, err := store.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range devices {
+		ret = append(ret, d.Id)
+	}
+
+	sort.Strings(ret)
+	return
+}
+
+func TestSqlRepository_BackupRestore(t *testing.T) {
+	source := newBackupStore(t, "source")
+	defer source.Close()
+	fillBackupStore(t, source, backupDevice("wg0", "alice", "bob"), backupDevice("wg1"))
+	if err := source.SaveMetaFields([]MetaField{{Entity: MetaDevice, Key: "site", Type: FieldString}}); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := source.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The document goes through JSON, as it would when kept in a file.
+	data, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var read Backup
+	if err = json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  []wg.Device
+		mode    RestoreMode
+		wantIds []string
+	}{
+		{name: "empty", mode: RestoreMerge, wantIds: []string{"wg0", "wg1"}},
+		{name: "merge", stored: []wg.Device{backupDevice("wg0", "carol"), backupDevice("wg2")}, mode: RestoreMerge,
+			wantIds: []string{"wg0", "wg1", "wg2"}},
+		{name: "replace", stored: []wg.Device{backupDevice("wg0", "carol"), backupDevice("wg2")}, mode: RestoreReplace,
+			wantIds: []string{"wg0", "wg1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newBackupStore(t, tt.name)
+			defer store.Close()
+			fillBackupStore(t, store, tt.stored...)
+
+			if err := store.Restore(read, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := deviceIds(t, store); !reflect.DeepEqual(got, tt.wantIds) {
+				t.Errorf("Restore() devices = %v, want %v", got, tt.wantIds)
+			}
+
+			restored, err := store.Backup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The devices of the document come back exactly, without what was stored of them, such as carol.
+			for i, d := range backup.Devices {
+				if !reflect.DeepEqual(restored.Devices[i], d) {
+					t.Errorf("Restore() device = %+v, want %+v", restored.Devices[i], d)
+				}
+			}
+
+			if !reflect.DeepEqual(restored.Fields, backup.Fields) {
+				t.Errorf("Restore() fields = %v, want %v", restored.Fields, backup.Fields)
+			}
+		})
+	}
+}
+
+func TestSqlRepository_RestoreInvalid(t *testing.T) {
+	store := newBackupStore(t, "invalid")
+	defer store.Close()
+	fillBackupStore(t, store, backupDevice("wg0", "alice"))
+
+	valid := BackupDevice{Id: "wg1", PrivateKey: newKeyFromString("wg1"), Peers: []BackupPeer{}}
+	tests := []struct {
+		name      string
+		backup    Backup
+		wantField string
+	}{
+		{
+			name:      "version",
+			backup:    Backup{Version: BackupVersion + 1},
+			wantField: "version",
+		},
+		{
+			name:      "duplicate device",
+			backup:    Backup{Version: BackupVersion, Devices: []BackupDevice{valid, valid}},
+			wantField: "devices[1].id",
+		},
+		{
+			name: "allowed ips",
+			backup: Backup{Version: BackupVersion, Devices: []BackupDevice{valid, {
+				Id:         "wg2",
+				PrivateKey: newKeyFromString("wg2"),
+				Peers:      []BackupPeer{{PublicKey: newKeyFromString("bob"), AllowedIPs: []string{"10.0.0.300/32"}}},
+			}}},
+			wantField: "devices[1].peers[0].allowed_ips",
+		},
+		{
+			name: "reservations",
+			backup: Backup{Version: BackupVersion, Devices: []BackupDevice{{
+				Id:           "wg2",
+				PrivateKey:   newKeyFromString("wg2"),
+				Reservations: []BackupReservation{{IP: "10.0.0.2"}, {IP: "10.0.0.2"}},
+			}}},
+			wantField: "devices[0].reservations[1].ip",
+		},
+		{
+			name: "field",
+			backup: Backup{Version: BackupVersion, Devices: []BackupDevice{valid},
+				Fields: []MetaField{{Entity: MetaPeer, Key: "floor", Type: FieldEnum}}},
+			wantField: "fields[0]",
+		},
+		{
+			name: "meta",
+			backup: Backup{Version: BackupVersion, Devices: []BackupDevice{{
+				Id:         "wg2",
+				PrivateKey: newKeyFromString("wg2"),
+				Peers:      []BackupPeer{{PublicKey: newKeyFromString("bob"), Meta: map[string]string{"floor": "roof"}}},
+			}}, Fields: []MetaField{{Entity: MetaPeer, Key: "floor", Type: FieldInt}}},
+			wantField: "devices[0].peers[0].meta",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.Restore(tt.backup, RestoreReplace)
+			if e, ok := err.(*InvalidBackupError); !ok || e.Field != tt.wantField {
+				t.Fatalf("Restore() error = %v, want an invalid %v", err, tt.wantField)
+			}
+
+			if got := deviceIds(t, store); !reflect.DeepEqual(got, []string{"wg0"}) {
+				t.Errorf("Restore() left devices %v, want the store untouched", got)
+			}
+		})
+	}
+}
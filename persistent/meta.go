@@ -0,0 +1,150 @@
+package persistent
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MetaEntity is what a metadata key belongs to.
+type MetaEntity string
+
+const (
+	MetaDevice MetaEntity = "device"
+	MetaPeer   MetaEntity = "peer"
+)
+
+// FieldType is the type of the values of a custom field.
+type FieldType string
+
+const (
+	FieldString FieldType = "string"
+	FieldInt    FieldType = "int"
+	FieldBool   FieldType = "bool"
+	FieldDate   FieldType = "date"
+	FieldEnum   FieldType = "enum"
+)
+
+// DateLayout is how the values of date fields are written.
+const DateLayout = "2006-01-02"
+
+// MetaField declares the type of a metadata key of devices or peers, like an owner, an asset tag or a location.
+// Values of the key are checked against it when written. Keys without a field take any string.
+type MetaField struct {
+	Entity MetaEntity `json:"entity"`
+	Key    MetaKey    `json:"key"`
+	Type   FieldType  `json:"type"`
+	// Values are the choices of an enum field.
+	Values      []string `json:"values,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// InvalidMetaError tells why a field or a metadata value was refused.
+type InvalidMetaError struct {
+	Key    MetaKey
+	Reason string
+}
+
+func (e *InvalidMetaError) Error() string {
+	return fmt.Sprintf("invalid metadata %v: %v", e.Key, e.Reason)
+}
+
+func invalidMeta(key MetaKey, format string, args ...interface{}) error {
+	return &InvalidMetaError{Key: key, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks the declaration of the field.
+func (f MetaField) Validate() error {
+	if f.Entity != MetaDevice && f.Entity != MetaPeer {
+		return invalidMeta(f.Key, "unknown entity %q", f.Entity)
+	}
+
+	if len(f.Key) == 0 {
+		return invalidMeta(f.Key, "the key is missing")
+	}
+
+	switch f.Type {
+	case FieldString, FieldInt, FieldBool, FieldDate:
+		if len(f.Values) > 0 {
+			return invalidMeta(f.Key, "only enum fields have values")
+		}
+	case FieldEnum:
+		if len(f.Values) == 0 {
+			return invalidMeta(f.Key, "an enum field needs values")
+		}
+
+		seen := make(map[string]bool, len(f.Values))
+		for _, v := range f.Values {
+			if seen[v] {
+				return invalidMeta(f.Key, "%q is there twice", v)
+			}
+			seen[v] = true
+		}
+	default:
+		return invalidMeta(f.Key, "unknown type %q", f.Type)
+	}
+
+	return nil
+}
+
+// Normalise checks a value of the field and gives it the way it's stored: integers in decimal, booleans as true or
+// false and dates as DateLayout, so that finding by value doesn't depend on how it was written.
+func (f MetaField) Normalise(value string) (string, error) {
+	switch f.Type {
+	case FieldInt:
+		if v, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", invalidMeta(f.Key, "%q is not an integer", value)
+		} else {
+			return strconv.FormatInt(v, 10), nil
+		}
+	case FieldBool:
+		if v, err := strconv.ParseBool(value); err != nil {
+			return "", invalidMeta(f.Key, "%q is not a boolean", value)
+		} else {
+			return strconv.FormatBool(v), nil
+		}
+	case FieldDate:
+		if v, err := time.Parse(DateLayout, value); err != nil {
+			return "", invalidMeta(f.Key, "%q is not a date like %v", value, DateLayout)
+		} else {
+			return v.Format(DateLayout), nil
+		}
+	case FieldEnum:
+		for _, v := range f.Values {
+			if v == value {
+				return value, nil
+			}
+		}
+		return "", invalidMeta(f.Key, "%q is not one of %v", value, f.Values)
+	default:
+		return value, nil
+	}
+}
+
+// NormaliseMeta checks the metadata of an entity against the fields declared for it, and gives it with the values
+// normalised. It fails with an *InvalidMetaError on the first value that doesn't fit its field.
+func NormaliseMeta(fields []MetaField, entity MetaEntity, meta map[MetaKey]string) (map[MetaKey]string, error) {
+	byKey := make(map[MetaKey]MetaField)
+	for _, f := range fields {
+		if f.Entity == entity {
+			byKey[f.Key] = f
+		}
+	}
+
+	ret := make(map[MetaKey]string, len(meta))
+	for k, v := range meta {
+		if len(k) == 0 {
+			return nil, invalidMeta(k, "the key is missing")
+		}
+
+		if f, ok := byKey[k]; ok {
+			var err error
+			if v, err = f.Normalise(v); err != nil {
+				return nil, err
+			}
+		}
+		ret[k] = v
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,212 @@
+package persistent
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"testing"
+)
+
+func TestMetaField_Normalise(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   MetaField
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "string", field: MetaField{Type: FieldString}, value: " anything ", want: " anything "},
+		{name: "int", field: MetaField{Type: FieldInt}, value: "+042", want: "42"},
+		{name: "not an int", field: MetaField{Type: FieldInt}, value: "4.2", wantErr: true},
+		{name: "bool", field: MetaField{Type: FieldBool}, value: "1", want: "true"},
+		{name: "not a bool", field: MetaField{Type: FieldBool}, value: "yes", wantErr: true},
+		{name: "date", field: MetaField{Type: FieldDate}, value: "2020-02-29", want: "2020-02-29"},
+		{name: "not a date", field: MetaField{Type: FieldDate}, value: "2019-02-29", wantErr: true},
+		{name: "enum", field: MetaField{Type: FieldEnum, Values: []string{"hq", "lab"}}, value: "lab", want: "lab"},
+		{name: "not in enum", field: MetaField{Type: FieldEnum, Values: []string{"hq", "lab"}}, value: "Lab", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.field.Normalise(tt.value)
+			if _, ok := err.(*InvalidMetaError); ok != tt.wantErr || (err != nil && !ok) {
+				t.Fatalf("Normalise() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("Normalise() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetaField_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   MetaField
+		wantErr bool
+	}{
+		{name: "valid", field: MetaField{Entity: MetaPeer, Key: "owner", Type: FieldString}},
+		{name: "valid enum", field: MetaField{Entity: MetaDevice, Key: "site", Type: FieldEnum, Values: []string{"a", "b"}}},
+		{name: "entity", field: MetaField{Entity: "user", Key: "owner", Type: FieldString}, wantErr: true},
+		{name: "key", field: MetaField{Entity: MetaPeer, Type: FieldString}, wantErr: true},
+		{name: "type", field: MetaField{Entity: MetaPeer, Key: "owner", Type: "float"}, wantErr: true},
+		{name: "enum without values", field: MetaField{Entity: MetaPeer, Key: "site", Type: FieldEnum}, wantErr: true},
+		{name: "enum with twice a value", field: MetaField{Entity: MetaPeer, Key: "site", Type: FieldEnum, Values: []string{"a", "a"}}, wantErr: true},
+		{name: "values of a string", field: MetaField{Entity: MetaPeer, Key: "site", Type: FieldString, Values: []string{"a"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.field.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func newMetaStore(t *testing.T, name string) Repository {
+	store, err := NewSqliteRepository("file:meta_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.SaveDevices([]wg.Device{backupDevice("wg0", "alice", "bob"), backupDevice("wg1")}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSqlRepository_DeviceMeta(t *testing.T) {
+	store := newMetaStore(t, "device")
+	defer store.Close()
+
+	fields := []MetaField{
+		{Entity: MetaDevice, Key: "rack", Type: FieldInt},
+		{Entity: MetaDevice, Key: "site", Type: FieldEnum, Values: []string{"hq", "lab, west"}, Description: "Where it is"},
+	}
+	if err := store.SaveMetaFields(fields); err != nil {
+		t.Fatal("SaveMetaFields():", err)
+	}
+
+	if got, err := store.ListMetaFields(); err != nil || !reflect.DeepEqual(got, fields) {
+		t.Errorf("ListMetaFields() = %v, %v, want %v", got, err, fields)
+	}
+
+	if err := store.ReplaceDeviceMeta("wg0", map[MetaKey]string{"rack": "07", "site": "lab, west", "note": "x"}); err != nil {
+		t.Fatal("ReplaceDeviceMeta():", err)
+	}
+	if err := store.ReplaceDeviceMeta("wg1", map[MetaKey]string{"rack": "7", "site": "hq"}); err != nil {
+		t.Fatal("ReplaceDeviceMeta():", err)
+	}
+
+	want := map[MetaKey]string{"rack": "7", "site": "lab, west", "note": "x"}
+	if got, err := store.ListDeviceMeta("wg0"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ListDeviceMeta() = %v, %v, want %v", got, err, want)
+	}
+
+	// A value that doesn't fit its field is refused, and the metadata left as it was.
+	for _, write := range []func() error{
+		func() error { return store.SetDeviceMeta("wg0", "site", "garage") },
+		func() error { return store.ReplaceDeviceMeta("wg0", map[MetaKey]string{"rack": "seven"}) },
+	} {
+		if err := write(); err == nil {
+			t.Error("writing an invalid value succeeded")
+		} else if _, ok := err.(*InvalidMetaError); !ok {
+			t.Errorf("writing an invalid value error = %v, want an *InvalidMetaError", err)
+		}
+	}
+
+	if got, err := store.ListDeviceMeta("wg0"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ListDeviceMeta() = %v, %v, want %v", got, err, want)
+	}
+
+	findTests := []struct {
+		key   MetaKey
+		value string
+		want  []DeviceId
+	}{
+		{key: "rack", value: "007", want: []DeviceId{"wg0", "wg1"}},
+		{key: "rack", value: "seven"},
+		{key: "site", value: "hq", want: []DeviceId{"wg1"}},
+		{key: "note", value: "x", want: []DeviceId{"wg0"}},
+		{key: "note", value: "y"},
+	}
+	for _, tt := range findTests {
+		if got, err := store.FindDevicesByMeta(tt.key, tt.value); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FindDevicesByMeta(%v, %v) = %v, %v, want %v", tt.key, tt.value, got, err, tt.want)
+		}
+	}
+
+	// Typing a key that has values already checks and normalises them.
+	if err := store.SaveMetaFields([]MetaField{{Entity: MetaDevice, Key: "note", Type: FieldBool}}); err == nil {
+		t.Error("SaveMetaFields() of a field the values don't fit succeeded")
+	}
+
+	if err := store.SetDeviceMeta("wg1", "note", "T"); err != nil {
+		t.Fatal("SetDeviceMeta():", err)
+	}
+	if err := store.SetDeviceMeta("wg0", "note", "0"); err != nil {
+		t.Fatal("SetDeviceMeta():", err)
+	}
+	if err := store.SaveMetaFields([]MetaField{{Entity: MetaDevice, Key: "note", Type: FieldBool}}); err != nil {
+		t.Fatal("SaveMetaFields():", err)
+	}
+
+	if got, err := store.GetDeviceMeta("note"); err != nil || !reflect.DeepEqual(got, map[DeviceId]string{"wg0": "false", "wg1": "true"}) {
+		t.Errorf("GetDeviceMeta() = %v, %v, want the values normalised", got, err)
+	}
+
+	if err := store.RemoveMetaFields(MetaDevice, []MetaKey{"note", "rack"}); err != nil {
+		t.Fatal("RemoveMetaFields():", err)
+	}
+	if err := store.SetDeviceMeta("wg0", "rack", "seven"); err != nil {
+		t.Error("SetDeviceMeta() of a key without a field:", err)
+	}
+}
+
+func TestSqlRepository_PeerMeta(t *testing.T) {
+	store := newMetaStore(t, "peer")
+	defer store.Close()
+
+	if err := store.SaveMetaFields([]MetaField{{Entity: MetaPeer, Key: "since", Type: FieldDate}}); err != nil {
+		t.Fatal("SaveMetaFields():", err)
+	}
+
+	alice := PeerId{DeviceId: "wg0", PublicKey: newKeyFromString("alice")}
+	bob := PeerId{DeviceId: "wg0", PublicKey: newKeyFromString("bob")}
+
+	if err := store.ReplacePeerMeta(alice, map[MetaKey]string{MetaKeyName: "Alice", "since": "2020-01-02"}); err != nil {
+		t.Fatal("ReplacePeerMeta():", err)
+	}
+	if err := store.SetPeerMeta(bob, "since", "2020-01-02"); err != nil {
+		t.Fatal("SetPeerMeta():", err)
+	}
+	if err := store.SetPeerMeta(bob, "since", "January"); err == nil {
+		t.Error("SetPeerMeta() of an invalid date succeeded")
+	}
+
+	// The device fields don't apply to peers.
+	if err := store.SaveMetaFields([]MetaField{{Entity: MetaDevice, Key: "name", Type: FieldInt}}); err != nil {
+		t.Fatal("SaveMetaFields():", err)
+	}
+
+	if err := store.ReplacePeerMeta(alice, map[MetaKey]string{MetaKeyName: "Alice"}); err != nil {
+		t.Fatal("ReplacePeerMeta():", err)
+	}
+
+	want := map[MetaKey]string{MetaKeyName: "Alice"}
+	if got, err := store.ListPeerMeta(alice); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ListPeerMeta() = %v, %v, want %v", got, err, want)
+	}
+
+	if got, err := store.FindPeersByMeta("since", "2020-01-02"); err != nil || !reflect.DeepEqual(got, []PeerId{bob}) {
+		t.Errorf("FindPeersByMeta() = %v, %v, want %v", got, err, []PeerId{bob})
+	}
+
+	// Removing a peer takes its metadata along.
+	if err := store.RemovePeers([]PeerId{bob}); err != nil {
+		t.Fatal("RemovePeers():", err)
+	}
+
+	if got, err := store.ListPeerMeta(bob); err != nil || len(got) != 0 {
+		t.Errorf("ListPeerMeta() of a removed peer = %v, %v, want nothing", got, err)
+	}
+}
@@ -1,14 +1,23 @@
 package persistent
 
 import (
+	"errors"
 	"io"
+	"net"
 	"nz.cloudwalker/wireguard-webadmin/wg"
 )
 
+var (
+	ErrAddressReserved = errors.New("address is reserved by another peer")
+)
+
 type MetaKey string
 
 const (
 	MetaKeyName MetaKey = "name"
+	// MetaKeyNetworks lists the networks a device hands its peers addresses out of besides the one of its Address, as
+	// its own address in each with the length of the network, comma separated, as fd00::1/64.
+	MetaKeyNetworks MetaKey = "networks"
 )
 
 type DeviceId string
@@ -17,17 +26,54 @@ type PeerId struct {
 	PublicKey wg.Key
 }
 
+// Reservation holds an address of a device's network. An address pinned to a peer is released along with the peer,
+// one with no PublicKey is held until it's removed.
+type Reservation struct {
+	DeviceId  DeviceId
+	IP        net.IP
+	PublicKey *wg.Key
+}
+
 type Repository interface {
 	io.Closer
 	SaveDevices(devices []wg.Device) error
 	ListDevices() ([]wg.Device, error)
 	RemoveDevices(ids []DeviceId) error
+	RemovePeers(ids []PeerId) error
+
+	// SaveReservations fails with ErrAddressReserved if any of the addresses is held by something else.
+	SaveReservations(reservations []Reservation) error
+	ListReservations(deviceId DeviceId) ([]Reservation, error)
+	RemoveReservations(deviceId DeviceId, ips []net.IP) error
 
+	// SetDeviceMeta, ReplaceDeviceMeta and their peer counterparts fail with an *InvalidMetaError if a value doesn't
+	// fit the field declared for its key, and store the values normalised otherwise.
 	SetDeviceMeta(deviceId DeviceId, key MetaKey, value string) error
 	GetDeviceMeta(key MetaKey) (map[DeviceId]string, error)
 	RemoveDeviceMeta(deviceId DeviceId, key MetaKey) error
+	// ListDeviceMeta gives every key of the device, and ReplaceDeviceMeta makes it have exactly the keys of meta.
+	ListDeviceMeta(deviceId DeviceId) (map[MetaKey]string, error)
+	ReplaceDeviceMeta(deviceId DeviceId, meta map[MetaKey]string) error
+	// FindDevicesByMeta gives the devices whose key has the value, normalised if the key has a field.
+	FindDevicesByMeta(key MetaKey, value string) ([]DeviceId, error)
 
 	SetPeerMeta(peerId PeerId, key MetaKey, value string) error
 	GetPeerMeta(key MetaKey) (map[PeerId]string, error)
 	RemovePeerMeta(id PeerId, key MetaKey) error
+	ListPeerMeta(id PeerId) (map[MetaKey]string, error)
+	ReplacePeerMeta(id PeerId, meta map[MetaKey]string) error
+	FindPeersByMeta(key MetaKey, value string) ([]PeerId, error)
+
+	// SaveMetaFields declares the fields, or changes them. It fails with an *InvalidMetaError if a field isn't valid
+	// or a value already stored doesn't fit it, and stored values are normalised to the new fields.
+	SaveMetaFields(fields []MetaField) error
+	ListMetaFields() ([]MetaField, error)
+	// RemoveMetaFields drops the fields of the keys, leaving their values as untyped strings.
+	RemoveMetaFields(entity MetaEntity, keys []MetaKey) error
+
+	// Backup reads the whole store at once.
+	Backup() (Backup, error)
+	// Restore writes the document in one go, or fails with an *InvalidBackupError and writes nothing if it isn't
+	// valid.
+	Restore(backup Backup, mode RestoreMode) error
 }
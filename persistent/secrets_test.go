@@ -0,0 +1,95 @@
+package persistent
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"strings"
+	"testing"
+)
+
+func TestSqliteRepository_MasterKey(t *testing.T) {
+	const dsn = "file:secrets?cache=shared&mode=memory"
+	master, err := secrets.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A store holding keys in plaintext gets them encrypted once it has a master key.
+	plain, err := NewSqliteRepository(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	fillBackupStore(t, plain, backupDevice("wg0", "alice"))
+
+	store, err := NewSqliteRepository(dsn, WithMasterKey(&master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	db := store.(*sqlRepository).DB
+	assertSealed := func() {
+		var columns []string
+		if err := db.Select(&columns, "SELECT private_key FROM devices UNION ALL SELECT pre_shared_key FROM peers"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range columns {
+			if !strings.HasPrefix(c, "sealed:") {
+				t.Errorf("column = %v, want it sealed", c)
+			}
+		}
+
+		devices, err := store.ListDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := backupDevice("wg0", "alice")
+		if devices[0].PrivateKey != want.PrivateKey || devices[0].Peers[0].PreSharedKey != want.Peers[0].PreSharedKey {
+			t.Errorf("ListDevices() keys don't read back")
+		}
+	}
+	assertSealed()
+
+	if _, err = NewSqliteRepository(dsn); err != secrets.ErrNoKey {
+		t.Errorf("NewSqliteRepository() without the key error = %v, want %v", err, secrets.ErrNoKey)
+	}
+
+	rotated, err := secrets.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.(secrets.Rotator).RotateMasterKey(rotated); err != nil {
+		t.Fatal(err)
+	}
+	assertSealed()
+
+	if _, err = NewSqliteRepository(dsn, WithMasterKey(&master)); err != secrets.ErrWrongKey {
+		t.Errorf("NewSqliteRepository() with the old key error = %v, want %v", err, secrets.ErrWrongKey)
+	}
+
+	reopened, err := NewSqliteRepository(dsn, WithMasterKey(&rotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = reopened.Close()
+
+	// Neither a key written in plaintext nor one sealed for another place reads once the store is encrypted.
+	for _, tt := range []struct {
+		statement string
+		wantErr   error
+	}{
+		{statement: "UPDATE devices SET private_key = '" + backupDevice("wg0", "alice").PrivateKey.String() + "'", wantErr: secrets.ErrNotSealed},
+		{statement: "UPDATE devices SET private_key = (SELECT pre_shared_key FROM peers)", wantErr: secrets.ErrWrongKey},
+	} {
+		if _, err = db.Exec(tt.statement); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = store.ListDevices(); err != tt.wantErr {
+			t.Errorf("ListDevices() after %v error = %v, want %v", tt.statement, err, tt.wantErr)
+		}
+	}
+}
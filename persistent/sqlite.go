@@ -1,9 +1,13 @@
 package persistent
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"net"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
 	"nz.cloudwalker/wireguard-webadmin/utils"
 	"nz.cloudwalker/wireguard-webadmin/wg"
 	"strings"
@@ -11,29 +15,29 @@ import (
 )
 
 type device struct {
-	Id         string `sql:"id"`
-	Name       string `sql:"name"`
-	PrivateKey wg.Key `sql:"private_key"`
-	ListenPort uint16 `sql:"listen_port"`
-	Address    string `sql:"address"`
+	Id         string `db:"id"`
+	Name       string `db:"name"`
+	PrivateKey wg.Key `db:"-"`
+	ListenPort uint16 `db:"listen_port"`
+	Address    string `db:"address"`
+
+	// SealedPrivateKey is the private key as stored, encrypted if the store has a master key.
+	SealedPrivateKey string `db:"private_key"`
 }
 
 type peer struct {
-	DeviceId            string        `sql:"device_id"`
-	PublicKey           wg.Key        `sql:"public_key"`
-	PreSharedKey        wg.Key        `sql:"pre_shared_key"`
-	Endpoint            string        `sql:"endpoint"`
-	AllowedIPs          string        `sql:"allowed_ips"`
-	PersistentKeepAlive time.Duration `sql:"persistent_keep_alive"`
+	DeviceId            string        `db:"device_id"`
+	PublicKey           wg.Key        `db:"public_key"`
+	PreSharedKey        wg.Key        `db:"-"`
+	Endpoint            string        `db:"endpoint"`
+	AllowedIPs          string        `db:"allowed_ips"`
+	PersistentKeepAlive time.Duration `db:"persistent_keep_alive"`
+
+	SealedPreSharedKey string `db:"pre_shared_key"`
 }
 
 var tableMigrations = [][]string{
 	{
-		`CREATE TABLE options(
-				name TEXT NOT NULL PRIMARY KEY,
-				value TEXT
-			)`,
-
 		`CREATE TABLE devices(
 				id TEXT NOT NULL PRIMARY KEY,
 				name TEXT NOT NULL,
@@ -72,20 +76,68 @@ var tableMigrations = [][]string{
 					ON DELETE CASCADE
 			)`,
 	},
+	{
+		`CREATE TABLE ip_reservations(
+				device_id TEXT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+				ip TEXT NOT NULL,
+				public_key TEXT,
+				PRIMARY KEY (device_id, ip)
+			)`,
+
+		`CREATE INDEX ip_reservations_public_key ON ip_reservations(device_id, public_key)`,
+	},
+	{
+		`CREATE TABLE meta_fields(
+				entity TEXT NOT NULL,
+				name TEXT NOT NULL,
+				type TEXT NOT NULL,
+				enum_values TEXT NOT NULL DEFAULT '',
+				description TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (entity, name)
+			)`,
+
+		`CREATE INDEX device_meta_value ON device_meta(name, value)`,
+		`CREATE INDEX peer_meta_value ON peer_meta(name, value)`,
+	},
 }
 
 const (
 	insertDeviceSql = `INSERT OR REPLACE INTO devices(id, name, private_key, listen_port, address)
-						VALUES (:id, :private_key, :name, :listen_port, :address)`
+						VALUES (:id, :name, :private_key, :listen_port, :address)`
 
 	insertPeerSql = `INSERT OR REPLACE INTO peers(device_id, public_key, pre_shared_key, endpoint, allowed_ips, persistent_keep_alive)
 					  VALUES (:device_id, :public_key, :pre_shared_key, :endpoint, :allowed_ips, :persistent_keep_alive)`
 )
 
 const (
-	optionSchemaVersion = "schema_version"
+	// optionDataKey is the data key the secrets are sealed with, itself sealed with the master key.
+	optionDataKey = "data_key"
 )
 
+// Option sets up the store as NewSqliteRepository opens it.
+type Option func(o *sqliteOptions)
+
+type sqliteOptions struct {
+	masterKey *secrets.MasterKey
+}
+
+// WithMasterKey encrypts the private and pre-shared keys with the master key, the ones stored in plaintext until
+// now included. A nil key leaves the store unencrypted, which fails with secrets.ErrNoKey if it's encrypted already.
+func WithMasterKey(key *secrets.MasterKey) Option {
+	return func(o *sqliteOptions) {
+		o.masterKey = key
+	}
+}
+
+// secretColumns are the columns that are sealed, by table, with the columns keying the rows of the table.
+var secretColumns = []struct {
+	table, column string
+	key           []string
+}{
+	{table: "devices", column: "private_key", key: []string{"id"}},
+	{table: "peers", column: "pre_shared_key", key: []string{"device_id", "public_key"}},
+}
+
 func (d *device) UpdateFrom(dev wg.Device) {
 	d.Id = dev.Id
 	if dev.Address != nil {
@@ -100,6 +152,7 @@ func (d *device) UpdateFrom(dev wg.Device) {
 
 func (p *peer) UpdateFrom(d wg.Device, o wg.Peer) {
 	p.PublicKey = o.PublicKey
+	p.PreSharedKey = o.PreSharedKey
 	p.PersistentKeepAlive = o.PersistentKeepAlive
 	p.DeviceId = d.Id
 
@@ -115,6 +168,44 @@ func (p *peer) UpdateFrom(d wg.Device, o wg.Peer) {
 	}
 }
 
+func (d *device) place() secrets.Place {
+	return secrets.Place{Table: "devices", Column: "private_key", Row: []string{d.Id}}
+}
+
+func (d *device) seal(keys *secrets.Keyring) (err error) {
+	d.SealedPrivateKey, err = keys.Seal(d.PrivateKey.String(), d.place())
+	return
+}
+
+func (d *device) open(keys *secrets.Keyring) error {
+	v, err := keys.Open(d.SealedPrivateKey, d.place())
+	if err != nil {
+		return err
+	}
+
+	d.PrivateKey, err = wg.NewKeyFromString(v)
+	return err
+}
+
+func (p *peer) place() secrets.Place {
+	return secrets.Place{Table: "peers", Column: "pre_shared_key", Row: []string{p.DeviceId, p.PublicKey.String()}}
+}
+
+func (p *peer) seal(keys *secrets.Keyring) (err error) {
+	p.SealedPreSharedKey, err = keys.Seal(p.PreSharedKey.String(), p.place())
+	return
+}
+
+func (p *peer) open(keys *secrets.Keyring) error {
+	v, err := keys.Open(p.SealedPreSharedKey, p.place())
+	if err != nil {
+		return err
+	}
+
+	p.PreSharedKey, err = wg.NewKeyFromString(v)
+	return err
+}
+
 func (d device) ToDevice(peersMap map[string][]peer) (wg.Device, error) {
 	peers, _ := peersMap[d.Id]
 
@@ -146,7 +237,11 @@ func (d device) ToDevice(peersMap map[string][]peer) (wg.Device, error) {
 }
 
 func (p peer) ToPeer() (wg.Peer, error) {
-	allowedIPStrings := strings.Split(p.AllowedIPs, ",")
+	var allowedIPStrings []string
+	if len(p.AllowedIPs) > 0 {
+		allowedIPStrings = strings.Split(p.AllowedIPs, ",")
+	}
+
 	ret := wg.Peer{
 		PeerConfig: wg.PeerConfig{
 			PublicKey:           p.PublicKey,
@@ -157,9 +252,11 @@ func (p peer) ToPeer() (wg.Peer, error) {
 		},
 	}
 
-	var err error
-	if ret.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
-		return ret, err
+	if len(p.Endpoint) > 0 {
+		var err error
+		if ret.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+			return ret, err
+		}
 	}
 
 	for _, ipString := range allowedIPStrings {
@@ -173,60 +270,69 @@ func (p peer) ToPeer() (wg.Peer, error) {
 	return ret, nil
 }
 
-func createDb(dsn string, targetSchemaVersion int) (*sqlx.DB, error) {
+func createDb(dsn string) (*sqlx.DB, error) {
 	db, err := sqlx.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	tx, err := db.Beginx()
-	if err != nil {
+	if err = schema.MigrateDB(db, "", tableMigrations); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			_ = db.Close()
-		} else {
-			if err = tx.Commit(); err != nil {
-				_ = db.Close()
-				db = nil
-			}
-		}
-	}()
+	return db, nil
+}
 
-	schemaVersion := 0
+type reservation struct {
+	DeviceId  string         `db:"device_id"`
+	IP        string         `db:"ip"`
+	PublicKey sql.NullString `db:"public_key"`
+}
 
-	row := tx.QueryRow("SELECT CAST(value AS INTEGER) FROM options WHERE name = $1", optionSchemaVersion)
-	_ = row.Scan(&schemaVersion)
+func (r *reservation) UpdateFrom(o Reservation) {
+	r.DeviceId = string(o.DeviceId)
+	r.IP = o.IP.String()
+	r.PublicKey = sql.NullString{}
+	if o.PublicKey != nil {
+		r.PublicKey = sql.NullString{String: o.PublicKey.String(), Valid: true}
+	}
+}
 
-	for v := schemaVersion; v < targetSchemaVersion; v++ {
-		for _, s := range tableMigrations[v] {
-			if _, err = tx.Exec(s); err != nil {
-				return nil, err
-			}
-		}
+func (r reservation) ToReservation() (ret Reservation, err error) {
+	ret.DeviceId = DeviceId(r.DeviceId)
+	if ret.IP = net.ParseIP(r.IP); ret.IP == nil {
+		return ret, fmt.Errorf("reservation: invalid ip %v", r.IP)
 	}
 
-	_, err = tx.Exec("INSERT OR REPLACE INTO options(name, value) VALUES ($1, $2)", optionSchemaVersion, targetSchemaVersion)
-	if err != nil {
-		return nil, err
+	if r.PublicKey.Valid {
+		var key wg.Key
+		if key, err = wg.NewKeyFromString(r.PublicKey.String); err != nil {
+			return
+		}
+		ret.PublicKey = &key
 	}
 
-	return db, nil
+	return
+}
+
+func isConstraintError(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && e.Code == sqlite3.ErrConstraint
 }
 
 type sqlRepository struct {
 	*sqlx.DB
+
+	// keys is nil for a store that isn't encrypted.
+	keys *secrets.Keyring
 }
 
 func (s sqlRepository) Close() error {
 	return s.DB.Close()
 }
 
-func (s sqlRepository) SaveDevices(devices []wg.Device) error {
+func (s sqlRepository) SaveDevices(devices []wg.Device) (err error) {
 	tx, err := s.Beginx()
 	if err != nil {
 		return err
@@ -240,12 +346,12 @@ func (s sqlRepository) SaveDevices(devices []wg.Device) error {
 		}
 	}()
 
-	devSt, err := s.PrepareNamed(insertDeviceSql)
+	devSt, err := tx.PrepareNamed(insertDeviceSql)
 	if err != nil {
 		return err
 	}
 
-	peerSt, err := s.PrepareNamed(insertPeerSql)
+	peerSt, err := tx.PrepareNamed(insertPeerSql)
 	if err != nil {
 		return err
 	}
@@ -255,13 +361,26 @@ func (s sqlRepository) SaveDevices(devices []wg.Device) error {
 
 	for _, d := range devices {
 		updatingDevice.UpdateFrom(d)
+		if err = updatingDevice.seal(s.keys); err != nil {
+			return err
+		}
+
 		if _, err = devSt.Exec(updatingDevice); err != nil {
 			return err
 		}
 
+		// The saved device has exactly the given peers, so drop the ones it no longer has.
+		if err = removeOtherPeers(tx, d); err != nil {
+			return err
+		}
+
 		for _, p := range d.Peers {
 			updatingPeer.UpdateFrom(d, p)
-			if _, err = peerSt.Exec(p); err != nil {
+			if err = updatingPeer.seal(s.keys); err != nil {
+				return err
+			}
+
+			if _, err = peerSt.Exec(updatingPeer); err != nil {
 				return err
 			}
 		}
@@ -270,12 +389,41 @@ func (s sqlRepository) SaveDevices(devices []wg.Device) error {
 	return nil
 }
 
+// removeOtherPeers removes the peers the device no longer has with everything they have, as RemovePeers does. The
+// reservations pinned to peers the device hasn't had yet are kept.
+func removeOtherPeers(tx *sqlx.Tx, d wg.Device) error {
+	var saved []wg.Key
+	if err := tx.Select(&saved, "SELECT public_key FROM peers WHERE device_id = ?", d.Id); err != nil {
+		return err
+	}
+
+	kept := make(map[wg.Key]bool, len(d.Peers))
+	for _, p := range d.Peers {
+		kept[p.PublicKey] = true
+	}
+
+	for _, k := range saved {
+		if kept[k] {
+			continue
+		}
+
+		for _, table := range []string{"peer_meta", "peers", "ip_reservations"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE device_id = ? AND public_key = ?", d.Id, k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (s sqlRepository) queryPeersMap() (map[string][]peer, error) {
 	rows, err := s.Queryx("SELECT * FROM peers")
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	ret := make(map[string][]peer)
 	var p peer
 	for rows.Next() {
@@ -283,6 +431,10 @@ func (s sqlRepository) queryPeersMap() (map[string][]peer, error) {
 			return ret, err
 		}
 
+		if err = p.open(s.keys); err != nil {
+			return ret, err
+		}
+
 		devicePeers, _ := ret[p.DeviceId]
 		devicePeers = append(devicePeers, p)
 		ret[p.DeviceId] = devicePeers
@@ -292,22 +444,28 @@ func (s sqlRepository) queryPeersMap() (map[string][]peer, error) {
 }
 
 func (s sqlRepository) ListDevices() (ret []wg.Device, err error) {
-	rows, err := s.Queryx("SELECT * FROM devices")
+	peersMap, err := s.queryPeersMap()
 	if err != nil {
 		return
 	}
 
-	peersMap, err := s.queryPeersMap()
+	rows, err := s.Queryx("SELECT * FROM devices")
 	if err != nil {
 		return
 	}
 
+	defer rows.Close()
+
 	var dev device
 	for rows.Next() {
 		if err = rows.StructScan(&dev); err != nil {
 			return
 		}
 
+		if err = dev.open(s.keys); err != nil {
+			return
+		}
+
 		if dev, e := dev.ToDevice(peersMap); e != nil {
 			err = e
 			return
@@ -319,83 +477,237 @@ func (s sqlRepository) ListDevices() (ret []wg.Device, err error) {
 	return
 }
 
-func (s sqlRepository) SetDeviceMeta(deviceId DeviceId, key MetaKey, value string) error {
-	_, err := s.Exec("INSERT OR REPLACE INTO device_meta (device_id, name, value) VALUES ($1, $2, $3)",
-		deviceId, key, value)
+func deleteByDeviceIds(tx *sqlx.Tx, statement string, ids []DeviceId) error {
+	query, args, err := sqlx.In(statement, ids)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, args...)
 	return err
 }
 
-func (s sqlRepository) GetDeviceMeta(key MetaKey) (map[DeviceId]string, error) {
-	rows, err := s.Query("SELECT device_id, name, value FROM device_meta WHERE name = $1", key)
+func (s sqlRepository) RemoveDevices(ids []DeviceId) (err error) {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := s.Beginx()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var deviceId, name, value string
-	ret := make(map[DeviceId]string)
-	for rows.Next() {
-		if err = rows.Scan(&deviceId, &name, &value); err != nil {
-			return ret, err
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
 		}
+	}()
 
-		ret[DeviceId(deviceId)] = value
+	err = removeDevices(tx, ids)
+	return err
+}
+
+// removeDevices removes the devices with everything they have. Foreign keys are not enforced unless the dsn asks
+// for it, so the cascades are done here.
+func removeDevices(tx *sqlx.Tx, ids []DeviceId) error {
+	for _, table := range []string{"peer_meta", "peers", "device_meta", "ip_reservations"} {
+		if err := deleteByDeviceIds(tx, "DELETE FROM "+table+" WHERE device_id IN (?)", ids); err != nil {
+			return err
+		}
 	}
 
-	return ret, nil
+	return deleteByDeviceIds(tx, "DELETE FROM devices WHERE id IN (?)", ids)
 }
 
-func (s sqlRepository) RemoveDeviceMeta(deviceId DeviceId, key MetaKey) error {
-	_, err := s.Exec("DELETE FROM device_meta WHERE device_id = $1 AND name = $2", deviceId, key)
-	return err
+func (s sqlRepository) RemovePeers(ids []PeerId) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	for _, id := range ids {
+		for _, table := range []string{"peer_meta", "peers", "ip_reservations"} {
+			_, err = tx.Exec("DELETE FROM "+table+" WHERE device_id = ? AND public_key = ?", id.DeviceId, id.PublicKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s sqlRepository) SaveReservations(reservations []Reservation) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var saving reservation
+	for _, r := range reservations {
+		saving.UpdateFrom(r)
+
+		var existing reservation
+		err = tx.Get(&existing, "SELECT * FROM ip_reservations WHERE device_id = ? AND ip = ?", saving.DeviceId, saving.IP)
+		if err == nil {
+			if existing.PublicKey != saving.PublicKey {
+				return ErrAddressReserved
+			}
+			continue
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		_, err = tx.NamedExec("INSERT INTO ip_reservations(device_id, ip, public_key) VALUES (:device_id, :ip, :public_key)", saving)
+		if isConstraintError(err) {
+			return ErrAddressReserved
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s sqlRepository) ListReservations(deviceId DeviceId) (ret []Reservation, err error) {
+	var rows []reservation
+	if err = s.Select(&rows, "SELECT * FROM ip_reservations WHERE device_id = ?", deviceId); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var r Reservation
+		if r, err = row.ToReservation(); err != nil {
+			return
+		}
+		ret = append(ret, r)
+	}
+
+	return
 }
 
-func (s sqlRepository) SetPeerMeta(peerId PeerId, key MetaKey, value string) error {
-	_, err := s.Exec("INSERT OR REPLACE INTO peer_meta (device_id, public_key, name, value) VALUES ($1, $2, $3, $4)",
-		peerId.DeviceId, peerId.PublicKey, key, value)
+func (s sqlRepository) RemoveReservations(deviceId DeviceId, ips []net.IP) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	ipStrings := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ipStrings = append(ipStrings, ip.String())
+	}
+
+	query, args, err := sqlx.In("DELETE FROM ip_reservations WHERE device_id = ? AND ip IN (?)", deviceId, ipStrings)
+	if err != nil {
+		return err
+	}
 
+	_, err = s.Exec(query, args...)
 	return err
 }
 
-func (s sqlRepository) GetPeerMeta(key MetaKey) (map[PeerId]string, error) {
-	rows, err := s.Query("SELECT device_id, public_key, value FROM peer_meta WHERE name = $1", key)
+// openKeyring opens the data key the store keeps with the master key. When the store gets encrypted, it keeps the
+// new data key and seals the secrets stored in plaintext until then.
+func openKeyring(db *sqlx.DB, master *secrets.MasterKey) (keys *secrets.Keyring, err error) {
+	tx, err := db.Beginx()
 	if err != nil {
 		return nil, err
 	}
 
-	var deviceId, value string
-	var publicKey wg.Key
-	ret := make(map[PeerId]string)
-	for rows.Next() {
-		if err = rows.Scan(&deviceId, &publicKey, &value); err != nil {
-			return ret, err
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
 		}
+	}()
 
-		ret[PeerId{
-			DeviceId:  DeviceId(deviceId),
-			PublicKey: publicKey,
-		}] = value
+	var wrapped string
+	if err = tx.Get(&wrapped, "SELECT value FROM options WHERE name = ?", optionDataKey); err != nil && err != sql.ErrNoRows {
+		return nil, err
 	}
 
-	return ret, nil
+	keys, newWrapped, err := secrets.OpenKeyring(master, wrapped)
+	if err != nil || len(newWrapped) == 0 {
+		return keys, err
+	}
+
+	if err = reseal(tx, nil, keys, newWrapped); err != nil {
+		return nil, err
+	}
+	return keys, nil
 }
 
-func (s sqlRepository) RemovePeerMeta(id PeerId, key MetaKey) error {
-	_, err := s.Exec("DELETE FROM peer_meta WHERE device_id = $1 AND public_key = $2 AND name = $3",
-		id.DeviceId, id.PublicKey, key)
+// reseal seals every secret again with to, and keeps the data key of to, wrapped.
+func reseal(tx *sqlx.Tx, from *secrets.Keyring, to *secrets.Keyring, wrapped string) error {
+	for _, c := range secretColumns {
+		if err := secrets.ResealColumn(tx, c.table, c.column, c.key, from, to); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO options(name, value) VALUES (?, ?)", optionDataKey, wrapped)
 	return err
 }
 
-func (s sqlRepository) RemoveDevices(ids []DeviceId) error {
-	_, err := s.Exec("DELETE FROM devices WHERE id IN ($1)", ids)
-	return err
+func (s sqlRepository) RotateMasterKey(master secrets.MasterKey) (err error) {
+	next, wrapped, err := secrets.NewKeyring(master)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err = reseal(tx, s.keys, next, wrapped); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	s.keys.Replace(next)
+	return nil
 }
 
-func NewSqliteRepository(dsn string) (Repository, error) {
-	db, err := createDb(dsn, len(tableMigrations))
+func NewSqliteRepository(dsn string, options ...Option) (Repository, error) {
+	var o sqliteOptions
+	for _, option := range options {
+		option(&o)
+	}
+
+	db, err := createDb(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	repo := &sqlRepository{DB: db}
+	keys, err := openKeyring(db, o.masterKey)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	repo := &sqlRepository{DB: db, keys: keys}
 	return repo, nil
 }
@@ -0,0 +1,292 @@
+package persistent
+
+import (
+	"github.com/jmoiron/sqlx"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"strings"
+	"time"
+)
+
+type deviceMeta struct {
+	DeviceId string `db:"device_id"`
+	Name     string `db:"name"`
+	Value    string `db:"value"`
+}
+
+type peerMeta struct {
+	DeviceId  string `db:"device_id"`
+	PublicKey wg.Key `db:"public_key"`
+	Name      string `db:"name"`
+	Value     string `db:"value"`
+}
+
+func (s sqlRepository) Backup() (ret Backup, err error) {
+	// Everything is read in one transaction so that the document is consistent.
+	tx, err := s.Beginx()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var devices []device
+	var peers []peer
+	var devicesMeta []deviceMeta
+	var peersMeta []peerMeta
+	var reservations []reservation
+	var fields []metaField
+
+	for _, q := range []struct {
+		dest  interface{}
+		query string
+	}{
+		{&devices, "SELECT * FROM devices ORDER BY id"},
+		{&peers, "SELECT * FROM peers ORDER BY device_id, public_key"},
+		{&devicesMeta, "SELECT device_id, name, value FROM device_meta ORDER BY device_id, name"},
+		{&peersMeta, "SELECT device_id, public_key, name, value FROM peer_meta ORDER BY device_id, public_key, name"},
+		{&reservations, "SELECT * FROM ip_reservations ORDER BY device_id, ip"},
+		{&fields, "SELECT * FROM meta_fields ORDER BY entity, name"},
+	} {
+		if err = tx.Select(q.dest, q.query); err != nil {
+			return
+		}
+	}
+
+	for i := range devices {
+		if err = devices[i].open(s.keys); err != nil {
+			return
+		}
+	}
+
+	for i := range peers {
+		if err = peers[i].open(s.keys); err != nil {
+			return
+		}
+	}
+
+	ret = Backup{
+		Version:   BackupVersion,
+		CreatedAt: time.Now().UTC(),
+		Devices:   make([]BackupDevice, 0, len(devices)),
+	}
+
+	deviceIndex := make(map[string]int, len(devices))
+	for i, d := range devices {
+		deviceIndex[d.Id] = i
+		ret.Devices = append(ret.Devices, BackupDevice{
+			Id:         d.Id,
+			Name:       d.Name,
+			PrivateKey: d.PrivateKey,
+			ListenPort: d.ListenPort,
+			Address:    d.Address,
+			Peers:      []BackupPeer{},
+		})
+	}
+
+	// Whatever is left of a device or a peer that's gone is not worth keeping.
+	peerIndex := make(map[PeerId]int, len(peers))
+	for _, p := range peers {
+		i, ok := deviceIndex[p.DeviceId]
+		if !ok {
+			continue
+		}
+
+		backupPeer := BackupPeer{
+			PublicKey:           p.PublicKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          []string{},
+			PersistentKeepAlive: int64(p.PersistentKeepAlive / time.Second),
+		}
+
+		if len(p.AllowedIPs) > 0 {
+			backupPeer.AllowedIPs = strings.Split(p.AllowedIPs, ",")
+		}
+
+		if !p.PreSharedKey.IsZero() {
+			psk := p.PreSharedKey
+			backupPeer.PreSharedKey = &psk
+		}
+
+		peerIndex[PeerId{DeviceId: DeviceId(p.DeviceId), PublicKey: p.PublicKey}] = len(ret.Devices[i].Peers)
+		ret.Devices[i].Peers = append(ret.Devices[i].Peers, backupPeer)
+	}
+
+	for _, m := range devicesMeta {
+		if i, ok := deviceIndex[m.DeviceId]; ok {
+			if ret.Devices[i].Meta == nil {
+				ret.Devices[i].Meta = make(map[string]string)
+			}
+			ret.Devices[i].Meta[m.Name] = m.Value
+		}
+	}
+
+	for _, m := range peersMeta {
+		j, ok := peerIndex[PeerId{DeviceId: DeviceId(m.DeviceId), PublicKey: m.PublicKey}]
+		if !ok {
+			continue
+		}
+
+		p := &ret.Devices[deviceIndex[m.DeviceId]].Peers[j]
+		if p.Meta == nil {
+			p.Meta = make(map[string]string)
+		}
+		p.Meta[m.Name] = m.Value
+	}
+
+	for _, row := range reservations {
+		i, ok := deviceIndex[row.DeviceId]
+		if !ok {
+			continue
+		}
+
+		var r Reservation
+		if r, err = row.ToReservation(); err != nil {
+			return
+		}
+
+		ret.Devices[i].Reservations = append(ret.Devices[i].Reservations, BackupReservation{
+			IP:        r.IP.String(),
+			PublicKey: r.PublicKey,
+		})
+	}
+
+	for _, row := range fields {
+		var f MetaField
+		if f, err = row.ToMetaField(); err != nil {
+			return
+		}
+		ret.Fields = append(ret.Fields, f)
+	}
+
+	return
+}
+
+func (s sqlRepository) Restore(backup Backup, mode RestoreMode) (err error) {
+	if err = backup.Validate(); err != nil {
+		return
+	}
+
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if mode == RestoreReplace {
+		for _, table := range []string{"peer_meta", "peers", "device_meta", "ip_reservations", "devices", "meta_fields"} {
+			if _, err = tx.Exec("DELETE FROM " + table); err != nil {
+				return
+			}
+		}
+	} else if len(backup.Devices) > 0 {
+		ids := make([]DeviceId, 0, len(backup.Devices))
+		for _, d := range backup.Devices {
+			ids = append(ids, DeviceId(d.Id))
+		}
+
+		if err = removeDevices(tx, ids); err != nil {
+			return
+		}
+	}
+
+	for _, d := range backup.Devices {
+		if err = restoreDevice(tx, s.keys, d); err != nil {
+			return
+		}
+	}
+
+	if err = saveMetaFields(tx, backup.Fields); err != nil {
+		return
+	}
+
+	// The values a merge keeps have to fit the fields of the document too.
+	for _, f := range backup.Fields {
+		if err = renormalise(tx, f); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// restoreDevice inserts a device of a valid document, sealing its secrets with keys.
+func restoreDevice(tx *sqlx.Tx, keys *secrets.Keyring, d BackupDevice) (err error) {
+	row := device{
+		Id:         d.Id,
+		Name:       d.Name,
+		PrivateKey: d.PrivateKey,
+		ListenPort: d.ListenPort,
+		Address:    d.Address,
+	}
+
+	if err = row.seal(keys); err != nil {
+		return
+	}
+
+	if _, err = tx.NamedExec(insertDeviceSql, row); err != nil {
+		return
+	}
+
+	for name, value := range d.Meta {
+		if _, err = tx.NamedExec("INSERT INTO device_meta (device_id, name, value) VALUES (:device_id, :name, :value)",
+			deviceMeta{DeviceId: d.Id, Name: name, Value: value}); err != nil {
+			return
+		}
+	}
+
+	for _, p := range d.Peers {
+		ips := make([]string, 0, len(p.AllowedIPs))
+		for _, s := range p.AllowedIPs {
+			_, n, _ := net.ParseCIDR(s)
+			ips = append(ips, n.String())
+		}
+
+		saving := peer{
+			DeviceId:            d.Id,
+			PublicKey:           p.PublicKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          strings.Join(ips, ","),
+			PersistentKeepAlive: time.Duration(p.PersistentKeepAlive) * time.Second,
+		}
+
+		if p.PreSharedKey != nil {
+			saving.PreSharedKey = *p.PreSharedKey
+		}
+
+		if err = saving.seal(keys); err != nil {
+			return
+		}
+
+		if _, err = tx.NamedExec(insertPeerSql, saving); err != nil {
+			return
+		}
+
+		for name, value := range p.Meta {
+			if _, err = tx.NamedExec("INSERT INTO peer_meta (device_id, public_key, name, value) VALUES (:device_id, :public_key, :name, :value)",
+				peerMeta{DeviceId: d.Id, PublicKey: p.PublicKey, Name: name, Value: value}); err != nil {
+				return
+			}
+		}
+	}
+
+	var saving reservation
+	for _, r := range d.Reservations {
+		saving.UpdateFrom(Reservation{DeviceId: DeviceId(d.Id), IP: net.ParseIP(r.IP), PublicKey: r.PublicKey})
+		if _, err = tx.NamedExec("INSERT INTO ip_reservations(device_id, ip, public_key) VALUES (:device_id, :ip, :public_key)", saving); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package persistent
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+)
+
+type metaField struct {
+	Entity      string `db:"entity"`
+	Name        string `db:"name"`
+	Type        string `db:"type"`
+	Values      string `db:"enum_values"`
+	Description string `db:"description"`
+}
+
+const insertMetaFieldSql = `INSERT OR REPLACE INTO meta_fields(entity, name, type, enum_values, description)
+							VALUES (:entity, :name, :type, :enum_values, :description)`
+
+func (f *metaField) UpdateFrom(o MetaField) error {
+	f.Entity = string(o.Entity)
+	f.Name = string(o.Key)
+	f.Type = string(o.Type)
+	f.Description = o.Description
+	f.Values = ""
+
+	if len(o.Values) > 0 {
+		// Enum values may have commas, so they're kept as a JSON array.
+		data, err := json.Marshal(o.Values)
+		if err != nil {
+			return err
+		}
+		f.Values = string(data)
+	}
+	return nil
+}
+
+func (f metaField) ToMetaField() (ret MetaField, err error) {
+	ret = MetaField{
+		Entity:      MetaEntity(f.Entity),
+		Key:         MetaKey(f.Name),
+		Type:        FieldType(f.Type),
+		Description: f.Description,
+	}
+
+	if len(f.Values) > 0 {
+		err = json.Unmarshal([]byte(f.Values), &ret.Values)
+	}
+	return
+}
+
+// inTx runs f in a transaction, which is committed if f succeeds and rolled back otherwise.
+func (s sqlRepository) inTx(f func(tx *sqlx.Tx) error) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = f(tx)
+	return
+}
+
+func selectMetaFields(q sqlx.Queryer) (ret []MetaField, err error) {
+	var rows []metaField
+	if err = sqlx.Select(q, &rows, "SELECT * FROM meta_fields ORDER BY entity, name"); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var f MetaField
+		if f, err = row.ToMetaField(); err != nil {
+			return
+		}
+		ret = append(ret, f)
+	}
+	return
+}
+
+// normaliseIn checks the metadata of an entity against the fields stored, in the transaction.
+func normaliseIn(tx *sqlx.Tx, entity MetaEntity, meta map[MetaKey]string) (map[MetaKey]string, error) {
+	fields, err := selectMetaFields(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return NormaliseMeta(fields, entity, meta)
+}
+
+func (s sqlRepository) SetDeviceMeta(deviceId DeviceId, key MetaKey, value string) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		meta, err := normaliseIn(tx, MetaDevice, map[MetaKey]string{key: value})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO device_meta (device_id, name, value) VALUES ($1, $2, $3)",
+			deviceId, key, meta[key])
+		return err
+	})
+}
+
+func (s sqlRepository) GetDeviceMeta(key MetaKey) (map[DeviceId]string, error) {
+	rows, err := s.Query("SELECT device_id, name, value FROM device_meta WHERE name = $1", key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var deviceId, name, value string
+	ret := make(map[DeviceId]string)
+	for rows.Next() {
+		if err = rows.Scan(&deviceId, &name, &value); err != nil {
+			return ret, err
+		}
+
+		ret[DeviceId(deviceId)] = value
+	}
+
+	return ret, rows.Err()
+}
+
+func (s sqlRepository) RemoveDeviceMeta(deviceId DeviceId, key MetaKey) error {
+	_, err := s.Exec("DELETE FROM device_meta WHERE device_id = $1 AND name = $2", deviceId, key)
+	return err
+}
+
+func (s sqlRepository) ListDeviceMeta(deviceId DeviceId) (map[MetaKey]string, error) {
+	var rows []deviceMeta
+	if err := s.Select(&rows, "SELECT device_id, name, value FROM device_meta WHERE device_id = ?", deviceId); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[MetaKey]string, len(rows))
+	for _, m := range rows {
+		ret[MetaKey(m.Name)] = m.Value
+	}
+	return ret, nil
+}
+
+func (s sqlRepository) ReplaceDeviceMeta(deviceId DeviceId, meta map[MetaKey]string) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		meta, err := normaliseIn(tx, MetaDevice, meta)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM device_meta WHERE device_id = ?", deviceId); err != nil {
+			return err
+		}
+
+		for name, value := range meta {
+			if _, err = tx.NamedExec("INSERT INTO device_meta (device_id, name, value) VALUES (:device_id, :name, :value)",
+				deviceMeta{DeviceId: string(deviceId), Name: string(name), Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findValue gives the value to look for as it would be stored, or ok false if no value of the key can be it.
+func (s sqlRepository) findValue(entity MetaEntity, key MetaKey, value string) (ret string, ok bool, err error) {
+	fields, err := selectMetaFields(s.DB)
+	if err != nil {
+		return
+	}
+
+	meta, err := NormaliseMeta(fields, entity, map[MetaKey]string{key: value})
+	if _, invalid := err.(*InvalidMetaError); invalid {
+		return "", false, nil
+	} else if err != nil {
+		return
+	}
+	return meta[key], true, nil
+}
+
+func (s sqlRepository) FindDevicesByMeta(key MetaKey, value string) (ret []DeviceId, err error) {
+	value, ok, err := s.findValue(MetaDevice, key, value)
+	if err != nil || !ok {
+		return
+	}
+
+	err = s.Select(&ret, "SELECT device_id FROM device_meta WHERE name = ? AND value = ? ORDER BY device_id", key, value)
+	return
+}
+
+func (s sqlRepository) SetPeerMeta(peerId PeerId, key MetaKey, value string) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		meta, err := normaliseIn(tx, MetaPeer, map[MetaKey]string{key: value})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO peer_meta (device_id, public_key, name, value) VALUES ($1, $2, $3, $4)",
+			peerId.DeviceId, peerId.PublicKey, key, meta[key])
+		return err
+	})
+}
+
+func (s sqlRepository) GetPeerMeta(key MetaKey) (map[PeerId]string, error) {
+	rows, err := s.Query("SELECT device_id, public_key, value FROM peer_meta WHERE name = $1", key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var deviceId, value string
+	var publicKey wg.Key
+	ret := make(map[PeerId]string)
+	for rows.Next() {
+		if err = rows.Scan(&deviceId, &publicKey, &value); err != nil {
+			return ret, err
+		}
+
+		ret[PeerId{
+			DeviceId:  DeviceId(deviceId),
+			PublicKey: publicKey,
+		}] = value
+	}
+
+	return ret, rows.Err()
+}
+
+func (s sqlRepository) RemovePeerMeta(id PeerId, key MetaKey) error {
+	_, err := s.Exec("DELETE FROM peer_meta WHERE device_id = $1 AND public_key = $2 AND name = $3",
+		id.DeviceId, id.PublicKey, key)
+	return err
+}
+
+func (s sqlRepository) ListPeerMeta(id PeerId) (map[MetaKey]string, error) {
+	var rows []peerMeta
+	err := s.Select(&rows, "SELECT device_id, public_key, name, value FROM peer_meta WHERE device_id = ? AND public_key = ?",
+		id.DeviceId, id.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[MetaKey]string, len(rows))
+	for _, m := range rows {
+		ret[MetaKey(m.Name)] = m.Value
+	}
+	return ret, nil
+}
+
+func (s sqlRepository) ReplacePeerMeta(id PeerId, meta map[MetaKey]string) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		meta, err := normaliseIn(tx, MetaPeer, meta)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM peer_meta WHERE device_id = ? AND public_key = ?", id.DeviceId, id.PublicKey); err != nil {
+			return err
+		}
+
+		for name, value := range meta {
+			if _, err = tx.NamedExec("INSERT INTO peer_meta (device_id, public_key, name, value) VALUES (:device_id, :public_key, :name, :value)",
+				peerMeta{DeviceId: string(id.DeviceId), PublicKey: id.PublicKey, Name: string(name), Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s sqlRepository) FindPeersByMeta(key MetaKey, value string) (ret []PeerId, err error) {
+	value, ok, err := s.findValue(MetaPeer, key, value)
+	if err != nil || !ok {
+		return
+	}
+
+	var rows []peerMeta
+	err = s.Select(&rows, "SELECT device_id, public_key, name, value FROM peer_meta WHERE name = ? AND value = ? ORDER BY device_id, public_key",
+		key, value)
+	for _, m := range rows {
+		ret = append(ret, PeerId{DeviceId: DeviceId(m.DeviceId), PublicKey: m.PublicKey})
+	}
+	return
+}
+
+// metaTables are the tables holding the values of the fields, by entity.
+var metaTables = map[MetaEntity]string{MetaDevice: "device_meta", MetaPeer: "peer_meta"}
+
+// renormalise brings the stored values of the field to its type, failing if one doesn't fit.
+func renormalise(tx *sqlx.Tx, f MetaField) error {
+	table := metaTables[f.Entity]
+
+	var rows []struct {
+		RowId int64  `db:"rowid"`
+		Value string `db:"value"`
+	}
+	if err := tx.Select(&rows, "SELECT rowid, value FROM "+table+" WHERE name = ?", f.Key); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		v, err := f.Normalise(row.Value)
+		if err != nil {
+			return err
+		}
+
+		if v != row.Value {
+			if _, err = tx.Exec("UPDATE "+table+" SET value = ? WHERE rowid = ?", v, row.RowId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func saveMetaFields(tx *sqlx.Tx, fields []MetaField) error {
+	var row metaField
+	for _, f := range fields {
+		if err := row.UpdateFrom(f); err != nil {
+			return err
+		}
+
+		if _, err := tx.NamedExec(insertMetaFieldSql, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s sqlRepository) SaveMetaFields(fields []MetaField) error {
+	for _, f := range fields {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return s.inTx(func(tx *sqlx.Tx) error {
+		if err := saveMetaFields(tx, fields); err != nil {
+			return err
+		}
+
+		for _, f := range fields {
+			if err := renormalise(tx, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s sqlRepository) ListMetaFields() ([]MetaField, error) {
+	return selectMetaFields(s.DB)
+}
+
+func (s sqlRepository) RemoveMetaFields(entity MetaEntity, keys []MetaKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("DELETE FROM meta_fields WHERE entity = ? AND name IN (?)", entity, keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Exec(query, args...)
+	return err
+}
@@ -121,7 +121,7 @@ func Test_device_ToDevice(t *testing.T) {
 							PreSharedKey: wg.Key{},
 							Endpoint:     parseAddress("2.3.4.5:90", t),
 							AllowedIPs: []net.IPNet{
-								*parseIPNet("1.2.3.0/24", t),
+								*parseCIDR("1.2.3.0/24", t),
 							},
 							PersistentKeepAlive: 10,
 						},
@@ -550,3 +550,49 @@ func Test_sqlRepository_queryPeersMap(t *testing.T) {
 		})
 	}
 }
+
+func TestSqlRepository_SaveDevices_RemovesOtherPeers(t *testing.T) {
+	s, err := NewSqliteRepository("file:save_devices_other_peers?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	kept, dropped := newKeyFromString("kept"), newKeyFromString("dropped")
+	d := wg.Device{Id: "device1", Name: "wg0", PrivateKey: newKeyFromString("device1"), Peers: []wg.Peer{
+		{PeerConfig: wg.PeerConfig{PublicKey: kept}},
+		{PeerConfig: wg.PeerConfig{PublicKey: dropped}},
+	}}
+	if err = s.SaveDevices([]wg.Device{d}); err != nil {
+		t.Fatal("SaveDevices():", err)
+	}
+
+	for _, k := range []wg.Key{kept, dropped} {
+		if err = s.SetPeerMeta(PeerId{DeviceId: "device1", PublicKey: k}, "owner", "alice"); err != nil {
+			t.Fatal("SetPeerMeta():", err)
+		}
+	}
+
+	key := dropped
+	reservations := []Reservation{
+		{DeviceId: "device1", IP: net.ParseIP("10.0.0.2"), PublicKey: &key},
+		{DeviceId: "device1", IP: net.ParseIP("10.0.0.9")},
+	}
+	if err = s.SaveReservations(reservations); err != nil {
+		t.Fatal("SaveReservations():", err)
+	}
+
+	d.Peers = d.Peers[:1]
+	if err = s.SaveDevices([]wg.Device{d}); err != nil {
+		t.Fatal("SaveDevices():", err)
+	}
+
+	want := map[PeerId]string{{DeviceId: "device1", PublicKey: kept}: "alice"}
+	if meta, err := s.GetPeerMeta("owner"); err != nil || !reflect.DeepEqual(meta, want) {
+		t.Errorf("GetPeerMeta() = %v, %v, want only the kept peer", meta, err)
+	}
+
+	if left, err := s.ListReservations("device1"); err != nil || len(left) != 1 || left[0].PublicKey != nil {
+		t.Errorf("ListReservations() = %+v, %v, want the reservation of no peer", left, err)
+	}
+}
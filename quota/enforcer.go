@@ -0,0 +1,275 @@
+package quota
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is how often the enforcer looks at the usage unless told otherwise.
+const DefaultInterval = time.Minute
+
+// Actor is who the audit log says disabled or restricted the peers.
+var Actor = repo.Actor{Name: "quota"}
+
+// Enforcer takes the actions of the thresholds the peers reach, and undoes them once the peers are back under. The
+// usage comes from the series of the stats collector, which carry on across restarts and counter resets of the
+// devices, so the collector has to run for the quotas to count anything.
+type Enforcer struct {
+	Repo     repo.Repository
+	Stats    *stats.Store
+	Store    *Store
+	Clock    utils.Clock
+	Interval time.Duration
+
+	// Notify is told of the thresholds with the Notify action the peers reach. It logs them unless set.
+	Notify func(usage Usage, threshold Threshold)
+
+	// Sync, if set, configures the devices of the peers disabled or restricted right away, so that the actions take
+	// hold even if the change is missed by whoever syncs the devices on the changes of the repository.
+	Sync func(deviceNames []string) (int, error)
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func NewEnforcer(repository repo.Repository, series *stats.Store, store *Store, clock utils.Clock, interval time.Duration) *Enforcer {
+	return &Enforcer{
+		Repo:     repository,
+		Stats:    series,
+		Store:    store,
+		Clock:    clock,
+		Interval: interval,
+	}
+}
+
+// Usage gives the traffic of the peer of the quota since the start of its current period.
+func (e *Enforcer) Usage(q Quota) (ret Usage, err error) {
+	now := e.Clock.Now()
+	ret = Usage{Quota: q, Since: q.Since(now)}
+
+	points, err := e.Stats.Series(stats.Query{
+		DeviceName: q.DeviceName,
+		PublicKey:  q.PublicKey,
+		Resolution: e.Stats.Retention.ResolutionFor(now, ret.Since),
+		From:       ret.Since,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, p := range points {
+		ret.RxBytes += p.RxBytes
+		ret.TxBytes += p.TxBytes
+	}
+	ret.Level = q.LevelOf(ret.Used())
+	return
+}
+
+// ListUsage gives the usage of every quota.
+func (e *Enforcer) ListUsage() ([]Usage, error) {
+	quotas, err := e.Store.ListQuotas()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Usage, 0, len(quotas))
+	for _, q := range quotas {
+		u, err := e.Usage(q)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+func (e *Enforcer) findPeer(deviceName string, publicKey repo.PublicKey) (repo.PeerInfo, bool, error) {
+	peers, _, err := e.Repo.ListPeersByKeys(deviceName, []repo.PublicKey{publicKey}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil || len(peers) == 0 {
+		return repo.PeerInfo{}, false, err
+	}
+	return peers[0], true, nil
+}
+
+// lift undoes the actions taken on the peer, telling whether it changed: it gets the AllowedIPs it had before it was
+// restricted, and is enabled again if it is still disabled by the enforcer.
+func (e *Enforcer) lift(en *entry, peer *repo.PeerInfo, now time.Time) (changed bool) {
+	if en.restricted() {
+		peer.AllowedIPs = en.saved
+		en.saved = nil
+		changed = true
+	}
+
+	if !peer.Enabled() && strings.HasPrefix(peer.StateReason, ReasonPrefix) {
+		peer.SetEnabled(true, ReasonPrefix+"back under", now)
+		changed = true
+	}
+	en.level = Under
+	return
+}
+
+// act takes the action of the threshold, telling whether the peer changed.
+func (e *Enforcer) act(en *entry, peer *repo.PeerInfo, usage Usage, threshold Threshold, now time.Time) bool {
+	switch threshold.Action {
+	case Notify:
+		if e.Notify != nil {
+			e.Notify(usage, threshold)
+		} else {
+			log.Printf("quota: peer %v of %v used %v of %v bytes since %v", usage.PublicKey, usage.DeviceName,
+				usage.Used(), threshold.Bytes, usage.Since.UTC().Format(time.RFC3339))
+		}
+	case Disable:
+		peer.SetEnabled(false, fmt.Sprintf("%vused %v of %v bytes since %v", ReasonPrefix, usage.Used(), threshold.Bytes,
+			usage.Since.UTC().Format(time.RFC3339)), now)
+		return true
+	case Restrict:
+		if !en.restricted() {
+			en.saved = append(make([]net.IPNet, 0, len(peer.AllowedIPs)), peer.AllowedIPs...)
+			peer.AllowedIPs = append([]net.IPNet(nil), en.RestrictedIPs...)
+			return true
+		}
+	}
+	return false
+}
+
+// enforce brings the peer of the entry to the level of its usage, telling whether the peer changed.
+func (e *Enforcer) enforce(en *entry, peer *repo.PeerInfo, usage Usage, now time.Time) (changed bool) {
+	notified := en.level
+	from := en.level + 1
+	if usage.Level < en.level {
+		// Going back under a threshold, as when a period starts, undoes everything and redoes what's still due, without
+		// notifying again of what was notified already.
+		changed = e.lift(en, peer, now)
+		from = Soft
+	}
+
+	for level := from; level <= usage.Level; level++ {
+		threshold := usage.Threshold(level)
+		if threshold.Action == Notify && level <= notified {
+			continue
+		}
+		if e.act(en, peer, usage, threshold, now) {
+			changed = true
+		}
+	}
+	en.level = usage.Level
+	return
+}
+
+// RunOnce brings every peer with a quota to the level of its usage, and returns how many it acted on. Peers that
+// aren't in the repository are left for later.
+func (e *Enforcer) RunOnce() (count int, err error) {
+	entries, err := e.Store.selectEntries("")
+	if err != nil {
+		return
+	}
+
+	var changed []string
+	defer func() {
+		if err == nil && e.Sync != nil && len(changed) > 0 {
+			_, err = e.Sync(changed)
+		}
+	}()
+
+	r := repo.AsActor(e.Repo, Actor)
+	now := e.Clock.Now()
+	for _, en := range entries {
+		var usage Usage
+		if usage, err = e.Usage(en.Quota); err != nil {
+			return
+		}
+
+		if usage.Level == en.level {
+			continue
+		}
+
+		peer, ok, err := e.findPeer(en.DeviceName, en.PublicKey)
+		if err != nil {
+			return count, err
+		} else if !ok {
+			continue
+		}
+
+		if e.enforce(&en, &peer, usage, now) {
+			if err = r.UpdatePeers(en.DeviceName, []repo.PeerInfo{peer}); err != nil {
+				return count, err
+			}
+			changed = append(changed, en.DeviceName)
+		}
+
+		if err = e.Store.saveState(en); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return
+}
+
+// RemoveQuota lifts what the quota of the peer did to it and removes the quota.
+func (e *Enforcer) RemoveQuota(deviceName string, publicKey repo.PublicKey) error {
+	en, ok, err := e.Store.findEntry(deviceName, publicKey)
+	if err != nil || !ok {
+		return err
+	}
+
+	if en.level != Under {
+		peer, ok, err := e.findPeer(deviceName, publicKey)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if e.lift(&en, &peer, e.Clock.Now()) {
+				if err = repo.AsActor(e.Repo, Actor).UpdatePeers(deviceName, []repo.PeerInfo{peer}); err != nil {
+					return err
+				}
+
+				if e.Sync != nil {
+					if _, err = e.Sync([]string{deviceName}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return e.Store.RemoveQuota(deviceName, publicKey)
+}
+
+func (e *Enforcer) run() {
+	defer close(e.done)
+
+	for {
+		if _, err := e.RunOnce(); err != nil {
+			log.Printf("quota: unable to enforce the quotas: %v", err)
+		}
+
+		select {
+		case <-e.stop:
+			return
+		case <-e.Clock.After(e.Interval):
+		}
+	}
+}
+
+// Start runs the enforcer in the background until Close.
+func (e *Enforcer) Start() {
+	e.stop = make(chan interface{})
+	e.done = make(chan interface{})
+	go e.run()
+}
+
+func (e *Enforcer) Close() error {
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+		e.stop = nil
+	}
+	return nil
+}
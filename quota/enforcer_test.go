@@ -0,0 +1,202 @@
+package quota
+
+import (
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC)
+
+type fixture struct {
+	t        *testing.T
+	repo     repo.Repository
+	series   *stats.Store
+	clock    *utils.ManualClock
+	enforcer *Enforcer
+	notified []Usage
+
+	// total is what the device counted for alice so far.
+	total uint64
+}
+
+func newFixture(t *testing.T, name string) *fixture {
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{{PublicKey: alice, DeviceName: "wg0", Name: "alice", AllowedIPs: mustParseCIDRs(t, "10.0.0.2/32")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := stats.NewSqliteStore("file:quota_stats_"+name+"?cache=shared&mode=memory", stats.DefaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSqliteStore("file:quota_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{t: t, repo: r, series: series, clock: utils.NewManualClock(start)}
+	f.enforcer = NewEnforcer(r, series, store, f.clock, DefaultInterval)
+	f.enforcer.Notify = func(usage Usage, threshold Threshold) {
+		f.notified = append(f.notified, usage)
+	}
+
+	// The first sample only sets where the counters start from.
+	f.use(0)
+	return f
+}
+
+func (f *fixture) Close() {
+	_ = f.enforcer.Store.Close()
+	_ = f.series.Close()
+}
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) (ret []net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, *n)
+	}
+	return
+}
+
+// use has alice move the bytes an hour from now, as the collector would see it.
+func (f *fixture) use(bytes uint64) {
+	f.clock.Advance(time.Hour)
+	f.total += bytes
+	if err := f.series.Record(f.clock.Now(), []stats.Sample{{DeviceName: "wg0", PublicKey: alice, RxBytes: f.total}}); err != nil {
+		f.t.Fatal("Record():", err)
+	}
+}
+
+func (f *fixture) runOnce(want int) {
+	f.t.Helper()
+	if got, err := f.enforcer.RunOnce(); err != nil || got != want {
+		f.t.Fatalf("RunOnce() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func (f *fixture) peer() repo.PeerInfo {
+	f.t.Helper()
+	peer, ok, err := f.enforcer.findPeer("wg0", alice)
+	if err != nil || !ok {
+		f.t.Fatalf("the peer is missing: %v", err)
+	}
+	return peer
+}
+
+func TestEnforcer_Monthly(t *testing.T) {
+	f := newFixture(t, "monthly")
+	defer f.Close()
+
+	q := Quota{
+		DeviceName: "wg0",
+		PublicKey:  alice,
+		Period:     Monthly,
+		Soft:       Threshold{Bytes: 100, Action: Notify},
+		Hard:       Threshold{Bytes: 200, Action: Disable},
+	}
+	if err := f.enforcer.Store.SaveQuota(q); err != nil {
+		t.Fatal("SaveQuota():", err)
+	}
+
+	f.runOnce(0)
+
+	f.use(150)
+	f.runOnce(1)
+	f.runOnce(0)
+	if len(f.notified) != 1 || f.notified[0].Used() != 150 || f.notified[0].Level != Soft {
+		t.Errorf("notified %v, want once of 150 bytes", f.notified)
+	}
+	if !f.peer().Enabled() {
+		t.Error("the peer is disabled at the soft threshold")
+	}
+
+	f.use(100)
+	f.runOnce(1)
+	if p := f.peer(); p.Enabled() || !strings.HasPrefix(p.StateReason, ReasonPrefix) {
+		t.Errorf("the peer is not disabled by the quota past the hard threshold: %v", p.StateReason)
+	}
+
+	usage, err := f.enforcer.ListUsage()
+	if err != nil || len(usage) != 1 || usage[0].Used() != 250 || usage[0].Level != Hard || !usage[0].Since.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ListUsage() = %v, %v, want 250 bytes since February", usage, err)
+	}
+
+	// The next month starts over.
+	f.clock.Advance(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC).Sub(f.clock.Now()))
+	f.use(10)
+	f.runOnce(1)
+	if !f.peer().Enabled() {
+		t.Error("the peer is still disabled in the next month")
+	}
+	if len(f.notified) != 1 {
+		t.Errorf("notified %v times, want once", len(f.notified))
+	}
+}
+
+func TestEnforcer_Restrict(t *testing.T) {
+	f := newFixture(t, "restrict")
+	defer f.Close()
+
+	allowed, restricted := mustParseCIDRs(t, "10.0.0.2/32"), mustParseCIDRs(t, "10.9.0.0/24")
+	q := Quota{
+		DeviceName:    "wg0",
+		PublicKey:     alice,
+		Period:        Rolling,
+		Window:        24 * time.Hour,
+		Hard:          Threshold{Bytes: 100, Action: Restrict},
+		RestrictedIPs: restricted,
+	}
+	if err := f.enforcer.Store.SaveQuota(q); err != nil {
+		t.Fatal("SaveQuota():", err)
+	}
+
+	checkAllowedIPs := func(want []net.IPNet) {
+		t.Helper()
+		if got := f.peer().AllowedIPs; !reflect.DeepEqual(got, want) {
+			t.Errorf("AllowedIPs = %v, want %v", got, want)
+		}
+	}
+
+	f.use(150)
+	f.runOnce(1)
+	checkAllowedIPs(restricted)
+
+	// Once the traffic is out of the window, the peer gets its AllowedIPs back.
+	f.clock.Advance(25 * time.Hour)
+	f.runOnce(1)
+	checkAllowedIPs(allowed)
+
+	f.use(150)
+	f.runOnce(1)
+	checkAllowedIPs(restricted)
+
+	// Changing the quota keeps where the enforcer got to.
+	q.Hard.Bytes = 120
+	if err := f.enforcer.Store.SaveQuota(q); err != nil {
+		t.Fatal("SaveQuota():", err)
+	}
+	f.runOnce(0)
+
+	if err := f.enforcer.RemoveQuota("wg0", alice); err != nil {
+		t.Fatal("RemoveQuota():", err)
+	}
+	checkAllowedIPs(allowed)
+
+	if quotas, err := f.enforcer.Store.ListQuotas(); err != nil || len(quotas) != 0 {
+		t.Errorf("ListQuotas() = %v, %v, want none", quotas, err)
+	}
+}
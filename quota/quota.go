@@ -0,0 +1,186 @@
+package quota
+
+import (
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"time"
+)
+
+// Period is what a quota counts the traffic over.
+type Period string
+
+const (
+	// Monthly counts from the start of the calendar month, in UTC.
+	Monthly Period = "monthly"
+	// Rolling counts over the last Window.
+	Rolling Period = "rolling"
+)
+
+// Action is what is done to a peer once it reaches a threshold.
+type Action string
+
+const (
+	// Notify only tells the enforcer's Notify.
+	Notify Action = "notify"
+	// Disable disables the peer, with a reason starting with ReasonPrefix.
+	Disable Action = "disable"
+	// Restrict cuts the AllowedIPs of the peer down to the RestrictedIPs of the quota.
+	Restrict Action = "restrict"
+)
+
+// ReasonPrefix starts the reason of the peers the enforcer disabled, so that it only enables those again.
+const ReasonPrefix = "quota: "
+
+// Threshold is how many bytes, received and sent together, it takes to do the action. Zero Bytes is no threshold.
+type Threshold struct {
+	Bytes  uint64
+	Action Action
+}
+
+// Level is the threshold a peer has reached.
+type Level int
+
+const (
+	Under Level = 0
+	Soft  Level = 1
+	Hard  Level = 2
+)
+
+func (l Level) String() string {
+	switch l {
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	default:
+		return "under"
+	}
+}
+
+// Quota limits the traffic of a peer. The actions taken at its thresholds are undone once the usage is back under
+// them, as when the month ends.
+type Quota struct {
+	DeviceName string
+	PublicKey  repo.PublicKey
+	Period     Period
+	// Window is how far back a Rolling quota counts.
+	Window time.Duration
+	Soft   Threshold
+	Hard   Threshold
+	// RestrictedIPs are the AllowedIPs a peer is cut down to by the Restrict action.
+	RestrictedIPs []net.IPNet
+}
+
+// InvalidQuotaError tells why a quota was refused.
+type InvalidQuotaError struct {
+	Reason string
+}
+
+func (e *InvalidQuotaError) Error() string {
+	return "invalid quota: " + e.Reason
+}
+
+func invalidQuota(format string, args ...interface{}) error {
+	return &InvalidQuotaError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func (t Threshold) validate(name string) error {
+	switch t.Action {
+	case Notify, Disable, Restrict:
+		if t.Bytes == 0 {
+			return invalidQuota("the %v threshold has an action but no bytes", name)
+		}
+	case "":
+		if t.Bytes > 0 {
+			return invalidQuota("the %v threshold has no action", name)
+		}
+	default:
+		return invalidQuota("unknown action %q", t.Action)
+	}
+	return nil
+}
+
+// Validate checks the quota has a period and at least one threshold, the soft one below the hard one.
+func (q Quota) Validate() error {
+	if len(q.DeviceName) == 0 || len(q.PublicKey.String()) == 0 {
+		return invalidQuota("the peer is missing")
+	}
+
+	switch q.Period {
+	case Monthly:
+		if q.Window != 0 {
+			return invalidQuota("only rolling quotas have a window")
+		}
+	case Rolling:
+		if q.Window <= 0 {
+			return invalidQuota("a rolling quota needs a window")
+		}
+	default:
+		return invalidQuota("unknown period %q", q.Period)
+	}
+
+	if err := q.Soft.validate("soft"); err != nil {
+		return err
+	}
+	if err := q.Hard.validate("hard"); err != nil {
+		return err
+	}
+
+	if q.Soft.Bytes == 0 && q.Hard.Bytes == 0 {
+		return invalidQuota("there is no threshold")
+	}
+
+	if q.Soft.Bytes > 0 && q.Hard.Bytes > 0 && q.Soft.Bytes >= q.Hard.Bytes {
+		return invalidQuota("the soft threshold is not below the hard one")
+	}
+	return nil
+}
+
+// Since gives when the current period of the quota started.
+func (q Quota) Since(now time.Time) time.Time {
+	if q.Period == Rolling {
+		return now.Add(-q.Window)
+	}
+
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// LevelOf gives the threshold reached by having used the bytes.
+func (q Quota) LevelOf(used uint64) Level {
+	switch {
+	case q.Hard.Bytes > 0 && used >= q.Hard.Bytes:
+		return Hard
+	case q.Soft.Bytes > 0 && used >= q.Soft.Bytes:
+		return Soft
+	default:
+		return Under
+	}
+}
+
+// Threshold gives the threshold of the level.
+func (q Quota) Threshold(level Level) Threshold {
+	switch level {
+	case Soft:
+		return q.Soft
+	case Hard:
+		return q.Hard
+	default:
+		return Threshold{}
+	}
+}
+
+// Usage is the traffic of a peer in the current period of its quota.
+type Usage struct {
+	Quota
+	Since   time.Time
+	RxBytes uint64
+	TxBytes uint64
+	Level   Level
+}
+
+// Used is what counts against the quota, received and sent bytes together.
+func (u Usage) Used() uint64 {
+	return u.RxBytes + u.TxBytes
+}
@@ -0,0 +1,70 @@
+package quota
+
+import (
+	"crypto/sha256"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"testing"
+	"time"
+)
+
+var alice = repo.NewPublicKey(wgtypes.Key(sha256.Sum256([]byte("alice"))))
+
+func TestQuota_Validate(t *testing.T) {
+	valid := Quota{DeviceName: "wg0", PublicKey: alice, Period: Monthly, Hard: Threshold{Bytes: 100, Action: Disable}}
+	tests := []struct {
+		name    string
+		update  func(q *Quota)
+		wantErr bool
+	}{
+		{name: "valid", update: func(q *Quota) {}},
+		{name: "rolling", update: func(q *Quota) { q.Period, q.Window = Rolling, time.Hour }},
+		{name: "soft and hard", update: func(q *Quota) { q.Soft = Threshold{Bytes: 50, Action: Notify} }},
+		{name: "soft only", update: func(q *Quota) { q.Soft, q.Hard = Threshold{Bytes: 50, Action: Restrict}, Threshold{} }},
+		{name: "no peer", update: func(q *Quota) { q.PublicKey = repo.PublicKey{} }, wantErr: true},
+		{name: "period", update: func(q *Quota) { q.Period = "weekly" }, wantErr: true},
+		{name: "monthly with a window", update: func(q *Quota) { q.Window = time.Hour }, wantErr: true},
+		{name: "rolling without a window", update: func(q *Quota) { q.Period = Rolling }, wantErr: true},
+		{name: "no threshold", update: func(q *Quota) { q.Hard = Threshold{} }, wantErr: true},
+		{name: "action", update: func(q *Quota) { q.Hard.Action = "throttle" }, wantErr: true},
+		{name: "no action", update: func(q *Quota) { q.Hard.Action = "" }, wantErr: true},
+		{name: "no bytes", update: func(q *Quota) { q.Soft = Threshold{Action: Notify} }, wantErr: true},
+		{name: "soft above hard", update: func(q *Quota) { q.Soft = Threshold{Bytes: 100, Action: Notify} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := valid
+			tt.update(&q)
+
+			err := q.Validate()
+			if _, ok := err.(*InvalidQuotaError); ok != tt.wantErr || (err != nil && !ok) {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuota_Since(t *testing.T) {
+	now := time.Date(2020, 3, 15, 10, 30, 0, 0, time.UTC)
+
+	if got, want := (Quota{Period: Monthly}).Since(now), time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Since() of a monthly quota = %v, want %v", got, want)
+	}
+
+	if got, want := (Quota{Period: Rolling, Window: 7 * 24 * time.Hour}).Since(now), now.Add(-7*24*time.Hour); !got.Equal(want) {
+		t.Errorf("Since() of a rolling quota = %v, want %v", got, want)
+	}
+}
+
+func TestQuota_LevelOf(t *testing.T) {
+	q := Quota{Soft: Threshold{Bytes: 50, Action: Notify}, Hard: Threshold{Bytes: 100, Action: Disable}}
+	for used, want := range map[uint64]Level{0: Under, 49: Under, 50: Soft, 99: Soft, 100: Hard, 1000: Hard} {
+		if got := q.LevelOf(used); got != want {
+			t.Errorf("LevelOf(%v) = %v, want %v", used, got, want)
+		}
+	}
+
+	if got := (Quota{Soft: Threshold{Bytes: 50, Action: Notify}}).LevelOf(1000); got != Soft {
+		t.Errorf("LevelOf() without a hard threshold = %v, want %v", got, Soft)
+	}
+}
@@ -0,0 +1,222 @@
+package quota
+
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"strings"
+	"time"
+)
+
+var tableMigrations = [][]string{
+	{
+		// level and saved_allowed_ips are where the enforcer got to: the threshold it acted on last, and the
+		// AllowedIPs the peer had before it was restricted, NULL unless it is.
+		`CREATE TABLE quotas(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				period TEXT NOT NULL,
+				window_seconds INTEGER NOT NULL,
+				soft_bytes INTEGER NOT NULL,
+				soft_action TEXT NOT NULL,
+				hard_bytes INTEGER NOT NULL,
+				hard_action TEXT NOT NULL,
+				restricted_ips TEXT NOT NULL,
+				level INTEGER NOT NULL DEFAULT 0,
+				saved_allowed_ips TEXT,
+				PRIMARY KEY (device_name, public_key)
+			)`,
+	},
+}
+
+// Store keeps the quotas in SQLite, in tables of their own so that it can share the database of the other stores.
+type Store struct {
+	*sqlx.DB
+}
+
+type quota struct {
+	DeviceName      string         `db:"device_name"`
+	PublicKey       repo.PublicKey `db:"public_key"`
+	Period          string         `db:"period"`
+	Window          int64          `db:"window_seconds"`
+	SoftBytes       uint64         `db:"soft_bytes"`
+	SoftAction      string         `db:"soft_action"`
+	HardBytes       uint64         `db:"hard_bytes"`
+	HardAction      string         `db:"hard_action"`
+	RestrictedIPs   string         `db:"restricted_ips"`
+	Level           Level          `db:"level"`
+	SavedAllowedIPs sql.NullString `db:"saved_allowed_ips"`
+}
+
+// entry is a quota with where the enforcer got to.
+type entry struct {
+	Quota
+	level Level
+	// saved are the AllowedIPs of a restricted peer before it was, nil if it isn't.
+	saved []net.IPNet
+}
+
+func (e entry) restricted() bool {
+	return e.saved != nil
+}
+
+func joinIPs(ips []net.IPNet) string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return strings.Join(ret, ",")
+}
+
+// splitIPs reads the IPs joined by joinIPs, giving an empty slice rather than nil for none.
+func splitIPs(s string) ([]net.IPNet, error) {
+	ret := make([]net.IPNet, 0)
+	if len(s) == 0 {
+		return ret, nil
+	}
+
+	for _, ip := range strings.Split(s, ",") {
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *ipNet)
+	}
+	return ret, nil
+}
+
+func (q *quota) UpdateFrom(o entry) {
+	q.DeviceName = o.DeviceName
+	q.PublicKey = o.PublicKey
+	q.Period = string(o.Period)
+	q.Window = int64(o.Window / time.Second)
+	q.SoftBytes = o.Soft.Bytes
+	q.SoftAction = string(o.Soft.Action)
+	q.HardBytes = o.Hard.Bytes
+	q.HardAction = string(o.Hard.Action)
+	q.RestrictedIPs = joinIPs(o.RestrictedIPs)
+	q.Level = o.level
+
+	q.SavedAllowedIPs = sql.NullString{}
+	if o.restricted() {
+		q.SavedAllowedIPs = sql.NullString{String: joinIPs(o.saved), Valid: true}
+	}
+}
+
+func (q quota) toEntry() (ret entry, err error) {
+	ret = entry{
+		Quota: Quota{
+			DeviceName: q.DeviceName,
+			PublicKey:  q.PublicKey,
+			Period:     Period(q.Period),
+			Window:     time.Duration(q.Window) * time.Second,
+			Soft:       Threshold{Bytes: q.SoftBytes, Action: Action(q.SoftAction)},
+			Hard:       Threshold{Bytes: q.HardBytes, Action: Action(q.HardAction)},
+		},
+		level: q.Level,
+	}
+
+	if ret.RestrictedIPs, err = splitIPs(q.RestrictedIPs); err != nil {
+		return
+	}
+
+	if q.SavedAllowedIPs.Valid {
+		ret.saved, err = splitIPs(q.SavedAllowedIPs.String)
+	}
+	return
+}
+
+func NewSqliteStore(dsn string) (*Store, error) {
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{DB: db}
+	if err = schema.MigrateDB(db, "quota_", tableMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// SaveQuota adds the quota of a peer or replaces it, keeping where the enforcer got to with the one it replaces.
+func (s *Store) SaveQuota(q Quota) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	var row quota
+	row.UpdateFrom(entry{Quota: q})
+	_, err := s.NamedExec(`INSERT INTO quotas(device_name, public_key, period, window_seconds, soft_bytes, soft_action, hard_bytes, hard_action, restricted_ips)
+							VALUES (:device_name, :public_key, :period, :window_seconds, :soft_bytes, :soft_action, :hard_bytes, :hard_action, :restricted_ips)
+							ON CONFLICT (device_name, public_key) DO UPDATE SET
+								period = excluded.period,
+								window_seconds = excluded.window_seconds,
+								soft_bytes = excluded.soft_bytes,
+								soft_action = excluded.soft_action,
+								hard_bytes = excluded.hard_bytes,
+								hard_action = excluded.hard_action,
+								restricted_ips = excluded.restricted_ips`, row)
+	return err
+}
+
+func (s *Store) RemoveQuota(deviceName string, publicKey repo.PublicKey) error {
+	_, err := s.Exec("DELETE FROM quotas WHERE device_name = ? AND public_key = ?", deviceName, publicKey)
+	return err
+}
+
+func (s *Store) selectEntries(query string, args ...interface{}) (ret []entry, err error) {
+	var rows []quota
+	if err = s.Select(&rows, "SELECT * FROM quotas "+query+" ORDER BY device_name, public_key", args...); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		var e entry
+		if e, err = row.toEntry(); err != nil {
+			return
+		}
+		ret = append(ret, e)
+	}
+	return
+}
+
+func (s *Store) findEntry(deviceName string, publicKey repo.PublicKey) (entry, bool, error) {
+	entries, err := s.selectEntries("WHERE device_name = ? AND public_key = ?", deviceName, publicKey)
+	if err != nil || len(entries) == 0 {
+		return entry{}, false, err
+	}
+	return entries[0], true, nil
+}
+
+// saveState records where the enforcer got to with the quota of the entry.
+func (s *Store) saveState(e entry) error {
+	var row quota
+	row.UpdateFrom(e)
+	_, err := s.NamedExec("UPDATE quotas SET level = :level, saved_allowed_ips = :saved_allowed_ips WHERE device_name = :device_name AND public_key = :public_key", row)
+	return err
+}
+
+// ListQuotas lists the quotas of every peer, by device and public key.
+func (s *Store) ListQuotas() ([]Quota, error) {
+	entries, err := s.selectEntries("")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Quota, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e.Quota)
+	}
+	return ret, nil
+}
+
+// FindQuota gives the quota of the peer, ok false if it has none.
+func (s *Store) FindQuota(deviceName string, publicKey repo.PublicKey) (Quota, bool, error) {
+	e, ok, err := s.findEntry(deviceName, publicKey)
+	return e.Quota, ok, err
+}
@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrAddressTaken is what writing a peer fails with when another peer of its device has one of its addresses.
+	ErrAddressTaken = errors.New("another peer of the device has the address")
+
+	// ErrPeerExists is what adding a peer fails with when its device has it already.
+	ErrPeerExists = errors.New("the device has the peer already")
+
+	// ErrOwnerLimit is what adding a peer fails with when its owner has as many as they may.
+	ErrOwnerLimit = errors.New("the owner has as many peers as they may")
+)
+
+// PeerAddresses gives the host addresses among the AllowedIPs, which no two peers of a device may share. The wider
+// networks routed to a peer, such as the LAN of a site, aren't addresses of its own.
+func PeerAddresses(allowedIPs []net.IPNet) (ret []string) {
+	seen := make(map[string]bool, len(allowedIPs))
+	for _, ip := range allowedIPs {
+		if ones, bits := ip.Mask.Size(); ones != bits || bits == 0 {
+			continue
+		}
+
+		if address := ip.String(); !seen[address] {
+			seen[address] = true
+			ret = append(ret, address)
+		}
+	}
+	return
+}
+
+// checkAddresses fails with ErrAddressTaken if writing the peers over those of the device would give an address to
+// two of them.
+func checkAddresses(stored map[PublicKey]*PeerInfo, peers []PeerInfo) error {
+	owners := make(map[string]PublicKey)
+	written := make(map[PublicKey]bool, len(peers))
+	for _, p := range peers {
+		written[p.PublicKey] = true
+	}
+
+	for k, p := range stored {
+		if !written[k] {
+			for _, address := range PeerAddresses(p.AllowedIPs) {
+				owners[address] = k
+			}
+		}
+	}
+
+	for _, p := range peers {
+		for _, address := range PeerAddresses(p.AllowedIPs) {
+			if owner, ok := owners[address]; ok && owner != p.PublicKey {
+				return ErrAddressTaken
+			}
+			owners[address] = p.PublicKey
+		}
+	}
+	return nil
+}
+
+// PeerAdder is a Repository that makes the checks of adding a peer in the transaction that adds it, so that they
+// hold even with other instances writing to the same database.
+type PeerAdder interface {
+	// AddPeer adds the peer to its device, failing with ErrPeerExists if the device has it already and with
+	// ErrOwnerLimit if its owner has maxOwned peers already, unless maxOwned is negative.
+	AddPeer(peer PeerInfo, maxOwned int) error
+}
+
+// AddPeer adds the peer through r as PeerAdder does. The repositories that aren't PeerAdders are checked before the
+// peer is written, which only holds while nothing else writes to them.
+func AddPeer(r Repository, peer PeerInfo, maxOwned int) error {
+	if a, ok := r.(PeerAdder); ok {
+		return a.AddPeer(peer, maxOwned)
+	}
+
+	existing, _, err := r.ListPeersByKeys(peer.DeviceName, []PublicKey{peer.PublicKey}, OrderNameAsc, PageRequest{})
+	if err != nil {
+		return err
+	} else if len(existing) > 0 {
+		return ErrPeerExists
+	}
+
+	if maxOwned >= 0 {
+		owned, _, err := r.ListPeers(PeerFilter{Owner: peer.Owner}, OrderNameAsc, PageRequest{})
+		if err != nil {
+			return err
+		} else if len(owned) >= maxOwned {
+			return ErrOwnerLimit
+		}
+	}
+
+	return r.UpdatePeers(peer.DeviceName, []PeerInfo{peer})
+}
@@ -0,0 +1,270 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	AuditDeviceUpdated AuditAction = "device.updated"
+	AuditDeviceRemoved AuditAction = "device.removed"
+	AuditPeerUpdated   AuditAction = "peer.updated"
+	AuditPeerRemoved   AuditAction = "peer.removed"
+)
+
+// Actor is who makes a change, as recorded in the audit log.
+type Actor struct {
+	Name     string
+	SourceIP string
+}
+
+// AuditChange is the value of a field before and after a change. A nil Before is a field that did not exist, as
+// when a peer is added, and a nil After one that no longer does.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry records a change to a device, or to a peer when PublicKey is set. Changes made outside the repository
+// may be to something else, named by Subject, such as a user. Changes only has the fields that changed; secrets are
+// never recorded, only a fingerprint telling one from another.
+type AuditEntry struct {
+	Id         int64
+	Time       time.Time
+	Actor      Actor
+	Action     AuditAction
+	DeviceName string
+	PublicKey  string
+	Subject    string
+	Changes    map[string]AuditChange
+}
+
+// AuditFilter narrows down the entries returned by AuditLog.ListAudit. Zero-valued fields are ignored.
+type AuditFilter struct {
+	Actor      string
+	Action     AuditAction
+	DeviceName string
+	PublicKey  string
+	Subject    string
+	Since      time.Time
+	Until      time.Time
+}
+
+// AuditLog is a Repository that records every change made through it, in the same transaction as the change.
+type AuditLog interface {
+	// WithActor gives a view of the repository whose changes are recorded as made by actor. Closing the view
+	// leaves the repository open.
+	WithActor(actor Actor) Repository
+
+	// Record writes entry for a change made outside the repository, as made by the actor of the view. The entry
+	// gets its id and time as it's written.
+	Record(entry AuditEntry) error
+
+	// ListAudit lists the entries from the newest. A page's cursor is the id of the entry it starts after, so
+	// there's only ever a next page.
+	ListAudit(filter AuditFilter, page PageRequest) (data []AuditEntry, cursors PageCursors, err error)
+}
+
+// AsActor gives the view of r acting as actor if r keeps an audit log, or r itself otherwise.
+func AsActor(r Repository, actor Actor) Repository {
+	if a, ok := r.(AuditLog); ok {
+		return a.WithActor(actor)
+	}
+	return r
+}
+
+func (f AuditFilter) Match(e *AuditEntry) bool {
+	return (len(f.Actor) == 0 || e.Actor.Name == f.Actor) &&
+		(len(f.Action) == 0 || e.Action == f.Action) &&
+		(len(f.DeviceName) == 0 || e.DeviceName == f.DeviceName) &&
+		(len(f.PublicKey) == 0 || e.PublicKey == f.PublicKey) &&
+		(len(f.Subject) == 0 || e.Subject == f.Subject) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// ParseAuditCursor gives the id a page starts after, or 0 for the first page.
+func ParseAuditCursor(cursor string) (int64, error) {
+	if len(cursor) == 0 {
+		return 0, nil
+	}
+
+	if id, err := strconv.ParseInt(cursor, 10, 64); err != nil || id <= 0 {
+		return 0, InvalidCursor
+	} else {
+		return id, nil
+	}
+}
+
+// AuditCursorsFor gives the cursors of a page of entries, more telling whether there are entries after it.
+func AuditCursorsFor(data []AuditEntry, more bool) (ret PageCursors) {
+	if more && len(data) > 0 {
+		ret.Next = strconv.FormatInt(data[len(data)-1].Id, 10)
+	}
+	return
+}
+
+type deviceAudit struct {
+	PublicKey  string `json:"public_key"`
+	ListenPort uint16 `json:"listen_port"`
+}
+
+type peerAudit struct {
+	Name                string            `json:"name"`
+	PreSharedKey        string            `json:"pre_shared_key"`
+	Endpoint            string            `json:"endpoint"`
+	PersistentKeepalive string            `json:"persistent_keepalive"`
+	AllowedIPs          []string          `json:"allowed_ips"`
+	Meta                map[string]string `json:"meta"`
+	Tags                []string          `json:"tags"`
+	Groups              []string          `json:"groups"`
+	Disabled            bool              `json:"disabled"`
+	StateReason         string            `json:"state_reason"`
+	ExpiresAt           int64             `json:"expires_at"`
+	Owner               string            `json:"owner"`
+}
+
+// fingerprint tells a secret from another without giving it away: the start of its hash, or "" if it isn't set.
+func fingerprint(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditFields flattens the audited view of an entity into its fields, as they come out of JSON.
+func auditFields(v interface{}) map[string]interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	var ret map[string]interface{}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func diffAuditFields(before map[string]interface{}, after map[string]interface{}) map[string]AuditChange {
+	ret := make(map[string]AuditChange)
+	for k, v := range after {
+		if b := before[k]; !reflect.DeepEqual(b, v) {
+			ret[k] = AuditChange{Before: b, After: v}
+		}
+	}
+
+	for k, v := range before {
+		if _, ok := after[k]; !ok && v != nil {
+			ret[k] = AuditChange{Before: v}
+		}
+	}
+	return ret
+}
+
+// AuditChanges gives the fields that differ between before and after, the views of something as they're to be
+// audited, either of which is nil when it's added or removed. The views are compared as they come out of JSON.
+func AuditChanges(before interface{}, after interface{}) map[string]AuditChange {
+	return diffAuditFields(auditFields(before), auditFields(after))
+}
+
+func deviceAuditFields(d *DeviceInfo) map[string]interface{} {
+	if d == nil {
+		return nil
+	}
+
+	a := deviceAudit{ListenPort: d.ListenPort}
+	if k, err := d.PrivateKey.ToKey(); err == nil {
+		a.PublicKey = NewPublicKey(k.PublicKey()).String()
+	}
+
+	return auditFields(a)
+}
+
+func peerAuditFields(p *PeerInfo) map[string]interface{} {
+	if p == nil {
+		return nil
+	}
+
+	a := peerAudit{
+		Name:                p.Name,
+		PreSharedKey:        fingerprint(p.PreSharedKey.String()),
+		PersistentKeepalive: p.PersistentKeepaliveInterval.String(),
+		Meta:                p.Meta,
+		Tags:                normaliseLabels(p.Tags),
+		Groups:              normaliseLabels(p.Groups),
+		Disabled:            p.Disabled,
+		StateReason:         p.StateReason,
+		ExpiresAt:           p.ExpiresAt,
+		Owner:               p.Owner,
+	}
+
+	if len(p.Meta) == 0 {
+		a.Meta = nil
+	}
+
+	if p.Endpoint != nil {
+		a.Endpoint = p.Endpoint.String()
+	}
+
+	for _, ip := range p.AllowedIPs {
+		a.AllowedIPs = append(a.AllowedIPs, ip.String())
+	}
+	sort.Strings(a.AllowedIPs)
+
+	return auditFields(a)
+}
+
+// DeviceAuditEntry records a device going from before to after, either of which is nil when the device is added
+// or removed. It returns nil if nothing audited has changed.
+func DeviceAuditEntry(actor Actor, before *DeviceInfo, after *DeviceInfo) *AuditEntry {
+	e := AuditEntry{
+		Actor:   actor,
+		Action:  AuditDeviceUpdated,
+		Changes: diffAuditFields(deviceAuditFields(before), deviceAuditFields(after)),
+	}
+
+	if after != nil {
+		e.DeviceName = after.Name
+	} else {
+		e.DeviceName = before.Name
+		e.Action = AuditDeviceRemoved
+	}
+
+	if len(e.Changes) == 0 && e.Action == AuditDeviceUpdated {
+		return nil
+	}
+	return &e
+}
+
+// PeerAuditEntry records a peer of the device going from before to after, as DeviceAuditEntry does for devices.
+// Handshakes aren't changes anyone made, so they are not audited.
+func PeerAuditEntry(actor Actor, deviceName string, before *PeerInfo, after *PeerInfo) *AuditEntry {
+	e := AuditEntry{
+		Actor:      actor,
+		Action:     AuditPeerUpdated,
+		DeviceName: deviceName,
+		Changes:    diffAuditFields(peerAuditFields(before), peerAuditFields(after)),
+	}
+
+	if after != nil {
+		e.PublicKey = after.PublicKey.String()
+	} else {
+		e.PublicKey = before.PublicKey.String()
+		e.Action = AuditPeerRemoved
+	}
+
+	if len(e.Changes) == 0 && e.Action == AuditPeerUpdated {
+		return nil
+	}
+	return &e
+}
@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"reflect"
+	"testing"
+)
+
+func TestPeerAuditEntry(t *testing.T) {
+	actor := Actor{Name: "alice", SourceIP: "192.0.2.1"}
+	before := genPagedPeers(1)[0]
+	before.Tags = []string{"b", "a"}
+
+	k, _ := wgtypes.GenerateKey()
+	psk := NewSymmetricKey(k)
+
+	tests := []struct {
+		name   string
+		before *PeerInfo
+		change func(p *PeerInfo)
+		want   *AuditEntry
+	}{
+		{
+			name:   "handshake only",
+			before: &before,
+			change: func(p *PeerInfo) {
+				p.LastHandshake++
+				p.Tags = []string{"a", "b", "a"}
+				p.Meta = map[string]string{}
+			},
+			want: nil,
+		},
+		{
+			name:   "renamed and disabled",
+			before: &before,
+			change: func(p *PeerInfo) {
+				p.Name = "renamed"
+				p.Disabled = true
+			},
+			want: &AuditEntry{
+				Actor:      actor,
+				Action:     AuditPeerUpdated,
+				DeviceName: "wg0",
+				PublicKey:  before.PublicKey.String(),
+				Changes: map[string]AuditChange{
+					"name":     {Before: before.Name, After: "renamed"},
+					"disabled": {Before: false, After: true},
+				},
+			},
+		},
+		{
+			name:   "pre-shared key is recorded by its fingerprint",
+			before: &before,
+			change: func(p *PeerInfo) {
+				p.PreSharedKey = psk
+			},
+			want: &AuditEntry{
+				Actor:      actor,
+				Action:     AuditPeerUpdated,
+				DeviceName: "wg0",
+				PublicKey:  before.PublicKey.String(),
+				Changes: map[string]AuditChange{
+					"pre_shared_key": {Before: fingerprint(before.PreSharedKey.String()), After: fingerprint(psk.String())},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := *tt.before
+			tt.change(&after)
+
+			if got := PeerAuditEntry(actor, "wg0", tt.before, &after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PeerAuditEntry() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Replacing a pre-shared key with another is recorded as well, the fingerprints telling them apart.
+	keyed := before
+	keyed.PreSharedKey = psk
+	rotated := keyed
+	k, _ = wgtypes.GenerateKey()
+	rotated.PreSharedKey = NewSymmetricKey(k)
+	if got := PeerAuditEntry(actor, "wg0", &keyed, &rotated); got == nil || len(got.Changes) != 1 ||
+		got.Changes["pre_shared_key"].Before == got.Changes["pre_shared_key"].After {
+		t.Errorf("PeerAuditEntry() of a rotated pre-shared key = %+v", got)
+	}
+
+	removed := PeerAuditEntry(actor, "wg0", &before, nil)
+	if removed == nil || removed.Action != AuditPeerRemoved || removed.Changes["name"].Before != before.Name ||
+		removed.Changes["name"].After != nil {
+		t.Errorf("PeerAuditEntry() of a removal = %+v", removed)
+	}
+}
+
+func TestAuditChanges(t *testing.T) {
+	type user struct {
+		Role     string `json:"role"`
+		MaxPeers uint   `json:"max_peers"`
+	}
+
+	got := AuditChanges(&user{Role: "user", MaxPeers: 1}, &user{Role: "user", MaxPeers: 2})
+	if want := map[string]AuditChange{"max_peers": {Before: 1.0, After: 2.0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AuditChanges() = %v, want %v", got, want)
+	}
+
+	var removed *user
+	if got = AuditChanges(&user{Role: "admin"}, removed); got["role"].Before != "admin" || got["role"].After != nil {
+		t.Errorf("AuditChanges() of a removal = %v", got)
+	}
+}
+
+func TestMemRepository_ListAudit(t *testing.T) {
+	r, peers := newGroupedRepository(t)
+	log := r.(AuditLog)
+
+	alice := AsActor(r, Actor{Name: "alice"})
+	if _, err := SetPeersEnabled(alice, "wg0", []PublicKey{peers[0].PublicKey}, false, "lost laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RemovePeers("wg1", []PublicKey{peers[1].PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, cursors, err := log.ListAudit(AuditFilter{Actor: "alice"}, PageRequest{Limit: 1})
+	if err != nil || len(got) != 1 || len(cursors.Next) == 0 {
+		t.Fatalf("ListAudit() = %+v, %+v, %v", got, cursors, err)
+	}
+	if got[0].Action != AuditPeerRemoved || got[0].DeviceName != "wg1" || got[0].PublicKey != peers[1].PublicKey.String() {
+		t.Errorf("newest entry = %+v, want the removal", got[0])
+	}
+
+	if got, cursors, err = log.ListAudit(AuditFilter{Actor: "alice"}, PageRequest{Cursor: cursors.Next}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(cursors.Next) != 0 || got[0].Changes["state_reason"].After != "lost laptop" {
+		t.Errorf("next page = %+v, %+v, want the disabling", got, cursors)
+	}
+
+	if got, _, err = log.ListAudit(AuditFilter{Action: AuditDeviceUpdated}, PageRequest{}); err != nil || len(got) != 2 {
+		t.Errorf("ListAudit(device.updated) = %+v, %v, want both devices added", got, err)
+	}
+	if got[0].Actor.Name != "" || got[0].Changes["listen_port"].After == nil {
+		t.Errorf("device entry = %+v", got[0])
+	}
+
+	// Changes made elsewhere are recorded as made by the actor of the view.
+	recorded := AuditEntry{Action: "user.removed", Subject: "bob", Changes: map[string]AuditChange{"role": {Before: "user"}}}
+	if err = AsActor(r, Actor{Name: "alice"}).(AuditLog).Record(recorded); err != nil {
+		t.Fatal("Record():", err)
+	}
+	if got, _, err = log.ListAudit(AuditFilter{Subject: "bob"}, PageRequest{}); err != nil || len(got) != 1 ||
+		got[0].Actor.Name != "alice" || got[0].Action != recorded.Action || got[0].Time.IsZero() {
+		t.Errorf("ListAudit(subject bob) = %+v, %v, want the recorded entry", got, err)
+	}
+
+	if _, _, err = log.ListAudit(AuditFilter{}, PageRequest{Cursor: "x"}); err != InvalidCursor {
+		t.Errorf("ListAudit() with a bad cursor = %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+)
+
+// peersByDevice reads every peer matching the filter, grouped by their device.
+func peersByDevice(r Repository, filter PeerFilter) (map[string][]PeerInfo, error) {
+	peers, _, err := r.ListPeers(filter, OrderNameAsc, PageRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]PeerInfo)
+	for _, p := range peers {
+		ret[p.DeviceName] = append(ret[p.DeviceName], p)
+	}
+	return ret, nil
+}
+
+// DeviceAddresses gives the AllowedIPs of the peers of the device, which no new peer should be given.
+func DeviceAddresses(r Repository, deviceName string) (ret []net.IPNet, err error) {
+	peers, _, err := r.ListPeersByDevices([]string{deviceName}, OrderNameAsc, PageRequest{})
+	for _, p := range peers {
+		ret = append(ret, p.AllowedIPs...)
+	}
+	return
+}
+
+// updateMatching changes every peer matching the filter and saves them a device at a time.
+func updateMatching(r Repository, filter PeerFilter, update func(peer *PeerInfo) error) (count int, err error) {
+	devices, err := peersByDevice(r, filter)
+	if err != nil {
+		return
+	}
+
+	for deviceName, peers := range devices {
+		for i := range peers {
+			if err = update(&peers[i]); err != nil {
+				return
+			}
+		}
+
+		if err = r.UpdatePeers(deviceName, peers); err != nil {
+			return
+		}
+		count += len(peers)
+	}
+
+	return
+}
+
+// RemoveMatchingPeers removes every peer matching the filter, such as all the peers of a group, and tells how many
+// there were. Each device's peers go at once but a failure can leave other devices' in place.
+func RemoveMatchingPeers(r Repository, filter PeerFilter) (count int, err error) {
+	devices, err := peersByDevice(r, filter)
+	if err != nil {
+		return
+	}
+
+	for deviceName, peers := range devices {
+		if err = r.RemovePeers(deviceName, peerKeys(peers)); err != nil {
+			return
+		}
+		count += len(peers)
+	}
+
+	return
+}
+
+// SetMatchingAllowedIPs replaces the AllowedIPs of every peer matching the filter.
+func SetMatchingAllowedIPs(r Repository, filter PeerFilter, allowedIPs []net.IPNet) (int, error) {
+	return updateMatching(r, filter, func(peer *PeerInfo) error {
+		peer.AllowedIPs = append([]net.IPNet(nil), allowedIPs...)
+		return nil
+	})
+}
+
+// RotateMatchingPreSharedKeys gives every peer matching the filter a new random pre-shared key of its own.
+func RotateMatchingPreSharedKeys(r Repository, filter PeerFilter) (int, error) {
+	return updateMatching(r, filter, func(peer *PeerInfo) error {
+		if k, err := wgtypes.GenerateKey(); err != nil {
+			return err
+		} else {
+			peer.PreSharedKey = NewSymmetricKey(k)
+			return nil
+		}
+	})
+}
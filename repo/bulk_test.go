@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"net"
+	"testing"
+)
+
+func newGroupedRepository(t *testing.T) (Repository, []PeerInfo) {
+	r := NewMemRepository()
+	if err := r.UpdateDevices([]DeviceInfo{{Name: "wg0"}, {Name: "wg1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := genPagedPeers(4)
+	for i := range peers {
+		peers[i].DeviceName = []string{"wg0", "wg1"}[i%2]
+		if i < 3 {
+			peers[i].Groups = []string{"engineering"}
+		}
+	}
+
+	for _, p := range peers {
+		if err := r.UpdatePeers(p.DeviceName, []PeerInfo{p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return r, peers
+}
+
+func listGroup(t *testing.T, r Repository, group string) []PeerInfo {
+	peers, _, err := r.ListPeers(PeerFilter{Group: group}, OrderNameAsc, PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func TestRemoveMatchingPeers(t *testing.T) {
+	r, _ := newGroupedRepository(t)
+
+	if count, err := RemoveMatchingPeers(r, PeerFilter{Group: "engineering"}); err != nil || count != 3 {
+		t.Fatalf("RemoveMatchingPeers() = %v, %v, want 3", count, err)
+	}
+
+	if left, _, _ := r.ListPeers(PeerFilter{}, OrderNameAsc, PageRequest{}); len(left) != 1 || len(left[0].Groups) != 0 {
+		t.Errorf("peers left = %v, want the one outside the group", left)
+	}
+}
+
+func TestSetMatchingAllowedIPs(t *testing.T) {
+	r, _ := newGroupedRepository(t)
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+
+	if count, err := SetMatchingAllowedIPs(r, PeerFilter{Group: "engineering"}, []net.IPNet{*network}); err != nil || count != 3 {
+		t.Fatalf("SetMatchingAllowedIPs() = %v, %v, want 3", count, err)
+	}
+
+	for _, p := range listGroup(t, r, "engineering") {
+		if len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "10.1.0.0/16" {
+			t.Errorf("AllowedIPs of %v = %v", p.PublicKey, p.AllowedIPs)
+		}
+	}
+
+	if outside, _, _ := r.ListPeers(PeerFilter{AllowedIP: net.ParseIP("10.1.0.1")}, OrderNameAsc, PageRequest{}); len(outside) != 3 {
+		t.Errorf("peers in 10.1.0.0/16 = %v, want only the group", len(outside))
+	}
+}
+
+func TestRotateMatchingPreSharedKeys(t *testing.T) {
+	r, _ := newGroupedRepository(t)
+
+	if count, err := RotateMatchingPreSharedKeys(r, PeerFilter{Group: "engineering"}); err != nil || count != 3 {
+		t.Fatalf("RotateMatchingPreSharedKeys() = %v, %v, want 3", count, err)
+	}
+
+	seen := make(map[SymmetricKey]bool)
+	for _, p := range listGroup(t, r, "engineering") {
+		if len(p.PreSharedKey.String()) == 0 || seen[p.PreSharedKey] {
+			t.Errorf("pre-shared key of %v = %q, want a new one of its own", p.PublicKey, p.PreSharedKey)
+		}
+		seen[p.PreSharedKey] = true
+	}
+}
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+type ChangeEventType int
+
+const (
+	DeviceUpdated ChangeEventType = 0
+	DeviceRemoved ChangeEventType = 1
+	PeersUpdated  ChangeEventType = 2
+	PeersRemoved  ChangeEventType = 3
+)
+
+func (t ChangeEventType) String() string {
+	switch t {
+	case DeviceUpdated:
+		return "DeviceUpdated"
+	case DeviceRemoved:
+		return "DeviceRemoved"
+	case PeersUpdated:
+		return "PeersUpdated"
+	case PeersRemoved:
+		return "PeersRemoved"
+	default:
+		return fmt.Sprintf("ChangeEventType(%d)", int(t))
+	}
+}
+
+// ChangeEvent describes a change that has been committed to a Repository.
+// Device events list every affected device in DeviceNames. Peer events carry exactly one device name, the device
+// the peers in PublicKeys belong to.
+type ChangeEvent struct {
+	Type        ChangeEventType
+	DeviceNames []string
+	PublicKeys  []PublicKey
+}
+
+// ChangeEventQueueSize is the number of undelivered events buffered for each listener.
+//
+// When a listener falls behind and its queue is full, the oldest pending event is dropped to make room for the new
+// one, so a slow listener never blocks the repository and always ends up with the most recent changes.
+const ChangeEventQueueSize = 64
+
+type ChangeNotification interface {
+	io.Closer
+
+	// AddChangeNotification registers a new listener and returns the channel its events are delivered on.
+	// The channel is closed when the listener is removed or the repository is closed.
+	AddChangeNotification() <-chan ChangeEvent
+	RemoveChangeNotification(channel <-chan ChangeEvent)
+}
+
+type DefaultChangeNotificationHandler struct {
+	listeners      map[<-chan ChangeEvent]chan ChangeEvent
+	listenersMutex sync.Mutex
+	closed         bool
+}
+
+func (d *DefaultChangeNotificationHandler) Close() error {
+	d.listenersMutex.Lock()
+	defer d.listenersMutex.Unlock()
+
+	for _, c := range d.listeners {
+		close(c)
+	}
+
+	d.listeners = nil
+	d.closed = true
+	return nil
+}
+
+// NotifyChange delivers events to every listener without blocking. See ChangeEventQueueSize for the overflow policy.
+func (d *DefaultChangeNotificationHandler) NotifyChange(events ...ChangeEvent) {
+	d.listenersMutex.Lock()
+	defer d.listenersMutex.Unlock()
+
+	for _, e := range events {
+		for _, c := range d.listeners {
+			select {
+			case c <- e:
+				continue
+			default:
+			}
+
+			// Queue is full: drop the oldest event. Only we send on c and we hold the lock, so there is room after this.
+			select {
+			case <-c:
+			default:
+			}
+			c <- e
+		}
+	}
+}
+
+func (d *DefaultChangeNotificationHandler) AddChangeNotification() <-chan ChangeEvent {
+	d.listenersMutex.Lock()
+	defer d.listenersMutex.Unlock()
+
+	c := make(chan ChangeEvent, ChangeEventQueueSize)
+	if d.closed {
+		close(c)
+		return c
+	}
+
+	if d.listeners == nil {
+		d.listeners = make(map[<-chan ChangeEvent]chan ChangeEvent)
+	}
+
+	d.listeners[c] = c
+	return c
+}
+
+func (d *DefaultChangeNotificationHandler) RemoveChangeNotification(channel <-chan ChangeEvent) {
+	d.listenersMutex.Lock()
+	defer d.listenersMutex.Unlock()
+
+	if c, ok := d.listeners[channel]; ok {
+		delete(d.listeners, channel)
+		close(c)
+	}
+}
+
+func deviceNames(devices []DeviceInfo) []string {
+	ret := make([]string, 0, len(devices))
+	for _, d := range devices {
+		ret = append(ret, d.Name)
+	}
+	return ret
+}
+
+func peerKeys(peers []PeerInfo) []PublicKey {
+	ret := make([]PublicKey, 0, len(peers))
+	for _, p := range peers {
+		ret = append(ret, p.PublicKey)
+	}
+	return ret
+}
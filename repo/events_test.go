@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultChangeNotificationHandler_NotifyChange(t *testing.T) {
+	var h DefaultChangeNotificationHandler
+	first := h.AddChangeNotification()
+	second := h.AddChangeNotification()
+
+	want := ChangeEvent{Type: DeviceRemoved, DeviceNames: []string{"wg0"}}
+	h.NotifyChange(want)
+
+	for i, c := range []<-chan ChangeEvent{first, second} {
+		if got := <-c; !reflect.DeepEqual(got, want) {
+			t.Errorf("listener %d got = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDefaultChangeNotificationHandler_Overflow(t *testing.T) {
+	var h DefaultChangeNotificationHandler
+	c := h.AddChangeNotification()
+
+	total := ChangeEventQueueSize + 10
+	for i := 0; i < total; i++ {
+		h.NotifyChange(ChangeEvent{Type: DeviceUpdated, DeviceNames: []string{fmt.Sprint("device", i)}})
+	}
+
+	if len(c) != ChangeEventQueueSize {
+		t.Fatalf("queue length = %v, want %v", len(c), ChangeEventQueueSize)
+	}
+
+	// The oldest events are the ones dropped.
+	for i := total - ChangeEventQueueSize; i < total; i++ {
+		want := fmt.Sprint("device", i)
+		if got := <-c; got.DeviceNames[0] != want {
+			t.Errorf("got event for %v, want %v", got.DeviceNames[0], want)
+		}
+	}
+}
+
+func TestDefaultChangeNotificationHandler_RemoveChangeNotification(t *testing.T) {
+	var h DefaultChangeNotificationHandler
+	removed := h.AddChangeNotification()
+	kept := h.AddChangeNotification()
+
+	h.RemoveChangeNotification(removed)
+	h.NotifyChange(ChangeEvent{Type: PeersUpdated})
+
+	if _, ok := <-removed; ok {
+		t.Error("removed listener is still open")
+	}
+
+	if e := <-kept; e.Type != PeersUpdated {
+		t.Errorf("kept listener got = %v, want %v", e.Type, PeersUpdated)
+	}
+}
+
+func TestDefaultChangeNotificationHandler_Close(t *testing.T) {
+	var h DefaultChangeNotificationHandler
+	before := h.AddChangeNotification()
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-before; ok {
+		t.Error("listener added before Close is still open")
+	}
+
+	if _, ok := <-h.AddChangeNotification(); ok {
+		t.Error("listener added after Close is open")
+	}
+
+	// Must not panic on closed channels.
+	h.NotifyChange(ChangeEvent{Type: DeviceUpdated})
+}
+
+func TestMemRepository_ChangeEvents(t *testing.T) {
+	r := NewMemRepository()
+	defer r.Close()
+
+	c := r.AddChangeNotification()
+
+	if err := r.UpdateDevices([]DeviceInfo{{Name: "wg0"}, {Name: "wg1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReplaceAllDevices([]DeviceInfo{{Name: "wg0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []ChangeEvent{
+		{Type: DeviceUpdated, DeviceNames: []string{"wg0", "wg1"}},
+		{Type: DeviceRemoved, DeviceNames: []string{"wg1"}},
+		{Type: DeviceUpdated, DeviceNames: []string{"wg0"}},
+	}
+	for _, want := range tests {
+		if got := <-c; !reflect.DeepEqual(got, want) {
+			t.Errorf("got = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package file
+
+import (
+	"log"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const DefaultPollInterval = 10 * time.Second
+
+// fileRepository serves the devices and peers described by a tree of YAML files, one device a file, so that they
+// can be kept in git and changed through pull requests. It is read-only: every write fails with repo.ErrReadOnly.
+//
+// The tree is read again every poll, and the change only taken if all of it is valid, so that a broken commit leaves
+// the service running as it was. Revisions count the changes seen, starting over when the service does.
+type fileRepository struct {
+	repo.DefaultChangeNotificationHandler
+	Dir string
+
+	// stateMutex guards the state and serialises the polls so that every change is reported exactly once.
+	stateMutex sync.Mutex
+	state      map[string]deviceState
+
+	// lastProblem is the last reason the tree was refused, to log it only once.
+	lastProblem string
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+// revised gives the state read with the revisions it moves the current one to.
+func revised(old map[string]deviceState, new map[string]deviceState) (map[string]deviceState, error) {
+	for name, n := range new {
+		var stored *repo.DeviceInfo
+		o, ok := old[name]
+		if ok {
+			stored = &o.Device
+		}
+
+		var err error
+		if n.Device.Revision, err = repo.DeviceRevision(stored, &n.Device); err != nil {
+			return nil, err
+		}
+
+		for k, p := range n.Peers {
+			var storedPeer *repo.PeerInfo
+			if op, ok := o.Peers[k]; ok {
+				storedPeer = &op
+			}
+
+			if p.Revision, err = repo.PeerRevision(storedPeer, &p); err != nil {
+				return nil, err
+			}
+			n.Peers[k] = p
+		}
+		new[name] = n
+	}
+	return new, nil
+}
+
+// diffStates tells what changed between two reads of the tree.
+func diffStates(old map[string]deviceState, new map[string]deviceState) (events []repo.ChangeEvent) {
+	var removedDevices, updatedDevices []string
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removedDevices = append(removedDevices, name)
+		}
+	}
+
+	for name, n := range new {
+		o, ok := old[name]
+		if !ok || o.Device != n.Device {
+			updatedDevices = append(updatedDevices, name)
+		}
+	}
+
+	if len(removedDevices) > 0 {
+		events = append(events, repo.ChangeEvent{Type: repo.DeviceRemoved, DeviceNames: removedDevices})
+	}
+
+	if len(updatedDevices) > 0 {
+		events = append(events, repo.ChangeEvent{Type: repo.DeviceUpdated, DeviceNames: updatedDevices})
+	}
+
+	for name, n := range new {
+		o := old[name]
+
+		var removedPeers, updatedPeers []repo.PublicKey
+		for k := range o.Peers {
+			if _, ok := n.Peers[k]; !ok {
+				removedPeers = append(removedPeers, k)
+			}
+		}
+
+		for k, p := range n.Peers {
+			if op, ok := o.Peers[k]; !ok || !reflect.DeepEqual(op, p) {
+				updatedPeers = append(updatedPeers, k)
+			}
+		}
+
+		if len(removedPeers) > 0 {
+			events = append(events, repo.ChangeEvent{Type: repo.PeersRemoved, DeviceNames: []string{name}, PublicKeys: removedPeers})
+		}
+
+		if len(updatedPeers) > 0 {
+			events = append(events, repo.ChangeEvent{Type: repo.PeersUpdated, DeviceNames: []string{name}, PublicKeys: updatedPeers})
+		}
+	}
+
+	return
+}
+
+// poll reads the tree and, if it's valid, takes it and notifies listeners of whatever changed since the last poll.
+func (f *fileRepository) poll() error {
+	f.stateMutex.Lock()
+	defer f.stateMutex.Unlock()
+
+	state, err := readTree(f.Dir)
+	if err == nil {
+		state, err = revised(f.state, state)
+	}
+	if err != nil {
+		return err
+	}
+
+	events := diffStates(f.state, state)
+	f.state = state
+	f.NotifyChange(events...)
+	return nil
+}
+
+func (f *fileRepository) pollAndLog() {
+	err := f.poll()
+
+	problem := ""
+	if err != nil {
+		problem = err.Error()
+	}
+
+	if problem != f.lastProblem {
+		if err != nil {
+			log.Printf("file-repository: keeping the devices as they were: %v", err)
+		} else {
+			log.Printf("file-repository: %v is valid again", f.Dir)
+		}
+		f.lastProblem = problem
+	}
+}
+
+func (f *fileRepository) pollLoop(interval time.Duration) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.pollAndLog()
+		}
+	}
+}
+
+func (f *fileRepository) ListDevices() ([]repo.DeviceInfo, error) {
+	f.stateMutex.Lock()
+	defer f.stateMutex.Unlock()
+
+	ret := make([]repo.DeviceInfo, 0, len(f.state))
+	for _, d := range f.state {
+		ret = append(ret, d.Device)
+	}
+	return ret, nil
+}
+
+func (f *fileRepository) listPeersCommon(filter func(peer *repo.PeerInfo) bool, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	f.stateMutex.Lock()
+	var peers []repo.PeerInfo
+	for _, d := range f.state {
+		for _, p := range d.Peers {
+			if filter == nil || filter(&p) {
+				peers = append(peers, p)
+			}
+		}
+	}
+	f.stateMutex.Unlock()
+
+	return repo.PaginatePeers(peers, order, page)
+}
+
+func (f *fileRepository) ListPeersByDevices(deviceNames []string, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	names := make(map[string]bool, len(deviceNames))
+	for _, n := range deviceNames {
+		names[n] = true
+	}
+
+	return f.listPeersCommon(func(peer *repo.PeerInfo) bool {
+		return names[peer.DeviceName]
+	}, order, page)
+}
+
+func (f *fileRepository) ListPeersByKeys(deviceName string, pubKeys []repo.PublicKey, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	keys := make(map[repo.PublicKey]bool, len(pubKeys))
+	for _, k := range pubKeys {
+		keys[k] = true
+	}
+
+	return f.listPeersCommon(func(peer *repo.PeerInfo) bool {
+		return peer.DeviceName == deviceName && keys[peer.PublicKey]
+	}, order, page)
+}
+
+func (f *fileRepository) ListPeers(filter repo.PeerFilter, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	return f.listPeersCommon(filter.Match, order, page)
+}
+
+func (f *fileRepository) UpdateDevices(devices []repo.DeviceInfo) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) RemoveDevices(names []string) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) ReplaceAllDevices(devices []repo.DeviceInfo) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) RemovePeers(deviceName string, publicKeys []repo.PublicKey) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) UpdatePeers(deviceName string, peers []repo.PeerInfo) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) ReplaceAllPeers(deviceName string, peers []repo.PeerInfo) error {
+	return repo.ErrReadOnly
+}
+
+func (f *fileRepository) Close() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+		f.stop = nil
+	}
+	return f.DefaultChangeNotificationHandler.Close()
+}
+
+// NewFileRepository reads the tree of the directory, failing with an *InvalidTreeError if any of it is invalid, and
+// checks it for changes every pollInterval. A zero pollInterval never does.
+func NewFileRepository(dir string, pollInterval time.Duration) (repo.Repository, error) {
+	f := &fileRepository{Dir: dir}
+
+	state, err := readTree(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.state, err = revised(nil, state); err != nil {
+		return nil, err
+	}
+
+	if pollInterval > 0 {
+		f.stop = make(chan interface{})
+		f.done = make(chan interface{})
+		go f.pollLoop(pollInterval)
+	}
+	return f, nil
+}
@@ -0,0 +1,255 @@
+package file
+
+import (
+	"crypto/sha256"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io/ioutil"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func genKey(name string) wgtypes.Key {
+	return wgtypes.Key(sha256.Sum256([]byte(name)))
+}
+
+var (
+	alice = genKey("alice").PublicKey().String()
+	bob   = genKey("bob").PublicKey().String()
+)
+
+const wg0 = `name: wg0
+private_key_file: keys/wg0
+listen_port: 51820
+peers:
+  - name: alice
+    public_key: ALICE
+    allowed_ips: [10.0.0.2/32]
+    persistent_keepalive: 25
+    tags: [laptop]
+    meta: {owner: ops}
+  - name: bob
+    public_key: BOB
+    allowed_ips: [10.0.0.3/32]
+    endpoint: 192.0.2.1:51820
+    disabled: true
+    state_reason: lost
+    expires_at: 2020-03-01T00:00:00Z
+`
+
+// newTree writes the files, with ALICE and BOB standing for their public keys, in a new directory.
+func newTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "wgadmin-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, dir, files)
+	return dir
+}
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	r := strings.NewReplacer("ALICE", alice, "BOB", bob)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(r.Replace(content)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func validTree(t *testing.T) string {
+	return newTree(t, map[string]string{
+		"wg0.yaml": wg0,
+		"keys/wg0": genKey("wg0").String() + "\n",
+		"sites/wg1.yml": `name: wg1
+private_key: ` + genKey("wg1").String(),
+		"README.md":      "not a device",
+		".git/HEAD.yaml": "not a device either",
+	})
+}
+
+func mustOpen(t *testing.T, dir string) *fileRepository {
+	r, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal("NewFileRepository():", err)
+	}
+	return r.(*fileRepository)
+}
+
+func listPeers(t *testing.T, r repo.Repository) map[string]repo.PeerInfo {
+	peers, _, err := r.ListPeers(repo.PeerFilter{}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListPeers():", err)
+	}
+
+	ret := make(map[string]repo.PeerInfo, len(peers))
+	for _, p := range peers {
+		ret[p.Name] = p
+	}
+	return ret
+}
+
+func TestNewFileRepository(t *testing.T) {
+	dir := validTree(t)
+	defer os.RemoveAll(dir)
+
+	r := mustOpen(t, dir)
+	defer r.Close()
+
+	devices, err := r.ListDevices()
+	if err != nil || len(devices) != 2 {
+		t.Fatalf("ListDevices() = %v, %v, want wg0 and wg1", devices, err)
+	}
+
+	for _, d := range devices {
+		if want := repo.NewPrivateKey(genKey(d.Name)); d.PrivateKey != want || d.Revision != 1 {
+			t.Errorf("device %v has key %v and revision %v, want %v and 1", d.Name, d.PrivateKey, d.Revision, want)
+		}
+	}
+
+	peers := listPeers(t, r)
+	a, b := peers["alice"], peers["bob"]
+	if a.DeviceName != "wg0" || a.PersistentKeepaliveInterval != 25*time.Second || a.AllowedIPs[0].String() != "10.0.0.2/32" ||
+		!reflect.DeepEqual(a.Tags, []string{"laptop"}) || a.Meta["owner"] != "ops" || !a.Enabled() || a.Revision != 1 {
+		t.Errorf("alice = %+v", a)
+	}
+
+	if b.Endpoint.String() != "192.0.2.1:51820" || b.Enabled() || b.StateReason != "lost" ||
+		b.ExpiresAt != time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("bob = %+v", b)
+	}
+
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{a}); err != repo.ErrReadOnly {
+		t.Errorf("UpdatePeers() error = %v, want %v", err, repo.ErrReadOnly)
+	}
+	if err := r.RemoveDevices([]string{"wg0"}); err != repo.ErrReadOnly {
+		t.Errorf("RemoveDevices() error = %v, want %v", err, repo.ErrReadOnly)
+	}
+}
+
+func TestNewFileRepository_Invalid(t *testing.T) {
+	dir := newTree(t, map[string]string{
+		"wg0.yaml": wg0,
+		"wg1.yaml": `name: wg1
+peers:
+  - name: carol
+    public_key: nope
+  - public_key: ALICE
+    allowed_ips: [10.0.0.300/32]
+    persistent_keepalive: -1
+  - public_key: BOB
+  - public_key: BOB
+`,
+		"a/wg2.yaml": "name: wg2",
+		"b/wg2.yaml": "name: wg2",
+		"typo.yaml":  "name: wg3\nlisten-port: 1",
+	})
+	defer os.RemoveAll(dir)
+
+	// wg0.yaml reads its private key from a file that isn't there.
+	_, err := NewFileRepository(dir, 0)
+	invalid, ok := err.(*InvalidTreeError)
+	if !ok {
+		t.Fatalf("NewFileRepository() error = %v, want an *InvalidTreeError", err)
+	}
+
+	want := []string{
+		"b/wg2.yaml: device wg2 is already in a/wg2.yaml",
+		"typo.yaml: ",
+		"wg0.yaml: unable to read the private key",
+		"wg1.yaml: peer \"carol\" has an invalid public key",
+		"wg1.yaml: peer " + alice + " has an invalid allowed ip",
+		"wg1.yaml: peer " + alice + " has an invalid persistent keepalive",
+		"wg1.yaml: peer " + bob + " is there twice",
+	}
+	if len(invalid.Problems) != len(want) {
+		t.Fatalf("problems = %q, want %d of them", invalid.Problems, len(want))
+	}
+
+	for i, p := range invalid.Problems {
+		if !strings.HasPrefix(p, want[i]) {
+			t.Errorf("problem %d = %q, want it to start with %q", i, p, want[i])
+		}
+	}
+}
+
+func expectEvents(t *testing.T, events <-chan repo.ChangeEvent, want ...repo.ChangeEventType) {
+	t.Helper()
+	var got []repo.ChangeEventType
+	for len(got) < len(want) {
+		select {
+		case e := <-events:
+			got = append(got, e.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %v", e)
+	default:
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
+
+func TestFileRepository_poll(t *testing.T) {
+	dir := validTree(t)
+	defer os.RemoveAll(dir)
+
+	r := mustOpen(t, dir)
+	defer r.Close()
+
+	events := r.AddChangeNotification()
+
+	// Nothing changed, nothing to tell.
+	if err := r.poll(); err != nil {
+		t.Fatal("poll():", err)
+	}
+	expectEvents(t, events)
+
+	writeTree(t, dir, map[string]string{"wg0.yaml": strings.Replace(wg0, "tags: [laptop]", "tags: [phone]", 1)})
+	if err := r.poll(); err != nil {
+		t.Fatal("poll():", err)
+	}
+	expectEvents(t, events, repo.PeersUpdated)
+
+	if a := listPeers(t, r)["alice"]; !reflect.DeepEqual(a.Tags, []string{"phone"}) || a.Revision != 2 {
+		t.Errorf("alice has tags %v and revision %v, want [phone] and 2", a.Tags, a.Revision)
+	}
+
+	// A broken change is refused as a whole, and the devices stay as they were.
+	writeTree(t, dir, map[string]string{"wg0.yaml": strings.Replace(wg0, "10.0.0.3/32", "10.0.0.3", 1)})
+	if _, ok := r.poll().(*InvalidTreeError); !ok {
+		t.Error("poll() of an invalid tree succeeded")
+	}
+	expectEvents(t, events)
+
+	if peers := listPeers(t, r); len(peers) != 2 {
+		t.Errorf("peers = %v, want alice and bob still", peers)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "wg0.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.poll(); err != nil {
+		t.Fatal("poll():", err)
+	}
+	expectEvents(t, events, repo.DeviceRemoved)
+
+	if devices, err := r.ListDevices(); err != nil || len(devices) != 1 || devices[0].Name != "wg1" {
+		t.Errorf("ListDevices() = %v, %v, want wg1", devices, err)
+	}
+}
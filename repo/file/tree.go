@@ -0,0 +1,259 @@
+package file
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deviceFile is a device and its peers as written in a file of the tree, like:
+//
+//	name: wg0
+//	private_key_file: /etc/wireguard/wg0.key
+//	listen_port: 51820
+//	peers:
+//	  - name: alice
+//	    public_key: xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+//	    allowed_ips: [10.0.0.2/32]
+//	    tags: [laptop]
+//
+// The keys may be written in the file or read from another one, so that the secrets can be kept out of git. Relative
+// key files are relative to the tree.
+type deviceFile struct {
+	Name           string     `yaml:"name"`
+	PrivateKey     string     `yaml:"private_key"`
+	PrivateKeyFile string     `yaml:"private_key_file"`
+	ListenPort     uint16     `yaml:"listen_port"`
+	Peers          []peerFile `yaml:"peers"`
+}
+
+type peerFile struct {
+	Name             string   `yaml:"name"`
+	PublicKey        string   `yaml:"public_key"`
+	PreSharedKey     string   `yaml:"preshared_key"`
+	PreSharedKeyFile string   `yaml:"preshared_key_file"`
+	AllowedIPs       []string `yaml:"allowed_ips"`
+	Endpoint         string   `yaml:"endpoint"`
+	// PersistentKeepalive is in seconds.
+	PersistentKeepalive int64             `yaml:"persistent_keepalive"`
+	Meta                map[string]string `yaml:"meta"`
+	Tags                []string          `yaml:"tags"`
+	Groups              []string          `yaml:"groups"`
+	Disabled            bool              `yaml:"disabled"`
+	StateReason         string            `yaml:"state_reason"`
+	// ExpiresAt is in RFC 3339.
+	ExpiresAt string `yaml:"expires_at"`
+	Owner     string `yaml:"owner"`
+}
+
+// deviceState is a device and its peers as read from the tree.
+type deviceState struct {
+	Device repo.DeviceInfo
+	Peers  map[repo.PublicKey]repo.PeerInfo
+}
+
+// InvalidTreeError lists everything wrong with a tree, each problem prefixed with the file it's in.
+type InvalidTreeError struct {
+	Problems []string
+}
+
+func (e *InvalidTreeError) Error() string {
+	return fmt.Sprintf("invalid configuration tree: %v", strings.Join(e.Problems, "; "))
+}
+
+// treeReader reads the files of a tree, noting the problems as it goes so that they are all told at once.
+type treeReader struct {
+	dir      string
+	problems []string
+}
+
+func (t *treeReader) problem(path string, format string, args ...interface{}) {
+	rel, err := filepath.Rel(t.dir, path)
+	if err != nil {
+		rel = path
+	}
+	t.problems = append(t.problems, rel+": "+fmt.Sprintf(format, args...))
+}
+
+// isTreeFile tells whether the file describes a device. Hidden files and directories, as .git, are left out.
+func isTreeFile(info os.FileInfo) bool {
+	ext := filepath.Ext(info.Name())
+	return !strings.HasPrefix(info.Name(), ".") && (ext == ".yaml" || ext == ".yml")
+}
+
+// treeFiles lists the files of the tree, sorted so that the problems are always told in the same order.
+func treeFiles(dir string) (ret []string, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if isTreeFile(info) {
+			ret = append(ret, path)
+		}
+		return nil
+	})
+
+	sort.Strings(ret)
+	return
+}
+
+// key reads a key given either in the file or in a key file, empty if neither is.
+func (t *treeReader) key(path string, what string, value string, file string) string {
+	if len(value) > 0 && len(file) > 0 {
+		t.problem(path, "%v is given both in the file and in %v", what, file)
+		return ""
+	}
+
+	if len(file) > 0 {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(t.dir, file)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.problem(path, "unable to read %v: %v", what, err)
+			return ""
+		}
+		value = strings.TrimSpace(string(data))
+	}
+	return value
+}
+
+func (t *treeReader) peer(path string, deviceName string, p peerFile) (ret repo.PeerInfo, ok bool) {
+	problems := len(t.problems)
+	ret = repo.PeerInfo{
+		DeviceName:                  deviceName,
+		Name:                        p.Name,
+		PersistentKeepaliveInterval: time.Duration(p.PersistentKeepalive) * time.Second,
+		AllowedIPs:                  make([]net.IPNet, 0, len(p.AllowedIPs)),
+		Meta:                        p.Meta,
+		Tags:                        p.Tags,
+		Groups:                      p.Groups,
+		Disabled:                    p.Disabled,
+		StateReason:                 p.StateReason,
+		Owner:                       p.Owner,
+	}
+
+	what := fmt.Sprintf("peer %q", p.Name)
+	if err := ret.PublicKey.Scan(p.PublicKey); err != nil || len(p.PublicKey) == 0 {
+		t.problem(path, "%v has an invalid public key", what)
+	} else {
+		what = fmt.Sprintf("peer %v", p.PublicKey)
+	}
+
+	if err := ret.PreSharedKey.Scan(t.key(path, what+" pre-shared key", p.PreSharedKey, p.PreSharedKeyFile)); err != nil {
+		t.problem(path, "%v has an invalid pre-shared key", what)
+	}
+
+	for _, s := range p.AllowedIPs {
+		if _, n, err := net.ParseCIDR(s); err != nil {
+			t.problem(path, "%v has an invalid allowed ip %q", what, s)
+		} else {
+			ret.AllowedIPs = append(ret.AllowedIPs, *n)
+		}
+	}
+
+	if len(p.Endpoint) > 0 {
+		var err error
+		if ret.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+			t.problem(path, "%v has an invalid endpoint %q", what, p.Endpoint)
+		}
+	}
+
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		t.problem(path, "%v has an invalid persistent keepalive %v", what, p.PersistentKeepalive)
+	}
+
+	if len(p.ExpiresAt) > 0 {
+		if at, err := time.Parse(time.RFC3339, p.ExpiresAt); err != nil {
+			t.problem(path, "%v expires at an invalid time %q", what, p.ExpiresAt)
+		} else {
+			ret.ExpiresAt = at.Unix()
+		}
+	}
+
+	return ret, len(t.problems) == problems
+}
+
+func (t *treeReader) device(path string) (ret deviceState, ok bool) {
+	problems := len(t.problems)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.problem(path, "%v", err)
+		return
+	}
+
+	var d deviceFile
+	if err = yaml.UnmarshalStrict(data, &d); err != nil {
+		t.problem(path, "%v", err)
+		return
+	}
+
+	if len(d.Name) == 0 {
+		t.problem(path, "the device has no name")
+	}
+
+	ret.Device = repo.DeviceInfo{Name: d.Name, ListenPort: d.ListenPort}
+	if err = ret.Device.PrivateKey.Scan(t.key(path, "the private key", d.PrivateKey, d.PrivateKeyFile)); err != nil {
+		t.problem(path, "the private key is invalid")
+	}
+
+	ret.Peers = make(map[repo.PublicKey]repo.PeerInfo, len(d.Peers))
+	for _, pf := range d.Peers {
+		if p, ok := t.peer(path, d.Name, pf); ok {
+			if _, seen := ret.Peers[p.PublicKey]; seen {
+				t.problem(path, "peer %v is there twice", p.PublicKey)
+			}
+			ret.Peers[p.PublicKey] = p
+		}
+	}
+
+	return ret, len(t.problems) == problems
+}
+
+// readTree reads every device of the tree, failing with an *InvalidTreeError unless all of it is valid.
+func readTree(dir string) (map[string]deviceState, error) {
+	files, err := treeFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := treeReader{dir: dir}
+	ret := make(map[string]deviceState, len(files))
+	seen := make(map[string]string, len(files))
+	for _, path := range files {
+		d, ok := t.device(path)
+		if !ok {
+			continue
+		}
+
+		if other, twice := seen[d.Device.Name]; twice {
+			t.problem(path, "device %v is already in %v", d.Device.Name, other)
+			continue
+		}
+
+		seen[d.Device.Name], _ = filepath.Rel(dir, path)
+		ret[d.Device.Name] = d
+	}
+
+	if len(t.problems) > 0 {
+		return nil, &InvalidTreeError{Problems: t.problems}
+	}
+	return ret, nil
+}
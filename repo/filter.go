@@ -0,0 +1,114 @@
+package repo
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// PeerFilter narrows down the peers returned by Repository.ListPeers.
+// Zero-valued fields are ignored; a peer has to match every field that is set.
+type PeerFilter struct {
+	// NameContains matches peers whose name contains the text, ignoring case.
+	NameContains string
+
+	// PublicKeyPrefix matches peers whose public key, in its string form, starts with the prefix.
+	PublicKeyPrefix string
+
+	// AllowedIP matches peers that have an AllowedIPs entry containing the address.
+	AllowedIP net.IP
+
+	// EndpointIP matches peers whose endpoint has the address.
+	EndpointIP net.IP
+
+	// HandshakeBefore and HandshakeAfter match peers whose last handshake is older or newer than the time.
+	HandshakeBefore time.Time
+	HandshakeAfter  time.Time
+
+	// Meta matches peers that have all the metadata key/value pairs.
+	Meta map[string]string
+
+	// Tags matches peers that have all the tags.
+	Tags []string
+
+	// Group matches peers that belong to the group.
+	Group string
+
+	// ExpiresBy matches peers that expire at or before the time.
+	ExpiresBy time.Time
+
+	// Owner matches peers that belong to the user.
+	Owner string
+}
+
+// Match tells whether the peer satisfies the filter.
+func (f PeerFilter) Match(peer *PeerInfo) bool {
+	if len(f.NameContains) > 0 && !strings.Contains(strings.ToLower(peer.Name), strings.ToLower(f.NameContains)) {
+		return false
+	}
+
+	if len(f.PublicKeyPrefix) > 0 && !strings.HasPrefix(peer.PublicKey.String(), f.PublicKeyPrefix) {
+		return false
+	}
+
+	if f.AllowedIP != nil && !AllowedIPsContain(peer.AllowedIPs, f.AllowedIP) {
+		return false
+	}
+
+	if f.EndpointIP != nil && (peer.Endpoint == nil || !peer.Endpoint.IP.Equal(f.EndpointIP)) {
+		return false
+	}
+
+	if !f.HandshakeBefore.IsZero() && peer.LastHandshake >= f.HandshakeBefore.Unix() {
+		return false
+	}
+
+	if !f.HandshakeAfter.IsZero() && peer.LastHandshake <= f.HandshakeAfter.Unix() {
+		return false
+	}
+
+	for k, v := range f.Meta {
+		if value, ok := peer.Meta[k]; !ok || value != v {
+			return false
+		}
+	}
+
+	for _, t := range f.Tags {
+		if !containsString(peer.Tags, t) {
+			return false
+		}
+	}
+
+	if len(f.Group) > 0 && !containsString(peer.Groups, f.Group) {
+		return false
+	}
+
+	if !f.ExpiresBy.IsZero() && (peer.ExpiresAt == 0 || peer.ExpiresAt > f.ExpiresBy.Unix()) {
+		return false
+	}
+
+	if len(f.Owner) > 0 && peer.Owner != f.Owner {
+		return false
+	}
+
+	return true
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedIPsContain tells whether any of the networks contains the ip.
+func AllowedIPsContain(allowedIPs []net.IPNet, ip net.IP) bool {
+	for _, n := range allowedIPs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
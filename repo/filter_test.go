@@ -0,0 +1,66 @@
+package repo
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerFilter_Match(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	peer := PeerInfo{
+		PublicKey:     PublicKey{key("GkIABv0kSRhvG6XoGvOD4xSE8ywaBU3CxfcCuHHD+0I=")},
+		Endpoint:      &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820},
+		AllowedIPs:    []net.IPNet{*allowed},
+		LastHandshake: 1000,
+		Name:          "Alice's Laptop",
+		Meta:          map[string]string{"owner": "alice", "site": "hq"},
+		Tags:          []string{"laptop", "managed"},
+		Groups:        []string{"engineering"},
+		ExpiresAt:     2000,
+		Owner:         "alice",
+	}
+
+	tests := []struct {
+		name   string
+		filter PeerFilter
+		want   bool
+	}{
+		{name: "empty", filter: PeerFilter{}, want: true},
+		{name: "name ignores case", filter: PeerFilter{NameContains: "laptop"}, want: true},
+		{name: "name mismatch", filter: PeerFilter{NameContains: "phone"}, want: false},
+		{name: "public key prefix", filter: PeerFilter{PublicKeyPrefix: "GkIA"}, want: true},
+		{name: "public key not a prefix", filter: PeerFilter{PublicKeyPrefix: "kIA"}, want: false},
+		{name: "allowed ip inside", filter: PeerFilter{AllowedIP: net.ParseIP("10.1.200.3")}, want: true},
+		{name: "allowed ip outside", filter: PeerFilter{AllowedIP: net.ParseIP("10.2.0.1")}, want: false},
+		{name: "endpoint ip", filter: PeerFilter{EndpointIP: net.ParseIP("2001:db8::1")}, want: true},
+		{name: "endpoint ip mismatch", filter: PeerFilter{EndpointIP: net.ParseIP("2001:db8::2")}, want: false},
+		{name: "handshake before", filter: PeerFilter{HandshakeBefore: time.Unix(1001, 0)}, want: true},
+		{name: "handshake not before", filter: PeerFilter{HandshakeBefore: time.Unix(1000, 0)}, want: false},
+		{name: "handshake after", filter: PeerFilter{HandshakeAfter: time.Unix(999, 0)}, want: true},
+		{name: "handshake not after", filter: PeerFilter{HandshakeAfter: time.Unix(1000, 0)}, want: false},
+		{name: "meta", filter: PeerFilter{Meta: map[string]string{"owner": "alice", "site": "hq"}}, want: true},
+		{name: "meta value mismatch", filter: PeerFilter{Meta: map[string]string{"owner": "bob"}}, want: false},
+		{name: "meta key missing", filter: PeerFilter{Meta: map[string]string{"asset": ""}}, want: false},
+		{name: "tags", filter: PeerFilter{Tags: []string{"managed", "laptop"}}, want: true},
+		{name: "tag missing", filter: PeerFilter{Tags: []string{"laptop", "phone"}}, want: false},
+		{name: "group", filter: PeerFilter{Group: "engineering"}, want: true},
+		{name: "group mismatch", filter: PeerFilter{Group: "sales"}, want: false},
+		{name: "expires by", filter: PeerFilter{ExpiresBy: time.Unix(2000, 0)}, want: true},
+		{name: "expires later", filter: PeerFilter{ExpiresBy: time.Unix(1999, 0)}, want: false},
+		{name: "owner", filter: PeerFilter{Owner: "alice"}, want: true},
+		{name: "owner mismatch", filter: PeerFilter{Owner: "bob"}, want: false},
+		{
+			name:   "all fields must match",
+			filter: PeerFilter{NameContains: "laptop", AllowedIP: net.ParseIP("10.2.0.1")},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(&peer); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -24,8 +24,14 @@ func (k key) LessThan(other fmt.Stringer) bool {
 	return k.String() < other.String()
 }
 
+// Scan reads a key, or an empty one for a key that isn't set, like a peer without a pre-shared key.
 func (k *key) Scan(src interface{}) error {
 	if str, ok := src.(string); ok {
+		if len(str) == 0 {
+			*k = ""
+			return nil
+		}
+
 		if _, err := wgtypes.ParseKey(str); err != nil {
 			return err
 		} else {
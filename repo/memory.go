@@ -3,6 +3,7 @@ package repo
 import (
 	"sort"
 	"sync"
+	"time"
 )
 
 type memDevice struct {
@@ -10,12 +11,81 @@ type memDevice struct {
 	Peers  map[PublicKey]*PeerInfo
 }
 
-type memRepository struct {
+type memStore struct {
 	DefaultChangeNotificationHandler
 
 	Mutex sync.Mutex
 
 	Devices map[string]*memDevice
+
+	audit       []AuditEntry
+	lastAuditId int64
+}
+
+// memRepository is the store as seen by one actor. Every view of the store shares its devices and audit log.
+type memRepository struct {
+	*memStore
+
+	actor Actor
+	view  bool
+}
+
+// record appends the entries that aren't nil to the audit log. The caller holds the mutex.
+func (m *memRepository) record(entries ...*AuditEntry) {
+	now := time.Now()
+	for _, e := range entries {
+		if e != nil {
+			m.lastAuditId++
+			e.Id, e.Time = m.lastAuditId, now
+			m.audit = append(m.audit, *e)
+		}
+	}
+}
+
+func (m *memRepository) WithActor(actor Actor) Repository {
+	return &memRepository{memStore: m.memStore, actor: actor, view: true}
+}
+
+func (m *memRepository) Close() error {
+	if m.view {
+		return nil
+	}
+	return m.memStore.Close()
+}
+
+func (m *memRepository) Record(entry AuditEntry) error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	entry.Actor = m.actor
+	m.record(&entry)
+	return nil
+}
+
+func (m *memRepository) ListAudit(filter AuditFilter, page PageRequest) (data []AuditEntry, cursors PageCursors, err error) {
+	after, err := ParseAuditCursor(page.Cursor)
+	if err != nil {
+		return
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	more := false
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		e := m.audit[i]
+		if (after != 0 && e.Id >= after) || !filter.Match(&e) {
+			continue
+		}
+
+		if page.Limit > 0 && uint(len(data)) == page.Limit {
+			more = true
+			break
+		}
+		data = append(data, e)
+	}
+
+	return data, AuditCursorsFor(data, more), nil
 }
 
 func (m *memRepository) ListDevices() ([]DeviceInfo, error) {
@@ -29,20 +99,68 @@ func (m *memRepository) ListDevices() ([]DeviceInfo, error) {
 	return devices, nil
 }
 
+// revisedDevices checks the devices against the stored ones and gives them with the revisions to store them with.
+// The caller holds the mutex.
+func (m *memRepository) revisedDevices(devices []DeviceInfo) ([]DeviceInfo, error) {
+	ret := make([]DeviceInfo, len(devices))
+	for i, d := range devices {
+		var stored *DeviceInfo
+		if md, ok := m.Devices[d.Name]; ok {
+			stored = &md.Device
+		}
+
+		revision, err := DeviceRevision(stored, &d)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i] = d
+		ret[i].Revision = revision
+	}
+	return ret, nil
+}
+
+// revisedPeers does what revisedDevices does for the peers of the device. They get the name of the device, whatever
+// DeviceName they come with.
+func revisedPeers(d *memDevice, peers []PeerInfo) ([]PeerInfo, error) {
+	ret := make([]PeerInfo, len(peers))
+	for i, p := range peers {
+		p.DeviceName = d.Device.Name
+		p.Tags, p.Groups = normaliseLabels(p.Tags), normaliseLabels(p.Groups)
+
+		revision, err := PeerRevision(d.Peers[p.PublicKey], &p)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i] = p
+		ret[i].Revision = revision
+	}
+	return ret, nil
+}
+
 func (m *memRepository) UpdateDevices(devices []DeviceInfo) error {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
+	devices, err := m.revisedDevices(devices)
+	if err != nil {
+		return err
+	}
+
 	for _, d := range devices {
+		d := d
 		if md, ok := m.Devices[d.Name]; ok {
+			m.record(DeviceAuditEntry(m.actor, &md.Device, &d))
 			md.Device = d
 		} else {
+			m.record(DeviceAuditEntry(m.actor, nil, &d))
 			m.Devices[d.Name] = &memDevice{Device: d, Peers: make(map[PublicKey]*PeerInfo)}
 		}
 	}
 
 	if len(devices) > 0 {
-		m.NotifyChange()
+		m.NotifyChange(ChangeEvent{Type: DeviceUpdated, DeviceNames: deviceNames(devices)})
 	}
 
 	return nil
@@ -52,12 +170,17 @@ func (m *memRepository) RemoveDevices(deviceNames []string) error {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
+	var removed []string
 	for _, k := range deviceNames {
-		delete(m.Devices, k)
+		if md, ok := m.Devices[k]; ok {
+			m.recordDeviceRemoved(md)
+			delete(m.Devices, k)
+			removed = append(removed, k)
+		}
 	}
 
-	if len(deviceNames) > 0 {
-		m.NotifyChange()
+	if len(removed) > 0 {
+		m.NotifyChange(ChangeEvent{Type: DeviceRemoved, DeviceNames: removed})
 	}
 
 	return nil
@@ -67,12 +190,20 @@ func (m *memRepository) ReplaceAllDevices(devices []DeviceInfo) error {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
+	devices, err := m.revisedDevices(devices)
+	if err != nil {
+		return err
+	}
+
 	newDevices := make(map[string]*memDevice, len(devices))
 	for _, d := range devices {
+		d := d
 		if old, ok := m.Devices[d.Name]; ok {
+			m.record(DeviceAuditEntry(m.actor, &old.Device, &d))
 			old.Device = d
 			newDevices[d.Name] = old
 		} else {
+			m.record(DeviceAuditEntry(m.actor, nil, &d))
 			newDevices[d.Name] = &memDevice{
 				Device: d,
 				Peers:  make(map[PublicKey]*PeerInfo),
@@ -80,41 +211,42 @@ func (m *memRepository) ReplaceAllDevices(devices []DeviceInfo) error {
 		}
 	}
 
+	var removed []string
+	for name, md := range m.Devices {
+		if _, ok := newDevices[name]; !ok {
+			m.recordDeviceRemoved(md)
+			removed = append(removed, name)
+		}
+	}
+
 	m.Devices = newDevices
-	m.NotifyChange()
+
+	if len(removed) > 0 {
+		m.NotifyChange(ChangeEvent{Type: DeviceRemoved, DeviceNames: removed})
+	}
+	if len(devices) > 0 {
+		m.NotifyChange(ChangeEvent{Type: DeviceUpdated, DeviceNames: deviceNames(devices)})
+	}
 	return nil
 }
 
-func (m *memRepository) listPeersCommon(filter func(peer *PeerInfo) bool, order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error) {
+func (m *memRepository) listPeersCommon(filter func(peer *PeerInfo) bool, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error) {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
+	var peers []PeerInfo
 	for _, d := range m.Devices {
 		for _, p := range d.Peers {
 			if filter == nil || filter(p) {
-				data = append(data, *p)
-				total++
+				peers = append(peers, *p)
 			}
 		}
 	}
 
-	sort.Slice(data, order.LessFunc(data))
-
-	if offset >= total {
-		data = make([]PeerInfo, 0)
-		return
-	}
-
-	end := offset + limit
-	if end >= total {
-		end = total
-	}
-
-	data = data[offset:end]
-	return
+	return PaginatePeers(peers, order, page)
 }
 
-func (m *memRepository) ListPeersByDevices(deviceNames []string, order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error) {
+func (m *memRepository) ListPeersByDevices(deviceNames []string, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error) {
 	keyMap := make(map[string]interface{})
 	for _, k := range deviceNames {
 		keyMap[k] = nil
@@ -123,10 +255,10 @@ func (m *memRepository) ListPeersByDevices(deviceNames []string, order PeerOrder
 	return m.listPeersCommon(func(peer *PeerInfo) bool {
 		_, ok := keyMap[peer.DeviceName]
 		return ok
-	}, order, offset, limit)
+	}, order, page)
 }
 
-func (m *memRepository) ListPeersByKeys(deviceName string, pubKeys []PublicKey, order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error) {
+func (m *memRepository) ListPeersByKeys(deviceName string, pubKeys []PublicKey, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error) {
 	keyMap := make(map[PublicKey]interface{})
 	for _, k := range pubKeys {
 		keyMap[k] = nil
@@ -139,11 +271,11 @@ func (m *memRepository) ListPeersByKeys(deviceName string, pubKeys []PublicKey,
 
 		_, ok := keyMap[peer.PublicKey]
 		return ok
-	}, order, offset, limit)
+	}, order, page)
 }
 
-func (m *memRepository) ListPeers(order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error) {
-	return m.listPeersCommon(nil, order, offset, limit)
+func (m *memRepository) ListPeers(filter PeerFilter, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error) {
+	return m.listPeersCommon(filter.Match, order, page)
 }
 
 func (m *memRepository) RemovePeers(deviceName string, publicKeys []PublicKey) error {
@@ -151,11 +283,18 @@ func (m *memRepository) RemovePeers(deviceName string, publicKeys []PublicKey) e
 	defer m.Mutex.Unlock()
 
 	if d, ok := m.Devices[deviceName]; ok {
+		var removed []PublicKey
 		for _, k := range publicKeys {
-			delete(d.Peers, k)
+			if p, ok := d.Peers[k]; ok {
+				m.record(PeerAuditEntry(m.actor, deviceName, p, nil))
+				delete(d.Peers, k)
+				removed = append(removed, k)
+			}
 		}
 
-		m.NotifyChange()
+		if len(removed) > 0 {
+			m.NotifyChange(ChangeEvent{Type: PeersRemoved, DeviceNames: []string{deviceName}, PublicKeys: removed})
+		}
 	}
 
 	return nil
@@ -166,33 +305,129 @@ func (m *memRepository) UpdatePeers(deviceName string, peers []PeerInfo) error {
 	defer m.Mutex.Unlock()
 
 	if d, ok := m.Devices[deviceName]; ok {
-		for _, p := range peers {
-			d.Peers[p.PublicKey] = &p
-		}
+		return m.updatePeers(d, deviceName, peers)
+	}
+
+	return nil
+}
+
+func (m *memRepository) updatePeers(d *memDevice, deviceName string, peers []PeerInfo) error {
+	peers, err := revisedPeers(d, peers)
+	if err != nil {
+		return err
+	}
+
+	if err = checkAddresses(d.Peers, peers); err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		p := p
+		m.record(PeerAuditEntry(m.actor, deviceName, d.Peers[p.PublicKey], &p))
+		d.Peers[p.PublicKey] = &p
+	}
 
-		m.NotifyChange()
+	if len(peers) > 0 {
+		m.NotifyChange(ChangeEvent{Type: PeersUpdated, DeviceNames: []string{deviceName}, PublicKeys: peerKeys(peers)})
 	}
 
 	return nil
 }
 
+func (m *memRepository) AddPeer(peer PeerInfo, maxOwned int) error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	d, ok := m.Devices[peer.DeviceName]
+	if !ok {
+		return nil
+	} else if _, ok = d.Peers[peer.PublicKey]; ok {
+		return ErrPeerExists
+	}
+
+	if maxOwned >= 0 {
+		owned := 0
+		for _, d := range m.Devices {
+			for _, p := range d.Peers {
+				if p.Owner == peer.Owner {
+					owned++
+				}
+			}
+		}
+
+		if owned >= maxOwned {
+			return ErrOwnerLimit
+		}
+	}
+
+	return m.updatePeers(d, peer.DeviceName, []PeerInfo{peer})
+}
+
 func (m *memRepository) ReplaceAllPeers(deviceName string, peers []PeerInfo) error {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
 	if d, ok := m.Devices[deviceName]; ok {
+		peers, err := revisedPeers(d, peers)
+		if err != nil {
+			return err
+		}
+
+		if err = checkAddresses(nil, peers); err != nil {
+			return err
+		}
+
+		oldPeers := d.Peers
 		d.Peers = make(map[PublicKey]*PeerInfo)
 		for _, p := range peers {
+			p := p
+			m.record(PeerAuditEntry(m.actor, deviceName, oldPeers[p.PublicKey], &p))
 			d.Peers[p.PublicKey] = &p
 		}
-		m.NotifyChange()
+
+		var removed []PublicKey
+		for k, p := range oldPeers {
+			if _, ok := d.Peers[k]; !ok {
+				m.record(PeerAuditEntry(m.actor, deviceName, p, nil))
+				removed = append(removed, k)
+			}
+		}
+
+		if len(removed) > 0 {
+			m.NotifyChange(ChangeEvent{Type: PeersRemoved, DeviceNames: []string{deviceName}, PublicKeys: removed})
+		}
+		if len(peers) > 0 {
+			m.NotifyChange(ChangeEvent{Type: PeersUpdated, DeviceNames: []string{deviceName}, PublicKeys: peerKeys(peers)})
+		}
 	}
 
 	return nil
 }
 
+// recordDeviceRemoved records the removal of a device and, before it, of each of its peers.
+func (m *memRepository) recordDeviceRemoved(md *memDevice) {
+	for _, p := range md.Peers {
+		m.record(PeerAuditEntry(m.actor, md.Device.Name, p, nil))
+	}
+	m.record(DeviceAuditEntry(m.actor, &md.Device, nil))
+}
+
+// normaliseLabels sorts the tags or groups and drops the duplicates, the way a database hands them back.
+func normaliseLabels(labels []string) (ret []string) {
+	set := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		if !set[l] {
+			set[l] = true
+			ret = append(ret, l)
+		}
+	}
+
+	sort.Strings(ret)
+	return
+}
+
 func NewMemRepository() Repository {
 	return &memRepository{
-		Devices: make(map[string]*memDevice),
+		memStore: &memStore{Devices: make(map[string]*memDevice)},
 	}
 }
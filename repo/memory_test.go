@@ -0,0 +1,13 @@
+package repo_test
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/repo/repotest"
+	"testing"
+)
+
+func TestMemRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repo.Repository {
+		return repo.NewMemRepository()
+	})
+}
@@ -0,0 +1,165 @@
+package repo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+var (
+	InvalidCursor = errors.New("invalid cursor")
+)
+
+// PageRequest selects a page of peers. An empty Cursor starts from the first peer in the order.
+// A Limit of zero returns all the peers from the cursor on.
+type PageRequest struct {
+	Cursor string
+	Limit  uint
+}
+
+// PageCursors points to the pages around the returned one. A cursor is empty when there is nothing in its direction.
+type PageCursors struct {
+	Next string
+	Prev string
+}
+
+// PeerCursor is a position between two peers in a PeerOrder: the peer it was taken from and the direction to read in.
+// The position is made of the sort key and the public key, the same tie-break PeerOrder.LessFunc uses, so it stays
+// valid while peers are added or removed.
+type PeerCursor struct {
+	Order         PeerOrder `json:"o"`
+	Backward      bool      `json:"b,omitempty"`
+	Name          string    `json:"n,omitempty"`
+	LastHandshake int64     `json:"h,omitempty"`
+	PublicKey     PublicKey `json:"-"`
+}
+
+type peerCursorJson struct {
+	PeerCursor
+	PublicKey string `json:"k"`
+}
+
+// CursorAfter gives the cursor that reads forward from the peer, exclusive.
+func CursorAfter(order PeerOrder, peer PeerInfo) PeerCursor {
+	return PeerCursor{
+		Order:         order,
+		Name:          peer.Name,
+		LastHandshake: peer.LastHandshake,
+		PublicKey:     peer.PublicKey,
+	}
+}
+
+// CursorBefore gives the cursor that reads backward from the peer, exclusive.
+func CursorBefore(order PeerOrder, peer PeerInfo) PeerCursor {
+	c := CursorAfter(order, peer)
+	c.Backward = true
+	return c
+}
+
+func (c PeerCursor) String() string {
+	data, err := json.Marshal(peerCursorJson{PeerCursor: c, PublicKey: c.PublicKey.String()})
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Peer returns a peer that sits exactly at the cursor position.
+func (c PeerCursor) Peer() PeerInfo {
+	return PeerInfo{
+		PublicKey:     c.PublicKey,
+		LastHandshake: c.LastHandshake,
+		Name:          c.Name,
+	}
+}
+
+// ParsePeerCursor decodes a cursor made for the order. An empty string gives a nil cursor.
+func ParsePeerCursor(order PeerOrder, s string) (*PeerCursor, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidCursor
+	}
+
+	var c peerCursorJson
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, InvalidCursor
+	}
+
+	if err = c.PeerCursor.PublicKey.Scan(c.PublicKey); err != nil || c.Order != order {
+		return nil, InvalidCursor
+	}
+
+	return &c.PeerCursor, nil
+}
+
+// PageCursorsFor works out the cursors around data, a page read with cursor. moreAfter and moreBefore tell whether
+// there are peers past either end of data that the read did not return.
+func PageCursorsFor(order PeerOrder, cursor *PeerCursor, data []PeerInfo, moreBefore bool, moreAfter bool) (ret PageCursors) {
+	if len(data) == 0 {
+		return
+	}
+
+	if cursor != nil {
+		// Having read from a cursor, the peer it was taken from lies behind us.
+		if cursor.Backward {
+			moreAfter = true
+		} else {
+			moreBefore = true
+		}
+	}
+
+	if moreAfter {
+		ret.Next = CursorAfter(order, data[len(data)-1]).String()
+	}
+
+	if moreBefore {
+		ret.Prev = CursorBefore(order, data[0]).String()
+	}
+
+	return
+}
+
+// PaginatePeers sorts peers in the order and picks the page out of them.
+func PaginatePeers(peers []PeerInfo, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error) {
+	cursor, err := ParsePeerCursor(order, page.Cursor)
+	if err != nil {
+		return
+	}
+
+	sort.Slice(peers, order.LessFunc(peers))
+
+	start, end := 0, len(peers)
+	if cursor != nil {
+		at := cursor.Peer()
+		if cursor.Backward {
+			end = sort.Search(len(peers), func(i int) bool {
+				return !order.Less(peers[i], at)
+			})
+		} else {
+			start = sort.Search(len(peers), func(i int) bool {
+				return order.Less(at, peers[i])
+			})
+		}
+	}
+
+	moreBefore, moreAfter := false, false
+	if page.Limit > 0 && uint(end-start) > page.Limit {
+		if cursor != nil && cursor.Backward {
+			start = end - int(page.Limit)
+			moreBefore = true
+		} else {
+			end = start + int(page.Limit)
+			moreAfter = true
+		}
+	}
+
+	data = peers[start:end]
+	cursors = PageCursorsFor(order, cursor, data, moreBefore, moreAfter)
+	return
+}
@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func genPagedPeers(num int) []PeerInfo {
+	ret := make([]PeerInfo, 0, num)
+	for i := 0; i < num; i++ {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			panic(err)
+		}
+
+		ret = append(ret, PeerInfo{
+			PublicKey:     NewPublicKey(k.PublicKey()),
+			LastHandshake: int64(i % 4),
+			Name:          fmt.Sprint("name", i%3),
+		})
+	}
+	return ret
+}
+
+func TestParsePeerCursor(t *testing.T) {
+	peer := genPagedPeers(1)[0]
+	cursor := CursorBefore(OrderLastHandshakeDesc, peer)
+
+	got, err := ParsePeerCursor(OrderLastHandshakeDesc, cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, cursor) {
+		t.Errorf("ParsePeerCursor() = %v, want %v", *got, cursor)
+	}
+
+	tests := []struct {
+		name   string
+		order  PeerOrder
+		cursor string
+	}{
+		{name: "not base64", order: OrderLastHandshakeDesc, cursor: "!!"},
+		{name: "not json", order: OrderLastHandshakeDesc, cursor: "bm90IGpzb24"},
+		{name: "bad public key", order: OrderNameAsc, cursor: "eyJvIjowLCJrIjoiYWJjIn0"},
+		{name: "another order", order: OrderNameAsc, cursor: cursor.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePeerCursor(tt.order, tt.cursor); err != InvalidCursor {
+				t.Errorf("ParsePeerCursor() error = %v, want %v", err, InvalidCursor)
+			}
+		})
+	}
+}
+
+func TestPaginatePeers(t *testing.T) {
+	for _, order := range []PeerOrder{OrderNameAsc, OrderNameDesc, OrderLastHandshakeAsc, OrderLastHandshakeDesc} {
+		t.Run(fmt.Sprint("order ", order), func(t *testing.T) {
+			peers := genPagedPeers(11)
+			want := append([]PeerInfo(nil), peers...)
+			sort.Slice(want, order.LessFunc(want))
+
+			// Forward through every page.
+			var got []PeerInfo
+			var pages []PageCursors
+			page := PageRequest{Limit: 3}
+			for {
+				data, cursors, err := PaginatePeers(peers, order, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, data...)
+				pages = append(pages, cursors)
+				if len(cursors.Next) == 0 {
+					break
+				}
+				page.Cursor = cursors.Next
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("forward pages = %v, want %v", got, want)
+			}
+			if len(pages) != 4 || len(pages[0].Prev) != 0 {
+				t.Errorf("forward cursors = %v", pages)
+			}
+
+			// And back again from the last page.
+			got = nil
+			page = PageRequest{Cursor: pages[len(pages)-1].Prev, Limit: 3}
+			for len(page.Cursor) > 0 {
+				data, cursors, err := PaginatePeers(peers, order, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(data, got...)
+				page.Cursor = cursors.Prev
+			}
+
+			if !reflect.DeepEqual(got, want[:9]) {
+				t.Errorf("backward pages = %v, want %v", got, want[:9])
+			}
+		})
+	}
+}
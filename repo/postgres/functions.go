@@ -0,0 +1,23 @@
+package postgres
+
+const (
+	// createAllowedIPsContainSql tells whether any network in the comma separated allowedIPs column contains ip.
+	createAllowedIPsContainSql = `CREATE OR REPLACE FUNCTION allowed_ips_contain(allowed_ips TEXT, ip TEXT) RETURNS BOOLEAN AS $$
+		SELECT EXISTS (
+			SELECT 1 FROM unnest(string_to_array(allowed_ips, ',')) AS n
+			WHERE n <> '' AND n::inet >>= ip::inet
+		)
+	$$ LANGUAGE sql IMMUTABLE STRICT`
+
+	// createEndpointIPSql extracts the canonical IP address from the endpoint column, or '' if there isn't one.
+	createEndpointIPSql = `CREATE OR REPLACE FUNCTION endpoint_ip(endpoint TEXT) RETURNS TEXT AS $$
+		DECLARE
+			addr TEXT;
+		BEGIN
+			addr := coalesce(substring(endpoint FROM '^\[(.*)\]:[0-9]+$'), substring(endpoint FROM '^([^:]*):[0-9]+$'));
+			RETURN coalesce(host(addr::inet), '');
+		EXCEPTION WHEN invalid_text_representation THEN
+			RETURN '';
+		END
+	$$ LANGUAGE plpgsql IMMUTABLE STRICT`
+)
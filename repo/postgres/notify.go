@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"log"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"time"
+)
+
+const (
+	// notifyChannel is the channel the instances sharing the database tell each other of their changes on.
+	notifyChannel = "wgadmin_changes"
+
+	// maxPayload is under the 8000 bytes PostgreSQL takes in a notification.
+	maxPayload = 7900
+
+	minReconnectInterval = time.Second
+	maxReconnectInterval = time.Minute
+)
+
+// notification is an event as sent to the other instances, with the instance it comes from.
+type notification struct {
+	Instance    string               `json:"i"`
+	Type        repo.ChangeEventType `json:"t"`
+	DeviceNames []string             `json:"d,omitempty"`
+	PublicKeys  []string             `json:"k,omitempty"`
+}
+
+func newInstanceId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (n notification) event() (e repo.ChangeEvent, err error) {
+	e = repo.ChangeEvent{Type: n.Type, DeviceNames: n.DeviceNames}
+	for _, s := range n.PublicKeys {
+		var k repo.PublicKey
+		if err = k.Scan(s); err != nil {
+			return
+		}
+		e.PublicKeys = append(e.PublicKeys, k)
+	}
+	return
+}
+
+// payloads encodes the event for the other instances, split up into as many events as needed to fit a notification.
+func payloads(instance string, e repo.ChangeEvent) ([]string, error) {
+	n := notification{Instance: instance, Type: e.Type, DeviceNames: e.DeviceNames}
+	for _, k := range e.PublicKeys {
+		n.PublicKeys = append(n.PublicKeys, k.String())
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) <= maxPayload || (len(e.DeviceNames) <= 1 && len(e.PublicKeys) <= 1) {
+		return []string{string(data)}, nil
+	}
+
+	// Peer events have one device and any number of keys, device events any number of devices.
+	first, second := e, e
+	if len(e.PublicKeys) > 1 {
+		half := len(e.PublicKeys) / 2
+		first.PublicKeys, second.PublicKeys = e.PublicKeys[:half], e.PublicKeys[half:]
+	} else {
+		half := len(e.DeviceNames) / 2
+		first.DeviceNames, second.DeviceNames = e.DeviceNames[:half], e.DeviceNames[half:]
+	}
+
+	ret, err := payloads(instance, first)
+	if err != nil {
+		return nil, err
+	}
+
+	rest, err := payloads(instance, second)
+	return append(ret, rest...), err
+}
+
+// publish sends the events to the other instances in the transaction of the change, so that they only hear of it
+// once it's committed.
+func (s *postgresRepository) publish(tx *sqlx.Tx, events []repo.ChangeEvent) error {
+	for _, e := range events {
+		data, err := payloads(s.instance, e)
+		if err != nil {
+			return err
+		}
+
+		for _, payload := range data {
+			if _, err = tx.Exec("SELECT pg_notify($1, $2)", notifyChannel, payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// listen passes on the changes of the other instances to the listeners of this one, until the listener is closed.
+func (s *postgresRepository) listen() {
+	defer close(s.done)
+
+	for n := range s.listener.Notify {
+		if n == nil {
+			// The connection was lost, and with it whatever was sent in the meantime: any device may have changed.
+			s.resync()
+			continue
+		}
+
+		var message notification
+		if err := json.Unmarshal([]byte(n.Extra), &message); err != nil {
+			log.Printf("postgres: ignoring notification %q: %v", n.Extra, err)
+			continue
+		}
+
+		if message.Instance == s.instance {
+			continue
+		}
+
+		if e, err := message.event(); err != nil {
+			log.Printf("postgres: ignoring notification %q: %v", n.Extra, err)
+		} else {
+			s.NotifyChange(e)
+		}
+	}
+}
+
+func (s *postgresRepository) resync() {
+	var names []string
+	if err := s.DB.Select(&names, "SELECT name FROM devices ORDER BY name"); err != nil {
+		log.Printf("postgres: unable to list devices after reconnecting: %v", err)
+		return
+	}
+
+	if len(names) > 0 {
+		s.NotifyChange(repo.ChangeEvent{Type: repo.DeviceUpdated, DeviceNames: names})
+	}
+}
+
+func newListener(dsn string) (*pq.Listener, error) {
+	l := pq.NewListener(dsn, minReconnectInterval, maxReconnectInterval, nil)
+	if err := l.Listen(notifyChannel); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,315 @@
+package postgres
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/url"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/repo/repotest"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dsnEnv holds the data source name of the PostgreSQL database the tests run against. They're skipped without it.
+const dsnEnv = "WGADMIN_POSTGRES_DSN"
+
+func genPrivateKey(str string) repo.PrivateKey {
+	c := crypto.SHA256.New()
+	if _, err := c.Write([]byte(str)); err != nil {
+		panic(err)
+	}
+
+	if k, err := wgtypes.NewKey(c.Sum(make([]byte, 0))); err != nil {
+		panic(err)
+	} else {
+		return repo.NewPrivateKey(k)
+	}
+}
+
+func genPublicKey(str string) repo.PublicKey {
+	return genPrivateKey(str).ToPublicKey()
+}
+
+func genNewDevices(num int) []repo.DeviceInfo {
+	var ret []repo.DeviceInfo
+	for i := 0; i < num; i++ {
+		ret = append(ret, repo.DeviceInfo{
+			PrivateKey: genPrivateKey(fmt.Sprint("privatekey", i)),
+			ListenPort: uint16(i),
+			Name:       fmt.Sprint("device", i),
+		})
+	}
+	return ret
+}
+
+// storedDevices gives the devices as they read back once written for the first time.
+func storedDevices(devices []repo.DeviceInfo) []repo.DeviceInfo {
+	ret := append([]repo.DeviceInfo(nil), devices...)
+	for i := range ret {
+		ret[i].Revision = 1
+	}
+	return ret
+}
+
+var schemaSeq = 0
+
+// newSchema makes an empty schema to run a test in, and gives the data source name using it.
+func newSchema(t *testing.T) (dsn string, drop func()) {
+	base := os.Getenv(dsnEnv)
+	if len(base) == 0 {
+		t.Skip(dsnEnv, "is not set")
+	}
+
+	schemaSeq++
+	schema := fmt.Sprintf("wgadmin_test_%d_%d", os.Getpid(), schemaSeq)
+
+	db := sqlx.MustConnect("postgres", base)
+	db.MustExec("CREATE SCHEMA " + schema)
+
+	if u, err := url.Parse(base); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn = base + " search_path=" + schema
+	}
+
+	return dsn, func() {
+		db.MustExec("DROP SCHEMA " + schema + " CASCADE")
+		_ = db.Close()
+	}
+}
+
+func mustOpen(t *testing.T, dsn string, opts ...Option) *postgresRepository {
+	r, err := NewPostgresRepository(dsn, opts...)
+	if err != nil {
+		t.Fatal("NewPostgresRepository():", err)
+	}
+	return r.(*postgresRepository)
+}
+
+func mustCreateRepository(t *testing.T, devices ...repo.DeviceInfo) (*postgresRepository, func()) {
+	dsn, drop := newSchema(t)
+	r := mustOpen(t, dsn)
+	if err := r.UpdateDevices(devices); err != nil {
+		t.Fatal("UpdateDevices():", err)
+	}
+
+	return r, func() {
+		_ = r.Close()
+		drop()
+	}
+}
+
+func TestPayloads(t *testing.T) {
+	var keys []repo.PublicKey
+	for i := 0; i < 500; i++ {
+		keys = append(keys, genPublicKey(fmt.Sprint(i)))
+	}
+
+	tests := []struct {
+		name  string
+		event repo.ChangeEvent
+		want  int
+	}{
+		{name: "small", event: repo.ChangeEvent{Type: repo.PeersUpdated, DeviceNames: []string{"wg0"}, PublicKeys: keys[:10]}, want: 1},
+		{name: "many keys", event: repo.ChangeEvent{Type: repo.PeersRemoved, DeviceNames: []string{"wg0"}, PublicKeys: keys}, want: 4},
+		{name: "many devices", event: repo.ChangeEvent{Type: repo.DeviceRemoved, DeviceNames: strings.Split(strings.Repeat("device-name,", 1000), ",")}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := payloads("instance", tt.event)
+			if err != nil {
+				t.Fatal("payloads():", err)
+			}
+
+			if len(got) != tt.want {
+				t.Errorf("payloads() gave %v notifications, want %v", len(got), tt.want)
+			}
+
+			var joined repo.ChangeEvent
+			for _, p := range got {
+				if len(p) > maxPayload {
+					t.Errorf("payloads() gave a notification of %v bytes", len(p))
+				}
+
+				var n notification
+				if err = json.Unmarshal([]byte(p), &n); err != nil {
+					t.Fatal("json.Unmarshal():", err)
+				}
+
+				e, err := n.event()
+				if err != nil {
+					t.Fatal("event():", err)
+				}
+
+				joined.Type = e.Type
+				joined.PublicKeys = append(joined.PublicKeys, e.PublicKeys...)
+				if len(joined.DeviceNames) == 0 || e.Type == repo.DeviceRemoved {
+					joined.DeviceNames = append(joined.DeviceNames, e.DeviceNames...)
+				}
+			}
+
+			if !reflect.DeepEqual(joined, tt.event) {
+				t.Errorf("payloads() split %v into %v", tt.event, joined)
+			}
+		})
+	}
+}
+
+// droppingRepository drops the schema of a test along with the repository.
+type droppingRepository struct {
+	*postgresRepository
+	drop func()
+}
+
+func (r droppingRepository) Close() error {
+	err := r.postgresRepository.Close()
+	r.drop()
+	return err
+}
+
+func Test_postgresRepository_Conformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repo.Repository {
+		dsn, drop := newSchema(t)
+		return droppingRepository{postgresRepository: mustOpen(t, dsn), drop: drop}
+	})
+}
+
+func Test_postgresRepository_Audit(t *testing.T) {
+	devices := genNewDevices(1)
+	r, drop := mustCreateRepository(t, devices...)
+	defer drop()
+
+	actor := repo.Actor{Name: "alice", SourceIP: "192.0.2.1"}
+	if err := r.WithActor(actor).RemoveDevices([]string{devices[0].Name}); err != nil {
+		t.Fatal("RemoveDevices():", err)
+	}
+
+	entries, _, err := r.ListAudit(repo.AuditFilter{}, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListAudit():", err)
+	}
+
+	if len(entries) != 2 || entries[0].Action != repo.AuditDeviceRemoved || entries[0].Actor != actor {
+		t.Errorf("ListAudit() = %v, want the device added then removed by %v", entries, actor)
+	}
+
+	if _, err = r.DB.Exec("DELETE FROM audit"); err == nil {
+		t.Error("deleting from the audit log succeeded")
+	}
+}
+
+// Test_postgresRepository_Notifications opens two instances on a database, each of which should hear of the
+// changes of the other once.
+func Test_postgresRepository_Notifications(t *testing.T) {
+	dsn, drop := newSchema(t)
+	defer drop()
+
+	first := mustOpen(t, dsn)
+	defer first.Close()
+
+	second := mustOpen(t, dsn)
+	defer second.Close()
+
+	firstEvents := first.AddChangeNotification()
+	secondEvents := second.AddChangeNotification()
+
+	devices := genNewDevices(1)
+	if err := first.UpdateDevices(devices); err != nil {
+		t.Fatal("UpdateDevices():", err)
+	}
+
+	want := repo.ChangeEvent{Type: repo.DeviceUpdated, DeviceNames: []string{devices[0].Name}}
+	for name, events := range map[string]<-chan repo.ChangeEvent{"first": firstEvents, "second": secondEvents} {
+		select {
+		case e := <-events:
+			if !reflect.DeepEqual(e, want) {
+				t.Errorf("%v instance heard of %v, want %v", name, e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v instance didn't hear of the change", name)
+		}
+	}
+
+	select {
+	case e := <-firstEvents:
+		t.Errorf("first instance heard of its change again: %v", e)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func Test_postgresRepository_MasterKey(t *testing.T) {
+	dsn, drop := newSchema(t)
+	defer drop()
+
+	plain := mustOpen(t, dsn)
+	devices := genNewDevices(1)
+	if err := plain.UpdateDevices(devices); err != nil {
+		t.Fatal("UpdateDevices():", err)
+	}
+	_ = plain.Close()
+
+	master, _ := secrets.NewMasterKey()
+	encrypted := mustOpen(t, dsn, WithMasterKey(&master))
+	defer encrypted.Close()
+
+	var stored string
+	if err := encrypted.DB.Get(&stored, "SELECT private_key FROM devices"); err != nil || stored == devices[0].PrivateKey.String() {
+		t.Errorf("private key stored as %v, %v, want it sealed", stored, err)
+	}
+
+	if got, err := encrypted.ListDevices(); err != nil || !reflect.DeepEqual(got, storedDevices(devices)) {
+		t.Errorf("ListDevices() = %v, %v, want %v", got, err, storedDevices(devices))
+	}
+
+	if _, err := NewPostgresRepository(dsn); err != secrets.ErrNoKey {
+		t.Errorf("NewPostgresRepository() without the key error = %v, want %v", err, secrets.ErrNoKey)
+	}
+
+	// Another instance carries on after a rotation with the data key it has, which the new master key opens.
+	other := mustOpen(t, dsn, WithMasterKey(&master))
+	defer other.Close()
+
+	next, _ := secrets.NewMasterKey()
+	if err := encrypted.RotateMasterKey(next); err != nil {
+		t.Fatal("RotateMasterKey():", err)
+	}
+
+	devices = append(devices, genNewDevices(2)[1])
+	if err := other.UpdateDevices(devices[1:]); err != nil {
+		t.Fatal("UpdateDevices():", err)
+	}
+
+	rotated := mustOpen(t, dsn, WithMasterKey(&next))
+	defer rotated.Close()
+
+	if got, err := rotated.ListDevices(); err != nil || !reflect.DeepEqual(got, storedDevices(devices)) {
+		t.Errorf("ListDevices() after the rotation = %v, %v, want %v", got, err, storedDevices(devices))
+	}
+}
+
+func Test_postgresRepository_MasterKey_staleInstance(t *testing.T) {
+	dsn, drop := newSchema(t)
+	defer drop()
+
+	plain := mustOpen(t, dsn)
+	defer plain.Close()
+
+	master, _ := secrets.NewMasterKey()
+	encrypted := mustOpen(t, dsn, WithMasterKey(&master))
+	_ = encrypted.Close()
+
+	// What the instance opened before the store got encrypted would write wouldn't read.
+	if err := plain.UpdateDevices(genNewDevices(1)); err != secrets.ErrNoKey {
+		t.Errorf("UpdateDevices() error = %v, want %v", err, secrets.ErrNoKey)
+	}
+}
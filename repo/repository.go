@@ -2,10 +2,8 @@ package repo
 
 import (
 	"errors"
-	"io"
 	"net"
 	"nz.cloudwalker/wireguard-webadmin/utils"
-	"sync"
 	"time"
 )
 
@@ -18,19 +16,35 @@ type PeerInfo struct {
 	DeviceName                  string
 	LastHandshake               int64
 
-	Name string
+	Name   string
+	Meta   map[string]string
+	Tags   []string
+	Groups []string
+
+	// Disabled peers are kept but not pushed to their device. StateReason and StateChangedAt, in unix seconds,
+	// tell why and when the peer was last enabled or disabled.
+	Disabled       bool
+	StateReason    string
+	StateChangedAt int64
+
+	// ExpiresAt is when, in unix seconds, the peer loses access. Zero is never.
+	ExpiresAt int64
+
+	// Owner is the name of the user the peer belongs to, empty for the peers only admins manage.
+	Owner string
+
+	// Revision counts the changes made to the peer. Writing a peer with a non-zero Revision fails with
+	// ErrRevisionConflict unless it is still the stored one; zero writes it whatever is stored.
+	Revision int64
 }
 
 type DeviceInfo struct {
 	PrivateKey PrivateKey
 	ListenPort uint16
 	Name       string
-}
 
-type ChangeNotification interface {
-	io.Closer
-	AddChangeNotification(channel chan<- interface{})
-	RemoveChangeNotification(channel chan<- interface{})
+	// Revision counts the changes made to the device, as PeerInfo.Revision does.
+	Revision int64
 }
 
 type PeerOrder int
@@ -44,6 +58,10 @@ const (
 
 var (
 	InvalidPeerOrder = errors.New("invalid peer order")
+
+	// ErrReadOnly is what writing to a repository that can't be written to fails with, as one whose devices are
+	// described by files kept elsewhere.
+	ErrReadOnly = errors.New("read-only repository")
 )
 
 func (o PeerOrder) LessFunc(peers []PeerInfo) func(lh, rh int) bool {
@@ -74,6 +92,11 @@ func (o PeerOrder) LessFunc(peers []PeerInfo) func(lh, rh int) bool {
 	}
 }
 
+// Less compares two peers the same way as LessFunc.
+func (o PeerOrder) Less(lhs, rhs PeerInfo) bool {
+	return o.LessFunc([]PeerInfo{lhs, rhs})(0, 1)
+}
+
 type Repository interface {
 	ChangeNotification
 
@@ -82,58 +105,11 @@ type Repository interface {
 	RemoveDevices(names []string) error
 	ReplaceAllDevices(devices []DeviceInfo) error
 
-	ListPeersByDevices(deviceNames []string, order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error)
-	ListPeersByKeys(deviceName string, pubKeys []PublicKey, order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error)
-	ListPeers(order PeerOrder, offset uint, limit uint) (data []PeerInfo, total uint, err error)
+	ListPeersByDevices(deviceNames []string, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error)
+	ListPeersByKeys(deviceName string, pubKeys []PublicKey, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error)
+	ListPeers(filter PeerFilter, order PeerOrder, page PageRequest) (data []PeerInfo, cursors PageCursors, err error)
 
 	RemovePeers(deviceName string, publicKeys []PublicKey) error
 	UpdatePeers(deviceName string, peers []PeerInfo) error
 	ReplaceAllPeers(deviceName string, peers []PeerInfo) error
 }
-
-type DefaultChangeNotificationHandler struct {
-	listeners      map[chan<- interface{}]interface{}
-	listenersMutex sync.Mutex
-}
-
-func (d *DefaultChangeNotificationHandler) Close() error {
-	d.listenersMutex.Lock()
-	defer d.listenersMutex.Unlock()
-
-	for c, _ := range d.listeners {
-		close(c)
-	}
-
-	d.listeners = make(map[chan<- interface{}]interface{})
-	return nil
-}
-
-func (d DefaultChangeNotificationHandler) NotifyChange() {
-	go func() {
-		defer func() {
-			recover()
-		}()
-
-		for c, _ := range d.listeners {
-			c <- nil
-		}
-	}()
-}
-
-func (d *DefaultChangeNotificationHandler) AddChangeNotification(channel chan<- interface{}) {
-	d.listenersMutex.Lock()
-	defer d.listenersMutex.Unlock()
-	if d.listeners != nil {
-		delete(d.listeners, channel)
-	}
-}
-
-func (d *DefaultChangeNotificationHandler) RemoveChangeNotification(channel chan<- interface{}) {
-	d.listenersMutex.Lock()
-	defer d.listenersMutex.Unlock()
-	if d.listeners == nil {
-		d.listeners = make(map[chan<- interface{}]interface{})
-	}
-
-	d.listeners[channel] = nil
-}
@@ -0,0 +1,881 @@
+// Package repotest is the conformance suite every repo.Repository runs from its tests, so that the memory, SQLite,
+// PostgreSQL and any later repository can be swapped for one another.
+package repotest
+
+import (
+	"crypto"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Factory makes an empty repository for a test. The suite closes it.
+type Factory func(t *testing.T) repo.Repository
+
+// Run checks the repositories made by factory, each test on a repository of its own.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, r repo.Repository)
+	}{
+		{name: "Devices", test: testDevices},
+		{name: "Peers", test: testPeers},
+		{name: "ListPeersByDevices", test: testListPeersByDevices},
+		{name: "ListPeersByKeys", test: testListPeersByKeys},
+		{name: "Order", test: testOrder},
+		{name: "Pagination", test: testPagination},
+		{name: "Filter", test: testFilter},
+		{name: "CascadingDeletes", test: testCascadingDeletes},
+		{name: "Addresses", test: testAddresses},
+		{name: "AddPeer", test: testAddPeer},
+		{name: "Notifications", test: testNotifications},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := factory(t)
+			defer r.Close()
+			tt.test(t, r)
+		})
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		testClose(t, factory(t))
+	})
+}
+
+var orders = []repo.PeerOrder{repo.OrderNameAsc, repo.OrderNameDesc, repo.OrderLastHandshakeAsc, repo.OrderLastHandshakeDesc}
+
+func genPrivateKey(str string) repo.PrivateKey {
+	c := crypto.SHA256.New()
+	if _, err := c.Write([]byte(str)); err != nil {
+		panic(err)
+	}
+
+	if k, err := wgtypes.NewKey(c.Sum(make([]byte, 0))); err != nil {
+		panic(err)
+	} else {
+		return repo.NewPrivateKey(k)
+	}
+}
+
+func genPublicKey(str string) repo.PublicKey {
+	return genPrivateKey(str).ToPublicKey()
+}
+
+// genDevices makes num devices, numbered from first on.
+func genDevices(first int, num int) []repo.DeviceInfo {
+	var ret []repo.DeviceInfo
+	for i := first; i < first+num; i++ {
+		ret = append(ret, repo.DeviceInfo{
+			PrivateKey: genPrivateKey(fmt.Sprint("privatekey", i)),
+			ListenPort: uint16(51820 + i),
+			Name:       fmt.Sprint("device", i),
+		})
+	}
+	return ret
+}
+
+// genPeers makes num peers of the device, numbered from first on. Their names and handshakes repeat, for the
+// tie-break on the public key to matter, and the optional fields are only set on some of them.
+func genPeers(deviceName string, first int, num int) []repo.PeerInfo {
+	var ret []repo.PeerInfo
+	for i := first; i < first+num; i++ {
+		_, v4, _ := net.ParseCIDR(fmt.Sprintf("10.0.%d.0/24", i))
+		_, v6, _ := net.ParseCIDR(fmt.Sprintf("fd00:%x::/64", i))
+		p := repo.PeerInfo{
+			PublicKey:                   genPublicKey(fmt.Sprint("pubkey", i)),
+			PersistentKeepaliveInterval: time.Duration(i%3) * 10 * time.Second,
+			AllowedIPs:                  []net.IPNet{*v4, *v6},
+			DeviceName:                  deviceName,
+			LastHandshake:               int64(1000 + i%4),
+			Name:                        fmt.Sprint("Name", i%5),
+			Tags:                        []string{fmt.Sprint("tag", i%2)},
+		}
+
+		if i%3 != 0 {
+			p.Endpoint = &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 51820}
+		}
+		if i%5 != 0 {
+			p.PreSharedKey = repo.SymmetricKey(genPrivateKey(fmt.Sprint("sharekey", i)))
+		}
+		if i%2 == 0 {
+			p.Meta = map[string]string{"owner": fmt.Sprint("owner", i%3)}
+			p.ExpiresAt = int64(2000 + i)
+			p.Owner = fmt.Sprint("user", i%3)
+		}
+		if i%4 == 0 {
+			p.Tags = append(p.Tags, "wifi")
+			p.Groups = []string{"admins", "staff"}
+			p.Disabled, p.StateReason, p.StateChangedAt = true, "lost", int64(1500+i)
+		}
+
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// storedDevices gives the devices as they read back once written for the first time, sorted by name.
+func storedDevices(devices ...repo.DeviceInfo) []repo.DeviceInfo {
+	ret := append([]repo.DeviceInfo(nil), devices...)
+	for i := range ret {
+		ret[i].Revision = 1
+	}
+	sortDevices(ret)
+	return ret
+}
+
+// storedPeers gives the peers as they read back once written for the first time, in name order.
+func storedPeers(peers ...[]repo.PeerInfo) []repo.PeerInfo {
+	var ret []repo.PeerInfo
+	for _, p := range peers {
+		ret = append(ret, p...)
+	}
+	for i := range ret {
+		ret[i].Revision = 1
+	}
+	return sortPeers(ret, repo.OrderNameAsc)
+}
+
+func sortDevices(devices []repo.DeviceInfo) {
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+}
+
+// sortPeers gives a sorted copy of the peers.
+func sortPeers(peers []repo.PeerInfo, order repo.PeerOrder) []repo.PeerInfo {
+	ret := append([]repo.PeerInfo(nil), peers...)
+	sort.Slice(ret, order.LessFunc(ret))
+	return ret
+}
+
+func mustUpdateDevices(t *testing.T, r repo.Repository, devices ...repo.DeviceInfo) {
+	t.Helper()
+
+	if err := r.UpdateDevices(devices); err != nil {
+		t.Fatal("UpdateDevices():", err)
+	}
+}
+
+func mustUpdatePeers(t *testing.T, r repo.Repository, deviceName string, peers []repo.PeerInfo) {
+	t.Helper()
+
+	if err := r.UpdatePeers(deviceName, peers); err != nil {
+		t.Fatal("UpdatePeers():", err)
+	}
+}
+
+func checkDevices(t *testing.T, r repo.Repository, want []repo.DeviceInfo) {
+	t.Helper()
+
+	got, err := r.ListDevices()
+	if err != nil {
+		t.Fatal("ListDevices():", err)
+	}
+
+	sortDevices(got)
+	if len(got) != 0 || len(want) != 0 {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListDevices() = %v, want %v", got, want)
+		}
+	}
+}
+
+// checkPeers compares the peers of the devices, in name order, with want.
+func checkPeers(t *testing.T, r repo.Repository, deviceNames []string, want []repo.PeerInfo) {
+	t.Helper()
+
+	got, _, err := r.ListPeersByDevices(deviceNames, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListPeersByDevices():", err)
+	}
+
+	if len(got) != 0 || len(want) != 0 {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListPeersByDevices(%v) = %v, want %v", deviceNames, got, want)
+		}
+	}
+}
+
+func testDevices(t *testing.T, r repo.Repository) {
+	checkDevices(t, r, nil)
+
+	devices := genDevices(0, 3)
+	mustUpdateDevices(t, r, devices...)
+	want := storedDevices(devices...)
+	checkDevices(t, r, want)
+
+	changed := want[0]
+	changed.ListenPort = 51900
+	mustUpdateDevices(t, r, changed)
+	changed.Revision = 2
+	want[0] = changed
+	checkDevices(t, r, want)
+
+	// A write made from an old read fails, taking the rest of the batch down with it.
+	stale := storedDevices(devices[0])[0]
+	stale.ListenPort = 51901
+	moved := want[1]
+	moved.ListenPort = 51902
+	if err := r.UpdateDevices([]repo.DeviceInfo{moved, stale}); err != repo.ErrRevisionConflict {
+		t.Errorf("UpdateDevices() of a stale device error = %v, want %v", err, repo.ErrRevisionConflict)
+	}
+	checkDevices(t, r, want)
+
+	// Writing a device as it is leaves its revision alone.
+	mustUpdateDevices(t, r, want[1], devices[2])
+	checkDevices(t, r, want)
+
+	if err := r.RemoveDevices([]string{devices[2].Name, "unknown"}); err != nil {
+		t.Fatal("RemoveDevices():", err)
+	}
+	want = want[:2]
+	checkDevices(t, r, want)
+
+	// Zero writes whatever is stored.
+	added := genDevices(3, 1)
+	if err := r.ReplaceAllDevices([]repo.DeviceInfo{devices[0], added[0]}); err != nil {
+		t.Fatal("ReplaceAllDevices():", err)
+	}
+
+	want = storedDevices(devices[0], added[0])
+	want[0].Revision = 3
+	checkDevices(t, r, want)
+
+	if err := r.ReplaceAllDevices(nil); err != nil {
+		t.Fatal("ReplaceAllDevices():", err)
+	}
+	checkDevices(t, r, nil)
+}
+
+// withPeer gives a copy of peers in name order, with p in place of the peer that has its key.
+func withPeer(peers []repo.PeerInfo, p repo.PeerInfo) []repo.PeerInfo {
+	ret := withoutPeer(peers, p.PublicKey)
+	return sortPeers(append(ret, p), repo.OrderNameAsc)
+}
+
+// withoutPeer gives a copy of peers without the peer that has the key.
+func withoutPeer(peers []repo.PeerInfo, key repo.PublicKey) (ret []repo.PeerInfo) {
+	for _, p := range peers {
+		if p.PublicKey != key {
+			ret = append(ret, p)
+		}
+	}
+	return
+}
+
+func testPeers(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	first, second := genPeers(devices[0].Name, 0, 6), genPeers(devices[1].Name, 6, 3)
+	mustUpdatePeers(t, r, devices[0].Name, first)
+	mustUpdatePeers(t, r, devices[1].Name, second)
+
+	want := storedPeers(first)
+	checkPeers(t, r, []string{devices[0].Name}, want)
+	checkPeers(t, r, []string{devices[1].Name}, storedPeers(second))
+
+	// Peers take the name of the device they're written to.
+	moved := genPeers(devices[1].Name, 9, 1)
+	mustUpdatePeers(t, r, devices[0].Name, moved)
+	moved[0].DeviceName = devices[0].Name
+	want = withPeer(want, storedPeers(moved)[0])
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	changed := storedPeers(first[:1])[0]
+	changed.Name = "renamed"
+	changed.Meta = map[string]string{"owner": "someone else", "room": "12"}
+	changed.Tags = []string{"tag9"}
+	changed.Groups = nil
+	changed.Endpoint = &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{changed})
+	changed.Revision = 2
+	want = withPeer(want, changed)
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	// A write made from an old read fails, taking the rest of the batch down with it.
+	stale := storedPeers(first[:1])[0]
+	stale.Name = "stale"
+	other := storedPeers(first[1:2])[0]
+	other.Name = "other"
+	if err := r.UpdatePeers(devices[0].Name, []repo.PeerInfo{other, stale}); err != repo.ErrRevisionConflict {
+		t.Errorf("UpdatePeers() of a stale peer error = %v, want %v", err, repo.ErrRevisionConflict)
+	}
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	// Writing a peer as it is, or with only a new handshake, leaves its revision alone.
+	handshake := storedPeers(first[1:2])[0]
+	handshake.LastHandshake = 5000
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{handshake, first[2]})
+	want = withPeer(want, handshake)
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	// A new pre-shared key alone is a change too, which a write made from before it can't undo.
+	rotated := storedPeers(first[2:3])[0]
+	rotated.PreSharedKey = repo.SymmetricKey(genPrivateKey("rotated"))
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{rotated})
+	rotated.Revision = 2
+	want = withPeer(want, rotated)
+
+	stale = storedPeers(first[2:3])[0]
+	if err := r.UpdatePeers(devices[0].Name, []repo.PeerInfo{stale}); err != repo.ErrRevisionConflict {
+		t.Errorf("UpdatePeers() with the pre-shared key before the rotation error = %v, want %v", err, repo.ErrRevisionConflict)
+	}
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	if err := r.RemovePeers(devices[0].Name, []repo.PublicKey{first[3].PublicKey, genPublicKey("unknown")}); err != nil {
+		t.Fatal("RemovePeers():", err)
+	}
+	if err := r.RemovePeers("unknown", []repo.PublicKey{first[4].PublicKey}); err != nil {
+		t.Fatal("RemovePeers() of an unknown device:", err)
+	}
+	want = withoutPeer(want, first[3].PublicKey)
+	checkPeers(t, r, []string{devices[0].Name}, want)
+
+	// The other device's peers are left alone.
+	checkPeers(t, r, []string{devices[1].Name}, storedPeers(second))
+
+	added := genPeers(devices[0].Name, 10, 2)
+	if err := r.ReplaceAllPeers(devices[0].Name, append([]repo.PeerInfo{first[4]}, added...)); err != nil {
+		t.Fatal("ReplaceAllPeers():", err)
+	}
+	checkPeers(t, r, []string{devices[0].Name}, storedPeers(first[4:5], added))
+	checkPeers(t, r, []string{devices[1].Name}, storedPeers(second))
+
+	if err := r.ReplaceAllPeers(devices[0].Name, nil); err != nil {
+		t.Fatal("ReplaceAllPeers():", err)
+	}
+	checkPeers(t, r, []string{devices[0].Name}, nil)
+}
+
+func testListPeersByDevices(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 3)
+	mustUpdateDevices(t, r, devices...)
+
+	first, second := genPeers(devices[0].Name, 0, 5), genPeers(devices[1].Name, 5, 5)
+	mustUpdatePeers(t, r, devices[0].Name, first)
+	mustUpdatePeers(t, r, devices[1].Name, second)
+
+	tests := []struct {
+		name        string
+		deviceNames []string
+		want        []repo.PeerInfo
+	}{
+		{name: "none", deviceNames: nil},
+		{name: "unknown", deviceNames: []string{"unknown"}},
+		{name: "no peers", deviceNames: []string{devices[2].Name}},
+		{name: "one", deviceNames: []string{devices[1].Name}, want: storedPeers(second)},
+		{name: "all", deviceNames: []string{devices[0].Name, devices[1].Name, devices[2].Name, "unknown"}, want: storedPeers(first, second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkPeers(t, r, tt.deviceNames, tt.want)
+		})
+	}
+}
+
+func testListPeersByKeys(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	// The same peer sits on both devices, with a different name on each.
+	first, second := genPeers(devices[0].Name, 0, 4), genPeers(devices[1].Name, 0, 4)
+	for i := range second {
+		second[i].Name = "second " + second[i].Name
+	}
+	mustUpdatePeers(t, r, devices[0].Name, first)
+	mustUpdatePeers(t, r, devices[1].Name, second)
+
+	tests := []struct {
+		name       string
+		deviceName string
+		keys       []repo.PublicKey
+		want       []repo.PeerInfo
+	}{
+		{name: "none", deviceName: devices[0].Name},
+		{name: "unknown key", deviceName: devices[0].Name, keys: []repo.PublicKey{genPublicKey("unknown")}},
+		{name: "unknown device", deviceName: "unknown", keys: []repo.PublicKey{first[0].PublicKey}},
+		{name: "first device", deviceName: devices[0].Name, keys: []repo.PublicKey{first[0].PublicKey, first[2].PublicKey}, want: storedPeers(first[0:1], first[2:3])},
+		{name: "second device", deviceName: devices[1].Name, keys: []repo.PublicKey{second[0].PublicKey, genPublicKey("unknown")}, want: storedPeers(second[0:1])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := r.ListPeersByKeys(tt.deviceName, tt.keys, repo.OrderNameAsc, repo.PageRequest{})
+			if err != nil {
+				t.Fatal("ListPeersByKeys():", err)
+			}
+
+			if (len(got) != 0 || len(tt.want) != 0) && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListPeersByKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testOrder(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	first, second := genPeers(devices[0].Name, 0, 13), genPeers(devices[1].Name, 13, 7)
+	mustUpdatePeers(t, r, devices[0].Name, first)
+	mustUpdatePeers(t, r, devices[1].Name, second)
+	stored := storedPeers(first, second)
+
+	for _, order := range orders {
+		t.Run(fmt.Sprint(order), func(t *testing.T) {
+			want := sortPeers(stored, order)
+
+			got, cursors, err := r.ListPeers(repo.PeerFilter{}, order, repo.PageRequest{})
+			if err != nil {
+				t.Fatal("ListPeers():", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ListPeers() = %v, want %v", got, want)
+			}
+
+			if cursors != (repo.PageCursors{}) {
+				t.Errorf("ListPeers() of everything gave cursors %v", cursors)
+			}
+
+			got, _, err = r.ListPeersByDevices([]string{devices[0].Name, devices[1].Name}, order, repo.PageRequest{})
+			if err != nil {
+				t.Fatal("ListPeersByDevices():", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ListPeersByDevices() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// testPagination walks every order a page at a time both ways, and checks the pages against repo.PaginatePeers.
+func testPagination(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 1)
+	mustUpdateDevices(t, r, devices...)
+
+	peers := genPeers(devices[0].Name, 0, 17)
+	mustUpdatePeers(t, r, devices[0].Name, peers)
+	stored := storedPeers(peers)
+
+	for _, order := range orders {
+		for _, limit := range []uint{1, 4, 17, 20} {
+			t.Run(fmt.Sprintf("order %v limit %v", order, limit), func(t *testing.T) {
+				// Forward to the last page, then back to the first.
+				var seen []repo.PeerInfo
+				page := repo.PageRequest{Limit: limit}
+				for _, backward := range []bool{false, true} {
+					for {
+						want, wantCursors, _ := repo.PaginatePeers(append([]repo.PeerInfo(nil), stored...), order, page)
+						got, gotCursors, err := r.ListPeers(repo.PeerFilter{}, order, page)
+						if err != nil {
+							t.Fatal("ListPeers():", err)
+						}
+
+						if !reflect.DeepEqual(got, want) || gotCursors != wantCursors {
+							t.Fatalf("ListPeers(%v) = %v, %v, want %v, %v", page, got, gotCursors, want, wantCursors)
+						}
+
+						if !backward {
+							seen = append(seen, got...)
+						}
+
+						next := gotCursors.Next
+						if backward {
+							next = gotCursors.Prev
+						}
+
+						if len(next) == 0 {
+							page.Cursor = gotCursors.Prev
+							break
+						}
+						page.Cursor = next
+					}
+				}
+
+				if want := sortPeers(stored, order); !reflect.DeepEqual(seen, want) {
+					t.Errorf("the pages put together = %v, want %v", seen, want)
+				}
+			})
+		}
+	}
+
+	other := repo.CursorAfter(repo.OrderNameAsc, stored[0]).String()
+	for _, cursor := range []string{"not a cursor", other} {
+		if _, _, err := r.ListPeers(repo.PeerFilter{}, repo.OrderLastHandshakeAsc, repo.PageRequest{Cursor: cursor}); err != repo.InvalidCursor {
+			t.Errorf("ListPeers() from cursor %q error = %v, want %v", cursor, err, repo.InvalidCursor)
+		}
+
+		if _, _, err := r.ListPeersByDevices(nil, repo.OrderLastHandshakeAsc, repo.PageRequest{Cursor: cursor}); err != repo.InvalidCursor {
+			t.Errorf("ListPeersByDevices() from cursor %q error = %v, want %v", cursor, err, repo.InvalidCursor)
+		}
+
+		if _, _, err := r.ListPeersByKeys(devices[0].Name, nil, repo.OrderLastHandshakeAsc, repo.PageRequest{Cursor: cursor}); err != repo.InvalidCursor {
+			t.Errorf("ListPeersByKeys() from cursor %q error = %v, want %v", cursor, err, repo.InvalidCursor)
+		}
+	}
+}
+
+func testFilter(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	first, second := genPeers(devices[0].Name, 0, 9), genPeers(devices[1].Name, 9, 4)
+	mustUpdatePeers(t, r, devices[0].Name, first)
+	mustUpdatePeers(t, r, devices[1].Name, second)
+	stored := storedPeers(first, second)
+
+	tests := []struct {
+		name   string
+		filter repo.PeerFilter
+	}{
+		{name: "everything", filter: repo.PeerFilter{}},
+		{name: "name", filter: repo.PeerFilter{NameContains: "name1"}},
+		{name: "public key", filter: repo.PeerFilter{PublicKeyPrefix: first[3].PublicKey.String()[:6]}},
+		{name: "allowed ip", filter: repo.PeerFilter{AllowedIP: net.ParseIP("10.0.2.9")}},
+		{name: "allowed ipv6", filter: repo.PeerFilter{AllowedIP: net.ParseIP("fd00:b::1")}},
+		{name: "endpoint ip", filter: repo.PeerFilter{EndpointIP: net.ParseIP("192.0.2.4")}},
+		{name: "handshake after", filter: repo.PeerFilter{HandshakeAfter: time.Unix(1001, 0)}},
+		{name: "handshake before", filter: repo.PeerFilter{HandshakeBefore: time.Unix(1001, 0)}},
+		{name: "meta", filter: repo.PeerFilter{Meta: map[string]string{"owner": "owner2"}}},
+		{name: "tags", filter: repo.PeerFilter{Tags: []string{"tag0", "wifi"}}},
+		{name: "group", filter: repo.PeerFilter{Group: "staff"}},
+		{name: "unknown group", filter: repo.PeerFilter{Group: "nobody"}},
+		{name: "expires by", filter: repo.PeerFilter{ExpiresBy: time.Unix(2004, 0)}},
+		{name: "owner", filter: repo.PeerFilter{Owner: "user1"}},
+		{name: "combined", filter: repo.PeerFilter{Tags: []string{"tag0"}, HandshakeAfter: time.Unix(1000, 0), NameContains: "NAME"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []repo.PeerInfo
+			for i := range stored {
+				if tt.filter.Match(&stored[i]) {
+					want = append(want, stored[i])
+				}
+			}
+
+			for _, order := range orders {
+				got, _, err := r.ListPeers(tt.filter, order, repo.PageRequest{})
+				if err != nil {
+					t.Fatal("ListPeers():", err)
+				}
+
+				if want := sortPeers(want, order); (len(got) != 0 || len(want) != 0) && !reflect.DeepEqual(got, want) {
+					t.Errorf("ListPeers() in order %v = %v, want %v", order, got, want)
+				}
+			}
+		})
+	}
+}
+
+func testCascadingDeletes(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 3)
+	mustUpdateDevices(t, r, devices...)
+
+	var peers [][]repo.PeerInfo
+	for i, d := range devices {
+		peers = append(peers, genPeers(d.Name, i*5, 5))
+		mustUpdatePeers(t, r, d.Name, peers[i])
+	}
+
+	// A removed device takes its peers along, and they don't come back with it.
+	if err := r.RemoveDevices([]string{devices[0].Name}); err != nil {
+		t.Fatal("RemoveDevices():", err)
+	}
+	mustUpdateDevices(t, r, devices[0])
+	checkPeers(t, r, []string{devices[0].Name}, nil)
+
+	if err := r.ReplaceAllDevices(devices[1:2]); err != nil {
+		t.Fatal("ReplaceAllDevices():", err)
+	}
+	mustUpdateDevices(t, r, devices[0], devices[2])
+	checkPeers(t, r, []string{devices[0].Name, devices[1].Name, devices[2].Name}, storedPeers(peers[1]))
+
+	if got, _, err := r.ListPeers(repo.PeerFilter{Group: "admins"}, repo.OrderNameAsc, repo.PageRequest{}); err != nil {
+		t.Fatal("ListPeers():", err)
+	} else {
+		for _, p := range got {
+			if p.DeviceName != devices[1].Name {
+				t.Errorf("ListPeers() found %v of %v, whose device was removed", p.PublicKey, p.DeviceName)
+			}
+		}
+	}
+
+	// A peer written again without its metadata, tags or groups loses them, whether on its own or with the rest of
+	// its device.
+	writes := []struct {
+		name  string
+		write func(deviceName string, peers []repo.PeerInfo) error
+	}{
+		{name: "UpdatePeers", write: r.UpdatePeers},
+		{name: "ReplaceAllPeers", write: r.ReplaceAllPeers},
+	}
+	for i, w := range writes {
+		d := devices[i*2]
+		mustUpdatePeers(t, r, d.Name, peers[i*2])
+
+		bare := append([]repo.PeerInfo(nil), peers[i*2]...)
+		for j := range bare {
+			bare[j].Meta, bare[j].Tags, bare[j].Groups = nil, nil, nil
+		}
+
+		if err := w.write(d.Name, bare); err != nil {
+			t.Fatal(w.name+"():", err)
+		}
+
+		want := storedPeers(bare)
+		for j := range want {
+			want[j].Revision = 2
+		}
+		checkPeers(t, r, []string{d.Name}, want)
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) (ret []net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, *n)
+	}
+	return
+}
+
+func testAddresses(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	a := repo.PeerInfo{PublicKey: genPublicKey("a"), Name: "a", AllowedIPs: mustParseCIDRs("10.9.0.2/32", "fd09::2/128", "192.168.1.0/24")}
+	b := repo.PeerInfo{PublicKey: genPublicKey("b"), Name: "b", AllowedIPs: mustParseCIDRs("10.9.0.2/32")}
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{a})
+
+	if err := r.UpdatePeers(devices[0].Name, []repo.PeerInfo{b}); err != repo.ErrAddressTaken {
+		t.Errorf("UpdatePeers() of a taken address error = %v, want %v", err, repo.ErrAddressTaken)
+	}
+
+	// Another device has addresses of its own, and a network routed to a peer isn't an address.
+	mustUpdatePeers(t, r, devices[1].Name, []repo.PeerInfo{b})
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{{PublicKey: genPublicKey("site"), AllowedIPs: mustParseCIDRs("192.168.1.0/24")}})
+
+	// A peer gives its address back when it moves to another, or is removed.
+	a.AllowedIPs = mustParseCIDRs("10.9.0.3/32")
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{a, b})
+	if err := r.RemovePeers(devices[0].Name, []repo.PublicKey{a.PublicKey}); err != nil {
+		t.Fatal("RemovePeers():", err)
+	}
+	c := repo.PeerInfo{PublicKey: genPublicKey("c"), Name: "c", AllowedIPs: mustParseCIDRs("10.9.0.3/32")}
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{c})
+
+	// Nothing of a write giving an address to two peers is kept.
+	d := repo.PeerInfo{PublicKey: genPublicKey("d"), Name: "d", AllowedIPs: mustParseCIDRs("10.9.0.3/32")}
+	if err := r.ReplaceAllPeers(devices[0].Name, []repo.PeerInfo{b, d, c}); err != repo.ErrAddressTaken {
+		t.Errorf("ReplaceAllPeers() of a taken address error = %v, want %v", err, repo.ErrAddressTaken)
+	}
+
+	got, _, err := r.ListPeersByDevices([]string{devices[0].Name}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListPeersByDevices():", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("ListPeersByDevices() = %v, want b, c and the site", got)
+	}
+
+	// The addresses go along with their device.
+	if err = r.RemoveDevices([]string{devices[0].Name}); err != nil {
+		t.Fatal("RemoveDevices():", err)
+	}
+	mustUpdateDevices(t, r, devices[0])
+	mustUpdatePeers(t, r, devices[0].Name, []repo.PeerInfo{d})
+}
+
+func testAddPeer(t *testing.T, r repo.Repository) {
+	devices := genDevices(0, 2)
+	mustUpdateDevices(t, r, devices...)
+
+	peer := func(name string, deviceName string) repo.PeerInfo {
+		return repo.PeerInfo{PublicKey: genPublicKey(name), DeviceName: deviceName, Name: name, Owner: "bob"}
+	}
+
+	// The limit counts the peers of the owner on every device.
+	for _, p := range []repo.PeerInfo{peer("phone", devices[0].Name), peer("laptop", devices[1].Name)} {
+		if err := repo.AddPeer(r, p, 2); err != nil {
+			t.Fatal("AddPeer():", err)
+		}
+	}
+
+	if err := repo.AddPeer(r, peer("tablet", devices[0].Name), 2); err != repo.ErrOwnerLimit {
+		t.Errorf("AddPeer() past the limit error = %v, want %v", err, repo.ErrOwnerLimit)
+	}
+
+	if err := repo.AddPeer(r, peer("phone", devices[0].Name), -1); err != repo.ErrPeerExists {
+		t.Errorf("AddPeer() of a peer there error = %v, want %v", err, repo.ErrPeerExists)
+	}
+
+	if err := repo.AddPeer(r, peer("tablet", devices[0].Name), -1); err != nil {
+		t.Fatal("AddPeer() without a limit:", err)
+	}
+
+	owned, _, err := r.ListPeers(repo.PeerFilter{Owner: "bob"}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		t.Fatal("ListPeers():", err)
+	}
+	if len(owned) != 3 {
+		t.Errorf("ListPeers() = %v, want the phone, the laptop and the tablet", owned)
+	}
+}
+
+// normalise sorts the lists of the event, which repositories are free to give in any order.
+func normalise(e repo.ChangeEvent) repo.ChangeEvent {
+	e.DeviceNames = append([]string(nil), e.DeviceNames...)
+	sort.Strings(e.DeviceNames)
+
+	e.PublicKeys = append([]repo.PublicKey(nil), e.PublicKeys...)
+	sort.Slice(e.PublicKeys, func(i, j int) bool {
+		return e.PublicKeys[i].LessThan(e.PublicKeys[j])
+	})
+
+	if len(e.DeviceNames) == 0 {
+		e.DeviceNames = nil
+	}
+	if len(e.PublicKeys) == 0 {
+		e.PublicKeys = nil
+	}
+	return e
+}
+
+// expectEvents checks that the events, and nothing else, have been sent on c.
+func expectEvents(t *testing.T, c <-chan repo.ChangeEvent, step string, want ...repo.ChangeEvent) {
+	t.Helper()
+
+	for _, w := range want {
+		select {
+		case got, ok := <-c:
+			if !ok {
+				t.Fatalf("%v: the channel was closed, want %v", step, w)
+			}
+
+			if got, w := normalise(got), normalise(w); !reflect.DeepEqual(got, w) {
+				t.Errorf("%v: got %v, want %v", step, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: got nothing, want %v", step, w)
+		}
+	}
+
+	select {
+	case got := <-c:
+		t.Errorf("%v: got %v, want nothing more", step, got)
+	default:
+	}
+}
+
+func testNotifications(t *testing.T, r repo.Repository) {
+	c := r.AddChangeNotification()
+
+	devices := genDevices(0, 3)
+	peers := genPeers(devices[0].Name, 0, 4)
+	keys := func(peers ...repo.PeerInfo) []repo.PublicKey {
+		var ret []repo.PublicKey
+		for _, p := range peers {
+			ret = append(ret, p.PublicKey)
+		}
+		return ret
+	}
+
+	steps := []struct {
+		name  string
+		write func() error
+		want  []repo.ChangeEvent
+	}{
+		{
+			name:  "UpdateDevices",
+			write: func() error { return r.UpdateDevices(devices[:2]) },
+			want:  []repo.ChangeEvent{{Type: repo.DeviceUpdated, DeviceNames: []string{devices[0].Name, devices[1].Name}}},
+		},
+		{
+			name:  "UpdatePeers",
+			write: func() error { return r.UpdatePeers(devices[0].Name, peers[:3]) },
+			want:  []repo.ChangeEvent{{Type: repo.PeersUpdated, DeviceNames: []string{devices[0].Name}, PublicKeys: keys(peers[:3]...)}},
+		},
+		{
+			name:  "RemovePeers",
+			write: func() error { return r.RemovePeers(devices[0].Name, keys(peers[0], peers[3])) },
+			want:  []repo.ChangeEvent{{Type: repo.PeersRemoved, DeviceNames: []string{devices[0].Name}, PublicKeys: keys(peers[0])}},
+		},
+		{
+			name:  "RemovePeers of unknown peers",
+			write: func() error { return r.RemovePeers(devices[0].Name, keys(peers[3])) },
+		},
+		{
+			name:  "ReplaceAllPeers",
+			write: func() error { return r.ReplaceAllPeers(devices[0].Name, peers[3:]) },
+			want: []repo.ChangeEvent{
+				{Type: repo.PeersRemoved, DeviceNames: []string{devices[0].Name}, PublicKeys: keys(peers[1:3]...)},
+				{Type: repo.PeersUpdated, DeviceNames: []string{devices[0].Name}, PublicKeys: keys(peers[3])},
+			},
+		},
+		{
+			name: "UpdateDevices of a stale device",
+			write: func() error {
+				stale := devices[1]
+				stale.Revision, stale.ListenPort = 7, 1
+				if err := r.UpdateDevices([]repo.DeviceInfo{stale}); err != repo.ErrRevisionConflict {
+					return fmt.Errorf("error = %v, want %v", err, repo.ErrRevisionConflict)
+				}
+				return nil
+			},
+		},
+		{
+			name:  "RemoveDevices",
+			write: func() error { return r.RemoveDevices([]string{devices[1].Name, "unknown"}) },
+			want:  []repo.ChangeEvent{{Type: repo.DeviceRemoved, DeviceNames: []string{devices[1].Name}}},
+		},
+		{
+			name:  "RemoveDevices of unknown devices",
+			write: func() error { return r.RemoveDevices([]string{"unknown"}) },
+		},
+		{
+			name:  "ReplaceAllDevices",
+			write: func() error { return r.ReplaceAllDevices(devices[2:]) },
+			want: []repo.ChangeEvent{
+				{Type: repo.DeviceRemoved, DeviceNames: []string{devices[0].Name}},
+				{Type: repo.DeviceUpdated, DeviceNames: []string{devices[2].Name}},
+			},
+		},
+	}
+	for _, s := range steps {
+		if err := s.write(); err != nil {
+			t.Fatalf("%v: %v", s.name, err)
+		}
+		expectEvents(t, c, s.name, s.want...)
+	}
+
+	r.RemoveChangeNotification(c)
+	if _, ok := <-c; ok {
+		t.Error("RemoveChangeNotification() left the channel open")
+	}
+}
+
+func testClose(t *testing.T, r repo.Repository) {
+	c := r.AddChangeNotification()
+	if err := r.Close(); err != nil {
+		t.Fatal("Close():", err)
+	}
+
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Error("Close() sent an event instead of closing the channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Close() left the channel open")
+	}
+}
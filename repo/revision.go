@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"errors"
+)
+
+var (
+	ErrRevisionConflict = errors.New("revision conflict: it has been changed since it was read")
+)
+
+// nextRevision checks a write given the revision it was read at, or zero to write whatever is stored, and gives the
+// revision to store it with.
+func nextRevision(stored int64, given int64, changed bool) (int64, error) {
+	if given != 0 && given != stored {
+		return stored, ErrRevisionConflict
+	}
+
+	if changed {
+		return stored + 1, nil
+	}
+	return stored, nil
+}
+
+// DeviceRevision checks a write of device over the stored one, nil if there's none, and gives the revision to store
+// it with. The revision only moves when something audited changes.
+func DeviceRevision(stored *DeviceInfo, device *DeviceInfo) (int64, error) {
+	var current int64
+	if stored != nil {
+		current = stored.Revision
+	}
+
+	changed := len(diffAuditFields(deviceAuditFields(stored), deviceAuditFields(device))) > 0
+	return nextRevision(current, device.Revision, changed)
+}
+
+// PeerRevision checks a write of peer as DeviceRevision does for devices. The revision moves with whatever is stored
+// of the peer but its handshake, so that the peer's traffic doesn't get in the way of someone editing it. The fields
+// that aren't audited, the pre-shared key above all, are compared as well: a write made from a read before the key
+// was rotated would otherwise put the old key back.
+func PeerRevision(stored *PeerInfo, peer *PeerInfo) (int64, error) {
+	var current int64
+	if stored != nil {
+		current = stored.Revision
+	}
+
+	changed := stored == nil ||
+		peer.PreSharedKey != stored.PreSharedKey ||
+		peer.StateChangedAt != stored.StateChangedAt ||
+		len(diffAuditFields(peerAuditFields(stored), peerAuditFields(peer))) > 0
+	return nextRevision(current, peer.Revision, changed)
+}
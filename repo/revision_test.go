@@ -0,0 +1,59 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestMemRepository_Revision(t *testing.T) {
+	r, peers := newGroupedRepository(t)
+
+	read := func() PeerInfo {
+		got, _, err := r.ListPeersByKeys("wg0", []PublicKey{peers[0].PublicKey}, OrderNameAsc, PageRequest{})
+		if err != nil || len(got) != 1 {
+			t.Fatalf("ListPeersByKeys() = %v, %v", got, err)
+		}
+		return got[0]
+	}
+
+	p := read()
+	if p.Revision != 1 {
+		t.Fatalf("new peer revision = %v, want 1", p.Revision)
+	}
+
+	p.LastHandshake++
+	if err := r.UpdatePeers("wg0", []PeerInfo{p}); err != nil || read().Revision != 1 {
+		t.Errorf("handshake moved the revision: %v, %+v", err, read())
+	}
+
+	first, second := p, p
+	first.Name, second.Name = "first", "second"
+	if err := r.UpdatePeers("wg0", []PeerInfo{first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdatePeers("wg0", []PeerInfo{second}); err != ErrRevisionConflict {
+		t.Errorf("UpdatePeers() over a newer revision = %v, want ErrRevisionConflict", err)
+	}
+	if err := r.ReplaceAllPeers("wg0", []PeerInfo{second}); err != ErrRevisionConflict {
+		t.Errorf("ReplaceAllPeers() over a newer revision = %v, want ErrRevisionConflict", err)
+	}
+
+	if got := read(); got.Name != "first" || got.Revision != 2 {
+		t.Errorf("peer = %+v, want the first change at revision 2", got)
+	}
+
+	second.Revision = 0
+	if err := r.UpdatePeers("wg0", []PeerInfo{second}); err != nil || read().Name != "second" {
+		t.Errorf("UpdatePeers() without a revision = %v, %+v", err, read())
+	}
+
+	devices, _ := r.ListDevices()
+	stale := devices[0]
+	devices[0].ListenPort = 51820
+	if err := r.UpdateDevices(devices[:1]); err != nil {
+		t.Fatal(err)
+	}
+	stale.ListenPort = 51821
+	if err := r.UpdateDevices([]DeviceInfo{stale}); err != ErrRevisionConflict {
+		t.Errorf("UpdateDevices() over a newer revision = %v, want ErrRevisionConflict", err)
+	}
+}
@@ -0,0 +1,53 @@
+package sqlite
+
+import (
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+	"net"
+	"strings"
+)
+
+// driverName is the sqlite3 driver with the functions below registered on every connection.
+const driverName = "sqlite3_wgadmin"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("allowed_ips_contain", allowedIPsContain, true); err != nil {
+				return err
+			}
+
+			return conn.RegisterFunc("endpoint_ip", endpointIP, true)
+		},
+	})
+}
+
+// allowedIPsContain tells whether any network in the comma separated allowedIPs column contains ip.
+func allowedIPsContain(allowedIPs string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, s := range strings.Split(allowedIPs, ",") {
+		if _, n, err := net.ParseCIDR(s); err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endpointIP extracts the canonical IP address from the endpoint column, or "" if there isn't one.
+func endpointIP(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,216 @@
+package sqlrepo
+
+import (
+	"encoding/json"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"strings"
+	"time"
+)
+
+type device struct {
+	PublicKey  repo.PublicKey  `db:"public_key"`
+	PrivateKey repo.PrivateKey `db:"-"`
+	Name       string          `db:"name"`
+	ListenPort uint16          `db:"listen_port"`
+	Revision   int64           `db:"revision"`
+
+	// SealedPrivateKey is the private key as stored, encrypted if the store has a master key.
+	SealedPrivateKey string `db:"private_key"`
+}
+
+type peer struct {
+	Name                        string            `db:"name"`
+	PublicKey                   repo.PublicKey    `db:"public_key"`
+	PreSharedKey                repo.SymmetricKey `db:"-"`
+	Endpoint                    string            `db:"endpoint"`
+	PersistentKeepaliveInterval time.Duration     `db:"persistent_keepalive_interval"`
+	AllowedIPs                  string            `db:"allowed_ips"`
+	DeviceName                  string            `db:"device_name"`
+	LastHandshake               int64             `db:"last_handshake"`
+	Disabled                    bool              `db:"disabled"`
+	StateReason                 string            `db:"state_reason"`
+	StateChangedAt              int64             `db:"state_changed_at"`
+	ExpiresAt                   int64             `db:"expires_at"`
+	Owner                       string            `db:"owner"`
+	Revision                    int64             `db:"revision"`
+
+	SealedPreSharedKey string `db:"pre_shared_key"`
+}
+
+type auditEntry struct {
+	Id         int64  `db:"id"`
+	Time       int64  `db:"time"`
+	Actor      string `db:"actor"`
+	SourceIP   string `db:"source_ip"`
+	Action     string `db:"action"`
+	DeviceName string `db:"device_name"`
+	PublicKey  string `db:"public_key"`
+	Subject    string `db:"subject"`
+	Changes    string `db:"changes"`
+}
+
+// secretColumns are the columns that are sealed, by table, with the columns keying the rows of the table.
+var secretColumns = []struct {
+	table, column string
+	key           []string
+}{
+	{table: "devices", column: "private_key", key: []string{"name"}},
+	{table: "peers", column: "pre_shared_key", key: []string{"device_name", "public_key"}},
+}
+
+func (e *auditEntry) fromAuditEntry(entry *repo.AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	*e = auditEntry{
+		Time:       entry.Time.UnixNano(),
+		Actor:      entry.Actor.Name,
+		SourceIP:   entry.Actor.SourceIP,
+		Action:     string(entry.Action),
+		DeviceName: entry.DeviceName,
+		PublicKey:  entry.PublicKey,
+		Subject:    entry.Subject,
+		Changes:    string(changes),
+	}
+	return nil
+}
+
+func (e auditEntry) toAuditEntry() (entry repo.AuditEntry, err error) {
+	entry = repo.AuditEntry{
+		Id:         e.Id,
+		Time:       time.Unix(0, e.Time),
+		Actor:      repo.Actor{Name: e.Actor, SourceIP: e.SourceIP},
+		Action:     repo.AuditAction(e.Action),
+		DeviceName: e.DeviceName,
+		PublicKey:  e.PublicKey,
+		Subject:    e.Subject,
+	}
+
+	err = json.Unmarshal([]byte(e.Changes), &entry.Changes)
+	return
+}
+
+func (p *peer) FromPeerInfo(info repo.PeerInfo) {
+	p.PublicKey = info.PublicKey
+	p.PreSharedKey = info.PreSharedKey
+	p.PersistentKeepaliveInterval = info.PersistentKeepaliveInterval
+	p.DeviceName = info.DeviceName
+	p.Name = info.Name
+	p.LastHandshake = info.LastHandshake
+	p.Disabled = info.Disabled
+	p.StateReason = info.StateReason
+	p.StateChangedAt = info.StateChangedAt
+	p.ExpiresAt = info.ExpiresAt
+	p.Owner = info.Owner
+	p.Revision = info.Revision
+
+	if info.Endpoint != nil {
+		p.Endpoint = info.Endpoint.String()
+	} else {
+		p.Endpoint = ""
+	}
+
+	var ips []string
+	for _, ip := range info.AllowedIPs {
+		ips = append(ips, ip.String())
+	}
+	p.AllowedIPs = strings.Join(ips, ",")
+}
+
+func (p peer) ToPeerInfo() (info repo.PeerInfo, err error) {
+	info = repo.PeerInfo{
+		PublicKey:                   p.PublicKey,
+		PreSharedKey:                p.PreSharedKey,
+		PersistentKeepaliveInterval: p.PersistentKeepaliveInterval,
+		DeviceName:                  p.DeviceName,
+		LastHandshake:               p.LastHandshake,
+		Name:                        p.Name,
+		Disabled:                    p.Disabled,
+		StateReason:                 p.StateReason,
+		StateChangedAt:              p.StateChangedAt,
+		ExpiresAt:                   p.ExpiresAt,
+		Owner:                       p.Owner,
+		Revision:                    p.Revision,
+	}
+
+	if len(p.Endpoint) > 0 {
+		if info.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint); err != nil {
+			return
+		}
+	}
+
+	if len(p.AllowedIPs) == 0 {
+		return
+	}
+
+	ips := strings.Split(p.AllowedIPs, ",")
+	for _, ip := range ips {
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(ip)
+		if err != nil {
+			return
+		}
+
+		info.AllowedIPs = append(info.AllowedIPs, *ipnet)
+	}
+
+	return
+}
+
+func (d device) ToDeviceInfo() repo.DeviceInfo {
+	return repo.DeviceInfo{
+		PrivateKey: d.PrivateKey,
+		ListenPort: d.ListenPort,
+		Name:       d.Name,
+		Revision:   d.Revision,
+	}
+}
+
+func (d *device) fromDeviceInfo(info repo.DeviceInfo) error {
+	d.PrivateKey = info.PrivateKey
+	d.PublicKey = info.PrivateKey.ToPublicKey()
+	d.Name = info.Name
+	d.ListenPort = info.ListenPort
+	d.Revision = info.Revision
+	return nil
+}
+
+func (d *device) place() secrets.Place {
+	return secrets.Place{Table: "devices", Column: "private_key", Row: []string{d.Name}}
+}
+
+func (d *device) seal(keys *secrets.Keyring) (err error) {
+	d.SealedPrivateKey, err = keys.Seal(d.PrivateKey.String(), d.place())
+	return
+}
+
+func (d *device) open(keys *secrets.Keyring) error {
+	v, err := keys.Open(d.SealedPrivateKey, d.place())
+	if err != nil {
+		return err
+	}
+
+	return d.PrivateKey.Scan(v)
+}
+
+func (p *peer) place() secrets.Place {
+	return secrets.Place{Table: "peers", Column: "pre_shared_key", Row: []string{p.DeviceName, p.PublicKey.String()}}
+}
+
+func (p *peer) seal(keys *secrets.Keyring) (err error) {
+	p.SealedPreSharedKey, err = keys.Seal(p.PreSharedKey.String(), p.place())
+	return
+}
+
+func (p *peer) open(keys *secrets.Keyring) error {
+	v, err := keys.Open(p.SealedPreSharedKey, p.place())
+	if err != nil {
+		return err
+	}
+
+	return p.PreSharedKey.Scan(v)
+}
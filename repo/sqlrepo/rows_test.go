@@ -0,0 +1,314 @@
+package sqlrepo
+
+import (
+	"crypto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func genPrivateKey(str string) repo.PrivateKey {
+	c := crypto.SHA256.New()
+	if _, err := c.Write([]byte(str)); err != nil {
+		panic(err)
+	}
+
+	if k, err := wgtypes.NewKey(c.Sum(make([]byte, 0))); err != nil {
+		panic(err)
+	} else {
+		return repo.NewPrivateKey(k)
+	}
+}
+
+func genPublicKey(str string) repo.PublicKey {
+	return genPrivateKey(str).ToPublicKey()
+}
+
+func genSymmetricKey(str string) repo.SymmetricKey {
+	return repo.SymmetricKey(genPrivateKey(str))
+}
+
+func Test_device_ToDeviceInfo(t *testing.T) {
+	type fields struct {
+		PublicKey  repo.PublicKey
+		PrivateKey repo.PrivateKey
+		Name       string
+		ListenPort uint16
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		want   repo.DeviceInfo
+	}{
+		{
+			name: "Test",
+			fields: fields{
+				PublicKey:  genPublicKey("pk1"),
+				PrivateKey: genPrivateKey("privkey"),
+				Name:       "name",
+				ListenPort: 123,
+			},
+			want: repo.DeviceInfo{
+				PrivateKey: genPrivateKey("privkey"),
+				ListenPort: 123,
+				Name:       "name",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := device{
+				PublicKey:  tt.fields.PublicKey,
+				PrivateKey: tt.fields.PrivateKey,
+				Name:       tt.fields.Name,
+				ListenPort: tt.fields.ListenPort,
+			}
+			if got := d.ToDeviceInfo(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ToDeviceInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_device_fromDeviceInfo(t *testing.T) {
+	type args struct {
+		info repo.DeviceInfo
+	}
+	tests := []struct {
+		name string
+		args args
+		want device
+	}{
+		{
+			name: "First time init",
+			args: args{
+				info: repo.DeviceInfo{
+					PrivateKey: genPrivateKey("key"),
+					ListenPort: 456,
+					Name:       "name",
+				},
+			},
+			want: device{
+				PublicKey:  genPublicKey("key"),
+				PrivateKey: genPrivateKey("key"),
+				Name:       "name",
+				ListenPort: 456,
+			},
+		},
+		{
+			name: "Second time init",
+			args: args{
+				info: repo.DeviceInfo{
+					PrivateKey: genPrivateKey("key1"),
+					ListenPort: 457,
+					Name:       "name1",
+				},
+			},
+			want: device{
+				PublicKey:  genPublicKey("key1"),
+				PrivateKey: genPrivateKey("key1"),
+				Name:       "name1",
+				ListenPort: 457,
+			},
+		},
+	}
+
+	var got device
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := got.fromDeviceInfo(tt.args.info); err != nil {
+				t.Error(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fromDeviceInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustResolveUdp(address string) *net.UDPAddr {
+	udp, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		panic(err)
+	}
+
+	return udp
+}
+
+func mustResolveIPNet(address string) net.IPNet {
+	_, ret, err := net.ParseCIDR(address)
+	if err != nil {
+		panic(err)
+	}
+
+	return *ret
+}
+
+func Test_peer_FromPeerInfo(t *testing.T) {
+	type args struct {
+		info repo.PeerInfo
+	}
+	tests := []struct {
+		name string
+		args args
+		want peer
+	}{
+		{
+			name: "Empty variable test",
+			args: args{
+				info: repo.PeerInfo{
+					PublicKey:                   genPublicKey("pubkey"),
+					PreSharedKey:                genSymmetricKey("preshared_key"),
+					Endpoint:                    mustResolveUdp("1.2.3.4:1234"),
+					PersistentKeepaliveInterval: 20,
+					AllowedIPs:                  []net.IPNet{mustResolveIPNet("1.2.3.4/24"), mustResolveIPNet("4.5.6.7/32")},
+					DeviceName:                  "wg0",
+					LastHandshake:               123,
+					Name:                        "name1",
+				},
+			},
+			want: peer{
+				PublicKey:                   genPublicKey("pubkey"),
+				PreSharedKey:                genSymmetricKey("preshared_key"),
+				Endpoint:                    "1.2.3.4:1234",
+				PersistentKeepaliveInterval: 20,
+				AllowedIPs:                  "1.2.3.0/24,4.5.6.7/32",
+				DeviceName:                  "wg0",
+				LastHandshake:               123,
+				Name:                        "name1",
+			},
+		},
+		{
+			name: "Override variable test",
+			args: args{
+				info: repo.PeerInfo{
+					PublicKey:                   genPublicKey("pubkey1"),
+					PreSharedKey:                genSymmetricKey("preshared_key1"),
+					Endpoint:                    mustResolveUdp("1.2.3.5:1234"),
+					PersistentKeepaliveInterval: 0,
+					AllowedIPs:                  []net.IPNet{mustResolveIPNet("1.2.3.5/24"), mustResolveIPNet("4.5.6.8/32")},
+					DeviceName:                  "wg0",
+					LastHandshake:               0,
+					Name:                        "name2",
+				},
+			},
+			want: peer{
+				PublicKey:                   genPublicKey("pubkey1"),
+				PreSharedKey:                genSymmetricKey("preshared_key1"),
+				Endpoint:                    "1.2.3.5:1234",
+				PersistentKeepaliveInterval: 0,
+				AllowedIPs:                  "1.2.3.0/24,4.5.6.8/32",
+				DeviceName:                  "wg0",
+				LastHandshake:               0,
+				Name:                        "name2",
+			},
+		},
+	}
+
+	var got peer
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got.FromPeerInfo(tt.args.info)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FromPeerInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_peer_ToPeerInfo(t *testing.T) {
+	type fields struct {
+		PublicKey                   repo.PublicKey
+		PreSharedKey                repo.SymmetricKey
+		Endpoint                    string
+		PersistentKeepaliveInterval time.Duration
+		AllowedIPs                  string
+		DeviceName                  string
+		LastHandshake               int64
+		Name                        string
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		wantInfo repo.PeerInfo
+		wantErr  bool
+	}{
+		{
+			name: "correct info",
+			fields: fields{
+				PublicKey:                   genPublicKey("pubkey"),
+				PreSharedKey:                genSymmetricKey("presharedkey"),
+				Endpoint:                    "1.2.3.4:5000",
+				PersistentKeepaliveInterval: 20,
+				AllowedIPs:                  "1.2.3.0/24,4.5.6.7/32",
+				DeviceName:                  "wg0",
+				LastHandshake:               0,
+				Name:                        "name",
+			},
+			wantInfo: repo.PeerInfo{
+				PublicKey:                   genPublicKey("pubkey"),
+				PreSharedKey:                genSymmetricKey("presharedkey"),
+				Endpoint:                    mustResolveUdp("1.2.3.4:5000"),
+				PersistentKeepaliveInterval: 20,
+				AllowedIPs:                  []net.IPNet{mustResolveIPNet("1.2.3.4/24"), mustResolveIPNet("4.5.6.7/32")},
+				DeviceName:                  "wg0",
+				LastHandshake:               0,
+				Name:                        "name",
+			},
+			wantErr: false,
+		},
+		{
+			name: "incorrect endpoint",
+			fields: fields{
+				PublicKey:                   genPublicKey("pubkey"),
+				PreSharedKey:                genSymmetricKey("presharedkey"),
+				Endpoint:                    "not an address",
+				PersistentKeepaliveInterval: 20,
+				AllowedIPs:                  "1.2.3.0/24,4.5.6.7/32",
+				DeviceName:                  "wg0",
+				LastHandshake:               0,
+				Name:                        "name",
+			},
+			wantErr: true,
+		},
+		{
+			name: "incorrect allowed ips",
+			fields: fields{
+				PublicKey:                   genPublicKey("pubkey"),
+				PreSharedKey:                genSymmetricKey("presharedkey"),
+				Endpoint:                    "1.2.3.4:5000",
+				PersistentKeepaliveInterval: 20,
+				AllowedIPs:                  "not an address",
+				DeviceName:                  "wg0",
+				LastHandshake:               0,
+				Name:                        "name",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := peer{
+				PublicKey:                   tt.fields.PublicKey,
+				PreSharedKey:                tt.fields.PreSharedKey,
+				Endpoint:                    tt.fields.Endpoint,
+				PersistentKeepaliveInterval: tt.fields.PersistentKeepaliveInterval,
+				AllowedIPs:                  tt.fields.AllowedIPs,
+				DeviceName:                  tt.fields.DeviceName,
+				LastHandshake:               tt.fields.LastHandshake,
+				Name:                        tt.fields.Name,
+			}
+			gotInfo, err := p.ToPeerInfo()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ToPeerInfo() error = %v, wantErr: %v", err, tt.wantErr)
+				}
+			} else if !reflect.DeepEqual(gotInfo, tt.wantInfo) {
+				t.Errorf("ToPeerInfo() gotInfo = %v, want %v", gotInfo, tt.wantInfo)
+			}
+		})
+	}
+}
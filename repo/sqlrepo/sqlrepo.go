@@ -0,0 +1,1233 @@
+// Package sqlrepo keeps the repository in an SQL database. The SQLite and PostgreSQL repositories are this one with
+// the dialect of their database.
+package sqlrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dialect is what tells the databases apart.
+type Dialect struct {
+	// Migrations are the changes to the schema, by version. Besides the tables, the filters need the functions
+	// allowed_ips_contain(allowed_ips, ip) and endpoint_ip(endpoint), if the driver doesn't provide them.
+	Migrations [][]string
+
+	// Like is the operator matching a pattern regardless of case.
+	Like string
+
+	// WriteLock, if set, is run first in the transaction of every change, for the writers to take turns so that a
+	// revision can't be changed between being checked and written.
+	WriteLock string
+
+	// ReadOptions are those of the transactions of the listings, for the reads of one to agree with each other.
+	ReadOptions *sql.TxOptions
+
+	// Shared tells whether instances share the database. They keep the data key on a rotation, which the others use.
+	Shared bool
+}
+
+const (
+	updateDeviceSql = `INSERT INTO devices (private_key, public_key, name, listen_port, revision)
+		VALUES (:private_key, :public_key, :name, :listen_port, :revision)
+		ON CONFLICT (name) DO UPDATE SET private_key = excluded.private_key, public_key = excluded.public_key,
+			listen_port = excluded.listen_port, revision = excluded.revision`
+
+	updatePeerSql = `
+		INSERT INTO peers(
+			public_key, pre_shared_key, endpoint, persistent_keepalive_interval, allowed_ips, device_name, last_handshake, name,
+			disabled, state_reason, state_changed_at, expires_at, owner, revision
+		)
+		VALUES (:public_key, :pre_shared_key, :endpoint, :persistent_keepalive_interval, :allowed_ips, :device_name, :last_handshake, :name,
+			:disabled, :state_reason, :state_changed_at, :expires_at, :owner, :revision)
+		ON CONFLICT (device_name, public_key) DO UPDATE SET
+			pre_shared_key = excluded.pre_shared_key, endpoint = excluded.endpoint,
+			persistent_keepalive_interval = excluded.persistent_keepalive_interval, allowed_ips = excluded.allowed_ips,
+			last_handshake = excluded.last_handshake, name = excluded.name, disabled = excluded.disabled,
+			state_reason = excluded.state_reason, state_changed_at = excluded.state_changed_at,
+			expires_at = excluded.expires_at, owner = excluded.owner, revision = excluded.revision
+	`
+
+	updatePeerMetaSql = `INSERT INTO peer_meta (device_name, public_key, name, value) VALUES (?, ?, ?, ?)
+		ON CONFLICT (device_name, public_key, name) DO UPDATE SET value = excluded.value`
+
+	updatePeerTagSql = `INSERT INTO peer_tags (device_name, public_key, tag) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+
+	updatePeerGroupSql = `INSERT INTO peer_groups (device_name, public_key, group_name) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+
+	// insertPeerAddressSql inserts nothing if another peer of the device has the address, since those of the peer
+	// itself are deleted first.
+	insertPeerAddressSql = `INSERT INTO peer_addresses (device_name, address, public_key) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+
+	countOwnedSql = `SELECT COUNT(*) FROM peers WHERE owner = ?`
+
+	insertAuditSql = `INSERT INTO audit (time, actor, source_ip, action, device_name, public_key, subject, changes)
+		VALUES (:time, :actor, :source_ip, :action, :device_name, :public_key, :subject, :changes)`
+
+	updateOptionSql = `INSERT INTO options (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value`
+
+	// optionDataKey is the data key the secrets are sealed with, itself sealed with the master key.
+	optionDataKey = "data_key"
+)
+
+// peerTables are the tables holding more of a peer, keyed by its device name and public key.
+var peerTables = []string{"peer_meta", "peer_tags", "peer_groups", "peer_addresses"}
+
+// Store is the database with the listeners of its changes.
+type Store struct {
+	repo.DefaultChangeNotificationHandler
+	DB *sqlx.DB
+
+	dialect Dialect
+
+	// keys seals the private and pre-shared keys, if the store has a master key.
+	keys *secrets.Keyring
+
+	// Publish, if set, tells the other instances sharing the database of the events of a change, in its
+	// transaction, so that they only hear of it once it's committed.
+	Publish func(tx *sqlx.Tx, events []repo.ChangeEvent) error
+}
+
+// Repository is the database as seen by one actor. Every view of it shares the connection and listeners.
+type Repository struct {
+	*Store
+
+	actor repo.Actor
+	view  bool
+}
+
+// Open brings the schema of the database up to date and opens its keyring with master, nil if the store isn't
+// encrypted. The repository closes db, as does Open if it fails.
+func Open(db *sqlx.DB, dialect Dialect, master *secrets.MasterKey) (r *Repository, err error) {
+	s := &Store{DB: db, dialect: dialect}
+
+	tx, err := s.beginWrite()
+	if err != nil {
+		_ = db.Close()
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			_ = db.Close()
+			r = nil
+		}
+	}()
+
+	if err = schema.Migrate(tx, "", dialect.Migrations); err != nil {
+		return
+	}
+
+	var wrapped string
+	if err = tx.Get(&wrapped, tx.Rebind("SELECT value FROM options WHERE name = ?"), optionDataKey); err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	keys, newWrapped, err := secrets.OpenKeyring(master, wrapped)
+	if err != nil {
+		return
+	}
+
+	if len(newWrapped) > 0 {
+		if err = reseal(tx, nil, keys, newWrapped); err != nil {
+			return
+		}
+	}
+
+	s.keys = keys
+	return &Repository{Store: s}, nil
+}
+
+func (s *Repository) WithActor(actor repo.Actor) repo.Repository {
+	return &Repository{Store: s.Store, actor: actor, view: true}
+}
+
+// beginWrite starts the transaction of a change, once the other writers are done.
+func (s *Store) beginWrite() (*sqlx.Tx, error) {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.dialect.WriteLock) > 0 {
+		if _, err = tx.Exec(s.dialect.WriteLock); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// An instance opened before another encrypted the store would write its secrets in plaintext, which no longer
+	// read. The keyring is only opened once the schema is up to date.
+	if s.keys != nil && !s.keys.HasDataKey() {
+		var count int
+		err = tx.Get(&count, tx.Rebind("SELECT count(*) FROM options WHERE name = ?"), optionDataKey)
+		if err == nil && count > 0 {
+			err = secrets.ErrNoKey
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// beginRead starts the transaction of a listing.
+func (s *Store) beginRead() (*sqlx.Tx, error) {
+	if s.dialect.ReadOptions == nil {
+		return s.DB.Beginx()
+	}
+	return s.DB.BeginTxx(context.Background(), s.dialect.ReadOptions)
+}
+
+// finish commits the transaction of a change, or rolls it back if err isn't nil, and tells the listeners, of this
+// instance and the others, about the events.
+func (s *Store) finish(tx *sqlx.Tx, err error, events ...repo.ChangeEvent) error {
+	if err == nil && s.Publish != nil {
+		err = s.Publish(tx, events)
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err == nil {
+		s.NotifyChange(events...)
+	}
+	return err
+}
+
+// record writes the entries that aren't nil to the audit log, in the transaction of the change.
+func (s *Repository) record(tx *sqlx.Tx, entries ...*repo.AuditEntry) error {
+	now := time.Now()
+
+	var e auditEntry
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+
+		entry.Time = now
+		if err := e.fromAuditEntry(entry); err != nil {
+			return err
+		}
+
+		if _, err := tx.NamedExec(insertAuditSql, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Repository) Record(entry repo.AuditEntry) error {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	entry.Actor = s.actor
+	return s.finish(tx, s.record(tx, &entry))
+}
+
+func (s *Repository) ListAudit(filter repo.AuditFilter, page repo.PageRequest) (data []repo.AuditEntry, cursors repo.PageCursors, err error) {
+	after, err := repo.ParseAuditCursor(page.Cursor)
+	if err != nil {
+		return
+	}
+
+	conditions := []string{"TRUE"}
+	var args []interface{}
+
+	if after != 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, after)
+	}
+
+	if len(filter.Actor) > 0 {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+
+	if len(filter.Action) > 0 {
+		conditions = append(conditions, "action = ?")
+		args = append(args, string(filter.Action))
+	}
+
+	if len(filter.DeviceName) > 0 {
+		conditions = append(conditions, "device_name = ?")
+		args = append(args, filter.DeviceName)
+	}
+
+	if len(filter.PublicKey) > 0 {
+		conditions = append(conditions, "public_key = ?")
+		args = append(args, filter.PublicKey)
+	}
+
+	if len(filter.Subject) > 0 {
+		conditions = append(conditions, "subject = ?")
+		args = append(args, filter.Subject)
+	}
+
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+
+	st := fmt.Sprintf("SELECT * FROM audit WHERE (%s) ORDER BY id DESC", strings.Join(conditions, ") AND ("))
+	if page.Limit > 0 {
+		// One more row tells whether there is another page.
+		st = fmt.Sprintf("%s LIMIT %v", st, page.Limit+1)
+	}
+
+	var rows []auditEntry
+	if err = s.DB.Select(&rows, s.DB.Rebind(st), args...); err != nil {
+		return
+	}
+
+	more := page.Limit > 0 && uint(len(rows)) > page.Limit
+	if more {
+		rows = rows[:page.Limit]
+	}
+
+	for _, r := range rows {
+		var entry repo.AuditEntry
+		if entry, err = r.toAuditEntry(); err != nil {
+			return
+		}
+		data = append(data, entry)
+	}
+
+	return data, repo.AuditCursorsFor(data, more), nil
+}
+
+// selectDevices reads the devices with the names, by name.
+func (s *Store) selectDevices(tx *sqlx.Tx, names []string) (map[string]repo.DeviceInfo, error) {
+	ret := make(map[string]repo.DeviceInfo, len(names))
+	if len(names) == 0 {
+		return ret, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM devices WHERE name IN (?)", names)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []device
+	if err = tx.Select(&devices, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	for _, d := range devices {
+		if err = d.open(s.keys); err != nil {
+			return nil, err
+		}
+		ret[d.Name] = d.ToDeviceInfo()
+	}
+	return ret, nil
+}
+
+// selectPeers reads the peers matching whereStatement, with ? placeholders, along with what's kept of them in the
+// other tables.
+func (s *Store) selectPeers(tx *sqlx.Tx, whereStatement string, args ...interface{}) (ret []repo.PeerInfo, err error) {
+	var peers []peer
+	if err = tx.Select(&peers, tx.Rebind("SELECT * FROM peers WHERE "+whereStatement), args...); err != nil {
+		return
+	}
+
+	for _, p := range peers {
+		if err = p.open(s.keys); err != nil {
+			return
+		}
+
+		var info repo.PeerInfo
+		if info, err = p.ToPeerInfo(); err != nil {
+			return
+		}
+		ret = append(ret, info)
+	}
+
+	if err = loadPeerMeta(tx, ret); err != nil {
+		return
+	}
+
+	err = loadPeerLabels(tx, ret)
+	return
+}
+
+// selectPeersByKeys reads the peers of the device with the keys, by key.
+func (s *Store) selectPeersByKeys(tx *sqlx.Tx, deviceName string, keys []repo.PublicKey) (map[repo.PublicKey]repo.PeerInfo, error) {
+	ret := make(map[repo.PublicKey]repo.PeerInfo, len(keys))
+	if len(keys) == 0 {
+		return ret, nil
+	}
+
+	query, args, err := sqlx.In("device_name = ? AND public_key IN (?)", deviceName, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := s.selectPeers(tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range peers {
+		ret[p.PublicKey] = p
+	}
+	return ret, nil
+}
+
+// deletePeers deletes the peers of the device with the keys from every table holding them.
+func deletePeers(tx *sqlx.Tx, deviceName string, keys []repo.PublicKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, table := range append([]string{"peers"}, peerTables...) {
+		query, args, err := sqlx.In("DELETE FROM "+table+" WHERE device_name = ? AND public_key IN (?)", deviceName, keys)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(tx.Rebind(query), args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteDevices deletes the devices with the names and their peers, recording both. It returns the names of the
+// devices that were there.
+func (s *Repository) deleteDevices(tx *sqlx.Tx, names []string) (removed []string, err error) {
+	devices, err := s.selectDevices(tx, names)
+	if err != nil || len(devices) == 0 {
+		return
+	}
+
+	for name := range devices {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+
+	query, args, err := sqlx.In("device_name IN (?)", removed)
+	if err != nil {
+		return
+	}
+
+	peers, err := s.selectPeers(tx, query, args...)
+	if err != nil {
+		return
+	}
+
+	for i := range peers {
+		if err = s.record(tx, repo.PeerAuditEntry(s.actor, peers[i].DeviceName, &peers[i], nil)); err != nil {
+			return
+		}
+	}
+
+	for _, table := range append([]string{"peers"}, peerTables...) {
+		if _, err = tx.Exec(tx.Rebind("DELETE FROM "+table+" WHERE "+query), args...); err != nil {
+			return
+		}
+	}
+
+	query, args, err = sqlx.In("DELETE FROM devices WHERE name IN (?)", removed)
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(tx.Rebind(query), args...); err != nil {
+		return
+	}
+
+	for _, name := range removed {
+		d := devices[name]
+		if err = s.record(tx, repo.DeviceAuditEntry(s.actor, &d, nil)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *Repository) ListDevices() (info []repo.DeviceInfo, err error) {
+	var rows *sqlx.Rows
+	rows, err = s.DB.Queryx("SELECT * FROM devices ORDER BY name")
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	var d device
+	for rows.Next() {
+		if err = rows.StructScan(&d); err != nil {
+			return
+		}
+
+		if err = d.open(s.keys); err != nil {
+			return
+		}
+
+		info = append(info, d.ToDeviceInfo())
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (s *Repository) upsertDevices(removeAll bool, devices []repo.DeviceInfo) (err error) {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	var events []repo.ChangeEvent
+
+	defer func() {
+		err = s.finish(tx, err, events...)
+	}()
+
+	if removeAll {
+		var removed []string
+		if err = tx.Select(&removed, "SELECT name FROM devices"); err != nil {
+			return err
+		}
+
+		if removed, err = s.deleteDevices(tx, subtractNames(removed, devices)); err != nil {
+			return err
+		}
+
+		if len(removed) > 0 {
+			events = append(events, repo.ChangeEvent{Type: repo.DeviceRemoved, DeviceNames: removed})
+		}
+	}
+
+	before, err := s.selectDevices(tx, deviceNames(devices))
+	if err != nil {
+		return err
+	}
+
+	st, err := tx.PrepareNamed(updateDeviceSql)
+	if err != nil {
+		return err
+	}
+
+	defer st.Close()
+
+	var d device
+	for _, info := range devices {
+		var old *repo.DeviceInfo
+		if b, ok := before[info.Name]; ok {
+			old = &b
+		}
+
+		if info.Revision, err = repo.DeviceRevision(old, &info); err != nil {
+			return err
+		}
+
+		if err = d.fromDeviceInfo(info); err != nil {
+			return err
+		}
+
+		if err = d.seal(s.keys); err != nil {
+			return err
+		}
+
+		if _, err = st.Exec(d); err != nil {
+			return err
+		}
+
+		if err = s.record(tx, repo.DeviceAuditEntry(s.actor, old, &info)); err != nil {
+			return err
+		}
+	}
+
+	if len(devices) > 0 {
+		events = append(events, repo.ChangeEvent{Type: repo.DeviceUpdated, DeviceNames: deviceNames(devices)})
+	}
+
+	return err
+}
+
+func (s *Repository) UpdateDevices(devices []repo.DeviceInfo) error {
+	return s.upsertDevices(false, devices)
+}
+
+func (s *Repository) RemoveDevices(names []string) (err error) {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+
+	defer func() {
+		if len(removed) > 0 {
+			err = s.finish(tx, err, repo.ChangeEvent{Type: repo.DeviceRemoved, DeviceNames: removed})
+		} else {
+			err = s.finish(tx, err)
+		}
+	}()
+
+	removed, err = s.deleteDevices(tx, names)
+	return err
+}
+
+func (s *Repository) ReplaceAllDevices(devices []repo.DeviceInfo) error {
+	return s.upsertDevices(true, devices)
+}
+
+// filterStatement narrows whereStatement down to the peers matching filter.
+func (s *Store) filterStatement(filter repo.PeerFilter, whereStatement string, args []interface{}) (string, []interface{}) {
+	conditions := []string{whereStatement}
+
+	if len(filter.NameContains) > 0 {
+		conditions = append(conditions, "name "+s.dialect.Like+` ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(filter.NameContains)+"%")
+	}
+
+	if len(filter.PublicKeyPrefix) > 0 {
+		conditions = append(conditions, "substr(public_key, 1, ?) = ?")
+		args = append(args, len(filter.PublicKeyPrefix), filter.PublicKeyPrefix)
+	}
+
+	if filter.AllowedIP != nil {
+		conditions = append(conditions, "allowed_ips_contain(allowed_ips, ?)")
+		args = append(args, filter.AllowedIP.String())
+	}
+
+	if filter.EndpointIP != nil {
+		conditions = append(conditions, "endpoint_ip(endpoint) = ?")
+		args = append(args, filter.EndpointIP.String())
+	}
+
+	if !filter.HandshakeBefore.IsZero() {
+		conditions = append(conditions, "last_handshake < ?")
+		args = append(args, filter.HandshakeBefore.Unix())
+	}
+
+	if !filter.HandshakeAfter.IsZero() {
+		conditions = append(conditions, "last_handshake > ?")
+		args = append(args, filter.HandshakeAfter.Unix())
+	}
+
+	metaKeys := make([]string, 0, len(filter.Meta))
+	for k := range filter.Meta {
+		metaKeys = append(metaKeys, k)
+	}
+	sort.Strings(metaKeys)
+
+	for _, k := range metaKeys {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM peer_meta m
+			WHERE m.device_name = peers.device_name AND m.public_key = peers.public_key AND m.name = ? AND m.value = ?)`)
+		args = append(args, k, filter.Meta[k])
+	}
+
+	for _, t := range filter.Tags {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM peer_tags t
+			WHERE t.device_name = peers.device_name AND t.public_key = peers.public_key AND t.tag = ?)`)
+		args = append(args, t)
+	}
+
+	if len(filter.Group) > 0 {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM peer_groups g
+			WHERE g.device_name = peers.device_name AND g.public_key = peers.public_key AND g.group_name = ?)`)
+		args = append(args, filter.Group)
+	}
+
+	if !filter.ExpiresBy.IsZero() {
+		conditions = append(conditions, "expires_at != 0 AND expires_at <= ?")
+		args = append(args, filter.ExpiresBy.Unix())
+	}
+
+	if len(filter.Owner) > 0 {
+		conditions = append(conditions, "owner = ?")
+		args = append(args, filter.Owner)
+	}
+
+	return "(" + strings.Join(conditions, ") AND (") + ")", args
+}
+
+func escapeLike(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v)
+}
+
+func loadPeerMeta(tx *sqlx.Tx, peers []repo.PeerInfo) error {
+	st, err := tx.Preparex(tx.Rebind("SELECT name, value FROM peer_meta WHERE device_name = ? AND public_key = ?"))
+	if err != nil {
+		return err
+	}
+
+	defer st.Close()
+
+	for i := range peers {
+		rows, err := st.Query(peers[i].DeviceName, peers[i].PublicKey)
+		if err != nil {
+			return err
+		}
+
+		var name, value string
+		for rows.Next() {
+			if err = rows.Scan(&name, &value); err != nil {
+				_ = rows.Close()
+				return err
+			}
+
+			if peers[i].Meta == nil {
+				peers[i].Meta = make(map[string]string)
+			}
+			peers[i].Meta[name] = value
+		}
+
+		if err = rows.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadPeerStrings reads a column of the rows belonging to each of the peers, as picked by the query.
+func loadPeerStrings(tx *sqlx.Tx, query string, peers []repo.PeerInfo, add func(peer *repo.PeerInfo, value string)) error {
+	st, err := tx.Preparex(tx.Rebind(query))
+	if err != nil {
+		return err
+	}
+
+	defer st.Close()
+
+	for i := range peers {
+		var values []string
+		if err = st.Select(&values, peers[i].DeviceName, peers[i].PublicKey); err != nil {
+			return err
+		}
+
+		for _, v := range values {
+			add(&peers[i], v)
+		}
+	}
+
+	return nil
+}
+
+func loadPeerLabels(tx *sqlx.Tx, peers []repo.PeerInfo) error {
+	err := loadPeerStrings(tx, "SELECT tag FROM peer_tags WHERE device_name = ? AND public_key = ? ORDER BY tag", peers,
+		func(peer *repo.PeerInfo, value string) {
+			peer.Tags = append(peer.Tags, value)
+		})
+
+	if err != nil {
+		return err
+	}
+
+	return loadPeerStrings(tx, "SELECT group_name FROM peer_groups WHERE device_name = ? AND public_key = ? ORDER BY group_name", peers,
+		func(peer *repo.PeerInfo, value string) {
+			peer.Groups = append(peer.Groups, value)
+		})
+}
+
+// listPeersCommon lists the peers matching whereStatement, with ? placeholders, and filter.
+func (s *Repository) listPeersCommon(filter repo.PeerFilter, page repo.PageRequest, order repo.PeerOrder, whereStatement string, args ...interface{}) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	var cursor *repo.PeerCursor
+	if cursor, err = repo.ParsePeerCursor(order, page.Cursor); err != nil {
+		return
+	}
+
+	var tx *sqlx.Tx
+	tx, err = s.beginRead()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = tx.Commit()
+	}()
+
+	whereStatement, args = s.filterStatement(filter, whereStatement, args)
+
+	var sortColumn string
+	var descending bool
+	switch order {
+	case repo.OrderLastHandshakeAsc:
+		sortColumn = "last_handshake"
+	case repo.OrderLastHandshakeDesc:
+		sortColumn, descending = "last_handshake", true
+	case repo.OrderNameAsc:
+		sortColumn = "name"
+	case repo.OrderNameDesc:
+		sortColumn, descending = "name", true
+	default:
+		panic(repo.InvalidPeerOrder)
+	}
+
+	// Reading backward walks the order in reverse and flips the page around afterwards.
+	backward := cursor != nil && cursor.Backward
+	direction, comparison := "ASC", ">"
+	if backward != descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if cursor != nil {
+		whereStatement = fmt.Sprintf("%s AND (%s, public_key) %s (?, ?)", whereStatement, sortColumn, comparison)
+		if sortColumn == "name" {
+			args = append(args, cursor.Name, cursor.PublicKey)
+		} else {
+			args = append(args, cursor.LastHandshake, cursor.PublicKey)
+		}
+	}
+
+	st := fmt.Sprintf("SELECT * FROM peers WHERE %s ORDER BY %s %s, public_key %s", whereStatement, sortColumn, direction, direction)
+	if page.Limit > 0 {
+		// One more row tells whether there is another page.
+		st = fmt.Sprintf("%s LIMIT %v", st, page.Limit+1)
+	}
+
+	var rows *sqlx.Rows
+	if rows, err = tx.Queryx(tx.Rebind(st), args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var p peer
+	for rows.Next() {
+		if err = rows.StructScan(&p); err != nil {
+			return
+		}
+
+		if err = p.open(s.keys); err != nil {
+			return
+		}
+
+		if info, e := p.ToPeerInfo(); e != nil {
+			err = e
+			return
+		} else {
+			data = append(data, info)
+		}
+	}
+
+	if err = rows.Close(); err != nil {
+		return
+	}
+
+	more := page.Limit > 0 && uint(len(data)) > page.Limit
+	if more {
+		data = data[:page.Limit]
+	}
+
+	if backward {
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+		cursors = repo.PageCursorsFor(order, cursor, data, more, false)
+	} else {
+		cursors = repo.PageCursorsFor(order, cursor, data, false, more)
+	}
+
+	if err = loadPeerMeta(tx, data); err != nil {
+		return
+	}
+
+	err = loadPeerLabels(tx, data)
+	return
+}
+
+func (s *Repository) ListPeersByDevices(deviceNames []string, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	if len(deviceNames) == 0 {
+		_, err = repo.ParsePeerCursor(order, page.Cursor)
+		return
+	}
+
+	query, args, err := sqlx.In("device_name IN (?)", deviceNames)
+	if err != nil {
+		return
+	}
+	return s.listPeersCommon(repo.PeerFilter{}, page, order, query, args...)
+}
+
+func (s *Repository) ListPeersByKeys(deviceName string, pubKeys []repo.PublicKey, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	if len(pubKeys) == 0 {
+		_, err = repo.ParsePeerCursor(order, page.Cursor)
+		return
+	}
+
+	query, args, err := sqlx.In("device_name = ? AND public_key IN (?)", deviceName, pubKeys)
+	if err != nil {
+		return
+	}
+	return s.listPeersCommon(repo.PeerFilter{}, page, order, query, args...)
+}
+
+func (s *Repository) ListPeers(filter repo.PeerFilter, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	return s.listPeersCommon(filter, page, order, "TRUE")
+}
+
+func (s *Repository) RemovePeers(deviceName string, publicKeys []repo.PublicKey) (err error) {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	var removed []repo.PublicKey
+
+	defer func() {
+		if len(removed) > 0 {
+			err = s.finish(tx, err, repo.ChangeEvent{
+				Type:        repo.PeersRemoved,
+				DeviceNames: []string{deviceName},
+				PublicKeys:  removed,
+			})
+		} else {
+			err = s.finish(tx, err)
+		}
+	}()
+
+	before, err := s.selectPeersByKeys(tx, deviceName, publicKeys)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range publicKeys {
+		if p, ok := before[k]; ok {
+			removed = append(removed, k)
+			if err = s.record(tx, repo.PeerAuditEntry(s.actor, deviceName, &p, nil)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return deletePeers(tx, deviceName, removed)
+}
+
+func (s *Repository) ReplaceAllPeers(deviceName string, peers []repo.PeerInfo) error {
+	return s.upsertPeers(true, deviceName, peers, nil)
+}
+
+// Close closes the database, unless this is a view of it for an actor.
+func (s *Repository) Close() error {
+	if s.view {
+		return nil
+	}
+
+	err := s.DB.Close()
+	s.DB = nil
+	if e := s.DefaultChangeNotificationHandler.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// upsertPeers writes the peers of the device, or all of them if removeAll. check, if set, is given the stored peers
+// with the keys of those written before anything is, to fail the write with.
+func (s *Repository) upsertPeers(removeAll bool, deviceName string, peers []repo.PeerInfo, check func(tx *sqlx.Tx, before map[repo.PublicKey]repo.PeerInfo) error) (err error) {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	var events []repo.ChangeEvent
+
+	defer func() {
+		err = s.finish(tx, err, events...)
+	}()
+
+	var before map[repo.PublicKey]repo.PeerInfo
+	if removeAll {
+		var existing []repo.PeerInfo
+		if existing, err = s.selectPeers(tx, "device_name = ?", deviceName); err != nil {
+			return err
+		}
+
+		before = make(map[repo.PublicKey]repo.PeerInfo, len(existing))
+		keys := make([]repo.PublicKey, 0, len(existing))
+		for _, p := range existing {
+			before[p.PublicKey] = p
+			keys = append(keys, p.PublicKey)
+		}
+
+		removed := subtractKeys(keys, peers)
+		for _, k := range removed {
+			p := before[k]
+			if err = s.record(tx, repo.PeerAuditEntry(s.actor, deviceName, &p, nil)); err != nil {
+				return err
+			}
+		}
+
+		if len(removed) > 0 {
+			events = append(events, repo.ChangeEvent{
+				Type:        repo.PeersRemoved,
+				DeviceNames: []string{deviceName},
+				PublicKeys:  removed,
+			})
+		}
+
+		for _, table := range append([]string{"peers"}, peerTables...) {
+			if _, err = tx.Exec(tx.Rebind("DELETE FROM "+table+" WHERE device_name = ?"), deviceName); err != nil {
+				return err
+			}
+		}
+	} else if before, err = s.selectPeersByKeys(tx, deviceName, peerKeys(peers)); err != nil {
+		return err
+	}
+
+	if check != nil {
+		if err = check(tx, before); err != nil {
+			return err
+		}
+	}
+
+	st, err := tx.PrepareNamed(updatePeerSql)
+	if err != nil {
+		return err
+	}
+
+	defer st.Close()
+
+	metaSt, err := tx.Preparex(tx.Rebind(updatePeerMetaSql))
+	if err != nil {
+		return err
+	}
+
+	defer metaSt.Close()
+
+	tagSt, err := tx.Preparex(tx.Rebind(updatePeerTagSql))
+	if err != nil {
+		return err
+	}
+
+	defer tagSt.Close()
+
+	groupSt, err := tx.Preparex(tx.Rebind(updatePeerGroupSql))
+	if err != nil {
+		return err
+	}
+
+	defer groupSt.Close()
+
+	addressSt, err := tx.Preparex(tx.Rebind(insertPeerAddressSql))
+	if err != nil {
+		return err
+	}
+
+	defer addressSt.Close()
+
+	var p peer
+	for _, peerInfo := range peers {
+		var old *repo.PeerInfo
+		if b, ok := before[peerInfo.PublicKey]; ok {
+			old = &b
+		}
+
+		if peerInfo.Revision, err = repo.PeerRevision(old, &peerInfo); err != nil {
+			return err
+		}
+
+		peerInfo.DeviceName = deviceName
+		p.FromPeerInfo(peerInfo)
+		if err = p.seal(s.keys); err != nil {
+			return err
+		}
+
+		if _, err = st.Exec(p); err != nil {
+			return err
+		}
+
+		if err = s.record(tx, repo.PeerAuditEntry(s.actor, deviceName, old, &peerInfo)); err != nil {
+			return err
+		}
+
+		for _, table := range peerTables {
+			_, err = tx.Exec(tx.Rebind("DELETE FROM "+table+" WHERE device_name = ? AND public_key = ?"), deviceName, peerInfo.PublicKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		for name, value := range peerInfo.Meta {
+			if _, err = metaSt.Exec(deviceName, peerInfo.PublicKey, name, value); err != nil {
+				return err
+			}
+		}
+
+		for _, tag := range peerInfo.Tags {
+			if _, err = tagSt.Exec(deviceName, peerInfo.PublicKey, tag); err != nil {
+				return err
+			}
+		}
+
+		for _, group := range peerInfo.Groups {
+			if _, err = groupSt.Exec(deviceName, peerInfo.PublicKey, group); err != nil {
+				return err
+			}
+		}
+
+		for _, address := range repo.PeerAddresses(peerInfo.AllowedIPs) {
+			var result sql.Result
+			if result, err = addressSt.Exec(deviceName, address, peerInfo.PublicKey); err != nil {
+				return err
+			}
+
+			var inserted int64
+			if inserted, err = result.RowsAffected(); err != nil {
+				return err
+			} else if inserted == 0 {
+				return repo.ErrAddressTaken
+			}
+		}
+	}
+
+	if len(peers) > 0 {
+		events = append(events, repo.ChangeEvent{
+			Type:        repo.PeersUpdated,
+			DeviceNames: []string{deviceName},
+			PublicKeys:  peerKeys(peers),
+		})
+	}
+
+	return nil
+}
+
+func (s *Repository) UpdatePeers(deviceName string, peers []repo.PeerInfo) error {
+	return s.upsertPeers(false, deviceName, peers, nil)
+}
+
+// AddPeer adds the peer with the checks made in the transaction adding it, once the other writers are done, so that
+// no other instance adds a peer between the count of the owner's and the insert.
+func (s *Repository) AddPeer(peer repo.PeerInfo, maxOwned int) error {
+	return s.upsertPeers(false, peer.DeviceName, []repo.PeerInfo{peer}, func(tx *sqlx.Tx, before map[repo.PublicKey]repo.PeerInfo) error {
+		if _, ok := before[peer.PublicKey]; ok {
+			return repo.ErrPeerExists
+		} else if maxOwned < 0 {
+			return nil
+		}
+
+		var owned int
+		if err := tx.Get(&owned, tx.Rebind(countOwnedSql), peer.Owner); err != nil {
+			return err
+		} else if owned >= maxOwned {
+			return repo.ErrOwnerLimit
+		}
+		return nil
+	})
+}
+
+// subtractNames returns the names that are not used by any of the devices.
+func subtractNames(names []string, devices []repo.DeviceInfo) (ret []string) {
+	kept := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		kept[d.Name] = true
+	}
+
+	for _, n := range names {
+		if !kept[n] {
+			ret = append(ret, n)
+		}
+	}
+	return
+}
+
+func deviceNames(devices []repo.DeviceInfo) []string {
+	ret := make([]string, 0, len(devices))
+	for _, d := range devices {
+		ret = append(ret, d.Name)
+	}
+	return ret
+}
+
+func peerKeys(peers []repo.PeerInfo) []repo.PublicKey {
+	ret := make([]repo.PublicKey, 0, len(peers))
+	for _, p := range peers {
+		ret = append(ret, p.PublicKey)
+	}
+	return ret
+}
+
+// subtractKeys returns the keys that do not belong to any of the peers.
+func subtractKeys(keys []repo.PublicKey, peers []repo.PeerInfo) (ret []repo.PublicKey) {
+	kept := make(map[repo.PublicKey]bool, len(peers))
+	for _, p := range peers {
+		kept[p.PublicKey] = true
+	}
+
+	for _, k := range keys {
+		if !kept[k] {
+			ret = append(ret, k)
+		}
+	}
+	return
+}
+
+// reseal seals every secret again with to, and keeps the data key of to, wrapped.
+func reseal(tx *sqlx.Tx, from *secrets.Keyring, to *secrets.Keyring, wrapped string) error {
+	for _, c := range secretColumns {
+		if err := secrets.ResealColumn(tx, c.table, c.column, c.key, from, to); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(tx.Rebind(updateOptionSql), optionDataKey, wrapped)
+	return err
+}
+
+// RotateMasterKey makes master the key the data key is sealed with. A store of its own gets a new data key too,
+// which every secret is sealed again with. A shared one keeps its data key, the secrets staying sealed with it: the
+// other instances sharing the database carry on with the data key they have, which they couldn't open again without
+// the new master key. A store that isn't encrypted yet gets a data key and its secrets sealed.
+func (s *Repository) RotateMasterKey(master secrets.MasterKey) error {
+	tx, err := s.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	if s.dialect.Shared && s.keys.HasDataKey() {
+		wrapped, err := s.keys.Wrap(master)
+		if err == nil {
+			_, err = tx.Exec(tx.Rebind(updateOptionSql), optionDataKey, wrapped)
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	next, wrapped, err := secrets.NewKeyring(master)
+	if err == nil {
+		err = reseal(tx, s.keys, next, wrapped)
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err == nil {
+		s.keys.Replace(next)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"time"
+)
+
+func (p PeerInfo) Enabled() bool {
+	return !p.Disabled
+}
+
+func (p *PeerInfo) SetEnabled(enabled bool, reason string, at time.Time) {
+	p.Disabled = !enabled
+	p.StateReason = reason
+	p.StateChangedAt = at.Unix()
+}
+
+// SetPeersEnabled enables or disables the peers of the device, keeping everything else about them, and tells how
+// many of them there were.
+func SetPeersEnabled(r Repository, deviceName string, publicKeys []PublicKey, enabled bool, reason string) (int, error) {
+	peers, _, err := r.ListPeersByKeys(deviceName, publicKeys, OrderNameAsc, PageRequest{})
+	if err != nil || len(peers) == 0 {
+		return 0, err
+	}
+
+	now := time.Now()
+	for i := range peers {
+		peers[i].SetEnabled(enabled, reason, now)
+	}
+
+	return len(peers), r.UpdatePeers(deviceName, peers)
+}
+
+// SetMatchingEnabled enables or disables every peer matching the filter.
+func SetMatchingEnabled(r Repository, filter PeerFilter, enabled bool, reason string) (int, error) {
+	now := time.Now()
+	return updateMatching(r, filter, func(peer *PeerInfo) error {
+		peer.SetEnabled(enabled, reason, now)
+		return nil
+	})
+}
+
+// ToPeerConfig gives the peer as it is configured on its device.
+func (p PeerInfo) ToPeerConfig() (c wg.PeerConfig, err error) {
+	publicKey, err := p.PublicKey.ToKey()
+	if err != nil {
+		return
+	}
+
+	c.PublicKey = wg.Key(publicKey)
+	if len(p.PreSharedKey.String()) > 0 {
+		psk, err := p.PreSharedKey.ToKey()
+		if err != nil {
+			return c, err
+		}
+		c.PreSharedKey = wg.Key(psk)
+	}
+
+	c.Endpoint = p.Endpoint
+	c.AllowedIPs = p.AllowedIPs
+	c.PersistentKeepAlive = p.PersistentKeepaliveInterval
+	return
+}
+
+// PeerConfigs gives the set of peers to configure on a device: the enabled ones.
+func PeerConfigs(peers []PeerInfo) ([]wg.PeerConfig, error) {
+	ret := make([]wg.PeerConfig, 0, len(peers))
+	for _, p := range peers {
+		if !p.Enabled() {
+			continue
+		}
+
+		if c, err := p.ToPeerConfig(); err != nil {
+			return nil, err
+		} else {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret, nil
+}
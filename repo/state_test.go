@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestSetPeersEnabled(t *testing.T) {
+	r, peers := newGroupedRepository(t)
+
+	count, err := SetPeersEnabled(r, "wg0", []PublicKey{peers[0].PublicKey, peers[1].PublicKey}, false, "lost laptop")
+	if err != nil || count != 1 {
+		t.Fatalf("SetPeersEnabled() = %v, %v, want only the peer on wg0", count, err)
+	}
+
+	got, _, err := r.ListPeersByKeys("wg0", []PublicKey{peers[0].PublicKey}, OrderNameAsc, PageRequest{})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("ListPeersByKeys() = %v, %v", got, err)
+	}
+
+	p := got[0]
+	if p.Enabled() || p.StateReason != "lost laptop" || p.StateChangedAt == 0 {
+		t.Errorf("disabled peer = %+v", p)
+	}
+	if len(p.Groups) != 1 || p.Name != peers[0].Name {
+		t.Errorf("disabled peer lost its details: %+v", p)
+	}
+
+	if count, err = SetMatchingEnabled(r, PeerFilter{Group: "engineering"}, true, "found"); err != nil || count != 3 {
+		t.Fatalf("SetMatchingEnabled() = %v, %v, want 3", count, err)
+	}
+
+	for _, p := range listGroup(t, r, "engineering") {
+		if !p.Enabled() || p.StateReason != "found" {
+			t.Errorf("enabled peer = %+v", p)
+		}
+	}
+}
+
+func TestPeerConfigs(t *testing.T) {
+	peers := genPagedPeers(3)
+	peers[1].Disabled = true
+
+	configs, err := PeerConfigs(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(configs) != 2 {
+		t.Fatalf("PeerConfigs() = %v, want the 2 enabled peers", configs)
+	}
+
+	for i, p := range []PeerInfo{peers[0], peers[2]} {
+		k, _ := p.PublicKey.ToKey()
+		if configs[i].PublicKey != [32]byte(k) || !configs[i].PreSharedKey.IsZero() {
+			t.Errorf("PeerConfigs()[%v] = %v, want %v", i, configs[i], p)
+		}
+	}
+}
@@ -4,13 +4,34 @@ import (
 	"fmt"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"log"
 	"nz.cloudwalker/wireguard-webadmin/repo"
 	"os/exec"
+	"reflect"
+	"sync"
+	"time"
 )
 
+const DefaultPollInterval = 5 * time.Second
+
+// deviceState is what we last saw of a device, to tell what has changed since.
+type deviceState struct {
+	Device repo.DeviceInfo
+	Peers  map[repo.PublicKey]repo.PeerInfo
+}
+
+// wgRepository reads and writes devices straight from the kernel. It has nowhere to keep peer names or metadata,
+// so those are always empty.
 type wgRepository struct {
 	repo.DefaultChangeNotificationHandler
 	Client *wgctrl.Client
+
+	// stateMutex serialises polls so that every change is reported exactly once.
+	stateMutex sync.Mutex
+	state      map[string]deviceState
+
+	stop chan interface{}
+	done chan interface{}
 }
 
 func runIpCommand(command string, args ...interface{}) error {
@@ -25,10 +46,80 @@ func runIpCommand(command string, args ...interface{}) error {
 		}
 	}
 	cmd := exec.Command("ip", argStrings...)
-	return cmd.Run()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %v: %v: %s", command, err, output)
+	}
+	return nil
+}
+
+func toDeviceInfo(d *wgtypes.Device) repo.DeviceInfo {
+	return repo.DeviceInfo{
+		PrivateKey: repo.NewPrivateKey(d.PrivateKey),
+		ListenPort: uint16(d.ListenPort),
+		Name:       d.Name,
+	}
+}
+
+func toPeerInfo(deviceName string, p wgtypes.Peer) repo.PeerInfo {
+	info := repo.PeerInfo{
+		PublicKey:                   repo.NewPublicKey(p.PublicKey),
+		PreSharedKey:                repo.NewSymmetricKey(p.PresharedKey),
+		Endpoint:                    p.Endpoint,
+		PersistentKeepaliveInterval: p.PersistentKeepaliveInterval,
+		AllowedIPs:                  p.AllowedIPs,
+		DeviceName:                  deviceName,
+	}
+
+	if !p.LastHandshakeTime.IsZero() {
+		info.LastHandshake = p.LastHandshakeTime.Unix()
+	}
+
+	return info
 }
 
-func (w wgRepository) listDeviceMap() (map[string]repo.DeviceInfo, error) {
+func toPeerConfig(info repo.PeerInfo) (c wgtypes.PeerConfig, err error) {
+	if c.PublicKey, err = info.PublicKey.ToKey(); err != nil {
+		return
+	}
+
+	// An empty pre-shared key clears the one on the device.
+	psk := wgtypes.Key{}
+	if len(info.PreSharedKey.String()) > 0 {
+		if psk, err = info.PreSharedKey.ToKey(); err != nil {
+			return
+		}
+	}
+
+	keepalive := info.PersistentKeepaliveInterval
+
+	c.PresharedKey = &psk
+	c.Endpoint = info.Endpoint
+	c.PersistentKeepaliveInterval = &keepalive
+	c.ReplaceAllowedIPs = true
+	c.AllowedIPs = info.AllowedIPs
+	return
+}
+
+// toPeerConfigs configures the enabled peers and removes the disabled ones, the device having nowhere to keep them.
+func toPeerConfigs(peers []repo.PeerInfo) ([]wgtypes.PeerConfig, error) {
+	ret := make([]wgtypes.PeerConfig, 0, len(peers))
+	for _, p := range peers {
+		if !p.Enabled() {
+			if key, err := p.PublicKey.ToKey(); err != nil {
+				return nil, err
+			} else {
+				ret = append(ret, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+			}
+		} else if c, err := toPeerConfig(p); err != nil {
+			return nil, err
+		} else {
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+func (w *wgRepository) listDeviceMap() (map[string]repo.DeviceInfo, error) {
 	devices, err := w.Client.Devices()
 	if err != nil {
 		return nil, err
@@ -36,17 +127,13 @@ func (w wgRepository) listDeviceMap() (map[string]repo.DeviceInfo, error) {
 
 	ret := make(map[string]repo.DeviceInfo, len(devices))
 	for _, d := range devices {
-		ret[d.Name] = repo.DeviceInfo{
-			PrivateKey: repo.NewPrivateKey(d.PrivateKey),
-			ListenPort: uint16(d.ListenPort),
-			Name:       d.Name,
-		}
+		ret[d.Name] = toDeviceInfo(d)
 	}
 
 	return ret, nil
 }
 
-func (w wgRepository) ListDevices() ([]repo.DeviceInfo, error) {
+func (w *wgRepository) ListDevices() ([]repo.DeviceInfo, error) {
 	devices, err := w.Client.Devices()
 	if err != nil {
 		return nil, err
@@ -54,77 +141,313 @@ func (w wgRepository) ListDevices() ([]repo.DeviceInfo, error) {
 
 	var ret []repo.DeviceInfo
 	for _, d := range devices {
-		ret = append(ret, repo.DeviceInfo{
-			PrivateKey: repo.NewPrivateKey(d.PrivateKey),
-			ListenPort: uint16(d.ListenPort),
-			Name:       d.Name,
-		})
+		ret = append(ret, toDeviceInfo(d))
 	}
 
 	return ret, nil
 }
 
-func (w wgRepository) UpdateDevices(devices []repo.DeviceInfo) error {
+func (w *wgRepository) UpdateDevices(devices []repo.DeviceInfo) error {
+	deviceMap, err := w.listDeviceMap()
+	if err != nil {
+		return err
+	}
+
+	defer w.pollAndLog()
+
+	for _, d := range devices {
+		if _, ok := deviceMap[d.Name]; !ok {
+			if err = runIpCommand("link", "add", "dev", d.Name, "type", "wireguard"); err != nil {
+				return err
+			}
+		}
+
+		privateKey, err := d.PrivateKey.ToKey()
+		if err != nil {
+			return err
+		}
+
+		listenPort := int(d.ListenPort)
+		err = w.Client.ConfigureDevice(d.Name, wgtypes.Config{
+			PrivateKey: &privateKey,
+			ListenPort: &listenPort,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err = runIpCommand("link", "set", "up", "dev", d.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *wgRepository) RemoveDevices(names []string) error {
 	deviceMap, err := w.listDeviceMap()
 	if err != nil {
 		return err
 	}
 
-	var devicesToAdd []repo.DeviceInfo
+	defer w.pollAndLog()
+
+	for _, name := range names {
+		if _, ok := deviceMap[name]; ok {
+			if err = runIpCommand("link", "del", "dev", name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReplaceAllDevices removes every WireGuard device on the host that is not in devices.
+func (w *wgRepository) ReplaceAllDevices(devices []repo.DeviceInfo) error {
+	deviceMap, err := w.listDeviceMap()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		delete(deviceMap, d.Name)
+	}
+
+	removing := make([]string, 0, len(deviceMap))
+	for name := range deviceMap {
+		removing = append(removing, name)
+	}
+
+	if err = w.RemoveDevices(removing); err != nil {
+		return err
+	}
+
+	return w.UpdateDevices(devices)
+}
+
+func (w *wgRepository) listPeersCommon(filter func(peer *repo.PeerInfo) bool, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	devices, err := w.Client.Devices()
+	if err != nil {
+		return
+	}
 
+	var peers []repo.PeerInfo
 	for _, d := range devices {
-		if _, ok := deviceMap[d.PrivateKey.ToPublicKey()]; ok {
-			// Old device exists. Updating it.
-			config := wgtypes.Config{
-				PrivateKey:   ,
-				ListenPort:   nil,
-				FirewallMark: nil,
-				ReplacePeers: false,
-				Peers:        nil,
+		for _, p := range d.Peers {
+			info := toPeerInfo(d.Name, p)
+			if filter == nil || filter(&info) {
+				peers = append(peers, info)
 			}
-			if err := w.Client.ConfigureDevice(d.Name, wgtypes.Config{})
 		}
 	}
+
+	return repo.PaginatePeers(peers, order, page)
+}
+
+func (w *wgRepository) ListPeersByDevices(deviceNames []string, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	names := make(map[string]bool, len(deviceNames))
+	for _, n := range deviceNames {
+		names[n] = true
+	}
+
+	return w.listPeersCommon(func(peer *repo.PeerInfo) bool {
+		return names[peer.DeviceName]
+	}, order, page)
 }
 
-func (w wgRepository) RemoveDevices(pubKeys []repo.PublicKey) error {
-	panic("implement me")
+func (w *wgRepository) ListPeersByKeys(deviceName string, pubKeys []repo.PublicKey, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	keys := make(map[repo.PublicKey]bool, len(pubKeys))
+	for _, k := range pubKeys {
+		keys[k] = true
+	}
+
+	return w.listPeersCommon(func(peer *repo.PeerInfo) bool {
+		return peer.DeviceName == deviceName && keys[peer.PublicKey]
+	}, order, page)
 }
 
-func (w wgRepository) ReplaceAllDevices(devices []repo.DeviceInfo) error {
-	panic("implement me")
+func (w *wgRepository) ListPeers(filter repo.PeerFilter, order repo.PeerOrder, page repo.PageRequest) (data []repo.PeerInfo, cursors repo.PageCursors, err error) {
+	return w.listPeersCommon(filter.Match, order, page)
+}
+
+func (w *wgRepository) RemovePeers(deviceName string, publicKeys []repo.PublicKey) error {
+	peers := make([]wgtypes.PeerConfig, 0, len(publicKeys))
+	for _, k := range publicKeys {
+		key, err := k.ToKey()
+		if err != nil {
+			return err
+		}
+
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+
+	defer w.pollAndLog()
+	return w.Client.ConfigureDevice(deviceName, wgtypes.Config{Peers: peers})
 }
 
-func (w wgRepository) ListPeersByDevices(pubKeys []repo.PublicKey, order repo.PeerOrder, offset uint, limit uint) (data []repo.PeerInfo, total uint, err error) {
-	panic("implement me")
+func (w *wgRepository) UpdatePeers(deviceName string, peers []repo.PeerInfo) error {
+	configs, err := toPeerConfigs(peers)
+	if err != nil {
+		return err
+	}
+
+	defer w.pollAndLog()
+	return w.Client.ConfigureDevice(deviceName, wgtypes.Config{Peers: configs})
 }
 
-func (w wgRepository) ListPeersByKeys(devicePubKey repo.PublicKey, pubKeys []repo.PublicKey, order repo.PeerOrder, offset uint, limit uint) (data []repo.PeerInfo, total uint, err error) {
-	panic("implement me")
+func (w *wgRepository) ReplaceAllPeers(deviceName string, peers []repo.PeerInfo) error {
+	configs, err := toPeerConfigs(peers)
+	if err != nil {
+		return err
+	}
+
+	defer w.pollAndLog()
+	return w.Client.ConfigureDevice(deviceName, wgtypes.Config{ReplacePeers: true, Peers: configs})
+}
+
+func (w *wgRepository) Close() error {
+	close(w.stop)
+	<-w.done
+
+	err := w.Client.Close()
+	_ = w.DefaultChangeNotificationHandler.Close()
+	return err
+}
+
+func (w *wgRepository) readState() (map[string]deviceState, error) {
+	devices, err := w.Client.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]deviceState, len(devices))
+	for _, d := range devices {
+		s := deviceState{
+			Device: toDeviceInfo(d),
+			Peers:  make(map[repo.PublicKey]repo.PeerInfo, len(d.Peers)),
+		}
+
+		for _, p := range d.Peers {
+			info := toPeerInfo(d.Name, p)
+			s.Peers[info.PublicKey] = info
+		}
+
+		ret[d.Name] = s
+	}
+
+	return ret, nil
 }
 
-func (w wgRepository) ListPeers(order repo.PeerOrder, offset uint, limit uint) (data []repo.PeerInfo, total uint, err error) {
-	panic("implement me")
+// diffStates tells what changed between two reads of the devices.
+func diffStates(old map[string]deviceState, new map[string]deviceState) (events []repo.ChangeEvent) {
+	var removedDevices, updatedDevices []string
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removedDevices = append(removedDevices, name)
+		}
+	}
+
+	for name, n := range new {
+		o, ok := old[name]
+		if !ok || o.Device != n.Device {
+			updatedDevices = append(updatedDevices, name)
+		}
+	}
+
+	if len(removedDevices) > 0 {
+		events = append(events, repo.ChangeEvent{Type: repo.DeviceRemoved, DeviceNames: removedDevices})
+	}
+
+	if len(updatedDevices) > 0 {
+		events = append(events, repo.ChangeEvent{Type: repo.DeviceUpdated, DeviceNames: updatedDevices})
+	}
+
+	for name, n := range new {
+		o := old[name]
+
+		var removedPeers, updatedPeers []repo.PublicKey
+		for k := range o.Peers {
+			if _, ok := n.Peers[k]; !ok {
+				removedPeers = append(removedPeers, k)
+			}
+		}
+
+		for k, p := range n.Peers {
+			if op, ok := o.Peers[k]; !ok || !reflect.DeepEqual(op, p) {
+				updatedPeers = append(updatedPeers, k)
+			}
+		}
+
+		if len(removedPeers) > 0 {
+			events = append(events, repo.ChangeEvent{Type: repo.PeersRemoved, DeviceNames: []string{name}, PublicKeys: removedPeers})
+		}
+
+		if len(updatedPeers) > 0 {
+			events = append(events, repo.ChangeEvent{Type: repo.PeersUpdated, DeviceNames: []string{name}, PublicKeys: updatedPeers})
+		}
+	}
+
+	return
 }
 
-func (w wgRepository) RemovePeers(devicePubKey repo.PublicKey, publicKeys []repo.PublicKey) error {
-	panic("implement me")
+// poll reads the devices and notifies listeners of whatever changed since the last poll.
+func (w *wgRepository) poll() error {
+	w.stateMutex.Lock()
+	defer w.stateMutex.Unlock()
+
+	state, err := w.readState()
+	if err != nil {
+		return err
+	}
+
+	events := diffStates(w.state, state)
+	w.state = state
+	w.NotifyChange(events...)
+	return nil
 }
 
-func (w wgRepository) UpdatePeers(devicePubKey repo.PublicKey, peers []repo.PeerInfo) error {
-	panic("implement me")
+func (w *wgRepository) pollAndLog() {
+	if err := w.poll(); err != nil {
+		log.Printf("wg-repository: unable to read devices: %v", err)
+	}
 }
 
-func (w wgRepository) ReplaceAllPeers(devicePubKey repo.PublicKey, peers []repo.PeerInfo) error {
-	panic("implement me")
+func (w *wgRepository) pollLoop(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.pollAndLog()
+		}
+	}
 }
 
-func NewWgRepository() (repo.Repository, error) {
-	if client, err := wgctrl.New(); err != nil {
+// NewWgRepository talks to the kernel through wgctrl and checks it for changes made elsewhere every pollInterval.
+func NewWgRepository(pollInterval time.Duration) (repo.Repository, error) {
+	client, err := wgctrl.New()
+	if err != nil {
 		return nil, err
-	} else {
-		return &wgRepository{
-			Client: client,
-		}, nil
 	}
+
+	w := &wgRepository{
+		Client: client,
+		stop:   make(chan interface{}),
+		done:   make(chan interface{}),
+	}
+
+	if w.state, err = w.readState(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	go w.pollLoop(pollInterval)
+	return w, nil
 }
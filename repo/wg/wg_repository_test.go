@@ -0,0 +1,86 @@
+package wg
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"testing"
+)
+
+func Test_diffStates(t *testing.T) {
+	k1, _ := wgtypes.GeneratePrivateKey()
+	k2, _ := wgtypes.GeneratePrivateKey()
+	pk1 := repo.NewPublicKey(k1.PublicKey())
+	pk2 := repo.NewPublicKey(k2.PublicKey())
+
+	wg0 := repo.DeviceInfo{PrivateKey: repo.NewPrivateKey(k1), ListenPort: 51820, Name: "wg0"}
+	peer1 := repo.PeerInfo{PublicKey: pk1, DeviceName: "wg0"}
+	peer2 := repo.PeerInfo{PublicKey: pk2, DeviceName: "wg0"}
+	shookHands := peer1
+	shookHands.LastHandshake = 1000
+
+	state := func(d repo.DeviceInfo, peers ...repo.PeerInfo) map[string]deviceState {
+		s := deviceState{Device: d, Peers: make(map[repo.PublicKey]repo.PeerInfo)}
+		for _, p := range peers {
+			s.Peers[p.PublicKey] = p
+		}
+		return map[string]deviceState{d.Name: s}
+	}
+
+	movedPort := wg0
+	movedPort.ListenPort = 51821
+
+	tests := []struct {
+		name string
+		old  map[string]deviceState
+		new  map[string]deviceState
+		want []repo.ChangeEvent
+	}{
+		{name: "unchanged", old: state(wg0, peer1), new: state(wg0, peer1), want: nil},
+		{
+			name: "device added",
+			old:  nil,
+			new:  state(wg0, peer1),
+			want: []repo.ChangeEvent{
+				{Type: repo.DeviceUpdated, DeviceNames: []string{"wg0"}},
+				{Type: repo.PeersUpdated, DeviceNames: []string{"wg0"}, PublicKeys: []repo.PublicKey{pk1}},
+			},
+		},
+		{
+			name: "device removed",
+			old:  state(wg0, peer1),
+			new:  map[string]deviceState{},
+			want: []repo.ChangeEvent{{Type: repo.DeviceRemoved, DeviceNames: []string{"wg0"}}},
+		},
+		{
+			name: "device changed",
+			old:  state(wg0),
+			new:  state(movedPort),
+			want: []repo.ChangeEvent{{Type: repo.DeviceUpdated, DeviceNames: []string{"wg0"}}},
+		},
+		{
+			name: "peer replaced",
+			old:  state(wg0, peer1),
+			new:  state(wg0, peer2),
+			want: []repo.ChangeEvent{
+				{Type: repo.PeersRemoved, DeviceNames: []string{"wg0"}, PublicKeys: []repo.PublicKey{pk1}},
+				{Type: repo.PeersUpdated, DeviceNames: []string{"wg0"}, PublicKeys: []repo.PublicKey{pk2}},
+			},
+		},
+		{
+			name: "peer handshake",
+			old:  state(wg0, peer1),
+			new:  state(wg0, shookHands),
+			want: []repo.ChangeEvent{
+				{Type: repo.PeersUpdated, DeviceNames: []string{"wg0"}, PublicKeys: []repo.PublicKey{pk1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffStates(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffStates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
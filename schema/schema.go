@@ -0,0 +1,70 @@
+// Package schema brings the tables of a store up to date. Several stores can share a database: each keeps its
+// schema version in an options table of its own, named after the prefix of its tables.
+package schema
+
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"strconv"
+)
+
+const optionSchemaVersion = "schema_version"
+
+// OptionTable is the name of the table holding the options, the schema version among them, of the store whose
+// tables are named with prefix.
+func OptionTable(prefix string) string {
+	return prefix + "options"
+}
+
+// Migrate runs the migrations the store whose tables are named with prefix hasn't had yet, in the transaction, and
+// records that it's had them all. The statements of each migration work both in SQLite and PostgreSQL as long as
+// the migrations themselves do.
+func Migrate(tx *sqlx.Tx, prefix string, migrations [][]string) error {
+	options := OptionTable(prefix)
+
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + options + ` (
+		name TEXT NOT NULL PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version string
+	err = tx.Get(&version, tx.Rebind("SELECT value FROM "+options+" WHERE name = ?"), optionSchemaVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	schemaVersion, _ := strconv.Atoi(version)
+	for v := schemaVersion; v < len(migrations); v++ {
+		for _, st := range migrations[v] {
+			if _, err = tx.Exec(st); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(tx.Rebind(`INSERT INTO `+options+` (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value`), optionSchemaVersion, strconv.Itoa(len(migrations)))
+	return err
+}
+
+// MigrateDB runs Migrate in a transaction of its own.
+func MigrateDB(db *sqlx.DB, prefix string, migrations [][]string) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = Migrate(tx, prefix, migrations)
+	return
+}
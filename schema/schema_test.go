@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+)
+
+func tables(t *testing.T, db *sqlx.DB) (ret []string) {
+	if err := db.Select(&ret, "SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name"); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", "file:schema_migrate?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := [][]string{
+		{`CREATE TABLE a_first (id INTEGER PRIMARY KEY)`},
+	}
+
+	// Running them again, as a store does each time it's opened, leaves the tables as they are.
+	for i := 0; i < 2; i++ {
+		if err = MigrateDB(db, "a_", migrations); err != nil {
+			t.Fatalf("MigrateDB() #%v error = %v", i, err)
+		}
+	}
+
+	// Another store in the same database has a version of its own.
+	if err = MigrateDB(db, "b_", [][]string{{`CREATE TABLE b_first (id INTEGER PRIMARY KEY)`}}); err != nil {
+		t.Fatal("MigrateDB() of another prefix:", err)
+	}
+
+	migrations = append(migrations, []string{`CREATE TABLE a_second (id INTEGER PRIMARY KEY)`})
+	if err = MigrateDB(db, "a_", migrations); err != nil {
+		t.Fatal("MigrateDB() of a new version:", err)
+	}
+
+	want := []string{"a_first", "a_options", "a_second", "b_first", "b_options"}
+	if got := tables(t, db); len(got) != len(want) {
+		t.Errorf("tables = %v, want %v", got, want)
+	} else {
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("tables = %v, want %v", got, want)
+				break
+			}
+		}
+	}
+
+	var version string
+	if err = db.Get(&version, "SELECT value FROM a_options WHERE name = ?", optionSchemaVersion); err != nil || version != "2" {
+		t.Errorf("schema version = %v, %v, want 2", version, err)
+	}
+}
+
+func TestMigrate_failure(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", "file:schema_failure?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = MigrateDB(db, "", [][]string{{`CREATE TABLE first (id INTEGER PRIMARY KEY)`, `NOT SQL`}})
+	if err == nil {
+		t.Fatal("MigrateDB() of a broken migration succeeds")
+	}
+
+	// Nothing of a migration that fails is kept.
+	if got := tables(t, db); len(got) != 0 {
+		t.Errorf("tables = %v, want none", got)
+	}
+}
@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"github.com/jmoiron/sqlx"
+	"strings"
+)
+
+// ResealColumn opens every value of the column with from and seals it again with to, in the transaction. The rows
+// are told apart by the key columns, whose values are the row of the Place the values are sealed at.
+func ResealColumn(tx *sqlx.Tx, table string, column string, keyColumns []string, from *Keyring, to *Keyring) error {
+	type row struct {
+		value string
+		key   []string
+	}
+
+	rows, err := tx.Query("SELECT " + column + ", " + strings.Join(keyColumns, ", ") + " FROM " + table)
+	if err != nil {
+		return err
+	}
+
+	// The rows are all read before any is written, as some drivers can't do both at once on a connection.
+	var values []row
+	for rows.Next() {
+		r := row{key: make([]string, len(keyColumns))}
+		dest := []interface{}{&r.value}
+		for i := range r.key {
+			dest = append(dest, &r.key[i])
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		values = append(values, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	update := tx.Rebind("UPDATE " + table + " SET " + column + " = ? WHERE " + strings.Join(keyColumns, " = ? AND ") + " = ?")
+	for _, r := range values {
+		at := Place{Table: table, Column: column, Row: r.key}
+		plaintext, err := from.Open(r.value, at)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := to.Seal(plaintext, at)
+		if err != nil {
+			return err
+		}
+
+		args := []interface{}{sealed}
+		for _, k := range r.key {
+			args = append(args, k)
+		}
+
+		if _, err = tx.Exec(update, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+// Package secrets encrypts the secret columns of a store, such as private and pre-shared keys, so that the database
+// file alone gives nothing away.
+//
+// It uses envelope encryption: the columns are sealed with a random data key, which is kept in the store sealed with
+// a master key held outside of it, in a file or an environment variable. Rotating the master key seals everything
+// again with a new data key.
+package secrets
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix marks the values that are sealed, which neither hex nor base64 keys can start with.
+const sealedPrefix = "sealed:"
+
+var (
+	ErrWrongKey  = errors.New("secrets: the master key is not the one the store was encrypted with")
+	ErrNoKey     = errors.New("secrets: the store is encrypted, a master key is needed")
+	ErrNotSealed = errors.New("secrets: a secret of the encrypted store is not sealed")
+)
+
+// Place is where a secret is kept: its table and column, and the key of its row. The place is sealed along with the
+// secret, so that a sealed value copied to another row or column doesn't open.
+type Place struct {
+	Table  string
+	Column string
+	Row    []string
+}
+
+func (p Place) additionalData() []byte {
+	return []byte(strings.Join(append([]string{p.Table, p.Column}, p.Row...), "\x00"))
+}
+
+// Rotator is a store whose master key can be changed.
+type Rotator interface {
+	// RotateMasterKey makes master the key the data key is sealed with. Stores opened once only seal every secret
+	// again with a new data key too, while those shared between instances keep the data key the others use. A store
+	// that isn't encrypted yet gets encrypted.
+	RotateMasterKey(master MasterKey) error
+}
+
+type MasterKey [chacha20poly1305.KeySize]byte
+
+func NewMasterKey() (k MasterKey, err error) {
+	_, err = rand.Read(k[:])
+	return
+}
+
+// Encode gives the key in base64, as ParseMasterKey reads it.
+func (k MasterKey) Encode() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func ParseMasterKey(v string) (k MasterKey, err error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return k, errors.New("secrets: the master key is not valid base64")
+	}
+
+	if len(b) != len(k) {
+		return k, errors.New("secrets: the master key is not 32 bytes long")
+	}
+
+	copy(k[:], b)
+	return k, nil
+}
+
+// LoadMasterKey reads the master key from the file or, with no file, from the environment variable. It gives nil if
+// neither has one, for a store that isn't encrypted.
+func LoadMasterKey(file string, env string) (*MasterKey, error) {
+	v := os.Getenv(env)
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		v = string(b)
+	}
+
+	if len(strings.TrimSpace(v)) == 0 {
+		return nil, nil
+	}
+
+	k, err := ParseMasterKey(v)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Keyring seals and opens the secrets of a store. One without a data key, or a nil one, leaves them as they are.
+type Keyring struct {
+	mutex sync.RWMutex
+	key   []byte
+	aead  cipher.AEAD
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		// Only a key of the wrong size fails.
+		panic(err)
+	}
+	return aead
+}
+
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+func open(aead cipher.AEAD, v string, additionalData []byte) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(v, sealedPrefix))
+	if err != nil || len(b) < aead.NonceSize() {
+		return nil, errors.New("secrets: sealed value is not valid")
+	}
+
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], additionalData)
+}
+
+// NewKeyring makes a keyring with a new data key, and gives the data key sealed with master for the store to keep.
+func NewKeyring(master MasterKey) (k *Keyring, wrapped string, err error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	if wrapped, err = seal(newAEAD(master[:]), key, nil); err != nil {
+		return
+	}
+
+	return &Keyring{key: key, aead: newAEAD(key)}, wrapped, nil
+}
+
+// OpenKeyring opens the data key the store keeps, wrapped, with master, either of which may be missing. With a
+// master key and no data key yet, it makes one as NewKeyring does: the store is to keep the new wrapped key and seal
+// what it has in plaintext. It fails with ErrWrongKey if master doesn't open the data key, and ErrNoKey if there is
+// a data key but no master key.
+func OpenKeyring(master *MasterKey, wrapped string) (k *Keyring, newWrapped string, err error) {
+	switch {
+	case len(wrapped) == 0 && master == nil:
+		return &Keyring{}, "", nil
+	case len(wrapped) == 0:
+		return NewKeyring(*master)
+	case master == nil:
+		return nil, "", ErrNoKey
+	}
+
+	key, err := open(newAEAD(master[:]), wrapped, nil)
+	if err != nil {
+		return nil, "", ErrWrongKey
+	}
+
+	return &Keyring{key: key, aead: newAEAD(key)}, "", nil
+}
+
+// Replace makes the keyring use the data key of the other, once everything has been sealed with it.
+func (k *Keyring) Replace(other *Keyring) {
+	other.mutex.RLock()
+	key, aead := other.key, other.aead
+	other.mutex.RUnlock()
+
+	k.mutex.Lock()
+	k.key, k.aead = key, aead
+	k.mutex.Unlock()
+}
+
+// HasDataKey tells whether the keyring seals what it's given.
+func (k *Keyring) HasDataKey() bool {
+	if k == nil {
+		return false
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.aead != nil
+}
+
+// Wrap gives the data key sealed with master, for the store to keep in place of the one sealed with the old master
+// key. It fails with ErrNoKey without a data key.
+func (k *Keyring) Wrap(master MasterKey) (string, error) {
+	if k == nil {
+		return "", ErrNoKey
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if k.key == nil {
+		return "", ErrNoKey
+	}
+	return seal(newAEAD(master[:]), k.key, nil)
+}
+
+// Seal encrypts the value kept at the place, or leaves it as it is without a data key. Empty values, which hold
+// nothing secret, are left empty.
+func (k *Keyring) Seal(v string, at Place) (string, error) {
+	if k == nil {
+		return v, nil
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if k.aead == nil || len(v) == 0 {
+		return v, nil
+	}
+	return seal(k.aead, []byte(v), at.additionalData())
+}
+
+// Open decrypts a value sealed at the place. Values that aren't sealed, written before the store was encrypted, are
+// only given as they are by a keyring without a data key, as the one a store is encrypted from; once there is a data
+// key, they fail with ErrNotSealed.
+func (k *Keyring) Open(v string, at Place) (string, error) {
+	if !strings.HasPrefix(v, sealedPrefix) {
+		if len(v) == 0 || k == nil {
+			return v, nil
+		}
+
+		k.mutex.RLock()
+		defer k.mutex.RUnlock()
+
+		if k.aead != nil {
+			return "", ErrNotSealed
+		}
+		return v, nil
+	} else if k == nil {
+		return "", ErrNoKey
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if k.aead == nil {
+		return "", ErrNoKey
+	}
+
+	b, err := open(k.aead, v, at.additionalData())
+	if err != nil {
+		return "", ErrWrongKey
+	}
+	return string(b), nil
+}
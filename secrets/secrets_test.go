@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func newMasterKey(t *testing.T) MasterKey {
+	k, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestOpenKeyring(t *testing.T) {
+	master, other := newMasterKey(t), newMasterKey(t)
+	sealing, wrapped, err := NewKeyring(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := Place{Table: "devices", Column: "private_key", Row: []string{"wg0"}}
+	sealed, err := sealing.Seal("secret", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(sealed, sealedPrefix) || strings.Contains(sealed, "secret") {
+		t.Fatalf("Seal() = %v, want it sealed", sealed)
+	}
+
+	tests := []struct {
+		name        string
+		master      *MasterKey
+		wrapped     string
+		wantErr     error
+		wantWrapped bool
+		wantOpened  string
+	}{
+		{name: "plaintext", wantErr: ErrNoKey},
+		{name: "encrypting", master: &other, wantWrapped: true, wantErr: ErrWrongKey},
+		{name: "right key", master: &master, wrapped: wrapped, wantOpened: "secret"},
+		{name: "wrong key", master: &other, wrapped: wrapped, wantErr: ErrWrongKey},
+		{name: "no key", wrapped: wrapped, wantErr: ErrNoKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, newWrapped, err := OpenKeyring(tt.master, tt.wrapped)
+			if err == nil {
+				if (len(newWrapped) > 0) != tt.wantWrapped {
+					t.Errorf("OpenKeyring() wrapped = %q, want a new one: %v", newWrapped, tt.wantWrapped)
+				}
+
+				// Keys that aren't sealed only read as they are before the store is encrypted.
+				if v, err := keys.Open("plain", at); tt.master != nil && err != ErrNotSealed {
+					t.Errorf("Open(plain) = %v, %v, want %v", v, err, ErrNotSealed)
+				} else if tt.master == nil && v != "plain" {
+					t.Errorf("Open(plain) = %v, want plain", v)
+				}
+
+				var opened string
+				opened, err = keys.Open(sealed, at)
+				if err == nil && opened != tt.wantOpened {
+					t.Errorf("Open() = %v, want %v", opened, tt.wantOpened)
+				}
+			}
+
+			if err != tt.wantErr {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyring_Wrap(t *testing.T) {
+	master, next := newMasterKey(t), newMasterKey(t)
+	keys, _, err := NewKeyring(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := Place{Table: "devices", Column: "private_key", Row: []string{"wg0"}}
+	sealed, err := keys.Seal("secret", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := keys.Wrap(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The data key wrapped with the next master key opens what was sealed before.
+	reopened, _, err := OpenKeyring(&next, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := reopened.Open(sealed, at); err != nil || v != "secret" {
+		t.Errorf("Open() = %v, %v, want secret", v, err)
+	}
+
+	if _, err = (&Keyring{}).Wrap(next); err != ErrNoKey {
+		t.Errorf("Wrap() without a data key error = %v, want %v", err, ErrNoKey)
+	}
+}
+
+func TestKeyring_Open_otherPlace(t *testing.T) {
+	keys, _, err := NewKeyring(newMasterKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := Place{Table: "peers", Column: "pre_shared_key", Row: []string{"wg0", "alice"}}
+	sealed, err := keys.Seal("secret", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, other := range []Place{
+		{Table: "peers", Column: "pre_shared_key", Row: []string{"wg0", "bob"}},
+		{Table: "peers", Column: "pre_shared_key", Row: []string{"wg1", "alice"}},
+		{Table: "devices", Column: "private_key", Row: []string{"wg0", "alice"}},
+	} {
+		if v, err := keys.Open(sealed, other); err != ErrWrongKey {
+			t.Errorf("Open(%+v) = %v, %v, want %v", other, v, err, ErrWrongKey)
+		}
+	}
+
+	if v, err := keys.Open(sealed, at); err != nil || v != "secret" {
+		t.Errorf("Open() = %v, %v, want secret", v, err)
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	master := newMasterKey(t)
+	if k, err := ParseMasterKey(master.Encode() + "\n"); err != nil || k != master {
+		t.Errorf("ParseMasterKey() = %v, %v, want the key back", k, err)
+	}
+
+	for _, v := range []string{"", "not base64!", "c2hvcnQ="} {
+		if _, err := ParseMasterKey(v); err == nil {
+			t.Errorf("ParseMasterKey(%q) error = nil, want one", v)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/repo/sqlite"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"os"
+)
+
+// masterKeyEnv holds the master key, in base64, when no key file is given.
+const masterKeyEnv = "WGADMIN_MASTER_KEY"
+
+// addKeyFileFlag adds the -key-file flag of the commands opening the store.
+func addKeyFileFlag(flags *flag.FlagSet) *string {
+	return flags.String("key-file", "", "file holding the master key in base64, $"+masterKeyEnv+" if empty")
+}
+
+// openStore opens the store with the master key of the file or the environment, if any.
+func openStore(dsn string, keyFile string) (persistent.Repository, error) {
+	master, err := secrets.LoadMasterKey(keyFile, masterKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return persistent.NewSqliteRepository(dsn, persistent.WithMasterKey(master))
+}
+
+// openRepository opens the peer repository with the master key of the file or the environment, if any.
+func openRepository(dsn string, keyFile string) (repo.Repository, error) {
+	master, err := secrets.LoadMasterKey(keyFile, masterKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlite.NewSqliteRepository(dsn, sqlite.WithMasterKey(master))
+}
+
+// runRotateKey encrypts the secrets of the store and of the peer repository again with a new master key, or encrypts
+// them for the first time. It exits with 1 when the current master key is wrong or missing, and 2 on any other error.
+func runRotateKey(args []string) int {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	repoDsn := flags.String("repo", "file:wgadmin-peers.db", "data source name of the peer repository")
+	keyFile := addKeyFileFlag(flags)
+	newKeyFile := flags.String("new-key-file", "", "file holding the new master key in base64, such as made by: head -c 32 /dev/urandom | base64")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: rotate-key [-db dsn] [-repo dsn] [-key-file file] -new-key-file file")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if len(*newKeyFile) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	fail := func(err error) int {
+		_, _ = fmt.Fprintln(os.Stderr, "rotate-key:", err)
+		if err == secrets.ErrWrongKey || err == secrets.ErrNoKey {
+			return 1
+		}
+		return 2
+	}
+
+	next, err := secrets.LoadMasterKey(*newKeyFile, "")
+	if err == nil && next == nil {
+		err = fmt.Errorf("%v is empty", *newKeyFile)
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "rotate-key:", err)
+		return 2
+	}
+
+	current, err := secrets.LoadMasterKey(*keyFile, masterKeyEnv)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Both are opened before either is rotated, so that a wrong key leaves them as they were.
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		return fail(err)
+	}
+
+	defer store.Close()
+
+	repository, err := openRepository(*repoDsn, *keyFile)
+	if err != nil {
+		return fail(err)
+	}
+
+	defer repository.Close()
+
+	if err = store.(secrets.Rotator).RotateMasterKey(*next); err != nil {
+		return fail(err)
+	}
+
+	if err = repository.(secrets.Rotator).RotateMasterKey(*next); err != nil {
+		// The store goes back to the current key, for the two to open with the same one.
+		if current != nil {
+			if back := store.(secrets.Rotator).RotateMasterKey(*current); back != nil {
+				_, _ = fmt.Fprintln(os.Stderr, "rotate-key: the store is left with the new master key:", back)
+			}
+		}
+		return fail(err)
+	}
+
+	_, _ = fmt.Fprintln(os.Stdout, "The store and the peer repository are now encrypted with the new master key")
+	return 0
+}
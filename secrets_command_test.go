@@ -0,0 +1,95 @@
+package main
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io/ioutil"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/secrets"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeMasterKey(t *testing.T, dir string, name string) string {
+	master, err := secrets.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(file, []byte(master.Encode()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestRunRotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, repoDsn := "file:"+filepath.Join(dir, "wgadmin.db"), "file:"+filepath.Join(dir, "wgadmin-peers.db")
+	current, next := writeMasterKey(t, dir, "current.key"), writeMasterKey(t, dir, "next.key")
+
+	store, err := openStore(db, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	repository, err := openRepository(repoDsn, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := repo.PeerInfo{PublicKey: repo.NewPublicKey(private.PublicKey()), PreSharedKey: repo.NewSymmetricKey(psk), DeviceName: "wg0", Name: "alice"}
+	if err = repository.UpdateDevices([]repo.DeviceInfo{{Name: "wg0", PrivateKey: repo.NewPrivateKey(private)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repository.UpdatePeers("wg0", []repo.PeerInfo{peer}); err != nil {
+		t.Fatal(err)
+	}
+	_ = repository.Close()
+
+	if code := runRotateKey([]string{"-db", db, "-repo", repoDsn, "-key-file", next, "-new-key-file", current}); code != 1 {
+		t.Errorf("runRotateKey() with the wrong key = %v, want 1", code)
+	}
+
+	if code := runRotateKey([]string{"-db", db, "-repo", repoDsn, "-key-file", current, "-new-key-file", next}); code != 0 {
+		t.Fatalf("runRotateKey() = %v, want 0", code)
+	}
+
+	// Both open with the new key only.
+	if _, err = openStore(db, current); err != secrets.ErrWrongKey {
+		t.Errorf("openStore() with the old key error = %v, want %v", err, secrets.ErrWrongKey)
+	}
+	if _, err = openRepository(repoDsn, current); err != secrets.ErrWrongKey {
+		t.Errorf("openRepository() with the old key error = %v, want %v", err, secrets.ErrWrongKey)
+	}
+
+	if store, err = openStore(db, next); err != nil {
+		t.Fatal("openStore():", err)
+	}
+	_ = store.Close()
+
+	if repository, err = openRepository(repoDsn, next); err != nil {
+		t.Fatal("openRepository():", err)
+	}
+	defer repository.Close()
+
+	peers, _, err := repository.ListPeersByKeys("wg0", []repo.PublicKey{peer.PublicKey}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil || len(peers) != 1 || peers[0].PreSharedKey != peer.PreSharedKey {
+		t.Errorf("ListPeersByKeys() = %+v, %v, want alice with her pre-shared key", peers, err)
+	}
+}
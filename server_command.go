@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"io"
+	"log"
+	"net/http"
+	"nz.cloudwalker/wireguard-webadmin/agent"
+	"nz.cloudwalker/wireguard-webadmin/api"
+	"nz.cloudwalker/wireguard-webadmin/drift"
+	"nz.cloudwalker/wireguard-webadmin/expiry"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/quota"
+	"nz.cloudwalker/wireguard-webadmin/site"
+	"nz.cloudwalker/wireguard-webadmin/stats"
+	"nz.cloudwalker/wireguard-webadmin/users"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"nz.cloudwalker/wireguard-webadmin/wgsync"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// adminTokenEnv holds the admin token, which would show in the process list as a flag.
+const adminTokenEnv = "WGADMIN_ADMIN_TOKEN"
+
+// shutdownTimeout is how long the requests being served are given to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// userDevices are the devices members add their peers to, given as name,network,endpoint, such as
+// wg0,10.0.0.1/24,vpn.example.com:51820, once per device.
+type userDevices map[string]users.Device
+
+func (d userDevices) String() string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+func (d userDevices) Set(v string) error {
+	parts := strings.Split(v, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("%v is not name,network,endpoint", v)
+	}
+
+	network, err := utils.ParseCIDRAsIPNet(parts[1])
+	if err != nil {
+		return err
+	}
+
+	d[parts[0]] = users.Device{Network: *network, Endpoint: parts[2]}
+	return nil
+}
+
+// closers closes what the server started, in the reverse order, logging what fails to.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i].Close(); err != nil {
+			log.Printf("server: closing: %v", err)
+		}
+	}
+	return nil
+}
+
+// runServe serves the api on the peer repository until it's interrupted, with the background jobs: the sync of the
+// devices up on this host with the repository, the expiry of the peers, the collection of their stats, the
+// enforcement of their quotas and, through /drift, the checks of the devices against the store. The store holds the
+// devices, the users, the stats, the quotas, the agents and the sites, and the repository the peers, since their
+// tables would clash. It exits with 2 on error.
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:9090", "address to serve the api on")
+	db := flags.String("db", "file:wgadmin.db", "data source name of the store")
+	repoDsn := flags.String("repo", "file:wgadmin-peers.db", "data source name of the peer repository")
+	keyFile := addKeyFileFlag(flags)
+	expire := flags.String("expire", "disable", "what to do with the peers that expire: disable or remove")
+	statsInterval := flags.Duration("stats-interval", stats.DefaultInterval, "how often to sample the devices")
+	quotaInterval := flags.Duration("quota-interval", quota.DefaultInterval, "how often to enforce the quotas")
+	devices := make(userDevices)
+	flags.Var(devices, "user-device", "device members add their peers to, as name,network,endpoint, once per device")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: [serve] [-listen address] [-db dsn] [-repo dsn] [-key-file file] [-expire disable|remove] [-stats-interval duration] [-quota-interval duration] [-user-device name,network,endpoint]...")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	var action expiry.Action
+	switch *expire {
+	case "disable":
+		action = expiry.Disable
+	case "remove":
+		action = expiry.Remove
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	if *statsInterval <= 0 || *quotaInterval <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var started closers
+	defer func() {
+		_ = started.Close()
+	}()
+
+	fail := func(err error) int {
+		_, _ = fmt.Fprintln(os.Stderr, "server:", err)
+		return 2
+	}
+
+	store, err := openStore(*db, *keyFile)
+	if err != nil {
+		return fail(err)
+	}
+	started = append(started, store)
+
+	repository, err := openRepository(*repoDsn, *keyFile)
+	if err != nil {
+		return fail(err)
+	}
+	started = append(started, repository)
+
+	series, err := stats.NewSqliteStore(*db, stats.DefaultRetention)
+	if err != nil {
+		return fail(err)
+	}
+	quotas, err := quota.NewSqliteStore(*db)
+	if err != nil {
+		return fail(err)
+	}
+	userStore, err := users.NewSqliteStore(*db)
+	if err != nil {
+		return fail(err)
+	}
+	agents, err := agent.NewSqliteStore(*db)
+	if err != nil {
+		return fail(err)
+	}
+	sites, err := site.NewSqliteStore(*db)
+	if err != nil {
+		return fail(err)
+	}
+	started = append(started, series, quotas, userStore, agents, sites)
+
+	live, err := wgctrl.New()
+	if err != nil {
+		return fail(err)
+	}
+	started = append(started, live)
+
+	client, err := wg.NewWgctrlClient()
+	if err != nil {
+		return fail(err)
+	}
+	started = append(started, client)
+
+	syncer := wgsync.NewSyncer(repository, client)
+	scheduler := expiry.NewScheduler(repository, utils.SystemClock, action)
+	scheduler.Sync = syncer.Sync
+	collector := stats.NewCollector(live, series, utils.SystemClock, *statsInterval)
+	enforcer := quota.NewEnforcer(repository, series, quotas, utils.SystemClock, *quotaInterval)
+	enforcer.Sync = syncer.Sync
+	checker := drift.NewChecker(store, client)
+
+	handler, err := api.NewHttpApi(repository,
+		api.WithBackup(store, os.Getenv(adminTokenEnv)),
+		api.WithMetadata(store),
+		api.WithDriftChecker(checker),
+		api.WithAllocator(ipam.NewAllocator(store)),
+		api.WithStats(series),
+		api.WithQuotas(enforcer),
+		api.WithAgents(agent.NewServer(repository, agents, series, utils.SystemClock)),
+		api.WithSites(sites),
+		api.WithUsers(userStore, devices),
+	)
+	if err != nil {
+		return fail(err)
+	}
+
+	syncer.Start()
+	scheduler.Start()
+	collector.Start()
+	enforcer.Start()
+	started = append(started, syncer, scheduler, collector, enforcer)
+
+	server := &http.Server{Addr: *listen, Handler: handler}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	log.Printf("server: serving on %v", *listen)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err = <-served:
+		return fail(err)
+	case s := <-signals:
+		log.Printf("server: stopping on %v", s)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err = server.Shutdown(ctx); err != nil {
+		return fail(err)
+	}
+	return 0
+}
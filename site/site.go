@@ -0,0 +1,278 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"strings"
+	"time"
+)
+
+// Site is a peer of a device that is a whole remote site, as another office: besides its address in the tunnel, the
+// prefixes of its LAN are routed to it, and it routes the prefixes of the LAN on the device's side back.
+type Site struct {
+	DeviceName string
+	PublicKey  repo.PublicKey
+	// Networks are the prefixes of the site's LAN.
+	Networks []net.IPNet
+	// LocalNetworks are the prefixes of the LAN on the device's side.
+	LocalNetworks []net.IPNet
+}
+
+// InvalidSiteError lists everything that keeps a site from being routed, so that it can all be fixed at once.
+type InvalidSiteError struct {
+	Problems []string
+}
+
+func (e *InvalidSiteError) Error() string {
+	return fmt.Sprintf("invalid site: %v", strings.Join(e.Problems, "; "))
+}
+
+// ErrNoPeer is what making a site of a peer that isn't in the repository fails with.
+var ErrNoPeer = errors.New("site: no such peer")
+
+// Manager keeps the AllowedIPs of the peers of the sites in step with their prefixes.
+type Manager struct {
+	Repo  repo.Repository
+	Store *Store
+}
+
+func overlaps(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// without gives the ips but those in others.
+func without(ips []net.IPNet, others []net.IPNet) []net.IPNet {
+	ret := make([]net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		found := false
+		for _, o := range others {
+			if ip.String() == o.String() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+func (m Manager) findPeer(deviceName string, publicKey repo.PublicKey) (repo.PeerInfo, bool, error) {
+	peers, _, err := m.Repo.ListPeersByKeys(deviceName, []repo.PublicKey{publicKey}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil || len(peers) == 0 {
+		return repo.PeerInfo{}, false, err
+	}
+	return peers[0], true, nil
+}
+
+// check gives the problems of the site: a prefix overlapping another of it, the prefixes of another site, of any device
+// since they share the routing table of the host, or the AllowedIPs of another peer of the device. tunnel are what's
+// routed to the peer of the site besides the prefixes of its LAN.
+func check(s Site, tunnel []net.IPNet, sites []Site, peers []repo.PeerInfo) (problems []string) {
+	if len(s.Networks) == 0 {
+		problems = append(problems, "the site has no network")
+	}
+
+	routed := make(map[repo.PublicKey][]net.IPNet)
+	for _, other := range sites {
+		if other.DeviceName == s.DeviceName {
+			routed[other.PublicKey] = other.Networks
+		}
+	}
+
+	for i, n := range s.Networks {
+		for _, o := range s.Networks[:i] {
+			if overlaps(n, o) {
+				problems = append(problems, fmt.Sprintf("network %v overlaps network %v", n.String(), o.String()))
+			}
+		}
+
+		for _, o := range s.LocalNetworks {
+			if overlaps(n, o) {
+				problems = append(problems, fmt.Sprintf("network %v overlaps local network %v", n.String(), o.String()))
+			}
+		}
+
+		for _, o := range tunnel {
+			if overlaps(n, o) {
+				problems = append(problems, fmt.Sprintf("network %v overlaps %v, which the peer has in the tunnel", n.String(), o.String()))
+			}
+		}
+
+		for _, other := range sites {
+			if other.DeviceName == s.DeviceName && other.PublicKey == s.PublicKey {
+				continue
+			}
+
+			for _, o := range other.Networks {
+				if overlaps(n, o) {
+					problems = append(problems, fmt.Sprintf("network %v overlaps network %v of the site %v on device %v", n.String(), o.String(), other.PublicKey, other.DeviceName))
+				}
+			}
+		}
+
+		for _, p := range peers {
+			if p.PublicKey == s.PublicKey {
+				continue
+			}
+
+			// The prefixes of another site of the device have been told of already.
+			for _, o := range without(p.AllowedIPs, routed[p.PublicKey]) {
+				if overlaps(n, o) {
+					problems = append(problems, fmt.Sprintf("network %v overlaps %v of the peer %v", n.String(), o.String(), p.PublicKey))
+				}
+			}
+		}
+	}
+	return
+}
+
+// Save makes the peer of the site a site, or changes the prefixes of one: the peer keeps what it was routed besides
+// the prefixes it had as a site, and is routed the new ones. Save fails with an *InvalidSiteError listing every
+// problem of the site.
+func (m Manager) Save(s Site) error {
+	peer, ok, err := m.findPeer(s.DeviceName, s.PublicKey)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrNoPeer
+	}
+
+	old, wasSite, err := m.Store.FindSite(s.DeviceName, s.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	sites, err := m.Store.ListSites()
+	if err != nil {
+		return err
+	}
+
+	peers, _, err := m.Repo.ListPeersByDevices([]string{s.DeviceName}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		return err
+	}
+
+	tunnel := without(peer.AllowedIPs, old.Networks)
+	if problems := check(s, tunnel, sites, peers); len(problems) > 0 {
+		return &InvalidSiteError{Problems: problems}
+	}
+
+	if err = m.Store.SaveSite(s); err != nil {
+		return err
+	}
+
+	peer.AllowedIPs = append(tunnel, s.Networks...)
+	if err = m.Repo.UpdatePeers(s.DeviceName, []repo.PeerInfo{peer}); err != nil {
+		// The peer is routed as it was, and so should the site be.
+		if wasSite {
+			_ = m.Store.SaveSite(old)
+		} else {
+			_ = m.Store.RemoveSite(s.DeviceName, s.PublicKey)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove makes the peer an ordinary one again, no longer routed the prefixes of the site.
+func (m Manager) Remove(deviceName string, publicKey repo.PublicKey) error {
+	s, ok, err := m.Store.FindSite(deviceName, publicKey)
+	if err != nil || !ok {
+		return err
+	}
+
+	peer, ok, err := m.findPeer(deviceName, publicKey)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		peer.AllowedIPs = without(peer.AllowedIPs, s.Networks)
+		if err = m.Repo.UpdatePeers(deviceName, []repo.PeerInfo{peer}); err != nil {
+			return err
+		}
+	}
+	return m.Store.RemoveSite(deviceName, publicKey)
+}
+
+// Remote is what the far end of a site needs besides what's kept of it.
+type Remote struct {
+	// PrivateKey is the site's, which is kept nowhere here, zero for the site to fill in.
+	PrivateKey wg.Key
+	// Address is the device's in the tunnel, with the length of the tunnel network.
+	Address net.IPNet
+	// Endpoint is where the site reaches the device.
+	Endpoint            *net.UDPAddr
+	ListenPort          uint16
+	PersistentKeepalive time.Duration
+}
+
+// RemoteConfig gives the device of the far end of the site. It has the site's address in the tunnel network and peers
+// with the device alone, through which it routes the tunnel network and the prefixes of the LAN on the device's side.
+// The host of the far end forwards, as the hosts of the devices do once a peer is routed a LAN.
+func (m Manager) RemoteConfig(s Site, remote Remote) (ret wg.DeviceConfig, err error) {
+	peer, ok, err := m.findPeer(s.DeviceName, s.PublicKey)
+	if err != nil {
+		return
+	} else if !ok {
+		return ret, ErrNoPeer
+	}
+
+	devices, err := m.Repo.ListDevices()
+	if err != nil {
+		return
+	}
+
+	var device *repo.DeviceInfo
+	for i := range devices {
+		if devices[i].Name == s.DeviceName {
+			device = &devices[i]
+		}
+	}
+	if device == nil {
+		return ret, fmt.Errorf("site: no device %q", s.DeviceName)
+	}
+
+	network := net.IPNet{IP: remote.Address.IP.Mask(remote.Address.Mask), Mask: remote.Address.Mask}
+	var address *net.IPNet
+	for _, ip := range without(peer.AllowedIPs, s.Networks) {
+		if network.Contains(ip.IP) {
+			address = &net.IPNet{IP: ip.IP, Mask: remote.Address.Mask}
+			break
+		}
+	}
+	if address == nil {
+		return ret, &InvalidSiteError{Problems: []string{fmt.Sprintf("the peer has no address in %v", network.String())}}
+	}
+
+	c, err := peer.ToPeerConfig()
+	if err != nil {
+		return
+	}
+
+	privateKey, err := device.PrivateKey.ToKey()
+	if err != nil {
+		return
+	}
+
+	ret = wg.DeviceConfig{
+		Name:       peer.Name,
+		PrivateKey: remote.PrivateKey,
+		ListenPort: remote.ListenPort,
+		Address:    address,
+		Peers: []wg.PeerConfig{{
+			PublicKey:           wg.Key(privateKey.PublicKey()),
+			PreSharedKey:        c.PreSharedKey,
+			Endpoint:            remote.Endpoint,
+			AllowedIPs:          append([]net.IPNet{network}, s.LocalNetworks...),
+			PersistentKeepAlive: remote.PersistentKeepalive,
+		}},
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package site
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, s ...string) []net.IPNet {
+	ret := make([]net.IPNet, 0, len(s))
+	for _, c := range s {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, *n)
+	}
+	return ret
+}
+
+func genKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+type fixture struct {
+	manager Manager
+	device  wgtypes.Key
+	// office and branch are peers of wg0, and laptop a road warrior.
+	office, branch, laptop repo.PeerInfo
+}
+
+func newFixture(t *testing.T, name string) *fixture {
+	f := &fixture{device: genKey(t)}
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0", PrivateKey: repo.NewPrivateKey(f.device)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.office = repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "office",
+		AllowedIPs: mustParseCIDRs(t, "10.0.0.2/32"), PreSharedKey: repo.NewSymmetricKey(genKey(t))}
+	f.branch = repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "branch", AllowedIPs: mustParseCIDRs(t, "10.0.0.3/32")}
+	f.laptop = repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "laptop", AllowedIPs: mustParseCIDRs(t, "10.0.0.4/32", "192.168.9.0/24")}
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{f.office, f.branch, f.laptop}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSqliteStore("file:site_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal("NewSqliteStore():", err)
+	}
+
+	f.manager = Manager{Repo: r, Store: store}
+	return f
+}
+
+func (f *fixture) allowedIPs(t *testing.T, key repo.PublicKey) string {
+	p, ok, err := f.manager.findPeer("wg0", key)
+	if err != nil || !ok {
+		t.Fatal("findPeer():", ok, err)
+	}
+	return joinIPs(p.AllowedIPs)
+}
+
+func TestManager_Save(t *testing.T) {
+	f := newFixture(t, "save")
+	defer f.manager.Store.Close()
+
+	office := Site{DeviceName: "wg0", PublicKey: f.office.PublicKey, Networks: mustParseCIDRs(t, "192.168.1.0/24", "172.16.0.0/16"),
+		LocalNetworks: mustParseCIDRs(t, "192.168.0.0/24")}
+	if err := f.manager.Save(office); err != nil {
+		t.Fatal("Save():", err)
+	}
+
+	if got := f.allowedIPs(t, f.office.PublicKey); got != "10.0.0.2/32,192.168.1.0/24,172.16.0.0/16" {
+		t.Errorf("office has AllowedIPs %v", got)
+	}
+
+	// The prefixes replace those the site had.
+	office.Networks = mustParseCIDRs(t, "192.168.1.0/24")
+	if err := f.manager.Save(office); err != nil {
+		t.Fatal("Save():", err)
+	}
+
+	if got := f.allowedIPs(t, f.office.PublicKey); got != "10.0.0.2/32,192.168.1.0/24" {
+		t.Errorf("office has AllowedIPs %v", got)
+	}
+
+	if sites, err := f.manager.Store.ListSites(); err != nil || len(sites) != 1 || !reflect.DeepEqual(sites[0], office) {
+		t.Errorf("ListSites() = %+v, %v, want the office", sites, err)
+	}
+
+	if err := f.manager.Remove("wg0", f.office.PublicKey); err != nil {
+		t.Fatal("Remove():", err)
+	}
+
+	if got := f.allowedIPs(t, f.office.PublicKey); got != "10.0.0.2/32" {
+		t.Errorf("office has AllowedIPs %v after Remove()", got)
+	}
+
+	if _, ok, err := f.manager.Store.FindSite("wg0", f.office.PublicKey); err != nil || ok {
+		t.Errorf("FindSite() = %v, %v after Remove()", ok, err)
+	}
+}
+
+func TestManager_Save_Invalid(t *testing.T) {
+	f := newFixture(t, "invalid")
+	defer f.manager.Store.Close()
+
+	if err := f.manager.Save(Site{DeviceName: "wg0", PublicKey: f.office.PublicKey, Networks: mustParseCIDRs(t, "192.168.1.0/24")}); err != nil {
+		t.Fatal("Save():", err)
+	}
+
+	err := f.manager.Save(Site{DeviceName: "wg0", PublicKey: f.branch.PublicKey,
+		Networks:      mustParseCIDRs(t, "192.168.0.0/16", "192.168.2.0/24", "10.0.0.0/24"),
+		LocalNetworks: mustParseCIDRs(t, "192.168.2.0/24")})
+	invalid, ok := err.(*InvalidSiteError)
+	if !ok {
+		t.Fatalf("Save() error = %v, want an *InvalidSiteError", err)
+	}
+
+	want := []string{
+		"network 192.168.0.0/16 overlaps local network 192.168.2.0/24",
+		"network 192.168.0.0/16 overlaps network 192.168.1.0/24 of the site " + f.office.PublicKey.String() + " on device wg0",
+		"network 192.168.0.0/16 overlaps 192.168.9.0/24 of the peer " + f.laptop.PublicKey.String(),
+		"network 192.168.2.0/24 overlaps network 192.168.0.0/16",
+		"network 192.168.2.0/24 overlaps local network 192.168.2.0/24",
+		"network 10.0.0.0/24 overlaps 10.0.0.3/32, which the peer has in the tunnel",
+		"network 10.0.0.0/24 overlaps 10.0.0.4/32 of the peer " + f.laptop.PublicKey.String(),
+		"network 10.0.0.0/24 overlaps 10.0.0.2/32 of the peer " + f.office.PublicKey.String(),
+	}
+	if len(invalid.Problems) != len(want) {
+		t.Fatalf("problems = %q, want %q", invalid.Problems, want)
+	}
+	for i, p := range want {
+		if invalid.Problems[i] != p {
+			t.Errorf("problem %d = %q, want %q", i, invalid.Problems[i], p)
+		}
+	}
+
+	if got := f.allowedIPs(t, f.branch.PublicKey); got != "10.0.0.3/32" {
+		t.Errorf("branch has AllowedIPs %v", got)
+	}
+
+	if err = f.manager.Save(Site{DeviceName: "wg0", PublicKey: f.branch.PublicKey}); err == nil || !strings.Contains(err.Error(), "the site has no network") {
+		t.Errorf("Save() of a site without networks error = %v", err)
+	}
+}
+
+func TestManager_RemoteConfig(t *testing.T) {
+	f := newFixture(t, "remote")
+	defer f.manager.Store.Close()
+
+	office := Site{DeviceName: "wg0", PublicKey: f.office.PublicKey, Networks: mustParseCIDRs(t, "192.168.1.0/24"),
+		LocalNetworks: mustParseCIDRs(t, "192.168.0.0/24")}
+	if err := f.manager.Save(office); err != nil {
+		t.Fatal("Save():", err)
+	}
+
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	config, err := f.manager.RemoteConfig(office, Remote{
+		Address:  net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+		Endpoint: endpoint,
+	})
+	if err != nil {
+		t.Fatal("RemoteConfig():", err)
+	}
+
+	psk, _ := f.office.PreSharedKey.ToKey()
+	if config.Name != "office" || config.Address.String() != "10.0.0.2/24" || len(config.Peers) != 1 {
+		t.Fatalf("RemoteConfig() = %+v", config)
+	}
+
+	p := config.Peers[0]
+	if p.PublicKey != wg.Key(f.device.PublicKey()) || p.PreSharedKey != wg.Key(psk) || p.Endpoint != endpoint ||
+		joinIPs(p.AllowedIPs) != "10.0.0.0/24,192.168.0.0/24" {
+		t.Errorf("RemoteConfig() has the device as %+v", p)
+	}
+
+	if _, err = f.manager.RemoteConfig(office, Remote{Address: net.IPNet{IP: net.ParseIP("10.9.0.1"), Mask: net.CIDRMask(24, 32)}}); err == nil {
+		t.Error("RemoteConfig() in a network the site has no address in succeeded")
+	}
+}
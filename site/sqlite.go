@@ -0,0 +1,137 @@
+package site
+
+import (
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"strings"
+)
+
+var tableMigrations = [][]string{
+	{
+		`CREATE TABLE sites(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				networks TEXT NOT NULL,
+				local_networks TEXT NOT NULL,
+				PRIMARY KEY (device_name, public_key)
+			)`,
+	},
+}
+
+// Store keeps the sites in SQLite, in tables of their own so that it can share the database of the other stores.
+type Store struct {
+	*sqlx.DB
+}
+
+type site struct {
+	DeviceName    string         `db:"device_name"`
+	PublicKey     repo.PublicKey `db:"public_key"`
+	Networks      string         `db:"networks"`
+	LocalNetworks string         `db:"local_networks"`
+}
+
+func joinIPs(ips []net.IPNet) string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return strings.Join(ret, ",")
+}
+
+// splitIPs reads the IPs joined by joinIPs, giving an empty slice rather than nil for none.
+func splitIPs(s string) ([]net.IPNet, error) {
+	ret := make([]net.IPNet, 0)
+	if len(s) == 0 {
+		return ret, nil
+	}
+
+	for _, ip := range strings.Split(s, ",") {
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *ipNet)
+	}
+	return ret, nil
+}
+
+func (s *site) UpdateFrom(o Site) {
+	s.DeviceName = o.DeviceName
+	s.PublicKey = o.PublicKey
+	s.Networks = joinIPs(o.Networks)
+	s.LocalNetworks = joinIPs(o.LocalNetworks)
+}
+
+func (s site) toSite() (ret Site, err error) {
+	ret = Site{DeviceName: s.DeviceName, PublicKey: s.PublicKey}
+	if ret.Networks, err = splitIPs(s.Networks); err != nil {
+		return
+	}
+	ret.LocalNetworks, err = splitIPs(s.LocalNetworks)
+	return
+}
+
+func NewSqliteStore(dsn string) (*Store, error) {
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{DB: db}
+	if err = schema.MigrateDB(db, "site_", tableMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// SaveSite adds the site or replaces it. It only keeps the site: Manager.Save also routes it.
+func (s *Store) SaveSite(o Site) error {
+	var row site
+	row.UpdateFrom(o)
+	_, err := s.NamedExec(`INSERT INTO sites(device_name, public_key, networks, local_networks)
+							VALUES (:device_name, :public_key, :networks, :local_networks)
+							ON CONFLICT (device_name, public_key) DO UPDATE SET
+								networks = excluded.networks,
+								local_networks = excluded.local_networks`, row)
+	return err
+}
+
+func (s *Store) RemoveSite(deviceName string, publicKey repo.PublicKey) error {
+	_, err := s.Exec("DELETE FROM sites WHERE device_name = ? AND public_key = ?", deviceName, publicKey)
+	return err
+}
+
+func (s *Store) selectSites(query string, args ...interface{}) ([]Site, error) {
+	var rows []site
+	if err := s.Select(&rows, "SELECT * FROM sites "+query+" ORDER BY device_name, public_key", args...); err != nil {
+		return nil, err
+	}
+
+	ret := make([]Site, 0, len(rows))
+	for _, row := range rows {
+		o, err := row.toSite()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, o)
+	}
+	return ret, nil
+}
+
+// ListSites lists the sites of every device, by device and public key.
+func (s *Store) ListSites() ([]Site, error) {
+	return s.selectSites("")
+}
+
+// FindSite gives the site of the peer, ok false if it isn't one.
+func (s *Store) FindSite(deviceName string, publicKey repo.PublicKey) (Site, bool, error) {
+	sites, err := s.selectSites("WHERE device_name = ? AND public_key = ?", deviceName, publicKey)
+	if err != nil || len(sites) == 0 {
+		return Site{}, false, err
+	}
+	return sites[0], true, nil
+}
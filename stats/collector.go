@@ -0,0 +1,95 @@
+package stats
+
+import (
+	"log"
+	"nz.cloudwalker/wireguard-webadmin/importer"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"time"
+)
+
+// DefaultInterval is how often the collector samples the devices unless told otherwise.
+const DefaultInterval = time.Minute
+
+// Collector samples the handshakes and traffic of the peers of the live devices into the store, and drops the points
+// past their retention as it goes.
+type Collector struct {
+	Devices  importer.DeviceLister
+	Store    *Store
+	Clock    utils.Clock
+	Interval time.Duration
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func NewCollector(devices importer.DeviceLister, store *Store, clock utils.Clock, interval time.Duration) *Collector {
+	return &Collector{
+		Devices:  devices,
+		Store:    store,
+		Clock:    clock,
+		Interval: interval,
+	}
+}
+
+// RunOnce takes a sample of every peer of every device, and returns how many it took.
+func (c *Collector) RunOnce() (int, error) {
+	devices, err := c.Devices.Devices()
+	if err != nil {
+		return 0, err
+	}
+
+	var samples []Sample
+	for _, d := range devices {
+		for _, p := range d.Peers {
+			sample := Sample{
+				DeviceName: d.Name,
+				PublicKey:  repo.NewPublicKey(p.PublicKey),
+				RxBytes:    uint64(p.ReceiveBytes),
+				TxBytes:    uint64(p.TransmitBytes),
+			}
+			if !p.LastHandshakeTime.IsZero() {
+				sample.LastHandshake = p.LastHandshakeTime.Unix()
+			}
+			samples = append(samples, sample)
+		}
+	}
+
+	now := c.Clock.Now()
+	if err = c.Store.Record(now, samples); err != nil {
+		return 0, err
+	}
+	return len(samples), c.Store.Prune(now)
+}
+
+func (c *Collector) run() {
+	defer close(c.done)
+
+	for {
+		if _, err := c.RunOnce(); err != nil {
+			log.Printf("stats: unable to sample the devices: %v", err)
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-c.Clock.After(c.Interval):
+		}
+	}
+}
+
+// Start runs the collector in the background until Close.
+func (c *Collector) Start() {
+	c.stop = make(chan interface{})
+	c.done = make(chan interface{})
+	go c.run()
+}
+
+func (c *Collector) Close() error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	return nil
+}
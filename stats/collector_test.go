@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeDevices []*wgtypes.Device
+
+func (f fakeDevices) Devices() ([]*wgtypes.Device, error) {
+	return f, nil
+}
+
+func TestCollector_RunOnce(t *testing.T) {
+	store := newStore(t, "collector", DefaultRetention)
+	defer store.Close()
+
+	handshake := start.Add(-time.Minute)
+	alice := &wgtypes.Peer{PublicKey: newKey("alice"), LastHandshakeTime: handshake, ReceiveBytes: 100, TransmitBytes: 10}
+	bob := &wgtypes.Peer{PublicKey: newKey("bob")}
+	devices := fakeDevices{
+		{Name: "wg0", Peers: []wgtypes.Peer{*alice}},
+		{Name: "wg1", Peers: []wgtypes.Peer{*bob}},
+	}
+
+	clock := utils.NewManualClock(start)
+	collector := NewCollector(devices, store, clock, DefaultInterval)
+
+	if n, err := collector.RunOnce(); err != nil || n != 2 {
+		t.Fatalf("RunOnce() = %v, %v, want 2 samples", n, err)
+	}
+
+	clock.Advance(DefaultInterval)
+	devices[0].Peers[0].ReceiveBytes = 300
+	devices[0].Peers[0].TransmitBytes = 30
+
+	if _, err := collector.RunOnce(); err != nil {
+		t.Fatal("RunOnce():", err)
+	}
+
+	want := []Point{
+		{Time: start.Unix(), LastHandshake: handshake.Unix()},
+		{Time: start.Add(DefaultInterval).Unix(), LastHandshake: handshake.Unix(), RxBytes: 200, TxBytes: 20},
+	}
+	checkSeries(t, store, Query{DeviceName: "wg0", PublicKey: repo.NewPublicKey(alice.PublicKey), Resolution: Raw, From: start}, want)
+
+	// A peer that never had a handshake has none in its points.
+	want = []Point{{Time: start.Unix()}, {Time: start.Add(DefaultInterval).Unix()}}
+	checkSeries(t, store, Query{DeviceName: "wg1", Resolution: Raw, From: start}, want)
+}
+
+func TestCollector_Start(t *testing.T) {
+	store := newStore(t, "start", DefaultRetention)
+	defer store.Close()
+
+	devices := fakeDevices{{Name: "wg0", Peers: []wgtypes.Peer{{PublicKey: newKey("alice")}}}}
+	clock := utils.NewManualClock(start)
+	collector := NewCollector(devices, store, clock, DefaultInterval)
+
+	collector.Start()
+	defer collector.Close()
+
+	// Each interval takes a sample, once the collector waits for the next one.
+	for i := 1; i <= 3; i++ {
+		waitFor(t, func() bool { return clock.Waiters() == 1 })
+		if i < 3 {
+			clock.Advance(DefaultInterval)
+		}
+	}
+
+	points, err := store.Series(Query{DeviceName: "wg0", Resolution: Raw, From: start})
+	if err != nil {
+		t.Fatal("Series():", err)
+	}
+
+	var times []int64
+	for _, p := range points {
+		times = append(times, p.Time)
+	}
+
+	want := []int64{start.Unix(), start.Add(DefaultInterval).Unix(), start.Add(2 * DefaultInterval).Unix()}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("sampled at %v, want %v", times, want)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"time"
+)
+
+var tableMigrations = [][]string{
+	{
+		// stats_counters has the totals of the last sample of each peer, to take the traffic of the next one from.
+		`CREATE TABLE stats_counters(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL,
+				time INTEGER NOT NULL,
+				PRIMARY KEY (device_name, public_key)
+			)`,
+
+		`CREATE TABLE stats_raw(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				time INTEGER NOT NULL,
+				last_handshake INTEGER NOT NULL,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL,
+				PRIMARY KEY (device_name, public_key, time)
+			)`,
+
+		`CREATE TABLE stats_hourly(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				time INTEGER NOT NULL,
+				last_handshake INTEGER NOT NULL,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL,
+				PRIMARY KEY (device_name, public_key, time)
+			)`,
+
+		`CREATE TABLE stats_daily(
+				device_name TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				time INTEGER NOT NULL,
+				last_handshake INTEGER NOT NULL,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL,
+				PRIMARY KEY (device_name, public_key, time)
+			)`,
+
+		`CREATE INDEX stats_raw_time ON stats_raw(time)`,
+		`CREATE INDEX stats_hourly_time ON stats_hourly(time)`,
+		`CREATE INDEX stats_daily_time ON stats_daily(time)`,
+	},
+}
+
+// seriesTables are the tables holding the points, by resolution.
+var seriesTables = map[Resolution]string{Raw: "stats_raw", Hourly: "stats_hourly", Daily: "stats_daily"}
+
+// Store keeps the series in SQLite, in tables of their own so that it can share the database of the other stores.
+type Store struct {
+	*sqlx.DB
+	Retention Retention
+}
+
+type counters struct {
+	RxBytes uint64 `db:"rx_bytes"`
+	TxBytes uint64 `db:"tx_bytes"`
+}
+
+// delta is the traffic since the previous totals. Totals lower than before mean the counters started over, as they do
+// when the device restarts, so all of them are new.
+func delta(previous, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+func NewSqliteStore(dsn string, retention Retention) (*Store, error) {
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{DB: db, Retention: retention}
+	if err = schema.MigrateDB(db, "stats_", tableMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *Store) inTx(f func(tx *sqlx.Tx) error) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = f(tx)
+	return
+}
+
+// Record adds the samples taken at the time to the series. The traffic of a peer is what its totals grew by since its
+// previous sample, so the first sample of a peer only sets where it starts from.
+func (s *Store) Record(at time.Time, samples []Sample) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		for _, sample := range samples {
+			var previous counters
+			err := tx.Get(&previous, "SELECT rx_bytes, tx_bytes FROM stats_counters WHERE device_name = ? AND public_key = ?",
+				sample.DeviceName, sample.PublicKey)
+			seen := err == nil
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+
+			if _, err = tx.Exec("INSERT OR REPLACE INTO stats_counters(device_name, public_key, rx_bytes, tx_bytes, time) VALUES (?, ?, ?, ?, ?)",
+				sample.DeviceName, sample.PublicKey, sample.RxBytes, sample.TxBytes, at.Unix()); err != nil {
+				return err
+			}
+
+			point := Point{LastHandshake: sample.LastHandshake}
+			if seen {
+				point.RxBytes = delta(previous.RxBytes, sample.RxBytes)
+				point.TxBytes = delta(previous.TxBytes, sample.TxBytes)
+			}
+
+			for _, resolution := range []Resolution{Raw, Hourly, Daily} {
+				point.Time = bucket(resolution, at)
+				if err = addPoint(tx, seriesTables[resolution], sample, point); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// addPoint adds the traffic of the point to the one of its period, keeping the latest handshake.
+func addPoint(tx *sqlx.Tx, table string, sample Sample, point Point) error {
+	_, err := tx.Exec(`INSERT INTO `+table+`(device_name, public_key, time, last_handshake, rx_bytes, tx_bytes)
+						VALUES (?, ?, ?, ?, ?, ?)
+						ON CONFLICT (device_name, public_key, time) DO UPDATE SET
+							last_handshake = MAX(last_handshake, excluded.last_handshake),
+							rx_bytes = rx_bytes + excluded.rx_bytes,
+							tx_bytes = tx_bytes + excluded.tx_bytes`,
+		sample.DeviceName, sample.PublicKey, point.Time, point.LastHandshake, point.RxBytes, point.TxBytes)
+	return err
+}
+
+// Prune drops the points older than the retention of their resolution, and the totals of the peers that haven't had
+// a sample in as long as the raw points are kept.
+func (s *Store) Prune(now time.Time) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		for resolution, table := range seriesTables {
+			if kept := s.Retention.For(resolution); kept > 0 {
+				if _, err := tx.Exec("DELETE FROM "+table+" WHERE time < ?", now.Add(-kept).Unix()); err != nil {
+					return err
+				}
+			}
+		}
+
+		if s.Retention.Raw > 0 {
+			if _, err := tx.Exec("DELETE FROM stats_counters WHERE time < ?", now.Add(-s.Retention.Raw).Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Series gives the points of the query in time order. The points of a device add up the traffic of its peers and
+// have the latest handshake of any of them.
+func (s *Store) Series(q Query) (ret []Point, err error) {
+	table, ok := seriesTables[q.Resolution]
+	if !ok {
+		return nil, fmt.Errorf("stats: unknown resolution %q", q.Resolution)
+	}
+
+	query := "SELECT time, MAX(last_handshake) AS last_handshake, SUM(rx_bytes) AS rx_bytes, SUM(tx_bytes) AS tx_bytes FROM " +
+		table + " WHERE device_name = ? AND time >= ?"
+	args := []interface{}{q.DeviceName, bucket(q.Resolution, q.From)}
+
+	if len(q.PublicKey.String()) > 0 {
+		query += " AND public_key = ?"
+		args = append(args, q.PublicKey)
+	}
+
+	if !q.To.IsZero() {
+		query += " AND time < ?"
+		args = append(args, q.To.Unix())
+	}
+
+	err = s.Select(&ret, query+" GROUP BY time ORDER BY time", args...)
+	return
+}
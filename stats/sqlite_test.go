@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"crypto/sha256"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+func newKey(name string) wgtypes.Key {
+	return wgtypes.Key(sha256.Sum256([]byte(name)))
+}
+
+func newStore(t *testing.T, name string, retention Retention) *Store {
+	store, err := NewSqliteStore("file:stats_"+name+"?cache=shared&mode=memory", retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func record(t *testing.T, store *Store, at time.Time, samples ...Sample) {
+	if err := store.Record(at, samples); err != nil {
+		t.Fatal("Record():", err)
+	}
+}
+
+func checkSeries(t *testing.T, store *Store, q Query, want []Point) {
+	t.Helper()
+	if got, err := store.Series(q); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Series(%v %v) = %v, %v, want %v", q.Resolution, q.PublicKey, got, err, want)
+	}
+}
+
+func TestStore_Series(t *testing.T) {
+	store := newStore(t, "series", Retention{})
+	defer store.Close()
+
+	alice, bob := repo.NewPublicKey(newKey("alice")), repo.NewPublicKey(newKey("bob"))
+	handshake := start.Unix() - 10
+
+	// The first sample only sets where the totals start from, and the totals of bob start over at 50 minutes.
+	samples := [][2]Sample{
+		{{RxBytes: 1000, TxBytes: 100}, {RxBytes: 500}},
+		{{RxBytes: 1200, TxBytes: 150, LastHandshake: handshake}, {RxBytes: 600}},
+		{{RxBytes: 1300, TxBytes: 150, LastHandshake: handshake}, {RxBytes: 20}},
+		{{RxBytes: 1700, TxBytes: 250, LastHandshake: handshake + 3600}, {RxBytes: 30}},
+	}
+	at := []time.Time{start, start.Add(10 * time.Minute), start.Add(50 * time.Minute), start.Add(time.Hour)}
+	for i, s := range samples {
+		s[0].DeviceName, s[0].PublicKey = "wg0", alice
+		s[1].DeviceName, s[1].PublicKey = "wg0", bob
+		record(t, store, at[i], s[0], s[1])
+	}
+
+	unix := func(t time.Time) int64 { return t.Unix() }
+
+	checkSeries(t, store, Query{DeviceName: "wg0", PublicKey: alice, Resolution: Raw, From: start}, []Point{
+		{Time: unix(at[0])},
+		{Time: unix(at[1]), LastHandshake: handshake, RxBytes: 200, TxBytes: 50},
+		{Time: unix(at[2]), LastHandshake: handshake, RxBytes: 100},
+		{Time: unix(at[3]), LastHandshake: handshake + 3600, RxBytes: 400, TxBytes: 100},
+	})
+
+	checkSeries(t, store, Query{DeviceName: "wg0", PublicKey: bob, Resolution: Raw, From: at[1], To: at[3]}, []Point{
+		{Time: unix(at[1]), RxBytes: 100},
+		{Time: unix(at[2]), RxBytes: 20},
+	})
+
+	checkSeries(t, store, Query{DeviceName: "wg0", PublicKey: alice, Resolution: Hourly, From: start.Add(30 * time.Minute)}, []Point{
+		{Time: unix(start), LastHandshake: handshake, RxBytes: 300, TxBytes: 50},
+		{Time: unix(start.Add(time.Hour)), LastHandshake: handshake + 3600, RxBytes: 400, TxBytes: 100},
+	})
+
+	checkSeries(t, store, Query{DeviceName: "wg0", Resolution: Daily, From: start}, []Point{
+		{Time: unix(start), LastHandshake: handshake + 3600, RxBytes: 830, TxBytes: 150},
+	})
+
+	checkSeries(t, store, Query{DeviceName: "wg1", Resolution: Daily, From: start}, nil)
+
+	if _, err := store.Series(Query{DeviceName: "wg0", Resolution: "weekly"}); err == nil {
+		t.Error("Series() of an unknown resolution succeeded")
+	}
+}
+
+func TestStore_Prune(t *testing.T) {
+	retention := Retention{Raw: time.Hour, Hourly: 24 * time.Hour}
+	store := newStore(t, "prune", retention)
+	defer store.Close()
+
+	alice := Sample{DeviceName: "wg0", PublicKey: repo.NewPublicKey(newKey("alice"))}
+	for i := 0; i < 4; i++ {
+		alice.RxBytes += 100
+		record(t, store, start.Add(time.Duration(i)*12*time.Hour), alice)
+	}
+
+	now := start.Add(36 * time.Hour)
+	if err := store.Prune(now); err != nil {
+		t.Fatal("Prune():", err)
+	}
+
+	q := Query{DeviceName: "wg0", PublicKey: alice.PublicKey, From: start}
+	for _, tt := range []struct {
+		resolution Resolution
+		want       []Point
+	}{
+		{resolution: Raw, want: []Point{{Time: now.Unix(), RxBytes: 100}}},
+		{resolution: Hourly, want: []Point{
+			{Time: now.Add(-24 * time.Hour).Unix(), RxBytes: 100},
+			{Time: now.Add(-12 * time.Hour).Unix(), RxBytes: 100},
+			{Time: now.Unix(), RxBytes: 100},
+		}},
+		{resolution: Daily, want: []Point{{Time: start.Unix(), RxBytes: 100}, {Time: start.Add(24 * time.Hour).Unix(), RxBytes: 200}}},
+	} {
+		q.Resolution = tt.resolution
+		checkSeries(t, store, q, tt.want)
+	}
+
+	// Once its totals are dropped, a peer starts over as if it were new.
+	if err := store.Prune(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal("Prune():", err)
+	}
+
+	alice.RxBytes += 100
+	record(t, store, now.Add(2*time.Hour), alice)
+
+	q.Resolution = Raw
+	checkSeries(t, store, q, []Point{{Time: now.Add(2 * time.Hour).Unix()}})
+}
+
+func TestRetention_ResolutionFor(t *testing.T) {
+	now := start
+	tests := []struct {
+		name      string
+		retention Retention
+		from      time.Time
+		want      Resolution
+	}{
+		{name: "raw", retention: DefaultRetention, from: now.Add(-time.Hour), want: Raw},
+		{name: "hourly", retention: DefaultRetention, from: now.Add(-7 * 24 * time.Hour), want: Hourly},
+		{name: "daily", retention: DefaultRetention, from: now.Add(-365 * 24 * time.Hour), want: Daily},
+		{name: "raw kept forever", retention: Retention{}, from: now.Add(-365 * 24 * time.Hour), want: Raw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retention.ResolutionFor(now, tt.from); got != tt.want {
+				t.Errorf("ResolutionFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
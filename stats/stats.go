@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"time"
+)
+
+// Resolution is how far apart the points of a series are.
+type Resolution string
+
+const (
+	// Raw has a point for every sample the collector took.
+	Raw    Resolution = "raw"
+	Hourly Resolution = "hourly"
+	Daily  Resolution = "daily"
+)
+
+// Retention is how long the points of each resolution are kept. Zero keeps them forever.
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+}
+
+// DefaultRetention keeps two days of samples, two months of hours and two years of days.
+var DefaultRetention = Retention{
+	Raw:    48 * time.Hour,
+	Hourly: 60 * 24 * time.Hour,
+	Daily:  2 * 365 * 24 * time.Hour,
+}
+
+// For gives how long the points of the resolution are kept.
+func (r Retention) For(resolution Resolution) time.Duration {
+	switch resolution {
+	case Raw:
+		return r.Raw
+	case Hourly:
+		return r.Hourly
+	default:
+		return r.Daily
+	}
+}
+
+// ResolutionFor picks the finest resolution still kept as far back as from.
+func (r Retention) ResolutionFor(now, from time.Time) Resolution {
+	for _, resolution := range []Resolution{Raw, Hourly} {
+		if kept := r.For(resolution); kept == 0 || !from.Before(now.Add(-kept)) {
+			return resolution
+		}
+	}
+	return Daily
+}
+
+// Sample is what a peer's counters were when the collector looked at the device. The bytes are the totals the device
+// counted since the peer was added, or since it restarted.
+type Sample struct {
+	DeviceName    string
+	PublicKey     repo.PublicKey
+	LastHandshake int64
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// Point is the traffic moved in the period starting at Time, and the last handshake within it, both in unix seconds.
+// LastHandshake is 0 if the peer has never had one.
+type Point struct {
+	Time          int64  `db:"time"`
+	LastHandshake int64  `db:"last_handshake"`
+	RxBytes       uint64 `db:"rx_bytes"`
+	TxBytes       uint64 `db:"tx_bytes"`
+}
+
+// Query selects the series of a peer or, without a PublicKey, the sum over the peers of a device. From is inclusive
+// and To exclusive; a zero To has no end.
+type Query struct {
+	DeviceName string
+	PublicKey  repo.PublicKey
+	Resolution Resolution
+	From       time.Time
+	To         time.Time
+}
+
+// bucket gives the start of the period of the resolution the time falls in.
+func bucket(resolution Resolution, t time.Time) int64 {
+	switch resolution {
+	case Hourly:
+		return t.Truncate(time.Hour).Unix()
+	case Daily:
+		t = t.UTC()
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	default:
+		return t.Unix()
+	}
+}
@@ -0,0 +1,286 @@
+package topology
+
+import (
+	"fmt"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	// HubAndSpoke links every node to the hub only, which routes between them.
+	HubAndSpoke Kind = "hub_and_spoke"
+	// FullMesh links every node to every other.
+	FullMesh Kind = "full_mesh"
+	// PartialMesh links the nodes of the links only.
+	PartialMesh Kind = "partial_mesh"
+)
+
+// DefaultKeepalive is the keepalive of the nodes behind NAT unless told otherwise.
+const DefaultKeepalive = 25 * time.Second
+
+// Node is a machine of the network.
+type Node struct {
+	Name string
+	// PrivateKey is generated when it's zero.
+	PrivateKey wg.Key
+	// Address is the node's on the network, the next free one when it's nil.
+	Address net.IP
+	// Endpoint is where the other nodes reach the node, nil if they can't, as when it's behind NAT and only dials out.
+	Endpoint   *net.UDPAddr
+	ListenPort uint16
+	// NATed nodes keep their tunnels open with keepalives.
+	NATed bool
+	// Networks are routed to the node besides its address, as the LAN of a site.
+	Networks []net.IPNet
+}
+
+// Link is two nodes of a partial mesh that peer with each other.
+type Link struct {
+	A string
+	B string
+}
+
+// Network describes the nodes and how they're linked.
+type Network struct {
+	Kind Kind
+	// Network is where the nodes have their address, as 10.0.0.0/24.
+	Network net.IPNet
+	Nodes   []Node
+	// Hub is the node every other links to in a hub and spoke.
+	Hub string
+	// Links are the pairs of nodes linked in a partial mesh.
+	Links []Link
+	// Keepalive is the keepalive of the NATed nodes, DefaultKeepalive when it's zero.
+	Keepalive time.Duration
+}
+
+// InvalidNetworkError lists everything wrong with a network, so that it can all be fixed at once.
+type InvalidNetworkError struct {
+	Problems []string
+}
+
+func (e *InvalidNetworkError) Error() string {
+	return fmt.Sprintf("invalid network: %v", strings.Join(e.Problems, "; "))
+}
+
+// generator builds the devices of the nodes, noting the problems as it goes.
+type generator struct {
+	network Network
+	// all are the nodes in their order, and nodes the same by name.
+	all      []Node
+	nodes    map[string]*Node
+	problems []string
+}
+
+func (g *generator) problem(format string, args ...interface{}) {
+	g.problems = append(g.problems, fmt.Sprintf(format, args...))
+}
+
+func overlaps(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// routes are what a node is routed: its address and its networks.
+func routes(n *Node) []net.IPNet {
+	return append([]net.IPNet{ipam.HostNet(n.Address)}, n.Networks...)
+}
+
+// checkNodes checks the names and addresses of the nodes, handing out the next free address to those without one.
+func (g *generator) checkNodes() {
+	nodes := g.all
+	pool := ipam.NewPool(&g.network.Network)
+	for i := range nodes {
+		n := &nodes[i]
+		if len(n.Name) == 0 {
+			g.problem("node %v has no name", i+1)
+			continue
+		}
+
+		if _, ok := g.nodes[n.Name]; ok {
+			g.problem("node %v is there twice", n.Name)
+			continue
+		}
+		g.nodes[n.Name] = n
+
+		if n.Address == nil {
+			continue
+		}
+
+		if len(g.network.Network.Mask) == net.IPv4len && n.Address.To4() != nil {
+			n.Address = n.Address.To4()
+		}
+
+		if !ipam.IsHost(&g.network.Network, n.Address) {
+			g.problem("node %v has address %v, which isn't a host of %v", n.Name, n.Address, g.network.Network.String())
+		} else if pool.Contains(n.Address) {
+			g.problem("node %v has address %v, which another node has", n.Name, n.Address)
+		}
+		pool.Add(n.Address)
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if n.Address != nil || g.nodes[n.Name] != n {
+			continue
+		}
+
+		var err error
+		if n.Address, err = pool.Next(); err != nil {
+			g.problem("unable to give node %v an address: %v", n.Name, err)
+		}
+	}
+}
+
+// checkNetworks makes sure what's routed to a node is routed to no other, so that the AllowedIPs never overlap.
+func (g *generator) checkNetworks() {
+	nodes := g.all
+	for i := range nodes {
+		for _, network := range nodes[i].Networks {
+			if overlaps(network, g.network.Network) {
+				g.problem("node %v routes %v, which overlaps the network", nodes[i].Name, network.String())
+			}
+
+			for j := 0; j < i; j++ {
+				for _, other := range nodes[j].Networks {
+					if overlaps(network, other) {
+						g.problem("node %v routes %v, which overlaps %v of node %v", nodes[i].Name, network.String(), other.String(), nodes[j].Name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// links gives the pairs of nodes that peer with each other, each once.
+func (g *generator) links() (ret []Link) {
+	nodes := g.all
+	switch g.network.Kind {
+	case HubAndSpoke:
+		if _, ok := g.nodes[g.network.Hub]; !ok {
+			g.problem("there is no hub %q", g.network.Hub)
+			return
+		}
+
+		for _, n := range nodes {
+			if n.Name != g.network.Hub {
+				ret = append(ret, Link{A: g.network.Hub, B: n.Name})
+			}
+		}
+	case FullMesh:
+		for i := range nodes {
+			for j := i + 1; j < len(nodes); j++ {
+				ret = append(ret, Link{A: nodes[i].Name, B: nodes[j].Name})
+			}
+		}
+	case PartialMesh:
+		seen := make(map[Link]bool, len(g.network.Links))
+		for _, l := range g.network.Links {
+			if _, ok := g.nodes[l.A]; !ok {
+				g.problem("link %v-%v has no node %q", l.A, l.B, l.A)
+			} else if _, ok := g.nodes[l.B]; !ok {
+				g.problem("link %v-%v has no node %q", l.A, l.B, l.B)
+			} else if l.A == l.B {
+				g.problem("link %v-%v links the node to itself", l.A, l.B)
+			} else if seen[l] || seen[Link{A: l.B, B: l.A}] {
+				g.problem("link %v-%v is there twice", l.A, l.B)
+			} else {
+				seen[l] = true
+				ret = append(ret, l)
+			}
+		}
+	default:
+		g.problem("unknown kind %q", g.network.Kind)
+	}
+	return
+}
+
+// peer gives the entry of the device of from for to.
+func (g *generator) peer(from *Node, to *Node, psk wg.Key) wg.PeerConfig {
+	ret := wg.PeerConfig{
+		PublicKey:    to.PrivateKey.ToPublicKey(),
+		PreSharedKey: psk,
+		Endpoint:     to.Endpoint,
+		AllowedIPs:   routes(to),
+	}
+
+	// The spokes reach each other through the hub.
+	if g.network.Kind == HubAndSpoke && to.Name == g.network.Hub {
+		ret.AllowedIPs = append([]net.IPNet{g.network.Network}, to.Networks...)
+		for i := range g.all {
+			if n := &g.all[i]; n != from && n != to {
+				ret.AllowedIPs = append(ret.AllowedIPs, n.Networks...)
+			}
+		}
+	}
+
+	if from.NATed {
+		ret.PersistentKeepAlive = g.network.Keepalive
+	}
+	return ret
+}
+
+// Generate gives the device of every node, in the order of the nodes, with a peer for every node it's linked to. The
+// nodes without a key get a new one, and every link a pre-shared key of its own. Generate fails with an
+// *InvalidNetworkError listing every problem of the network.
+func Generate(network Network) ([]wg.DeviceConfig, error) {
+	if network.Keepalive == 0 {
+		network.Keepalive = DefaultKeepalive
+	}
+	network.Network.IP = network.Network.IP.Mask(network.Network.Mask)
+
+	nodes := append([]Node(nil), network.Nodes...)
+	g := &generator{network: network, all: nodes, nodes: make(map[string]*Node, len(nodes))}
+	g.checkNodes()
+	g.checkNetworks()
+	links := g.links()
+
+	for _, l := range links {
+		if a, b := g.nodes[l.A], g.nodes[l.B]; a.Endpoint == nil && b.Endpoint == nil {
+			g.problem("neither %v nor %v has an endpoint the other can reach", l.A, l.B)
+		}
+	}
+
+	if len(g.problems) > 0 {
+		return nil, &InvalidNetworkError{Problems: g.problems}
+	}
+
+	for i := range nodes {
+		if nodes[i].PrivateKey.IsZero() {
+			k, err := wg.NewRandom()
+			if err != nil {
+				return nil, err
+			}
+			nodes[i].PrivateKey = k
+		}
+	}
+
+	peers := make(map[string][]wg.PeerConfig, len(nodes))
+	for _, l := range links {
+		psk, err := wg.NewRandom()
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := g.nodes[l.A], g.nodes[l.B]
+		peers[a.Name] = append(peers[a.Name], g.peer(a, b, psk))
+		peers[b.Name] = append(peers[b.Name], g.peer(b, a, psk))
+	}
+
+	ret := make([]wg.DeviceConfig, 0, len(nodes))
+	for _, n := range nodes {
+		address := net.IPNet{IP: n.Address, Mask: network.Network.Mask}
+		ret = append(ret, wg.DeviceConfig{
+			Name:       n.Name,
+			PrivateKey: n.PrivateKey,
+			Peers:      peers[n.Name],
+			ListenPort: n.ListenPort,
+			Address:    &address,
+		})
+	}
+	return ret, nil
+}
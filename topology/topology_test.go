@@ -0,0 +1,188 @@
+package topology
+
+import (
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func mustResolve(t *testing.T, s string) *net.UDPAddr {
+	a, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func allowedIPs(p wg.PeerConfig) (ret []string) {
+	for _, ip := range p.AllowedIPs {
+		ret = append(ret, ip.String())
+	}
+	return
+}
+
+// checkDevices makes sure that every peer of a device is another device, holding the same pre-shared key, and that
+// the AllowedIPs of the peers of a device never overlap.
+func checkDevices(t *testing.T, devices []wg.DeviceConfig) map[string]wg.DeviceConfig {
+	t.Helper()
+	byKey := make(map[wg.Key]wg.DeviceConfig, len(devices))
+	byName := make(map[string]wg.DeviceConfig, len(devices))
+	for _, d := range devices {
+		byKey[d.PrivateKey.ToPublicKey()] = d
+		byName[d.Name] = d
+	}
+
+	for _, d := range devices {
+		var routed []net.IPNet
+		for _, p := range d.Peers {
+			other, ok := byKey[p.PublicKey]
+			if !ok {
+				t.Errorf("%v has a peer that's no device", d.Name)
+				continue
+			}
+
+			back := false
+			for _, op := range other.Peers {
+				if op.PublicKey == d.PrivateKey.ToPublicKey() {
+					back = op.PreSharedKey == p.PreSharedKey && !p.PreSharedKey.IsZero()
+				}
+			}
+			if !back {
+				t.Errorf("%v and %v don't share a pre-shared key", d.Name, other.Name)
+			}
+
+			for _, ip := range p.AllowedIPs {
+				for _, r := range routed {
+					if overlaps(ip, r) {
+						t.Errorf("%v routes %v to %v, which overlaps %v", d.Name, ip.String(), other.Name, r.String())
+					}
+				}
+			}
+			routed = append(routed, p.AllowedIPs...)
+		}
+	}
+	return byName
+}
+
+func TestGenerate_FullMesh(t *testing.T) {
+	devices, err := Generate(Network{
+		Kind:    FullMesh,
+		Network: mustParseCIDR(t, "10.0.0.0/24"),
+		Nodes: []Node{
+			{Name: "a", Endpoint: mustResolve(t, "192.0.2.1:51820"), ListenPort: 51820},
+			{Name: "b", Address: net.ParseIP("10.0.0.1"), Endpoint: mustResolve(t, "192.0.2.2:51820"), Networks: []net.IPNet{mustParseCIDR(t, "192.168.2.0/24")}},
+			{Name: "c", NATed: true},
+		},
+	})
+	if err != nil {
+		t.Fatal("Generate():", err)
+	}
+
+	byName := checkDevices(t, devices)
+	if len(devices) != 3 || devices[0].Name != "a" || len(byName["a"].Peers) != 2 || len(byName["c"].Peers) != 2 {
+		t.Fatalf("Generate() = %v, want a, b and c each with 2 peers", devices)
+	}
+
+	// b keeps its address, and a and c get the next ones.
+	for name, want := range map[string]string{"a": "10.0.0.2/24", "b": "10.0.0.1/24", "c": "10.0.0.3/24"} {
+		if got := byName[name].Address.String(); got != want {
+			t.Errorf("%v has address %v, want %v", name, got, want)
+		}
+	}
+
+	a := byName["a"]
+	if ips := allowedIPs(a.Peers[0]); !reflect.DeepEqual(ips, []string{"10.0.0.1/32", "192.168.2.0/24"}) ||
+		a.Peers[0].Endpoint.String() != "192.0.2.2:51820" || a.Peers[0].PersistentKeepAlive != 0 {
+		t.Errorf("a has b as %+v", a.Peers[0])
+	}
+
+	// c is behind NAT: it keeps its tunnels open, and the others can't reach it first.
+	for _, p := range byName["c"].Peers {
+		if p.PersistentKeepAlive != DefaultKeepalive {
+			t.Errorf("c has keepalive %v, want %v", p.PersistentKeepAlive, DefaultKeepalive)
+		}
+	}
+	if a.Peers[1].Endpoint != nil {
+		t.Errorf("a has c at %v", a.Peers[1].Endpoint)
+	}
+}
+
+func TestGenerate_HubAndSpoke(t *testing.T) {
+	devices, err := Generate(Network{
+		Kind:      HubAndSpoke,
+		Network:   mustParseCIDR(t, "10.0.0.0/24"),
+		Hub:       "hub",
+		Keepalive: 10 * time.Second,
+		Nodes: []Node{
+			{Name: "hub", Endpoint: mustResolve(t, "192.0.2.1:51820")},
+			{Name: "office", NATed: true, Networks: []net.IPNet{mustParseCIDR(t, "192.168.1.0/24")}},
+			{Name: "laptop", NATed: true},
+		},
+	})
+	if err != nil {
+		t.Fatal("Generate():", err)
+	}
+
+	byName := checkDevices(t, devices)
+	if hub := byName["hub"]; len(hub.Peers) != 2 || !reflect.DeepEqual(allowedIPs(hub.Peers[0]), []string{"10.0.0.2/32", "192.168.1.0/24"}) {
+		t.Errorf("hub has peers %+v", hub.Peers)
+	}
+
+	// The laptop reaches the office through the hub.
+	laptop := byName["laptop"]
+	if len(laptop.Peers) != 1 || !reflect.DeepEqual(allowedIPs(laptop.Peers[0]), []string{"10.0.0.0/24", "192.168.1.0/24"}) ||
+		laptop.Peers[0].PersistentKeepAlive != 10*time.Second {
+		t.Errorf("laptop has peers %+v", laptop.Peers)
+	}
+}
+
+func TestGenerate_Invalid(t *testing.T) {
+	_, err := Generate(Network{
+		Kind:    PartialMesh,
+		Network: mustParseCIDR(t, "10.0.0.0/30"),
+		Nodes: []Node{
+			{Name: "a", Address: net.ParseIP("10.0.0.1"), Networks: []net.IPNet{mustParseCIDR(t, "10.0.0.0/16")}},
+			{Name: "b", Address: net.ParseIP("10.0.0.1")},
+			{Name: "a"},
+			{Name: "c"},
+			{Name: "d"},
+		},
+		Links: []Link{{A: "a", B: "b"}, {A: "b", B: "a"}, {A: "a", B: "x"}, {A: "c", B: "c"}},
+	})
+
+	invalid, ok := err.(*InvalidNetworkError)
+	if !ok {
+		t.Fatalf("Generate() error = %v, want an *InvalidNetworkError", err)
+	}
+
+	want := []string{
+		"node b has address 10.0.0.1, which another node has",
+		"node a is there twice",
+		"unable to give node d an address",
+		"node a routes 10.0.0.0/16, which overlaps the network",
+		"link b-a is there twice",
+		`link a-x has no node "x"`,
+		"link c-c links the node to itself",
+		"neither a nor b has an endpoint the other can reach",
+	}
+	if len(invalid.Problems) != len(want) {
+		t.Fatalf("problems = %q, want %d of them", invalid.Problems, len(want))
+	}
+
+	for i, p := range invalid.Problems {
+		if !strings.HasPrefix(p, want[i]) {
+			t.Errorf("problem %d = %q, want it to start with %q", i, p, want[i])
+		}
+	}
+}
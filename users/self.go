@@ -0,0 +1,207 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/persistent"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"strings"
+	"time"
+)
+
+// Device is a device members add their peers to.
+type Device struct {
+	// Network is the device's own address, with the length of the network its peers get theirs from, as 10.0.0.1/24.
+	Network net.IPNet
+	// Endpoint is where the peers reach the device, as vpn.example.com:51820.
+	Endpoint string
+}
+
+// ErrNoDevice is what adding a peer to a device members can't add peers to fails with.
+var ErrNoDevice = errors.New("users: peers can't be added to the device")
+
+// Self is what a user does to the peers they own, through the repository of their requests. The peers of others
+// are as good as missing.
+type Self struct {
+	Repo repo.Repository
+	User User
+	// Devices are those the user may add peers to, by name.
+	Devices map[string]Device
+	// Allocator hands out the addresses of the peers the user adds.
+	Allocator *ipam.Allocator
+}
+
+// Created is a peer its owner added, with the private key generated for it, empty if the owner gave the public key.
+// The private key is kept nowhere.
+type Created struct {
+	Peer       repo.PeerInfo
+	PrivateKey repo.PrivateKey
+}
+
+// Peers lists the peers of the user, by name.
+func (s Self) Peers() ([]repo.PeerInfo, error) {
+	peers, _, err := s.Repo.ListPeers(repo.PeerFilter{Owner: s.User.Name}, repo.OrderNameAsc, repo.PageRequest{})
+	return peers, err
+}
+
+// Find gives the peer, ok false if there is none or it isn't the user's.
+func (s Self) Find(deviceName string, publicKey repo.PublicKey) (repo.PeerInfo, bool, error) {
+	peers, _, err := s.Repo.ListPeersByKeys(deviceName, []repo.PublicKey{publicKey}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil || len(peers) == 0 || peers[0].Owner != s.User.Name {
+		return repo.PeerInfo{}, false, err
+	}
+	return peers[0], true, nil
+}
+
+// Create adds a peer of the user to the device, with the next free address of its network from the allocator and a
+// pre-shared key of its own. The key pair is generated unless the public key is given. Members can't own more peers
+// than their limit, failing with ErrPeerLimit.
+func (s Self) Create(deviceName string, name string, publicKey repo.PublicKey) (ret Created, err error) {
+	device, ok := s.Devices[deviceName]
+	if !ok {
+		return ret, ErrNoDevice
+	}
+
+	peers, _, err := s.Repo.ListPeersByDevices([]string{deviceName}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil {
+		return
+	}
+
+	exists := fmt.Errorf("users: device %v already has the peer %v", deviceName, publicKey)
+	for _, p := range peers {
+		if p.PublicKey == publicKey {
+			return ret, exists
+		}
+	}
+
+	if len(publicKey.String()) == 0 {
+		private, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return ret, err
+		}
+		ret.PrivateKey = repo.NewPrivateKey(private)
+		publicKey = repo.NewPublicKey(private.PublicKey())
+	}
+
+	key, err := publicKey.ToKey()
+	if err != nil {
+		return
+	}
+
+	used := func() ([]net.IPNet, error) {
+		return repo.DeviceAddresses(s.Repo, deviceName)
+	}
+
+	held, err := s.Allocator.Hold(persistent.DeviceId(deviceName), []*net.IPNet{&device.Network}, used, wg.Key(key))
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = held.Release()
+	}()
+
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return
+	}
+
+	ret.Peer = repo.PeerInfo{
+		PublicKey:    publicKey,
+		PreSharedKey: repo.NewSymmetricKey(psk),
+		AllowedIPs:   held.AllowedIPs(),
+		DeviceName:   deviceName,
+		Name:         name,
+		Owner:        s.User.Name,
+	}
+
+	// The limit is checked as the peer is added, for it to hold whichever instance adds the peers of the user.
+	limit := -1
+	if !s.User.IsAdmin() {
+		limit = s.User.MaxPeers
+	}
+
+	switch err = repo.AddPeer(s.Repo, ret.Peer, limit); err {
+	case repo.ErrOwnerLimit:
+		err = ErrPeerLimit
+	case repo.ErrPeerExists:
+		err = exists
+	}
+	return
+}
+
+// Rename gives a new name to the peer of the user, ok false if there is none.
+func (s Self) Rename(deviceName string, publicKey repo.PublicKey, name string) (repo.PeerInfo, bool, error) {
+	p, ok, err := s.Find(deviceName, publicKey)
+	if err != nil || !ok {
+		return p, ok, err
+	}
+
+	p.Name = name
+	return p, true, s.Repo.UpdatePeers(deviceName, []repo.PeerInfo{p})
+}
+
+// Revoke removes the peer of the user, ok false if there is none.
+func (s Self) Revoke(deviceName string, publicKey repo.PublicKey) (bool, error) {
+	if _, ok, err := s.Find(deviceName, publicKey); err != nil || !ok {
+		return ok, err
+	}
+	return true, s.Repo.RemovePeers(deviceName, []repo.PublicKey{publicKey})
+}
+
+// Config gives the wg-quick configuration of the peer, with its private key if it's given. Only the peers of the
+// devices the user may add peers to have one, the others lacking a network and an endpoint.
+func (s Self) Config(p repo.PeerInfo, privateKey repo.PrivateKey) (string, error) {
+	device, ok := s.Devices[p.DeviceName]
+	if !ok {
+		return "", ErrNoDevice
+	}
+
+	devices, err := s.Repo.ListDevices()
+	if err != nil {
+		return "", err
+	}
+
+	var devicePublicKey string
+	for _, d := range devices {
+		if d.Name == p.DeviceName {
+			k, err := d.PrivateKey.ToKey()
+			if err != nil {
+				return "", err
+			}
+			devicePublicKey = k.PublicKey().String()
+		}
+	}
+
+	network := net.IPNet{IP: device.Network.IP.Mask(device.Network.Mask), Mask: device.Network.Mask}
+	var addresses []string
+	for _, ip := range p.AllowedIPs {
+		if network.Contains(ip.IP) {
+			addresses = append(addresses, ip.String())
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	if len(privateKey.String()) > 0 {
+		fmt.Fprintf(&b, "PrivateKey = %v\n", privateKey)
+	} else {
+		b.WriteString("# PrivateKey = the private key of the peer, which isn't kept here\n")
+	}
+	fmt.Fprintf(&b, "Address = %v\n", strings.Join(addresses, ", "))
+
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %v\n", devicePublicKey)
+	if len(p.PreSharedKey.String()) > 0 {
+		fmt.Fprintf(&b, "PresharedKey = %v\n", p.PreSharedKey)
+	}
+	fmt.Fprintf(&b, "Endpoint = %v\n", device.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %v\n", network.String())
+	if p.PersistentKeepaliveInterval > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %v\n", int64(p.PersistentKeepaliveInterval/time.Second))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,179 @@
+package users
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/ipam"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func genKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newSelf(t *testing.T, u User) (Self, wgtypes.Key) {
+	device := genKey(t)
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0", PrivateKey: repo.NewPrivateKey(device)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/29")
+	// The peer of another user has the first free address.
+	other := repo.PeerInfo{PublicKey: repo.NewPublicKey(genKey(t).PublicKey()), DeviceName: "wg0", Name: "other", Owner: "carol",
+		AllowedIPs: []net.IPNet{{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}}}
+	if err := r.UpdatePeers("wg0", []repo.PeerInfo{other}); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := map[string]Device{"wg0": {Network: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: network.Mask}, Endpoint: "vpn.example.com:51820"}}
+	return Self{Repo: r, User: u, Devices: devices, Allocator: ipam.NewAllocator(nil)}, device
+}
+
+func TestSelf_Create(t *testing.T) {
+	self, device := newSelf(t, User{Name: "bob", Role: Member, MaxPeers: 2})
+
+	created, err := self.Create("wg0", "phone", repo.PublicKey{})
+	if err != nil {
+		t.Fatal("Create():", err)
+	}
+
+	p := created.Peer
+	if p.Owner != "bob" || p.Name != "phone" || len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "10.0.0.3/32" {
+		t.Errorf("Create() = %+v", p)
+	}
+
+	private, err := created.PrivateKey.ToKey()
+	if err != nil || repo.NewPublicKey(private.PublicKey()) != p.PublicKey {
+		t.Errorf("Create() has the private key %v of another key pair: %v", created.PrivateKey, err)
+	}
+
+	config, err := self.Config(p, created.PrivateKey)
+	if err != nil {
+		t.Fatal("Config():", err)
+	}
+
+	for _, line := range []string{"PrivateKey = " + private.String(), "Address = 10.0.0.3/32", "PublicKey = " + device.PublicKey().String(),
+		"PresharedKey = " + p.PreSharedKey.String(), "Endpoint = vpn.example.com:51820", "AllowedIPs = 10.0.0.0/29"} {
+		if !strings.Contains(config, line+"\n") {
+			t.Errorf("Config() lacks %q:\n%v", line, config)
+		}
+	}
+
+	laptop := repo.NewPublicKey(genKey(t).PublicKey())
+	if created, err = self.Create("wg0", "laptop", laptop); err != nil || created.Peer.PublicKey != laptop || len(created.PrivateKey.String()) > 0 {
+		t.Errorf("Create() with a public key = %+v, %v", created, err)
+	}
+
+	if _, err = self.Create("wg0", "tablet", repo.PublicKey{}); err != ErrPeerLimit {
+		t.Errorf("Create() past the limit error = %v, want ErrPeerLimit", err)
+	}
+
+	if _, err = self.Create("wg1", "tablet", repo.PublicKey{}); err != ErrNoDevice {
+		t.Errorf("Create() on another device error = %v, want ErrNoDevice", err)
+	}
+
+	if peers, err := self.Peers(); err != nil || len(peers) != 2 || peers[0].Name != "laptop" || peers[1].Name != "phone" {
+		t.Errorf("Peers() = %+v, %v, want laptop and phone", peers, err)
+	}
+}
+
+// slowRepository takes its time to add peers, as a database does, so that concurrent adds overlap.
+type slowRepository struct {
+	repo.Repository
+}
+
+func (r slowRepository) UpdatePeers(deviceName string, peers []repo.PeerInfo) error {
+	time.Sleep(10 * time.Millisecond)
+	return r.Repository.UpdatePeers(deviceName, peers)
+}
+
+func (r slowRepository) AddPeer(peer repo.PeerInfo, maxOwned int) error {
+	time.Sleep(10 * time.Millisecond)
+	return r.Repository.(repo.PeerAdder).AddPeer(peer, maxOwned)
+}
+
+func TestSelf_Create_concurrently(t *testing.T) {
+	self, _ := newSelf(t, User{Name: "bob", Role: Member, MaxPeers: 2})
+	self.Repo = slowRepository{Repository: self.Repo}
+
+	const count = 4
+	errs := make(chan error, count)
+	var group sync.WaitGroup
+	for i := 0; i < count; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			_, err := self.Create("wg0", "phone", repo.PublicKey{})
+			errs <- err
+		}()
+	}
+	group.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrPeerLimit {
+			t.Errorf("Create() error = %v, want ErrPeerLimit", err)
+		}
+	}
+
+	peers, err := self.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 || len(peers) != 2 || peers[0].AllowedIPs[0].String() == peers[1].AllowedIPs[0].String() {
+		t.Errorf("Create() made %v peers, %+v, want 2 with addresses of their own", created, peers)
+	}
+}
+
+func TestSelf_OwnPeersOnly(t *testing.T) {
+	self, _ := newSelf(t, User{Name: "bob", Role: Member, MaxPeers: 1})
+
+	others, _, err := self.Repo.ListPeers(repo.PeerFilter{Owner: "carol"}, repo.OrderNameAsc, repo.PageRequest{})
+	if err != nil || len(others) != 1 {
+		t.Fatalf("ListPeers() = %v, %v", others, err)
+	}
+	other := others[0].PublicKey
+
+	if _, ok, err := self.Rename("wg0", other, "mine"); err != nil || ok {
+		t.Errorf("Rename() of the peer of another = %v, %v", ok, err)
+	}
+
+	if ok, err := self.Revoke("wg0", other); err != nil || ok {
+		t.Errorf("Revoke() of the peer of another = %v, %v", ok, err)
+	}
+
+	created, err := self.Create("wg0", "phone", repo.PublicKey{})
+	if err != nil {
+		t.Fatal("Create():", err)
+	}
+	key := created.Peer.PublicKey
+
+	if p, ok, err := self.Rename("wg0", key, "old phone"); err != nil || !ok || p.Name != "old phone" {
+		t.Errorf("Rename() = %+v, %v, %v", p, ok, err)
+	}
+
+	if ok, err := self.Revoke("wg0", key); err != nil || !ok {
+		t.Errorf("Revoke() = %v, %v", ok, err)
+	}
+
+	// Revoking a peer makes room for another.
+	if _, err = self.Create("wg0", "new phone", repo.PublicKey{}); err != nil {
+		t.Errorf("Create() after Revoke() error = %v", err)
+	}
+
+	if peers, _, err := self.Repo.ListPeers(repo.PeerFilter{}, repo.OrderNameAsc, repo.PageRequest{}); err != nil || len(peers) != 2 {
+		t.Errorf("ListPeers() = %+v, %v, want the peers of carol and bob", peers, err)
+	}
+}
@@ -0,0 +1,222 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"nz.cloudwalker/wireguard-webadmin/schema"
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"time"
+)
+
+var tableMigrations = [][]string{
+	{
+		`CREATE TABLE users(
+				name TEXT NOT NULL PRIMARY KEY,
+				password_hash TEXT NOT NULL,
+				role TEXT NOT NULL,
+				max_peers INTEGER NOT NULL DEFAULT 0
+			)`,
+
+		// Only the hash of the token is kept, the token itself being given once at login.
+		`CREATE TABLE user_sessions(
+				token_hash TEXT NOT NULL PRIMARY KEY,
+				user_name TEXT NOT NULL,
+				expires_at INTEGER NOT NULL
+			)`,
+
+		`CREATE INDEX user_sessions_user_name ON user_sessions(user_name)`,
+	},
+}
+
+// Store keeps the users and their sessions in SQLite, in tables of their own so that it can share the database of the
+// other stores.
+type Store struct {
+	*sqlx.DB
+
+	Clock utils.Clock
+	// SessionTTL is how long a session lasts from login.
+	SessionTTL time.Duration
+}
+
+type user struct {
+	Name         string `db:"name"`
+	PasswordHash string `db:"password_hash"`
+	Role         string `db:"role"`
+	MaxPeers     int    `db:"max_peers"`
+}
+
+func (u user) toUser() User {
+	return User{Name: u.Name, Role: Role(u.Role), MaxPeers: u.MaxPeers}
+}
+
+func NewSqliteStore(dsn string) (*Store, error) {
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{DB: db, Clock: utils.SystemClock, SessionTTL: DefaultSessionTTL}
+	if err = schema.MigrateDB(db, "user_", tableMigrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveUser adds the user or changes one. An empty password keeps the one the user has, which a new user can't do
+// without. Changing the password ends the sessions of the user.
+func (s *Store) SaveUser(u User, password string) (err error) {
+	if err = u.Validate(); err != nil {
+		return
+	}
+
+	if len(password) == 0 {
+		var result sql.Result
+		if result, err = s.Exec("UPDATE users SET role = ?, max_peers = ? WHERE name = ?", u.Role, u.MaxPeers, u.Name); err != nil {
+			return
+		}
+
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return invalidUser("a new user needs a password")
+		}
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	tx, err := s.Beginx()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec(`INSERT INTO users(name, password_hash, role, max_peers) VALUES (?, ?, ?, ?)
+							ON CONFLICT (name) DO UPDATE SET
+								password_hash = excluded.password_hash,
+								role = excluded.role,
+								max_peers = excluded.max_peers`, u.Name, string(hash), u.Role, u.MaxPeers); err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM user_sessions WHERE user_name = ?", u.Name)
+	return
+}
+
+// RemoveUser removes the user and ends their sessions. The peers they own keep them as owner until given to another.
+func (s *Store) RemoveUser(name string) (err error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM user_sessions WHERE user_name = ?", name); err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE name = ?", name)
+	return
+}
+
+func (s *Store) selectUsers(query string, args ...interface{}) ([]User, error) {
+	var rows []user
+	if err := s.Select(&rows, "SELECT * FROM users "+query+" ORDER BY name", args...); err != nil {
+		return nil, err
+	}
+
+	ret := make([]User, 0, len(rows))
+	for _, row := range rows {
+		ret = append(ret, row.toUser())
+	}
+	return ret, nil
+}
+
+// ListUsers lists every user by name.
+func (s *Store) ListUsers() ([]User, error) {
+	return s.selectUsers("")
+}
+
+// FindUser gives the user, ok false if there is none of that name.
+func (s *Store) FindUser(name string) (User, bool, error) {
+	users, err := s.selectUsers("WHERE name = ?", name)
+	if err != nil || len(users) == 0 {
+		return User{}, false, err
+	}
+	return users[0], true, nil
+}
+
+// Login checks the password of the user and starts a session, giving its token and when it expires. It fails with
+// ErrBadCredentials if the user or the password is wrong.
+func (s *Store) Login(name string, password string) (token string, expiresAt time.Time, err error) {
+	var row user
+	if err = s.Get(&row, "SELECT * FROM users WHERE name = ?", name); err == sql.ErrNoRows {
+		return "", time.Time{}, ErrBadCredentials
+	} else if err != nil {
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(row.PasswordHash), []byte(password)) != nil {
+		return "", time.Time{}, ErrBadCredentials
+	}
+
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return
+	}
+
+	now := s.Clock.Now()
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt = now.Add(s.SessionTTL)
+
+	// The sessions that are over are cleared as new ones start.
+	if _, err = s.Exec("DELETE FROM user_sessions WHERE expires_at <= ?", now.Unix()); err != nil {
+		return
+	}
+
+	_, err = s.Exec("INSERT INTO user_sessions(token_hash, user_name, expires_at) VALUES (?, ?, ?)", hashToken(token), name, expiresAt.Unix())
+	return
+}
+
+// Authenticate gives the user of the session of the token, ok false if there is no such session or it's over.
+func (s *Store) Authenticate(token string) (User, bool, error) {
+	users, err := s.selectUsers("WHERE name = (SELECT user_name FROM user_sessions WHERE token_hash = ? AND expires_at > ?)",
+		hashToken(token), s.Clock.Now().Unix())
+	if err != nil || len(users) == 0 {
+		return User{}, false, err
+	}
+	return users[0], true, nil
+}
+
+// Logout ends the session of the token.
+func (s *Store) Logout(token string) error {
+	_, err := s.Exec("DELETE FROM user_sessions WHERE token_hash = ?", hashToken(token))
+	return err
+}
@@ -0,0 +1,119 @@
+package users
+
+import (
+	"nz.cloudwalker/wireguard-webadmin/utils"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T, name string) *Store {
+	s, err := NewSqliteStore("file:users_" + name + "?cache=shared&mode=memory")
+	if err != nil {
+		t.Fatal("NewSqliteStore():", err)
+	}
+	return s
+}
+
+func TestStore_Users(t *testing.T) {
+	s := newStore(t, "users")
+	defer s.Close()
+
+	if err := s.SaveUser(User{Name: "bob", Role: Member}, ""); err == nil {
+		t.Error("SaveUser() of a new user without a password succeeded")
+	}
+
+	if err := s.SaveUser(User{Name: "bob smith", Role: Member}, "secret"); err == nil {
+		t.Error("SaveUser() of a name with spaces succeeded")
+	}
+
+	if err := s.SaveUser(User{Name: "bob", Role: "owner"}, "secret"); err == nil {
+		t.Error("SaveUser() of an unknown role succeeded")
+	}
+
+	for _, u := range []User{{Name: "bob", Role: Member, MaxPeers: 2}, {Name: "alice", Role: Admin}} {
+		if err := s.SaveUser(u, "secret"); err != nil {
+			t.Fatal("SaveUser():", err)
+		}
+	}
+
+	// The password is kept when none is given.
+	if err := s.SaveUser(User{Name: "bob", Role: Member, MaxPeers: 5}, ""); err != nil {
+		t.Fatal("SaveUser():", err)
+	}
+
+	want := []User{{Name: "alice", Role: Admin}, {Name: "bob", Role: Member, MaxPeers: 5}}
+	if list, err := s.ListUsers(); err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("ListUsers() = %v, %v, want %v", list, err, want)
+	}
+
+	if _, _, err := s.Login("bob", "secret"); err != nil {
+		t.Error("Login() after keeping the password:", err)
+	}
+
+	if err := s.RemoveUser("alice"); err != nil {
+		t.Fatal("RemoveUser():", err)
+	}
+
+	if _, ok, err := s.FindUser("alice"); err != nil || ok {
+		t.Errorf("FindUser() of a removed user = %v, %v", ok, err)
+	}
+}
+
+func TestStore_Sessions(t *testing.T) {
+	s := newStore(t, "sessions")
+	defer s.Close()
+
+	start := time.Unix(1000, 0)
+	clock := utils.NewManualClock(start)
+	s.Clock = clock
+
+	if err := s.SaveUser(User{Name: "bob", Role: Member}, "secret"); err != nil {
+		t.Fatal("SaveUser():", err)
+	}
+
+	for _, c := range [][2]string{{"bob", "wrong"}, {"carol", "secret"}} {
+		if _, _, err := s.Login(c[0], c[1]); err != ErrBadCredentials {
+			t.Errorf("Login(%q, %q) error = %v, want ErrBadCredentials", c[0], c[1], err)
+		}
+	}
+
+	token, expiresAt, err := s.Login("bob", "secret")
+	if err != nil || len(token) == 0 || !expiresAt.Equal(start.Add(DefaultSessionTTL)) {
+		t.Fatalf("Login() = %q, %v, %v", token, expiresAt, err)
+	}
+
+	if u, ok, err := s.Authenticate(token); err != nil || !ok || u.Name != "bob" {
+		t.Errorf("Authenticate() = %v, %v, %v, want bob", u, ok, err)
+	}
+
+	clock.Advance(DefaultSessionTTL)
+	if _, ok, err := s.Authenticate(token); err != nil || ok {
+		t.Errorf("Authenticate() of an expired session = %v, %v", ok, err)
+	}
+
+	if token, _, err = s.Login("bob", "secret"); err != nil {
+		t.Fatal("Login():", err)
+	}
+
+	if err = s.Logout(token); err != nil {
+		t.Fatal("Logout():", err)
+	}
+
+	if _, ok, err := s.Authenticate(token); err != nil || ok {
+		t.Errorf("Authenticate() after Logout() = %v, %v", ok, err)
+	}
+
+	// Changing the password ends the sessions.
+	if token, _, err = s.Login("bob", "secret"); err != nil {
+		t.Fatal("Login():", err)
+	}
+
+	if err = s.SaveUser(User{Name: "bob", Role: Member}, "another"); err != nil {
+		t.Fatal("SaveUser():", err)
+	}
+
+	if _, ok, err := s.Authenticate(token); err != nil || ok {
+		t.Errorf("Authenticate() after a new password = %v, %v", ok, err)
+	}
+}
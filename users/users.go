@@ -0,0 +1,77 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role is what a user may do.
+type Role string
+
+const (
+	// Admin users manage everything, as the api does without users.
+	Admin Role = "admin"
+	// Member users only manage the peers they own, up to their limit.
+	Member Role = "member"
+)
+
+// DefaultSessionTTL is how long a session lasts unless told otherwise.
+const DefaultSessionTTL = 24 * time.Hour
+
+// User is someone who logs in to manage peers.
+type User struct {
+	Name string
+	Role Role
+	// MaxPeers is how many peers a member may own. Admins have no limit.
+	MaxPeers int
+}
+
+var (
+	// ErrBadCredentials is what logging in with an unknown name or the wrong password fails with, telling neither
+	// apart.
+	ErrBadCredentials = errors.New("users: wrong name or password")
+
+	// ErrPeerLimit is what adding a peer fails with once its owner has as many as they may.
+	ErrPeerLimit = errors.New("users: the peer limit is reached")
+)
+
+// InvalidUserError tells why a user was refused.
+type InvalidUserError struct {
+	Reason string
+}
+
+func (e *InvalidUserError) Error() string {
+	return "invalid user: " + e.Reason
+}
+
+func invalidUser(format string, args ...interface{}) error {
+	return &InvalidUserError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func (u User) IsAdmin() bool {
+	return u.Role == Admin
+}
+
+// Validate checks the user has a name without spaces, a known role and a peer limit that isn't negative.
+func (u User) Validate() error {
+	if len(u.Name) == 0 {
+		return invalidUser("the name is missing")
+	}
+
+	if strings.ContainsAny(u.Name, " \t\n") {
+		return invalidUser("the name %q has spaces", u.Name)
+	}
+
+	switch u.Role {
+	case Admin, Member:
+	default:
+		return invalidUser("unknown role %q", u.Role)
+	}
+
+	if u.MaxPeers < 0 {
+		return invalidUser("the peer limit is negative")
+	}
+	return nil
+}
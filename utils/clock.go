@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time, so that whatever depends on it can be tested with a ManualClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var SystemClock Clock = systemClock{}
+
+type clockWaiter struct {
+	at      time.Time
+	channel chan time.Time
+}
+
+// ManualClock only moves when told to.
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := clockWaiter{at: c.now.Add(d), channel: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.channel <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+
+	return w.channel
+}
+
+// Waiters tells how many After channels are yet to fire.
+func (c *ManualClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.waiters)
+}
+
+// Advance moves the clock forward, firing the After channels that are due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.channel <- c.now
+		}
+	}
+	c.waiters = waiting
+}
@@ -16,6 +16,10 @@ type PeerConfig struct {
 type Peer struct {
 	PeerConfig
 	LastHandshake *time.Time
+
+	// RxBytes and TxBytes are what the peer moved, as far as the client counts it.
+	RxBytes uint64
+	TxBytes uint64
 }
 
 type DeviceConfig struct {
@@ -51,8 +55,8 @@ func (p *Peer) UpdateFromConfig(c PeerConfig) {
 
 func (d Device) GetPeersMap() map[Key]*Peer {
 	m := make(map[Key]*Peer, len(d.Peers))
-	for _, p := range d.Peers {
-		m[p.PublicKey] = &p
+	for i := range d.Peers {
+		m[d.Peers[i].PublicKey] = &d.Peers[i]
 	}
 	return m
 }
@@ -33,6 +33,15 @@ func (k Key) String() string {
 	return hex.EncodeToString(k[:])
 }
 
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *Key) UnmarshalText(text []byte) (err error) {
+	*k, err = NewKeyFromString(string(text))
+	return
+}
+
 func (k *Key) ToPublicKey() Key {
 	var dst [32]byte
 	curve25519.ScalarBaseMult(&dst, (*[32]byte)(k))
@@ -26,23 +26,58 @@ func (m memClient) Up(deviceId string, config DeviceConfig) (Device, error) {
 }
 
 func (m memClient) Down(deviceId string) error {
-	panic("implement me")
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.DeviceMap[deviceId]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(m.DeviceMap, deviceId)
+	return nil
 }
 
 func (m memClient) Configure(deviceId string, configurator func(config *DeviceConfig) error) error {
-	panic("implement me")
+	m.Lock()
+	defer m.Unlock()
+
+	d, ok := m.DeviceMap[deviceId]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	config := d.ToConfig()
+	if err := configurator(&config); err != nil {
+		return err
+	}
+
+	d.UpdateFromConfig(config)
+	return nil
 }
 
-func (m memClient) Devices() ([]Device, error) {
-	panic("implement me")
+func (m memClient) Devices() (devices []Device, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, d := range m.DeviceMap {
+		devices = append(devices, *d)
+	}
+	return
 }
 
 func (m memClient) Device(id string) (Device, error) {
-	panic("implement me")
+	m.RLock()
+	defer m.RUnlock()
+
+	if d, ok := m.DeviceMap[id]; ok {
+		return *d, nil
+	} else {
+		return Device{}, os.ErrNotExist
+	}
 }
 
 func (m memClient) Close() error {
-	panic("implement me")
+	return nil
 }
 
 func NewMemClient() (Client, error) {
@@ -1,12 +1,20 @@
 package wg
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type tunDevice struct {
@@ -41,36 +49,165 @@ func (t *tunDevice) Close() error {
 	return t.TunIf.Close()
 }
 
-func configureDevice(tunIf tun.Device, dev *device.Device, config DeviceConfig) error {
-	var link netlink.Link
-	if name, err := tunIf.Name(); err != nil {
-		return err
-	} else {
-		if link, err = netlink.LinkByName(name); err != nil {
-			return err
+// parseStats reads the handshakes and traffic of the peers out of what the device gives for a get of its
+// configuration, as "wg show" reads it, by public key.
+func parseStats(r io.Reader) (map[Key]Peer, error) {
+	ret := make(map[Key]Peer)
+	var key Key
+	var peer *Peer
+	var sec, nsec int64
+
+	// The handshake is in two lines, so it's only known once the next peer starts or the lines run out.
+	done := func() {
+		if peer != nil {
+			if sec != 0 || nsec != 0 {
+				handshake := time.Unix(sec, nsec)
+				peer.LastHandshake = &handshake
+			}
+			ret[key] = *peer
 		}
+	}
 
-		addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-		if err != nil {
-			return err
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
 		}
 
-		for _, addr := range addresses {
-			_ = netlink.AddrDel(link, &addr)
+		var err error
+		switch name, value := parts[0], parts[1]; {
+		case name == "public_key":
+			done()
+			if key, err = NewKeyFromString(value); err != nil {
+				return nil, err
+			}
+			peer, sec, nsec = &Peer{}, 0, 0
+		case peer == nil:
+		case name == "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+		case name == "last_handshake_time_nsec":
+			nsec, err = strconv.ParseInt(value, 10, 64)
+		case name == "rx_bytes":
+			peer.RxBytes, err = strconv.ParseUint(value, 10, 64)
+		case name == "tx_bytes":
+			peer.TxBytes, err = strconv.ParseUint(value, 10, 64)
 		}
 
-		if config.Address != nil {
-			addr := &netlink.Addr{
-				IPNet: config.Address,
+		if err != nil {
+			return nil, fmt.Errorf("wg-tun: %v of the device is not valid: %v", parts[0], err)
+		}
+	}
+
+	done()
+	return ret, scanner.Err()
+}
+
+// withStats gives the device with the handshakes and traffic of its peers, as the wireguard-go device counts them.
+func (t *tunDevice) withStats() (Device, error) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := t.Raw.IpcGetOperation(w); err != nil {
+		return Device{}, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return Device{}, err
+	}
+
+	stats, err := parseStats(&b)
+	if err != nil {
+		return Device{}, err
+	}
+
+	ret := t.Device
+	ret.Peers = make([]Peer, len(t.Peers))
+	for i, p := range t.Peers {
+		s := stats[p.PublicKey]
+		ret.Peers[i] = Peer{PeerConfig: p.PeerConfig, LastHandshake: s.LastHandshake, RxBytes: s.RxBytes, TxBytes: s.TxBytes}
+	}
+	return ret, nil
+}
+
+// forwarding tells whether the host has to pass on packets for the peers of the device, over IPv4 and IPv6: it does once
+// a peer is routed a prefix that's neither a host nor in the network of the device, as the LAN of a site, which the
+// packets come from or go to through another interface.
+func forwarding(config DeviceConfig) (v4 bool, v6 bool) {
+	var network *net.IPNet
+	if config.Address != nil {
+		network = &net.IPNet{IP: config.Address.IP.Mask(config.Address.Mask), Mask: config.Address.Mask}
+	}
+
+	for _, p := range config.Peers {
+		for _, ip := range p.AllowedIPs {
+			ones, bits := ip.Mask.Size()
+			if ones == bits || ones == 0 || (network != nil && network.Contains(ip.IP)) {
+				continue
 			}
 
-			if err = netlink.AddrAdd(link, addr); err != nil {
-				return err
+			if ip.IP.To4() != nil {
+				v4 = true
+			} else {
+				v6 = true
 			}
 		}
 	}
+	return
+}
+
+// enableForwarding turns forwarding on for the whole host. It's never turned off again, as other things may need it.
+func enableForwarding(v4 bool, v6 bool) error {
+	if v4 {
+		if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644); err != nil {
+			return err
+		}
+	}
 
-	if err := netlink.LinkSetUp(link); err != nil {
+	if v6 {
+		if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAddress gives the interface the address alone, none if it's nil, and brings it up.
+func setAddress(name string, address *net.IPNet) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addresses {
+		_ = netlink.AddrDel(link, &addr)
+	}
+
+	if address != nil {
+		addr := &netlink.Addr{
+			IPNet: address,
+		}
+
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	return link, netlink.LinkSetUp(link)
+}
+
+func configureDevice(tunIf tun.Device, dev *device.Device, config DeviceConfig) error {
+	name, err := tunIf.Name()
+	if err != nil {
+		return err
+	}
+
+	link, err := setAddress(name, config.Address)
+	if err != nil {
 		return err
 	}
 
@@ -98,9 +235,11 @@ func configureDevice(tunIf tun.Device, dev *device.Device, config DeviceConfig)
 				return err
 			}
 
+			// The route replaces any the host already has for the prefix, as that of a LAN reached another way
+			// before the site was linked.
 			for _, ip := range p.AllowedIPs {
 				if ones, _ := ip.Mask.Size(); ones > 0 {
-					err := netlink.RouteAdd(&netlink.Route{
+					err := netlink.RouteReplace(&netlink.Route{
 						LinkIndex: link.Attrs().Index,
 						Dst:       &ip,
 					})
@@ -115,6 +254,10 @@ func configureDevice(tunIf tun.Device, dev *device.Device, config DeviceConfig)
 		}
 	}
 
+	if err := enableForwarding(forwarding(config)); err != nil {
+		fmt.Printf("wg-tun: unable to enable forwarding: %v\n", err)
+	}
+
 	return nil
 }
 
@@ -159,7 +302,7 @@ func (t *tunClient) Up(deviceId string, config DeviceConfig) (ret Device, err er
 	return
 }
 
-func (t tunClient) Down(deviceId string) error {
+func (t *tunClient) Down(deviceId string) error {
 	t.Lock()
 	defer t.Unlock()
 
@@ -200,7 +343,11 @@ func (t *tunClient) Devices() (devices []Device, err error) {
 	defer t.RUnlock()
 
 	for _, d := range t.DeviceMap {
-		devices = append(devices, d.Device)
+		device, err := d.withStats()
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
 	}
 
 	return
@@ -211,7 +358,7 @@ func (t *tunClient) Device(id string) (Device, error) {
 	defer t.RUnlock()
 
 	if d, ok := t.DeviceMap[id]; ok {
-		return d.Device, nil
+		return d.withStats()
 	} else {
 		return Device{}, nil
 	}
@@ -0,0 +1,115 @@
+package wg
+
+import (
+	"crypto/sha256"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTun is a tun device that never has a packet to read and drops what's written to it.
+type fakeTun struct {
+	events chan tun.Event
+	closed chan interface{}
+}
+
+func newFakeTun() *fakeTun {
+	return &fakeTun{events: make(chan tun.Event), closed: make(chan interface{})}
+}
+
+func (f *fakeTun) File() *os.File { return nil }
+
+func (f *fakeTun) Read([]byte, int) (int, error) {
+	<-f.closed
+	return 0, os.ErrClosed
+}
+
+func (f *fakeTun) Write(b []byte, offset int) (int, error) { return len(b) - offset, nil }
+func (f *fakeTun) Flush() error                            { return nil }
+func (f *fakeTun) MTU() (int, error)                       { return device.DefaultMTU, nil }
+func (f *fakeTun) Name() (string, error)                   { return "fake0", nil }
+func (f *fakeTun) Events() chan tun.Event                  { return f.events }
+
+func (f *fakeTun) Close() error {
+	select {
+	case <-f.closed:
+	default:
+		close(f.closed)
+		close(f.events)
+	}
+	return nil
+}
+
+func newTestKey(v string) Key {
+	return Key(sha256.Sum256([]byte(v)))
+}
+
+func TestTunClient_Devices(t *testing.T) {
+	tunIf := newFakeTun()
+	raw := device.NewDevice(tunIf, device.NewLogger(device.LogLevelError, "test: "))
+
+	peers := []Peer{{PeerConfig: PeerConfig{PublicKey: newTestKey("alice")}}, {PeerConfig: PeerConfig{PublicKey: newTestKey("bob")}}}
+	for _, p := range peers {
+		if _, err := raw.NewPeer(p.PublicKey.ToNoisePublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &tunClient{DeviceMap: map[string]*tunDevice{
+		"device1": {Device: Device{Id: "device1", Name: "wg0", Peers: peers}, Raw: raw, TunIf: tunIf},
+	}}
+	defer client.Close()
+
+	devices, err := client.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any traffic the counters read as nothing, for each peer of the device.
+	if len(devices) != 1 || !reflect.DeepEqual(devices[0].Peers, peers) {
+		t.Errorf("Devices() = %+v, want the peers with no handshake nor traffic", devices)
+	}
+
+	if d, err := client.Device("device1"); err != nil || !reflect.DeepEqual(d, devices[0]) {
+		t.Errorf("Device() = %+v, %v, want %+v", d, err, devices[0])
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	alice, bob := newTestKey("alice"), newTestKey("bob")
+	stats, err := parseStats(strings.NewReader(strings.Join([]string{
+		"private_key=" + newTestKey("device").String(),
+		"listen_port=51820",
+		"public_key=" + alice.String(),
+		"last_handshake_time_sec=1577836800",
+		"last_handshake_time_nsec=500",
+		"tx_bytes=10",
+		"rx_bytes=20",
+		"allowed_ip=10.0.0.2/32",
+		"public_key=" + bob.String(),
+		"last_handshake_time_sec=0",
+		"last_handshake_time_nsec=0",
+		"tx_bytes=0",
+		"rx_bytes=0",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := time.Unix(1577836800, 500)
+	want := map[Key]Peer{
+		alice: {LastHandshake: &handshake, RxBytes: 20, TxBytes: 10},
+		bob:   {},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("parseStats() = %+v, want %+v", stats, want)
+	}
+
+	if _, err = parseStats(strings.NewReader("public_key=" + alice.String() + "\nrx_bytes=many\n")); err == nil {
+		t.Error("parseStats() of a count that isn't a number succeeds")
+	}
+}
@@ -0,0 +1,166 @@
+package wg
+
+import (
+	"errors"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"os"
+)
+
+// ErrNotManaged is what bringing a device up or down fails with on a client that only reaches the devices the host
+// already runs.
+var ErrNotManaged = errors.New("wg: the client doesn't bring devices up or down")
+
+// wgctrlClient reaches the devices the host runs, in the kernel or in userspace, from outside the process that runs
+// them. The id of a device is the name of its interface, as the importer has it.
+type wgctrlClient struct {
+	client *wgctrl.Client
+}
+
+// interfaceAddress gives the first address of the network interface, which WireGuard itself knows nothing about.
+func interfaceAddress(name string) (*net.IPNet, error) {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := i.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addresses {
+		if n, ok := a.(*net.IPNet); ok {
+			return n, nil
+		}
+	}
+	return nil, nil
+}
+
+func fromWgtypes(d *wgtypes.Device) (ret Device, err error) {
+	ret = Device{
+		Id:         d.Name,
+		Name:       d.Name,
+		PrivateKey: Key(d.PrivateKey),
+		ListenPort: uint16(d.ListenPort),
+		Peers:      make([]Peer, 0, len(d.Peers)),
+	}
+
+	if ret.Address, err = interfaceAddress(d.Name); err != nil {
+		return
+	}
+
+	for _, p := range d.Peers {
+		peer := Peer{
+			PeerConfig: PeerConfig{
+				PublicKey:           Key(p.PublicKey),
+				PreSharedKey:        Key(p.PresharedKey),
+				Endpoint:            p.Endpoint,
+				AllowedIPs:          p.AllowedIPs,
+				PersistentKeepAlive: p.PersistentKeepaliveInterval,
+			},
+			RxBytes: uint64(p.ReceiveBytes),
+			TxBytes: uint64(p.TransmitBytes),
+		}
+
+		if !p.LastHandshakeTime.IsZero() {
+			handshake := p.LastHandshakeTime
+			peer.LastHandshake = &handshake
+		}
+		ret.Peers = append(ret.Peers, peer)
+	}
+	return
+}
+
+func toWgtypes(config DeviceConfig) wgtypes.Config {
+	privateKey := wgtypes.Key(config.PrivateKey)
+	listenPort := int(config.ListenPort)
+	ret := wgtypes.Config{
+		PrivateKey:   &privateKey,
+		ListenPort:   &listenPort,
+		ReplacePeers: true,
+		Peers:        make([]wgtypes.PeerConfig, 0, len(config.Peers)),
+	}
+
+	for _, p := range config.Peers {
+		psk := wgtypes.Key(p.PreSharedKey)
+		keepalive := p.PersistentKeepAlive
+		ret.Peers = append(ret.Peers, wgtypes.PeerConfig{
+			PublicKey:                   wgtypes.Key(p.PublicKey),
+			PresharedKey:                &psk,
+			Endpoint:                    p.Endpoint,
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  p.AllowedIPs,
+		})
+	}
+	return ret
+}
+
+func (c wgctrlClient) Up(deviceId string, config DeviceConfig) (Device, error) {
+	return Device{}, ErrNotManaged
+}
+
+func (c wgctrlClient) Down(deviceId string) error {
+	return ErrNotManaged
+}
+
+func (c wgctrlClient) Configure(deviceId string, configurator func(config *DeviceConfig) error) error {
+	d, err := c.Device(deviceId)
+	if err != nil {
+		return err
+	}
+
+	config := d.ToConfig()
+	if err = configurator(&config); err != nil {
+		return err
+	}
+
+	if err = c.client.ConfigureDevice(deviceId, toWgtypes(config)); err != nil {
+		return err
+	}
+	_, err = setAddress(deviceId, config.Address)
+	return err
+}
+
+func (c wgctrlClient) Devices() ([]Device, error) {
+	devices, err := c.client.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		device, err := fromWgtypes(d)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, device)
+	}
+	return ret, nil
+}
+
+func (c wgctrlClient) Device(id string) (Device, error) {
+	d, err := c.client.Device(id)
+	if os.IsNotExist(err) {
+		return Device{}, os.ErrNotExist
+	} else if err != nil {
+		return Device{}, err
+	}
+	return fromWgtypes(d)
+}
+
+func (c wgctrlClient) Close() error {
+	return c.client.Close()
+}
+
+// NewWgctrlClient reaches the devices the host already runs, as the commands run beside the server do. It can
+// configure them but not bring them up or down.
+func NewWgctrlClient() (Client, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return wgctrlClient{client: client}, nil
+}
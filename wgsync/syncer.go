@@ -0,0 +1,194 @@
+// Package wgsync keeps the devices that are up on this host configured as the repository has them, so that a peer
+// that's disabled, expired or removed is taken off its device as soon as the change is stored.
+package wgsync
+
+import (
+	"log"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"sort"
+	"strings"
+)
+
+// Syncer configures the live devices with their enabled peers, on every change of the repository. The devices that
+// aren't up on this host, such as those an agent runs, are left alone, as is everything of a device but its peers.
+type Syncer struct {
+	Repo   repo.Repository
+	Client wg.Client
+
+	stop chan interface{}
+	done chan interface{}
+}
+
+func NewSyncer(repository repo.Repository, client wg.Client) *Syncer {
+	return &Syncer{
+		Repo:   repository,
+		Client: client,
+	}
+}
+
+// Sync configures the devices with the names that are up with their peers as stored. It returns how many devices it
+// changed: a device whose peers are configured already is left as it is, so that its sessions are kept.
+func (s *Syncer) Sync(deviceNames []string) (count int, err error) {
+	live, err := s.Client.Devices()
+	if err != nil {
+		return
+	}
+
+	up := make(map[string]wg.Device, len(live))
+	for _, d := range live {
+		up[d.Id] = d
+	}
+
+	for _, name := range deviceNames {
+		d, ok := up[name]
+		if !ok {
+			continue
+		}
+
+		var peers []repo.PeerInfo
+		if peers, _, err = s.Repo.ListPeersByDevices([]string{name}, repo.OrderNameAsc, repo.PageRequest{}); err != nil {
+			return
+		}
+
+		var wanted []wg.PeerConfig
+		if wanted, err = repo.PeerConfigs(peers); err != nil {
+			return
+		}
+
+		if samePeers(d.ToConfig().Peers, wanted) {
+			continue
+		}
+
+		err = s.Client.Configure(name, func(config *wg.DeviceConfig) error {
+			config.Peers = wanted
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		count++
+	}
+
+	return
+}
+
+// RunOnce syncs every device of the repository.
+func (s *Syncer) RunOnce() (int, error) {
+	devices, err := s.Repo.ListDevices()
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(devices))
+	for _, d := range devices {
+		names = append(names, d.Name)
+	}
+	return s.Sync(names)
+}
+
+// peerState is what's compared of a peer: the endpoint a peer roams to isn't a change, unless one is stored.
+type peerState struct {
+	PreSharedKey        wg.Key
+	Endpoint            string
+	AllowedIPs          string
+	PersistentKeepAlive int64
+}
+
+func peerStates(peers []wg.PeerConfig, endpoints map[wg.Key]bool) map[wg.Key]peerState {
+	ret := make(map[wg.Key]peerState, len(peers))
+	for _, p := range peers {
+		state := peerState{
+			PreSharedKey:        p.PreSharedKey,
+			AllowedIPs:          formatIPs(p.AllowedIPs),
+			PersistentKeepAlive: int64(p.PersistentKeepAlive),
+		}
+
+		if p.Endpoint != nil && endpoints[p.PublicKey] {
+			state.Endpoint = p.Endpoint.String()
+		}
+		ret[p.PublicKey] = state
+	}
+	return ret
+}
+
+func formatIPs(ips []net.IPNet) string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	sort.Strings(ret)
+
+	return strings.Join(ret, ",")
+}
+
+// samePeers tells whether the live peers are those wanted.
+func samePeers(live []wg.PeerConfig, wanted []wg.PeerConfig) bool {
+	if len(live) != len(wanted) {
+		return false
+	}
+
+	endpoints := make(map[wg.Key]bool, len(wanted))
+	for _, p := range wanted {
+		endpoints[p.PublicKey] = p.Endpoint != nil
+	}
+
+	have, want := peerStates(live, endpoints), peerStates(wanted, endpoints)
+	for k, p := range want {
+		if q, ok := have[k]; !ok || q != p {
+			return false
+		}
+	}
+	return true
+}
+
+// changedDevices gives the devices whose peers the event may have changed.
+func changedDevices(e repo.ChangeEvent) []string {
+	if e.Type == repo.DeviceRemoved {
+		return nil
+	}
+	return e.DeviceNames
+}
+
+func (s *Syncer) run() {
+	defer close(s.done)
+
+	changes := s.Repo.AddChangeNotification()
+	defer s.Repo.RemoveChangeNotification(changes)
+
+	if _, err := s.RunOnce(); err != nil {
+		log.Printf("wgsync: unable to sync the devices: %v", err)
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case e, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			if _, err := s.Sync(changedDevices(e)); err != nil {
+				log.Printf("wgsync: unable to sync %v: %v", e.DeviceNames, err)
+			}
+		}
+	}
+}
+
+// Start syncs every device, then those of every change, in the background until Close.
+func (s *Syncer) Start() {
+	s.stop = make(chan interface{})
+	s.done = make(chan interface{})
+	go s.run()
+}
+
+func (s *Syncer) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return nil
+}
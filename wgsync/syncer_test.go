@@ -0,0 +1,141 @@
+package wgsync
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"nz.cloudwalker/wireguard-webadmin/repo"
+	"nz.cloudwalker/wireguard-webadmin/wg"
+	"testing"
+	"time"
+)
+
+type fixture struct {
+	t      *testing.T
+	repo   repo.Repository
+	client wg.Client
+	peers  []repo.PeerInfo
+}
+
+// newFixture has wg0 up with alice and bob, and wg1 stored but not up.
+func newFixture(t *testing.T) *fixture {
+	r := repo.NewMemRepository()
+	if err := r.UpdateDevices([]repo.DeviceInfo{{Name: "wg0"}, {Name: "wg1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{t: t, repo: r}
+	for i, name := range []string{"alice", "bob"} {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.peers = append(f.peers, repo.PeerInfo{
+			PublicKey:  repo.NewPublicKey(k.PublicKey()),
+			DeviceName: "wg0",
+			Name:       name,
+			AllowedIPs: []net.IPNet{{IP: net.IPv4(10, 0, 0, byte(i+2)), Mask: net.CIDRMask(32, 32)}},
+		})
+	}
+
+	if err := r.UpdatePeers("wg0", f.peers); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdatePeers("wg1", []repo.PeerInfo{{PublicKey: f.peers[0].PublicKey, DeviceName: "wg1", Name: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wg.NewMemClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Up("wg0", wg.DeviceConfig{Name: "wg0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.client = client
+	return f
+}
+
+// livePeers gives the names of the peers configured on wg0.
+func (f *fixture) livePeers() map[string]bool {
+	d, err := f.client.Device("wg0")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	ret := make(map[string]bool)
+	for _, p := range d.Peers {
+		for _, q := range f.peers {
+			if k, _ := q.PublicKey.ToKey(); wg.Key(k) == p.PublicKey {
+				ret[q.Name] = true
+			}
+		}
+	}
+	return ret
+}
+
+func (f *fixture) disable(name string) {
+	for _, p := range f.peers {
+		if p.Name == name {
+			if _, err := repo.SetPeersEnabled(f.repo, "wg0", []repo.PublicKey{p.PublicKey}, false, "test"); err != nil {
+				f.t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	f := newFixture(t)
+	s := NewSyncer(f.repo, f.client)
+
+	count, err := s.Sync([]string{"wg0", "wg1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Sync() = %v, want 1: wg1 isn't up", count)
+	}
+	if live := f.livePeers(); len(live) != 2 {
+		t.Errorf("live peers = %v, want alice and bob", live)
+	}
+
+	if count, err = s.Sync([]string{"wg0"}); err != nil || count != 0 {
+		t.Errorf("Sync() in sync = %v, %v, want 0, <nil>", count, err)
+	}
+
+	f.disable("bob")
+	if count, err = s.Sync([]string{"wg0"}); err != nil || count != 1 {
+		t.Errorf("Sync() after disabling = %v, %v, want 1, <nil>", count, err)
+	}
+	if live := f.livePeers(); len(live) != 1 || !live["alice"] {
+		t.Errorf("live peers = %v, want alice alone", live)
+	}
+
+	if _, err = f.client.Device("wg1"); err == nil {
+		t.Error("wg1 was brought up")
+	}
+}
+
+func TestSyncer_Start(t *testing.T) {
+	f := newFixture(t)
+	s := NewSyncer(f.repo, f.client)
+
+	s.Start()
+	defer func() {
+		_ = s.Close()
+	}()
+
+	wait := func(want int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if len(f.livePeers()) == want {
+				return
+			}
+		}
+		t.Fatalf("live peers = %v, want %v of them", f.livePeers(), want)
+	}
+
+	wait(2)
+	f.disable("alice")
+	wait(1)
+}